@@ -0,0 +1,181 @@
+package core
+
+import (
+	"math/bits"
+)
+
+// register is the type of the integer registers: uint32 on RV32 (CPU) and uint64 on RV64 (CPU64).
+// The integer instructions are computed once for both widths by the helpers below.
+type register interface {
+	~uint32 | ~uint64
+}
+
+// xlen returns the width of the registers of type T in bits.
+func xlen[T register]() uint {
+	return uint(bits.Len64(uint64(^T(0))))
+}
+
+// signed sign extends a register value to 64 bits.
+func signed[T register](val T) int64 {
+	shift := 64 - xlen[T]()
+	return int64(uint64(val)<<shift) >> shift
+}
+
+// branchTaken reports whether the conditional branch op is taken for the values of rs1 and rs2.
+func branchTaken[T register](op RISCVInstruction, a T, b T) bool {
+	switch op {
+	case BEQ:
+		return a == b
+	case BNE:
+		return a != b
+	case BLT:
+		return signed(a) < signed(b)
+	case BGE:
+		return signed(a) >= signed(b)
+	case BLTU:
+		return a < b
+	case BGEU:
+		return a >= b
+	}
+	return false
+}
+
+// computeInteger computes the register-register and register-immediate integer instructions,
+// including those of the M extension, on a and b (rs2 or the sign-extended immediate).
+// Shift amounts are taken from the low log2(XLEN) bits of b. Division by zero and overflow
+// give the results defined by the specification instead of trapping.
+func computeInteger[T register](op RISCVInstruction, a T, b T) (T, bool) {
+	shift := uint64(b) & uint64(xlen[T]()-1)
+	switch op {
+	case ADD, ADDI:
+		return a + b, true
+	case SUB:
+		return a - b, true
+	case SLL, SLLI:
+		return a << shift, true
+	case SLT, SLTI:
+		return boolToRegister[T](signed(a) < signed(b)), true
+	case SLTU, SLTIU:
+		return boolToRegister[T](a < b), true
+	case XOR, XORI:
+		return a ^ b, true
+	case SRL, SRLI:
+		return a >> shift, true
+	case SRA, SRAI:
+		return T(signed(a) >> shift), true
+	case OR, ORI:
+		return a | b, true
+	case AND, ANDI:
+		return a & b, true
+	case MUL:
+		return a * b, true
+	case MULH:
+		return highProduct[T](uint64(signed(a)), uint64(signed(b)), signed(a) < 0, signed(b) < 0), true
+	case MULHSU:
+		return highProduct[T](uint64(signed(a)), uint64(b), signed(a) < 0, false), true
+	case MULHU:
+		return highProduct[T](uint64(a), uint64(b), false, false), true
+	case DIV:
+		switch {
+		case b == 0: // division by zero yields all bits set
+			return ^T(0), true
+		case a == 1<<(xlen[T]()-1) && signed(b) == -1: // signed overflow yields the dividend
+			return a, true
+		}
+		return T(signed(a) / signed(b)), true
+	case DIVU:
+		if b == 0 {
+			return ^T(0), true
+		}
+		return a / b, true
+	case REM:
+		switch {
+		case b == 0: // remainder of a division by zero is the dividend
+			return a, true
+		case a == 1<<(xlen[T]()-1) && signed(b) == -1: // signed overflow has no remainder
+			return 0, true
+		}
+		return T(signed(a) % signed(b)), true
+	case REMU:
+		if b == 0 {
+			return a, true
+		}
+		return a % b, true
+	}
+	return 0, false
+}
+
+// highProduct returns the upper XLEN bits of the product of a and b, which are the operands
+// extended to 64 bits. Negative operands were sign extended and are corrected for.
+func highProduct[T register](a uint64, b uint64, aNegative bool, bNegative bool) T {
+	hi, lo := bits.Mul64(a, b)
+	if aNegative {
+		hi -= b
+	}
+	if bNegative {
+		hi -= a
+	}
+	n := xlen[T]()
+	return T(lo>>n | hi<<(64-n))
+}
+
+// wordOperation returns the instruction computing the low word of an RV64 W instruction,
+// whose result is then sign extended.
+func wordOperation(op RISCVInstruction) (RISCVInstruction, bool) {
+	switch op {
+	case ADDIW, ADDW:
+		return ADD, true
+	case SUBW:
+		return SUB, true
+	case SLLIW, SLLW:
+		return SLL, true
+	case SRLIW, SRLW:
+		return SRL, true
+	case SRAIW, SRAW:
+		return SRA, true
+	case MULW:
+		return MUL, true
+	case DIVW:
+		return DIV, true
+	case DIVUW:
+		return DIVU, true
+	case REMW:
+		return REM, true
+	case REMUW:
+		return REMU, true
+	}
+	return op, false
+}
+
+// accessSize returns the number of bytes accessed by a load or store instruction.
+func accessSize(op RISCVInstruction) uint32 {
+	switch op {
+	case LB, LBU, SB:
+		return 1
+	case LH, LHU, SH:
+		return 2
+	case LD, SD:
+		return 8
+	}
+	return 4
+}
+
+// extendLoad sign or zero extends the value read by a load instruction to the register width.
+func extendLoad[T register](op RISCVInstruction, val uint64) T {
+	switch op {
+	case LB:
+		return T(int64(int8(val)))
+	case LH:
+		return T(int64(int16(val)))
+	case LW:
+		return T(int64(int32(val)))
+	}
+	return T(val)
+}
+
+func boolToRegister[T register](b bool) T {
+	if b {
+		return 1
+	}
+	return 0
+}
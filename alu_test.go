@@ -0,0 +1,55 @@
+package core
+
+import "testing"
+
+func TestComputeInteger32(t *testing.T) {
+	tests := []struct {
+		op   RISCVInstruction
+		a, b uint32
+		want uint32
+	}{
+		{SLL, 1, 33, 2}, // shift amounts are taken modulo 32
+		{SRA, 0x80000000, 63, 0xFFFFFFFF},
+		{SLT, 0x80000000, 0, 1},
+		{MULH, 0xFFFFFFFF, 0xFFFFFFFF, 0},
+		{MULHSU, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF},
+		{MULHU, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFE},
+		{DIV, 0x80000000, 0xFFFFFFFF, 0x80000000},
+		{REM, 0x80000000, 0xFFFFFFFF, 0},
+		{DIVU, 5, 0, 0xFFFFFFFF},
+	}
+	for _, test := range tests {
+		got, ok := computeInteger(test.op, test.a, test.b)
+		if !ok || got != test.want {
+			t.Errorf("%s 0x%x, 0x%x = 0x%x, %t, want 0x%x", RISCVInstructionToString(test.op), test.a, test.b, got, ok, test.want)
+		}
+	}
+	if _, ok := computeInteger[uint32](LW, 1, 2); ok {
+		t.Error("a load was computed as an integer instruction")
+	}
+}
+
+func TestRegisterWidth(t *testing.T) {
+	if xlen[uint32]() != 32 || xlen[uint64]() != 64 {
+		t.Errorf("xlen = %d and %d, want 32 and 64", xlen[uint32](), xlen[uint64]())
+	}
+	if signed[uint32](0x80000000) != -0x80000000 || signed[uint64](0x80000000) != 0x80000000 {
+		t.Error("signed does not sign extend from the register width")
+	}
+	tests := []struct {
+		op   RISCVInstruction
+		val  uint64
+		want uint32
+	}{
+		{LB, 0x80, 0xFFFFFF80},
+		{LH, 0x8000, 0xFFFF8000},
+		{LBU, 0x80, 0x80},
+		{LHU, 0x8000, 0x8000},
+		{LW, 0x80000000, 0x80000000},
+	}
+	for _, test := range tests {
+		if got := extendLoad[uint32](test.op, test.val); got != test.want {
+			t.Errorf("%s of 0x%x = 0x%x, want 0x%x", RISCVInstructionToString(test.op), test.val, got, test.want)
+		}
+	}
+}
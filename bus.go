@@ -0,0 +1,181 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Device is a peripheral mapped into the physical address space.
+// Offsets are relative to the base address the device is attached at,
+// and size is the access width in bytes (1, 2 or 4).
+type Device interface {
+	Load(offset uint32, size uint32) (uint32, error)
+	Store(offset uint32, size uint32, val uint32) error
+}
+
+// BusRegion is an address range claimed by a device.
+type BusRegion struct {
+	Base   uint32
+	Size   uint32
+	Device Device
+}
+
+// Bus dispatches physical memory accesses to the devices attached to it.
+type Bus struct {
+	lock    sync.RWMutex
+	regions []BusRegion // sorted by base address, never overlapping
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Attach maps a device at [base, base+size). Regions cannot overlap.
+func (b *Bus) Attach(base uint32, size uint32, device Device) error {
+	if size == 0 || uint64(base)+uint64(size) > 1<<32 {
+		return fmt.Errorf("invalid bus region base=0x%08x size=0x%x", base, size)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, region := range b.regions {
+		if base < region.Base+region.Size && region.Base < base+size {
+			return fmt.Errorf("bus region base=0x%08x size=0x%x overlaps region base=0x%08x size=0x%x", base, size, region.Base, region.Size)
+		}
+	}
+	b.regions = append(b.regions, BusRegion{Base: base, Size: size, Device: device})
+	sort.Slice(b.regions, func(i, j int) bool { return b.regions[i].Base < b.regions[j].Base })
+	return nil
+}
+
+// Detach removes the device attached at base.
+func (b *Bus) Detach(base uint32) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, region := range b.regions {
+		if region.Base == base {
+			b.regions = append(b.regions[:i], b.regions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Regions returns the attached regions ordered by base address.
+func (b *Bus) Regions() []BusRegion {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]BusRegion(nil), b.regions...)
+}
+
+// Find returns the region containing addr.
+func (b *Bus) Find(addr uint32) (BusRegion, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	i := sort.Search(len(b.regions), func(i int) bool { return b.regions[i].Base+(b.regions[i].Size-1) >= addr })
+	if i < len(b.regions) && b.regions[i].Base <= addr {
+		return b.regions[i], true
+	}
+	return BusRegion{}, false
+}
+
+// Load reads size bytes at a physical address. Accesses must not cross a region boundary.
+func (b *Bus) Load(addr uint32, size uint32) (uint32, error) {
+	region, ok := b.Find(addr)
+	if !ok || uint64(addr-region.Base)+uint64(size) > uint64(region.Size) {
+		return 0, fmt.Errorf("read of %d bytes out of range at addr=%d", size, addr)
+	}
+	return region.Device.Load(addr-region.Base, size)
+}
+
+// Store writes the low size bytes of val at a physical address. Accesses must not cross a region boundary.
+func (b *Bus) Store(addr uint32, size uint32, val uint32) error {
+	region, ok := b.Find(addr)
+	if !ok || uint64(addr-region.Base)+uint64(size) > uint64(region.Size) {
+		return fmt.Errorf("write of %d bytes out of range at addr=%d", size, addr)
+	}
+	return region.Device.Store(addr-region.Base, size, val)
+}
+
+// CallbackDevice builds a Device out of one callback per access width.
+// Accesses whose callback is nil fail.
+type CallbackDevice struct {
+	Read8   func(offset uint32) (uint32, error)
+	Read16  func(offset uint32) (uint32, error)
+	Read32  func(offset uint32) (uint32, error)
+	Write8  func(offset uint32, val uint32) error
+	Write16 func(offset uint32, val uint32) error
+	Write32 func(offset uint32, val uint32) error
+}
+
+func (d *CallbackDevice) Load(offset uint32, size uint32) (uint32, error) {
+	var read func(offset uint32) (uint32, error)
+	switch size {
+	case 1:
+		read = d.Read8
+	case 2:
+		read = d.Read16
+	case 4:
+		read = d.Read32
+	}
+	if read == nil {
+		return 0, fmt.Errorf("unsupported device read of %d bytes at offset=%d", size, offset)
+	}
+	return read(offset)
+}
+
+func (d *CallbackDevice) Store(offset uint32, size uint32, val uint32) error {
+	var write func(offset uint32, val uint32) error
+	switch size {
+	case 1:
+		write = d.Write8
+	case 2:
+		write = d.Write16
+	case 4:
+		write = d.Write32
+	}
+	if write == nil {
+		return fmt.Errorf("unsupported device write of %d bytes at offset=%d", size, offset)
+	}
+	return write(offset, val)
+}
+
+// RAM is a little-endian block of memory that can be attached to a Bus.
+// A read-only RAM behaves as a ROM: its content can only be set from Go.
+type RAM struct {
+	Data     []byte
+	ReadOnly bool
+}
+
+// NewRAM creates a zeroed, writable memory block.
+func NewRAM(size uint32) *RAM {
+	return &RAM{Data: make([]byte, size)}
+}
+
+// NewROM creates a read-only memory block holding content.
+func NewROM(content []byte) *RAM {
+	return &RAM{Data: content, ReadOnly: true}
+}
+
+func (r *RAM) Load(offset uint32, size uint32) (uint32, error) {
+	if uint64(offset)+uint64(size) > uint64(len(r.Data)) {
+		return 0, fmt.Errorf("read of %d bytes out of range at offset=%d", size, offset)
+	}
+	var val uint32
+	for i := uint32(0); i < size; i++ {
+		val |= uint32(r.Data[offset+i]) << (8 * i)
+	}
+	return val, nil
+}
+
+func (r *RAM) Store(offset uint32, size uint32, val uint32) error {
+	if r.ReadOnly {
+		return fmt.Errorf("write to read-only memory at offset=%d", offset)
+	}
+	if uint64(offset)+uint64(size) > uint64(len(r.Data)) {
+		return fmt.Errorf("write of %d bytes out of range at offset=%d", size, offset)
+	}
+	for i := uint32(0); i < size; i++ {
+		r.Data[offset+i] = byte(val >> (8 * i))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+const DEVICE_BASE = 0x10000000
+
+func TestBusAttach(t *testing.T) {
+	bus := NewBus()
+	if err := bus.Attach(0x1000, 0x1000, NewRAM(0x1000)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		base uint32
+		size uint32
+	}{
+		{"overlapping the start", 0x0800, 0x1000},
+		{"overlapping the end", 0x1FFF, 0x10},
+		{"inside", 0x1100, 0x10},
+		{"empty", 0x3000, 0},
+		{"past the top of the address space", 0xFFFFF000, 0x2000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := bus.Attach(test.base, test.size, NewRAM(0x10)); err == nil {
+				t.Error("the region was attached")
+			}
+		})
+	}
+	if err := bus.Attach(0xFFFFF000, 0x1000, NewRAM(0x1000)); err != nil {
+		t.Errorf("the last page of the address space was not attached: %v", err)
+	}
+	bus.Detach(0x1000)
+	if _, ok := bus.Find(0x1000); ok {
+		t.Error("the detached region is still mapped")
+	}
+}
+
+func TestBusDispatch(t *testing.T) {
+	bus := NewBus()
+	var written [5]uint32
+	device := &CallbackDevice{
+		Read32:  func(offset uint32) (uint32, error) { return 0xCAFE0000 | offset, nil },
+		Write8:  func(offset uint32, val uint32) error { written[1] = val; return nil },
+		Write32: func(offset uint32, val uint32) error { written[4] = val; return nil },
+	}
+	bus.Attach(DEVICE_BASE, 0x100, device)
+	bus.Attach(0x2000, 4, NewROM([]byte{1, 2, 3, 4}))
+
+	if got, err := bus.Load(DEVICE_BASE+8, 4); err != nil || got != 0xCAFE0008 {
+		t.Errorf("read 0x%x, %v, want 0xcafe0008 at offset 8", got, err)
+	}
+	if _, err := bus.Load(DEVICE_BASE, 2); err == nil {
+		t.Error("half word read without a Read16 callback was accepted")
+	}
+	if err := bus.Store(DEVICE_BASE, 1, 0xAB); err != nil || written[1] != 0xAB {
+		t.Errorf("byte write: %v, written 0x%x", err, written[1])
+	}
+	if err := bus.Store(DEVICE_BASE+0xFE, 4, 1); err == nil {
+		t.Error("write across the end of the region was accepted")
+	}
+	if _, err := bus.Load(0x3000, 4); err == nil {
+		t.Error("read of an unmapped address was accepted")
+	}
+	if got, err := bus.Load(0x2000, 4); err != nil || got != 0x04030201 {
+		t.Errorf("ROM read 0x%x, %v, want 0x04030201", got, err)
+	}
+	if err := bus.Store(0x2000, 4, 0); err == nil {
+		t.Error("ROM write was accepted")
+	}
+
+	// accesses wider than the region must fail without reaching the device
+	small := &CallbackDevice{
+		Read32: func(offset uint32) (uint32, error) {
+			t.Errorf("word read at offset %d of a small device", offset)
+			return 0, nil
+		},
+		Write32: func(offset uint32, val uint32) error {
+			t.Errorf("word write at offset %d of a small device", offset)
+			return nil
+		},
+	}
+	bus.Attach(0x4000, 1, small)
+	bus.Attach(0x4010, 2, small)
+	for _, addr := range []uint32{0x4000, 0x4010} {
+		if _, err := bus.Load(addr, 4); err == nil {
+			t.Errorf("word read of the device at 0x%x was accepted", addr)
+		}
+		if err := bus.Store(addr, 4, 0); err == nil {
+			t.Errorf("word write of the device at 0x%x was accepted", addr)
+		}
+	}
+}
+
+func TestMemoryDispatchesToDevices(t *testing.T) {
+	m := NewMemory()
+	var stored uint32
+	m.Bus.Attach(DEVICE_BASE, 0x100, &CallbackDevice{
+		Read8:   func(offset uint32) (uint32, error) { return offset, nil },
+		Read32:  func(offset uint32) (uint32, error) { return stored, nil },
+		Write32: func(offset uint32, val uint32) error { stored = val; return nil },
+	})
+	if err := m.WriteWord(DEVICE_BASE, 7); err != nil || stored != 7 {
+		t.Errorf("word write: %v, stored %d", err, stored)
+	}
+	if got, err := m.ReadSingleByte(DEVICE_BASE + 3); err != nil || got != 3 {
+		t.Errorf("byte read %d, %v, want 3", got, err)
+	}
+	old, err := m.AtomicModifyWord(DEVICE_BASE, func(old uint32) uint32 { return old + 1 })
+	if err != nil || old != 7 || stored != 8 {
+		t.Errorf("atomic add returned %d, %v and stored %d, want 7 and 8", old, err, stored)
+	}
+	m.LoadReserved(0, DEVICE_BASE)
+	if ok, err := m.StoreConditional(0, DEVICE_BASE, 9); err != nil || !ok || stored != 9 {
+		t.Errorf("store-conditional returned %v, %v and stored %d, want 9", ok, err, stored)
+	}
+}
+
+// TestDeviceAccessingMemory checks that devices run without the memory lock held,
+// e.g. a DMA engine copying a word to RAM when its register is written.
+func TestDeviceAccessingMemory(t *testing.T) {
+	tests := []struct {
+		name   string
+		access func(m *Memory) error
+	}{
+		{"word store", func(m *Memory) error { return m.WriteWord(DEVICE_BASE, 42) }},
+		{"half word store", func(m *Memory) error { return m.WriteHalfWord(DEVICE_BASE, 42) }},
+		{"atomic operation", func(m *Memory) error {
+			_, err := m.AtomicModifyWord(DEVICE_BASE, func(uint32) uint32 { return 42 })
+			return err
+		}},
+		{"store-conditional", func(m *Memory) error {
+			if _, err := m.LoadReserved(0, DEVICE_BASE); err != nil {
+				return err
+			}
+			_, err := m.StoreConditional(0, DEVICE_BASE, 42)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMemory()
+			dma := func(offset uint32, val uint32) error { return m.WriteWord(0x100, val) }
+			m.Bus.Attach(DEVICE_BASE, 0x100, &CallbackDevice{
+				Read32:  func(offset uint32) (uint32, error) { return m.ReadWord(0x100) },
+				Write16: dma,
+				Write32: dma,
+			})
+			done := make(chan error)
+			go func() { done <- test.access(m) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("deadlock: the device could not access memory")
+			}
+			if got, _ := m.ReadWord(0x100); got != 42 {
+				t.Errorf("the device wrote %d, want 42", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Core-local interruptor memory map, as laid out by SiFive and used by QEMU's virt machine.
+const (
+	CLINT_BASE     = 0x02000000
+	CLINT_SIZE     = 0x10000
+	CLINT_MSIP     = 0x0000 // one word per hart
+	CLINT_MTIMECMP = 0x4000 // one double word per hart
+	CLINT_MTIME    = 0xBFF8
+
+	CLINT_DEFAULT_HARTS = 8 // harts served by the CLINT and PLIC created by NewCPU
+)
+
+// CLINT is the core-local interruptor: it owns the machine timer (mtime), the per-hart
+// timer comparators (mtimecmp) and the per-hart software interrupt bits (msip).
+// A single CLINT can be shared by every hart of a machine.
+type CLINT struct {
+	lock     sync.Mutex
+	mtime    uint64
+	mtimecmp []uint64
+	msip     []uint32
+}
+
+// NewCLINT creates a CLINT serving the given number of harts.
+// Comparators start at their maximum value so no timer interrupt is pending until one is programmed.
+func NewCLINT(harts int) *CLINT {
+	clint := &CLINT{
+		mtimecmp: make([]uint64, harts),
+		msip:     make([]uint32, harts),
+	}
+	for i := range clint.mtimecmp {
+		clint.mtimecmp[i] = ^uint64(0)
+	}
+	return clint
+}
+
+// Load reads a CLINT register. Only aligned word accesses are supported.
+func (cl *CLINT) Load(offset uint32, size uint32) (uint32, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("unsupported CLINT read of %d bytes at offset=%d", size, offset)
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	switch {
+	case offset >= CLINT_MTIME && offset < CLINT_MTIME+8:
+		return uint32(cl.mtime >> (8 * (offset - CLINT_MTIME))), nil
+	case offset >= CLINT_MTIMECMP && offset < CLINT_MTIMECMP+8*uint32(len(cl.mtimecmp)):
+		hart := (offset - CLINT_MTIMECMP) / 8
+		return uint32(cl.mtimecmp[hart] >> (8 * (offset % 8))), nil
+	case offset < CLINT_MSIP+4*uint32(len(cl.msip)):
+		return cl.msip[offset/4], nil
+	default:
+		return 0, fmt.Errorf("CLINT read out of range at offset=%d", offset)
+	}
+}
+
+// Store writes a CLINT register. Only aligned word accesses are supported.
+func (cl *CLINT) Store(offset uint32, size uint32, val uint32) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("unsupported CLINT write of %d bytes at offset=%d", size, offset)
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	switch {
+	case offset >= CLINT_MTIME && offset < CLINT_MTIME+8:
+		cl.mtime = setWordOf(cl.mtime, offset-CLINT_MTIME, val)
+	case offset >= CLINT_MTIMECMP && offset < CLINT_MTIMECMP+8*uint32(len(cl.mtimecmp)):
+		hart := (offset - CLINT_MTIMECMP) / 8
+		cl.mtimecmp[hart] = setWordOf(cl.mtimecmp[hart], offset%8, val)
+	case offset < CLINT_MSIP+4*uint32(len(cl.msip)):
+		cl.msip[offset/4] = val & 1
+	default:
+		return fmt.Errorf("CLINT write out of range at offset=%d", offset)
+	}
+	return nil
+}
+
+// setWordOf replaces the low (offset 0) or high (offset 4) word of a 64-bit register.
+func setWordOf(reg uint64, offset uint32, val uint32) uint64 {
+	if offset == 0 {
+		return reg&^0xFFFFFFFF | uint64(val)
+	}
+	return reg&0xFFFFFFFF | uint64(val)<<32
+}
+
+// Time returns the current value of mtime.
+func (cl *CLINT) Time() uint64 {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.mtime
+}
+
+// Tick advances mtime by the given number of ticks.
+func (cl *CLINT) Tick(ticks uint64) {
+	cl.lock.Lock()
+	cl.mtime += ticks
+	cl.lock.Unlock()
+}
+
+// TimerPending reports whether the timer interrupt of a hart is pending (mtime >= mtimecmp).
+func (cl *CLINT) TimerPending(hart uint32) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return hart < uint32(len(cl.mtimecmp)) && cl.mtime >= cl.mtimecmp[hart]
+}
+
+// SoftwarePending reports whether the software interrupt of a hart is pending (msip set).
+func (cl *CLINT) SoftwarePending(hart uint32) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return hart < uint32(len(cl.msip)) && cl.msip[hart] != 0
+}
+
+// SkipToTimer advances mtime to the next timer event of a hart, if it lies in the future.
+func (cl *CLINT) SkipToTimer(hart uint32) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if hart < uint32(len(cl.mtimecmp)) && cl.mtimecmp[hart] != ^uint64(0) && cl.mtime < cl.mtimecmp[hart] {
+		cl.mtime = cl.mtimecmp[hart]
+	}
+}
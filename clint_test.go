@@ -0,0 +1,169 @@
+package core
+
+import "testing"
+
+func TestCLINTRegisters(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  uint32
+		size    uint32
+		val     uint32
+		want    uint32
+		wantErr bool
+	}{
+		{"msip keeps the low bit", CLINT_MSIP + 4, 4, 0xFFFFFFFF, 1, false},
+		{"mtimecmp low word", CLINT_MTIMECMP + 8, 4, 0x12345678, 0x12345678, false},
+		{"mtimecmp high word", CLINT_MTIMECMP + 12, 4, 0x9ABCDEF0, 0x9ABCDEF0, false},
+		{"mtime low word", CLINT_MTIME, 4, 100, 100, false},
+		{"mtime high word", CLINT_MTIME + 4, 4, 7, 7, false},
+		{"byte access", CLINT_MSIP, 1, 1, 0, true},
+		{"misaligned access", CLINT_MTIMECMP + 2, 4, 1, 0, true},
+		{"msip of a missing hart", CLINT_MSIP + 4*2, 4, 1, 0, true},
+		{"mtimecmp of a missing hart", CLINT_MTIMECMP + 8*2, 4, 1, 0, true},
+		{"hole between registers", 0x8000, 4, 1, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clint := NewCLINT(2)
+			err := clint.Store(test.offset, test.size, test.val)
+			if test.wantErr {
+				if err == nil {
+					t.Error("the write was accepted")
+				}
+				if _, err := clint.Load(test.offset, test.size); err == nil {
+					t.Error("the read was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := clint.Load(test.offset, test.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("read 0x%x, want 0x%x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCLINTTimer(t *testing.T) {
+	clint := NewCLINT(2)
+	if clint.TimerPending(0) {
+		t.Fatal("timer pending before mtimecmp was programmed")
+	}
+	clint.Store(CLINT_MTIMECMP, 4, 10)
+	clint.Store(CLINT_MTIMECMP+4, 4, 0)
+	clint.Tick(9)
+	if clint.TimerPending(0) {
+		t.Errorf("timer pending at mtime %d", clint.Time())
+	}
+	clint.Tick(1)
+	if !clint.TimerPending(0) {
+		t.Errorf("timer not pending at mtime %d", clint.Time())
+	}
+	if clint.TimerPending(1) || clint.TimerPending(5) {
+		t.Error("timer pending on a hart without a comparator")
+	}
+	clint.Store(CLINT_MTIMECMP+8, 4, 50)
+	clint.Store(CLINT_MTIMECMP+12, 4, 0)
+	clint.SkipToTimer(1)
+	if clint.Time() != 50 {
+		t.Errorf("mtime = %d after skipping to the timer, want 50", clint.Time())
+	}
+	clint.SkipToTimer(0) // already in the past
+	if clint.Time() != 50 {
+		t.Errorf("mtime = %d after skipping to a past timer, want 50", clint.Time())
+	}
+}
+
+func TestCLINTSharedBetweenHarts(t *testing.T) {
+	memory := NewMemory()
+	hart0 := NewCPU(memory)
+	hart1 := NewCPU(memory)
+	hart1.HartID = 1
+	if hart0.Clint != hart1.Clint || hart0.Plic != hart1.Plic {
+		t.Fatal("harts sharing a memory have different interrupt controllers")
+	}
+	if err := memory.WriteWord(CLINT_BASE+CLINT_MSIP+4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if hart0.pendingInterrupts()&MIP_MSIP != 0 || hart1.pendingInterrupts()&MIP_MSIP == 0 {
+		t.Error("msip of hart 1 did not raise the software interrupt of hart 1 only")
+	}
+}
+
+func TestTimerInterrupts(t *testing.T) {
+	// the handler records mcause and mepc and stops
+	handler := []uint32{
+		0x34202673, // csrr a2, mcause
+		0x34102773, // csrr a4, mepc
+		0x30501073, // csrw mtvec, zero
+		EBREAK_WORD,
+	}
+	enable := func(mie uint32, a1 uint32) func(c *CPU) {
+		return func(c *CPU) {
+			c.Registers[ARG_ONE] = a1
+			c.mtvec = HANDLER
+			c.mie = mie
+			c.mstatus |= MSTATUS_MIE
+		}
+	}
+	runTrapTests(t, []trapTest{
+		{
+			name:  "timer interrupt",
+			setup: enable(MIP_MTIP, 20),
+			program: []uint32{
+				0x020042b7, // lui t0, 0x2004
+				0x00b2a023, // sw a1, 0(t0)
+				0x0002a223, // sw zero, 4(t0)
+				0x0000006f, // j .
+			},
+			handler: handler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: 1<<31 | INTERRUPT_MACHINE_TIMER, ARG_FOUR: 12})
+				if c.Clint.Time() < 20 {
+					t.Errorf("interrupt taken at mtime %d, before mtimecmp", c.Clint.Time())
+				}
+			},
+		},
+		{
+			name:  "software interrupt",
+			setup: enable(MIP_MSIP, 1),
+			program: []uint32{
+				0x020002b7, // lui t0, 0x2000
+				0x00b2a023, // sw a1, 0(t0)
+				0x0000006f, // j .
+			},
+			handler: handler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: 1<<31 | INTERRUPT_MACHINE_SOFTWARE, ARG_FOUR: 8})
+			},
+		},
+		{
+			name: "wfi skips to the timer",
+			setup: func(c *CPU) {
+				c.Registers[ARG_ONE] = 1000
+				c.mie = MIP_MTIP // masked by mstatus.MIE, wfi still wakes up
+			},
+			program: []uint32{
+				0x020042b7, // lui t0, 0x2004
+				0x00b2a023, // sw a1, 0(t0)
+				0x0002a223, // sw zero, 4(t0)
+				0x10500073, // wfi
+				0x344026f3, // csrr a3, mip
+				EBREAK_WORD,
+			},
+			check: func(t *testing.T, c *CPU) {
+				if c.Registers[ARG_THREE]&MIP_MTIP == 0 {
+					t.Errorf("mip = 0x%x after wfi, want MTIP set", c.Registers[ARG_THREE])
+				}
+				if c.Clint.Time() < 1000 {
+					t.Errorf("mtime = %d after wfi, want at least 1000", c.Clint.Time())
+				}
+			},
+		},
+	})
+}
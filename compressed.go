@@ -0,0 +1,252 @@
+package core
+
+import "errors"
+
+// IsCompressed reports whether the low half-word of an instruction belongs to a 16-bit (RVC) encoding.
+func IsCompressed(low uint32) bool {
+	return low&0b11 != 0b11
+}
+
+// ExpandCompressed expands a 16-bit RVC instruction into its 32-bit base equivalent,
+// which can then be handed to DecodeInstruction.
+func ExpandCompressed(inst uint16) (uint32, error) {
+	return expandCompressed(inst, false)
+}
+
+// ExpandCompressed64 expands a 16-bit RVC instruction of RV64, where C.LD, C.SD, C.LDSP and C.SDSP
+// replace the single-precision loads and stores, C.ADDIW replaces C.JAL, C.SUBW and C.ADDW are
+// defined and shift amounts have 6 bits.
+func ExpandCompressed64(inst uint16) (uint32, error) {
+	return expandCompressed(inst, true)
+}
+
+func expandCompressed(inst uint16, rv64 bool) (uint32, error) {
+	in := uint32(inst)
+	func3 := (in >> 13) & 0b111
+	switch in & 0b11 {
+	case 0b00:
+		return expandQuadrant0(in, func3, rv64)
+	case 0b01:
+		return expandQuadrant1(in, func3, rv64)
+	case 0b10:
+		return expandQuadrant2(in, func3, rv64)
+	default:
+		return 0, errors.New("not a compressed instruction")
+	}
+}
+
+// expandQuadrant0 expands the stack-pointer based ADDI4SPN and the register based loads and stores.
+func expandQuadrant0(in uint32, func3 uint32, rv64 bool) (uint32, error) {
+	rdp := compressedRegister(in >> 2)
+	rs1p := compressedRegister(in >> 7)
+	// Offsets of the word and double-word sized loads and stores.
+	wordOffset := (in>>7)&0x38 | (in<<1)&0x40 | (in>>4)&0x4
+	doubleOffset := (in>>7)&0x38 | (in<<1)&0xC0
+	switch func3 {
+	case 0b000: // C.ADDI4SPN
+		imm := (in>>7)&0x30 | (in>>1)&0x3C0 | (in>>4)&0x4 | (in>>2)&0x8
+		if imm == 0 {
+			return 0, errors.New("illegal compressed instruction")
+		}
+		return encodeIType(0b0010011, rdp, 0x0, STACK_POINTER, imm), nil
+	case 0b001: // C.FLD
+		return encodeIType(0b0000111, rdp, 0x3, rs1p, doubleOffset), nil
+	case 0b010: // C.LW
+		return encodeIType(0b0000011, rdp, 0x2, rs1p, wordOffset), nil
+	case 0b011:
+		if rv64 { // C.LD
+			return encodeIType(0b0000011, rdp, 0x3, rs1p, doubleOffset), nil
+		}
+		return encodeIType(0b0000111, rdp, 0x2, rs1p, wordOffset), nil // C.FLW
+	case 0b101: // C.FSD
+		return encodeSType(0b0100111, 0x3, rs1p, rdp, doubleOffset), nil
+	case 0b110: // C.SW
+		return encodeSType(0b0100011, 0x2, rs1p, rdp, wordOffset), nil
+	case 0b111:
+		if rv64 { // C.SD
+			return encodeSType(0b0100011, 0x3, rs1p, rdp, doubleOffset), nil
+		}
+		return encodeSType(0b0100111, 0x2, rs1p, rdp, wordOffset), nil // C.FSW
+	default:
+		return 0, errors.New("illegal compressed instruction")
+	}
+}
+
+// expandQuadrant1 expands the immediate arithmetic, jumps and branches.
+func expandQuadrant1(in uint32, func3 uint32, rv64 bool) (uint32, error) {
+	rd := (in >> 7) & 0b11111
+	imm := signExtend((in>>7)&0x20|(in>>2)&0x1F, 6)
+	switch func3 {
+	case 0b000: // C.ADDI, C.NOP
+		return encodeIType(0b0010011, rd, 0x0, rd, imm), nil
+	case 0b001:
+		if rv64 { // C.ADDIW
+			if rd == 0 {
+				return 0, errors.New("illegal compressed instruction")
+			}
+			return encodeIType(0b0011011, rd, 0x0, rd, imm), nil
+		}
+		return encodeJType(RETURN_ADDRESS, compressedJumpOffset(in)), nil // C.JAL
+	case 0b010: // C.LI
+		return encodeIType(0b0010011, rd, 0x0, 0, imm), nil
+	case 0b011:
+		if rd == STACK_POINTER { // C.ADDI16SP
+			nzimm := signExtend((in>>3)&0x200|(in>>2)&0x10|(in<<1)&0x40|(in<<4)&0x180|(in<<3)&0x20, 10)
+			if nzimm == 0 {
+				return 0, errors.New("illegal compressed instruction")
+			}
+			return encodeIType(0b0010011, STACK_POINTER, 0x0, STACK_POINTER, nzimm), nil
+		}
+		if imm == 0 { // C.LUI
+			return 0, errors.New("illegal compressed instruction")
+		}
+		return encodeUType(0b0110111, rd, imm&0xFFFFF), nil
+	case 0b100:
+		rdp := compressedRegister(in >> 7)
+		rs2p := compressedRegister(in >> 2)
+		switch (in >> 10) & 0b11 {
+		case 0b00: // C.SRLI
+			if in&0x1000 != 0 && !rv64 {
+				return 0, errors.New("illegal compressed instruction")
+			}
+			return encodeIType(0b0010011, rdp, 0x5, rdp, imm&0x3F), nil
+		case 0b01: // C.SRAI
+			if in&0x1000 != 0 && !rv64 {
+				return 0, errors.New("illegal compressed instruction")
+			}
+			return encodeIType(0b0010011, rdp, 0x5, rdp, 0x400|imm&0x3F), nil
+		case 0b10: // C.ANDI
+			return encodeIType(0b0010011, rdp, 0x7, rdp, imm), nil
+		default:
+			if in&0x1000 != 0 { // C.SUBW and C.ADDW only exist in RV64
+				if !rv64 {
+					return 0, errors.New("illegal compressed instruction")
+				}
+				switch (in >> 5) & 0b11 {
+				case 0b00: // C.SUBW
+					return encodeRType(0b0111011, rdp, 0x0, rdp, rs2p, 0x20), nil
+				case 0b01: // C.ADDW
+					return encodeRType(0b0111011, rdp, 0x0, rdp, rs2p, 0x00), nil
+				default:
+					return 0, errors.New("illegal compressed instruction")
+				}
+			}
+			switch (in >> 5) & 0b11 {
+			case 0b00: // C.SUB
+				return encodeRType(0b0110011, rdp, 0x0, rdp, rs2p, 0x20), nil
+			case 0b01: // C.XOR
+				return encodeRType(0b0110011, rdp, 0x4, rdp, rs2p, 0x00), nil
+			case 0b10: // C.OR
+				return encodeRType(0b0110011, rdp, 0x6, rdp, rs2p, 0x00), nil
+			default: // C.AND
+				return encodeRType(0b0110011, rdp, 0x7, rdp, rs2p, 0x00), nil
+			}
+		}
+	case 0b101: // C.J
+		return encodeJType(0, compressedJumpOffset(in)), nil
+	case 0b110, 0b111: // C.BEQZ, C.BNEZ
+		offset := signExtend((in>>4)&0x100|(in>>7)&0x18|(in<<1)&0xC0|(in>>2)&0x6|(in<<3)&0x20, 9)
+		return encodeBType(func3&0x1, compressedRegister(in>>7), 0, offset), nil
+	}
+	return 0, errors.New("illegal compressed instruction")
+}
+
+// expandQuadrant2 expands the stack-pointer based loads and stores and the register to register operations.
+func expandQuadrant2(in uint32, func3 uint32, rv64 bool) (uint32, error) {
+	rd := (in >> 7) & 0b11111
+	rs2 := (in >> 2) & 0b11111
+	wordLoadOffset := (in>>7)&0x20 | (in>>2)&0x1C | (in<<4)&0xC0
+	doubleLoadOffset := (in>>7)&0x20 | (in>>2)&0x18 | (in<<4)&0x1C0
+	wordStoreOffset := (in>>7)&0x3C | (in>>1)&0xC0
+	doubleStoreOffset := (in>>7)&0x38 | (in>>1)&0x1C0
+	switch func3 {
+	case 0b000: // C.SLLI
+		if in&0x1000 != 0 && !rv64 {
+			return 0, errors.New("illegal compressed instruction")
+		}
+		return encodeIType(0b0010011, rd, 0x1, rd, (in>>7)&0x20|rs2), nil
+	case 0b001: // C.FLDSP
+		return encodeIType(0b0000111, rd, 0x3, STACK_POINTER, doubleLoadOffset), nil
+	case 0b010: // C.LWSP
+		if rd == 0 {
+			return 0, errors.New("illegal compressed instruction")
+		}
+		return encodeIType(0b0000011, rd, 0x2, STACK_POINTER, wordLoadOffset), nil
+	case 0b011:
+		if rv64 { // C.LDSP
+			if rd == 0 {
+				return 0, errors.New("illegal compressed instruction")
+			}
+			return encodeIType(0b0000011, rd, 0x3, STACK_POINTER, doubleLoadOffset), nil
+		}
+		return encodeIType(0b0000111, rd, 0x2, STACK_POINTER, wordLoadOffset), nil // C.FLWSP
+	case 0b100:
+		if in&0x1000 == 0 {
+			if rs2 == 0 { // C.JR
+				if rd == 0 {
+					return 0, errors.New("illegal compressed instruction")
+				}
+				return encodeIType(0b1100111, 0, 0x0, rd, 0), nil
+			}
+			return encodeRType(0b0110011, rd, 0x0, 0, rs2, 0x00), nil // C.MV
+		}
+		if rd == 0 && rs2 == 0 { // C.EBREAK
+			return 0x00100073, nil
+		}
+		if rs2 == 0 { // C.JALR
+			return encodeIType(0b1100111, RETURN_ADDRESS, 0x0, rd, 0), nil
+		}
+		return encodeRType(0b0110011, rd, 0x0, rd, rs2, 0x00), nil // C.ADD
+	case 0b101: // C.FSDSP
+		return encodeSType(0b0100111, 0x3, STACK_POINTER, rs2, doubleStoreOffset), nil
+	case 0b110: // C.SWSP
+		return encodeSType(0b0100011, 0x2, STACK_POINTER, rs2, wordStoreOffset), nil
+	default:
+		if rv64 { // C.SDSP
+			return encodeSType(0b0100011, 0x3, STACK_POINTER, rs2, doubleStoreOffset), nil
+		}
+		return encodeSType(0b0100111, 0x2, STACK_POINTER, rs2, wordStoreOffset), nil // C.FSWSP
+	}
+}
+
+// compressedRegister maps the 3-bit register fields of RVC to x8-x15.
+func compressedRegister(field uint32) uint32 {
+	return field&0b111 + 8
+}
+
+// compressedJumpOffset decodes the offset of C.J and C.JAL.
+func compressedJumpOffset(in uint32) uint32 {
+	offset := (in>>1)&0x800 | (in>>7)&0x10 | (in>>1)&0x300 | (in<<2)&0x400 |
+		(in>>1)&0x40 | (in<<1)&0x80 | (in>>2)&0xE | (in<<3)&0x20
+	return signExtend(offset, 12)
+}
+
+// signExtend sign-extends the low bits of val.
+func signExtend(val uint32, bits uint) uint32 {
+	return uint32(int32(val<<(32-bits)) >> (32 - bits))
+}
+
+func encodeRType(opcode, rd, func3, rs1, rs2, func7 uint32) uint32 {
+	return func7<<25 | rs2<<20 | rs1<<15 | func3<<12 | rd<<7 | opcode
+}
+
+func encodeIType(opcode, rd, func3, rs1, imm uint32) uint32 {
+	return (imm&0xFFF)<<20 | rs1<<15 | func3<<12 | rd<<7 | opcode
+}
+
+func encodeSType(opcode, func3, rs1, rs2, imm uint32) uint32 {
+	return (imm>>5&0x7F)<<25 | rs2<<20 | rs1<<15 | func3<<12 | (imm&0x1F)<<7 | opcode
+}
+
+func encodeBType(func3, rs1, rs2, imm uint32) uint32 {
+	return (imm>>12&0x1)<<31 | (imm>>5&0x3F)<<25 | rs2<<20 | rs1<<15 | func3<<12 |
+		(imm>>1&0xF)<<8 | (imm>>11&0x1)<<7 | 0b1100011
+}
+
+func encodeUType(opcode, rd, imm uint32) uint32 {
+	return imm<<12 | rd<<7 | opcode
+}
+
+func encodeJType(rd, imm uint32) uint32 {
+	return (imm>>20&0x1)<<31 | (imm>>1&0x3FF)<<21 | (imm>>11&0x1)<<20 | (imm>>12&0xFF)<<12 | rd<<7 | 0b1101111
+}
@@ -0,0 +1,104 @@
+package core
+
+import "testing"
+
+func TestExpandCompressed(t *testing.T) {
+	tests := []struct {
+		compressed uint16
+		want       uint32
+	}{
+		{0x0808, 0x01010513}, // c.addi4spn a0, sp, 16
+		{0x2588, 0x0085b507}, // c.fld fa0, 8(a1)
+		{0x41c8, 0x0045a503}, // c.lw a0, 4(a1)
+		{0x61c8, 0x0045a507}, // c.flw fa0, 4(a1)
+		{0xa588, 0x00a5b427}, // c.fsd fa0, 8(a1)
+		{0xdde8, 0x06a5ae23}, // c.sw a0, 124(a1)
+		{0xe1c8, 0x00a5a227}, // c.fsw fa0, 4(a1)
+		{0x0001, 0x00000013}, // c.nop
+		{0x1501, 0xfe050513}, // c.addi a0, -32
+		{0x3001, 0x801ff0ef}, // c.jal -2048
+		{0x457d, 0x01f00513}, // c.li a0, 31
+		{0x7101, 0xe0010113}, // c.addi16sp sp, -512
+		{0x757d, 0xfffff537}, // c.lui a0, 0xfffff
+		{0x817d, 0x01f55513}, // c.srli a0, 31
+		{0x8585, 0x4015d593}, // c.srai a1, 1
+		{0x997d, 0xfff57513}, // c.andi a0, -1
+		{0x8d0d, 0x40b50533}, // c.sub a0, a1
+		{0x8d2d, 0x00b54533}, // c.xor a0, a1
+		{0x8d4d, 0x00b56533}, // c.or a0, a1
+		{0x8d6d, 0x00b57533}, // c.and a0, a1
+		{0xaffd, 0x7fe0006f}, // c.j 2046
+		{0xd101, 0xf00500e3}, // c.beqz a0, -256
+		{0xed7d, 0x0e051f63}, // c.bnez a0, 254
+		{0x057e, 0x01f51513}, // c.slli a0, 31
+		{0x357e, 0x1f813507}, // c.fldsp fa0, 504(sp)
+		{0x557e, 0x0fc12503}, // c.lwsp a0, 252(sp)
+		{0x757e, 0x0fc12507}, // c.flwsp fa0, 252(sp)
+		{0x8502, 0x00050067}, // c.jr a0
+		{0x852e, 0x00b00533}, // c.mv a0, a1
+		{0x9002, 0x00100073}, // c.ebreak
+		{0x9502, 0x000500e7}, // c.jalr a0
+		{0x952e, 0x00b50533}, // c.add a0, a1
+		{0xbfaa, 0x1ea13c27}, // c.fsdsp fa0, 504(sp)
+		{0xdfaa, 0x0ea12e23}, // c.swsp a0, 252(sp)
+		{0xffaa, 0x0ea12e27}, // c.fswsp fa0, 252(sp)
+	}
+	for _, test := range tests {
+		got, err := ExpandCompressed(test.compressed)
+		if err != nil {
+			t.Errorf("0x%04x: %v", test.compressed, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("0x%04x expands to 0x%08x, want 0x%08x", test.compressed, got, test.want)
+		}
+	}
+}
+
+func TestIllegalCompressed(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed uint16
+	}{
+		{"all zeros", 0x0000},
+		{"c.addi4spn with a zero immediate", 0x0004},
+		{"c.lwsp to x0", 0x4002},
+		{"c.jr x0", 0x8002},
+		{"c.addi16sp with a zero immediate", 0x6101},
+		{"c.lui with a zero immediate", 0x6501},
+		{"c.srli with shamt[5] set", 0x9101},
+		{"c.slli with shamt[5] set", 0x1502},
+		{"c.subw on RV32", 0x9d0d},
+		{"not compressed", 0x0003},
+	}
+	for _, test := range tests {
+		if got, err := ExpandCompressed(test.compressed); err == nil {
+			t.Errorf("%s: 0x%04x expanded to 0x%08x", test.name, test.compressed, got)
+		}
+	}
+}
+
+func TestCompressedExecution(t *testing.T) {
+	runCPUTests(t, []cpuTest{{
+		name: "mixed 16 and 32-bit instructions",
+		// 0x00: c.li a0, 5
+		// 0x02: addi a1, zero, 7
+		// 0x06: c.jal 0x0c
+		// 0x08: c.li a2, 1
+		// 0x0a: c.ebreak
+		// 0x0c: c.add a0, a1
+		// 0x0e: c.swsp a0, 64(sp)
+		// 0x10: c.lwsp a3, 64(sp)
+		// 0x12: c.jr ra
+		program:   []uint32{0x05934515, 0x20190070, 0x90024605, 0xc0aa952e, 0x80824686},
+		registers: map[uint32]uint32{STACK_POINTER: 0x200},
+		wantRegisters: map[uint32]uint32{
+			ARG_ZERO:       12,
+			ARG_ONE:        7,
+			ARG_TWO:        1,
+			ARG_THREE:      12,
+			RETURN_ADDRESS: 8,
+		},
+		wantMemory: map[uint32]uint32{0x240: 12},
+	}})
+}
@@ -1,7 +1,10 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 )
 
 const (
@@ -54,24 +57,163 @@ type CPU struct {
 	Memory    *Memory
 	Registers [32]uint32
 	PC        uint32
+	HartID    uint32 // identifies this CPU among the harts sharing Memory
+
+	FRegisters [32]uint64 // f0-f31, single-precision values are NaN-boxed
+	FCSR       uint32     // floating point control and status register (frm and fflags)
+
+	Cycles              uint64 // cycle/mcycle counter
+	InstructionsRetired uint64 // instret/minstret counter
+
+	// Clint provides the machine timer and software interrupts. Hart 0 advances its timer
+	// by one tick per executed instruction, so a CLINT shared by several harts runs at a single pace.
+	// NewCPU maps it on the memory bus, sharing the one already mapped by another hart.
+	Clint *CLINT
+	// Plic routes device interrupts to the machine (context 2*HartID) and supervisor
+	// (context 2*HartID+1) external interrupt lines. It is mapped on the memory bus like Clint.
+	Plic *PLIC
+
+	// ELF is the ELF file loaded by LoadFile, nil for other formats. Its symbols label the addresses printed by PrintInstruction.
+	ELF *ELFFile
+	// Debug maps addresses to source lines when the loaded file has DWARF information, nil otherwise.
+	// Malformed debugging information does not prevent loading, c.ELF.ReadDebugInfo reports why it is nil.
+	Debug *DebugInfo
+
+	// Personality selects how ECALL and semihosting requests are serviced.
+	// The zero value picks it from the OS/ABI of the loaded ELF file.
+	Personality Personality
+	semihost    *semihosting // open files of the semihosting personality
+	// Kernel holds the working directory and file descriptors of the Linux personality.
+	// NewCPU gives every CPU its own. When nil, the deprecated global Kernel is used.
+	Kernel *MicroKernel
+
+	privilege uint32 // current privilege level, one of the PRIVILEGE_* constants
+
+	mstatus    uint32
+	mtvec      uint32
+	mscratch   uint32
+	mepc       uint32
+	mcause     uint32
+	mtval      uint32
+	medeleg    uint32
+	mideleg    uint32
+	mcounteren uint32
+	mie        uint32
+	mip        uint32 // software writable pending bits, see pendingInterrupts
+
+	stvec      uint32
+	sscratch   uint32
+	sepc       uint32
+	scause     uint32
+	stval      uint32
+	scounteren uint32
+	satp       uint32
+
+	tlb [TLB_SIZE]tlbEntry // cached Sv32 translations
 }
 
 func NewCPU(mem *Memory) *CPU {
-	return &CPU{
-		Memory: mem,
+	c := &CPU{
+		Memory:    mem,
+		Kernel:    NewMicroKernel(),
+		privilege: PRIVILEGE_MACHINE,
+		mstatus:   PRIVILEGE_MACHINE << 11,
+	}
+	c.attachInterruptControllers()
+	return c
+}
+
+// NewCPUWithKernel creates a CPU whose Linux syscalls are serviced by k, which CPUs running
+// the threads of one program can share.
+func NewCPUWithKernel(mem *Memory, k *MicroKernel) *CPU {
+	c := NewCPU(mem)
+	c.Kernel = k
+	return c
+}
+
+// attachInterruptControllers maps a CLINT and a PLIC at their standard addresses.
+// Harts sharing a Memory share the controllers the first hart attached.
+func (c *CPU) attachInterruptControllers() {
+	if c.Memory == nil || c.Memory.Bus == nil {
+		c.Clint = NewCLINT(CLINT_DEFAULT_HARTS)
+		c.Plic = NewPLIC(PLIC_DEFAULT_SOURCES, 2*CLINT_DEFAULT_HARTS)
+		return
+	}
+	bus := c.Memory.Bus
+	if region, ok := bus.Find(CLINT_BASE); ok {
+		c.Clint, _ = region.Device.(*CLINT)
+	} else {
+		c.Clint = NewCLINT(CLINT_DEFAULT_HARTS)
+		bus.Attach(CLINT_BASE, CLINT_SIZE, c.Clint)
+	}
+	if region, ok := bus.Find(PLIC_BASE); ok {
+		c.Plic, _ = region.Device.(*PLIC)
+	} else {
+		c.Plic = NewPLIC(PLIC_DEFAULT_SOURCES, 2*CLINT_DEFAULT_HARTS)
+		bus.Attach(PLIC_BASE, PLIC_SIZE, c.Plic)
 	}
 }
 
+// LoadFile loads an ELF, Intel HEX, S-record or flat binary file, telling them apart from their contents,
+// and points PC at its entry point. Flat binaries are placed at the start of the lowest memory region.
 func (c *CPU) LoadFile(path string) error {
-	elf, err := ReadELFFile(path)
+	elf, img, err := readProgram(path, defaultLoadAddress(c.Memory))
+	if err != nil {
+		return err
+	}
+	if elf != nil {
+		return c.loadELF(elf)
+	}
+	return c.LoadImage(img)
+}
+
+// LoadBinary loads a flat binary at base and points PC at it.
+func (c *CPU) LoadBinary(path string, base uint32) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	img, err := ReadBinary(data, base)
+	if err != nil {
+		return err
+	}
+	return c.LoadImage(img)
+}
+
+// LoadImage copies a HEX, S-record or flat binary image to memory and points PC at its entry point.
+// Such images have no symbols, so c.ELF and c.Debug are cleared.
+func (c *CPU) LoadImage(img *Image) error {
+	err := img.CopyToMemory(c.Memory)
 	if err != nil {
 		return err
 	}
-	err = elf.CopyToMemory(c.Memory)
+	c.PC = img.Entry
+	c.ELF = nil
+	c.Debug = nil
+	return nil
+}
+
+// LoadELF loads the size bytes of an ELF file read from r, such as a bytes.Reader over an embedded program.
+func (c *CPU) LoadELF(r io.ReaderAt, size int64) error {
+	elf, err := ReadELF(r, size)
+	if err != nil {
+		return err
+	}
+	return c.loadELF(elf)
+}
+
+// loadELF copies the segments of elf to memory and points PC at its entry point.
+func (c *CPU) loadELF(elf *ELFFile) error {
+	if elf.Class != ELFCLASS32 {
+		return fmt.Errorf("ELF class %d cannot run on an RV32 CPU, use CPU64", elf.Class)
+	}
+	err := elf.CopyToMemory(c.Memory)
 	if err != nil {
 		return err
 	}
 	c.PC = elf.Entry
+	c.ELF = elf
+	c.Debug, _ = elf.ReadDebugInfo()
 	return nil
 }
 
@@ -146,8 +288,12 @@ func (c *CPU) PrintRegisters() {
 	}
 	fmt.Printf("Current:  ")
 	c.PrintInstruction(c.PC)
+	next := c.PC + 4
+	if _, length, err := c.fetchRaw(c.PC); err == nil {
+		next = c.PC + length
+	}
 	fmt.Printf("Next 1:   ")
-	c.PrintInstruction(c.PC + 4)
+	c.PrintInstruction(next)
 }
 
 func (c *CPU) PrintInstruction(addr uint32) {
@@ -156,11 +302,21 @@ func (c *CPU) PrintInstruction(addr uint32) {
 		fmt.Println("Error fetching instruction:", err)
 		return
 	}
-	val, err := c.Memory.ReadWord(addr)
+	val, length, err := c.fetchRaw(addr)
 	if err != nil {
 		fmt.Println("Error reading instruction :", err)
 	}
-	fmt.Printf("0x%08x: 0x%08x    #%s %s, %s, %s\n", addr, val, RISCVInstructionToString(instruction.value), RegisterToString(instruction.operand0), RegisterToString(instruction.operand1), RegisterToString(instruction.operand2))
+	label := ""
+	if c.ELF != nil {
+		if sym, offset, ok := c.ELF.SymbolAt(addr); ok {
+			label = fmt.Sprintf(" <%s+0x%x>", sym.Name, offset)
+		}
+	}
+	if length == 2 {
+		fmt.Printf("0x%08x%s: 0x%04x        #%s %s, %s, %s\n", addr, label, val, RISCVInstructionToString(instruction.value), RegisterToString(instruction.operand0), RegisterToString(instruction.operand1), RegisterToString(instruction.operand2))
+		return
+	}
+	fmt.Printf("0x%08x%s: 0x%08x    #%s %s, %s, %s\n", addr, label, val, RISCVInstructionToString(instruction.value), RegisterToString(instruction.operand0), RegisterToString(instruction.operand1), RegisterToString(instruction.operand2))
 }
 
 func (c *CPU) ExecuteFile(path string) error {
@@ -179,323 +335,304 @@ func (c *CPU) ExecuteFile(path string) error {
 }
 
 func (c *CPU) FetchNextInstruction() (Instruction, error) {
-	val, err := c.Memory.ReadWord(c.PC)
+	return c.FetchInstruction(c.PC)
+}
+
+// FetchInstruction decodes the instruction at addr, expanding compressed (16-bit) encodings.
+func (c *CPU) FetchInstruction(addr uint32) (Instruction, error) {
+	raw, length, err := c.fetchRaw(addr)
 	if err != nil {
 		return Instruction{}, err
 	}
-	return DecodeInstruction(val)
+	val := raw
+	if length == 2 {
+		val, err = ExpandCompressed(uint16(raw))
+		if err != nil {
+			return Instruction{}, &Exception{Cause: CAUSE_ILLEGAL_INSTRUCTION, Tval: raw, Err: err}
+		}
+	}
+	instruction, err := DecodeInstruction(val)
+	if err != nil {
+		return Instruction{}, &Exception{Cause: CAUSE_ILLEGAL_INSTRUCTION, Tval: raw, Err: err}
+	}
+	instruction.address = addr
+	instruction.length = length
+	instruction.raw = raw
+	return instruction, nil
 }
 
-func (c *CPU) FetchInstruction(addr uint32) (Instruction, error) {
-	val, err := c.Memory.ReadWord(addr)
+// fetchRaw reads the raw encoding of the instruction at addr along with its length in bytes.
+// Instructions are only 2-byte aligned, so 32-bit encodings are fetched as two half-words,
+// which may lie on different pages.
+func (c *CPU) fetchRaw(addr uint32) (uint32, uint32, error) {
+	low, err := c.fetchHalfWord(addr)
 	if err != nil {
-		return Instruction{}, err
+		return 0, 0, err
+	}
+	if !IsCompressed(low) {
+		high, err := c.fetchHalfWord(addr + 2)
+		if err != nil {
+			return 0, 0, err
+		}
+		return high<<16 | low, 4, nil
 	}
-	return DecodeInstruction(val)
+	return low, 2, nil
+}
+
+// fetchHalfWord reads half of an instruction from the virtual address addr.
+func (c *CPU) fetchHalfWord(addr uint32) (uint32, error) {
+	phys, err := c.Translate(addr, ACCESS_FETCH)
+	if err != nil {
+		return 0, err
+	}
+	err = c.Memory.CheckAccess(phys, 2, ACCESS_FETCH)
+	if err != nil {
+		return 0, accessFault(ACCESS_FETCH, addr, err)
+	}
+	val, err := c.Memory.ReadHalfWord(phys)
+	if err != nil {
+		return 0, accessFault(ACCESS_FETCH, addr, err)
+	}
+	return val, nil
+}
+
+// load reads size bytes at addr on behalf of a load instruction.
+// Misaligned and out of range accesses raise the matching exceptions.
+func (c *CPU) load(addr uint32, size uint32) (uint32, error) {
+	if addr%size != 0 {
+		return 0, &Exception{Cause: CAUSE_LOAD_MISALIGNED, Tval: addr}
+	}
+	phys, err := c.translateAndCheck(addr, size, ACCESS_LOAD)
+	if err != nil {
+		return 0, err
+	}
+	val, err := c.readPhysical(phys, size)
+	if err != nil {
+		return 0, &Exception{Cause: CAUSE_LOAD_ACCESS_FAULT, Tval: addr, Err: err}
+	}
+	return val, nil
+}
+
+// translateAndCheck translates the virtual address of a data access and checks
+// the segment permissions of the physical address.
+func (c *CPU) translateAndCheck(addr uint32, size uint32, access AccessType) (uint32, error) {
+	phys, err := c.Translate(addr, access)
+	if err != nil {
+		return 0, err
+	}
+	err = c.Memory.CheckAccess(phys, size, access)
+	if err != nil {
+		return 0, accessFault(access, addr, err)
+	}
+	return phys, nil
+}
+
+// readPhysical reads size bytes at a physical address.
+func (c *CPU) readPhysical(addr uint32, size uint32) (uint32, error) {
+	switch size {
+	case 1:
+		return c.Memory.ReadSingleByte(addr)
+	case 2:
+		return c.Memory.ReadHalfWord(addr)
+	default:
+		return c.Memory.ReadWord(addr)
+	}
+}
+
+// writePhysical writes the low size bytes of val at a physical address.
+func (c *CPU) writePhysical(addr uint32, size uint32, val uint32) error {
+	switch size {
+	case 1:
+		return c.Memory.WriteSingleByte(addr, val)
+	case 2:
+		return c.Memory.WriteHalfWord(addr, val)
+	default:
+		return c.Memory.WriteWord(addr, val)
+	}
+}
+
+// store writes the low size bytes of val at addr on behalf of a store instruction.
+// Misaligned and out of range accesses raise the matching exceptions.
+func (c *CPU) store(addr uint32, size uint32, val uint32) error {
+	if addr%size != 0 {
+		return &Exception{Cause: CAUSE_STORE_MISALIGNED, Tval: addr}
+	}
+	phys, err := c.translateAndCheck(addr, size, ACCESS_STORE)
+	if err != nil {
+		return err
+	}
+	err = c.writePhysical(phys, size, val)
+	if err != nil {
+		return &Exception{Cause: CAUSE_STORE_ACCESS_FAULT, Tval: addr, Err: err}
+	}
+	return nil
 }
 
 // ExecuteSingle decodes and executes a single instruction from memory at the program counter (PC).
 // It updates CPU registers based on the decoded instruction and increments the PC where applicable.
 // Returns True if Execution should be stopped
 func (c *CPU) ExecuteSingle() (int, error) {
+	if c.Clint != nil && c.HartID == 0 {
+		c.Clint.Tick(1)
+	}
+	if interrupt, ok := c.pendingInterrupt(); ok {
+		c.takeTrap(c.PC, 1<<31|interrupt, 0)
+		return OK, nil
+	}
 	instruction, err := c.FetchNextInstruction()
 	if err != nil {
-		return -1, err
+		return c.handleException(c.PC, err)
+	}
+	c.Cycles++
+	state, err := c.execute(instruction)
+	if err != nil {
+		return c.handleException(instruction.address, err)
+	}
+	c.InstructionsRetired++
+	return state, nil
+}
+
+// execute runs an already fetched instruction.
+func (c *CPU) execute(instruction Instruction) (int, error) {
+	c.PC += instruction.length
+	if isRV64Instruction(instruction) {
+		return -1, illegalInstruction(instruction, errors.New("RV64 instruction on an RV32 CPU"))
+	}
+	if isFloatInstruction(instruction.value) {
+		return c.executeFloat(instruction)
 	}
-	c.PC += 4
 	switch instruction.value {
 	case LUI:
 		c.WriteRegister(instruction.operand0, instruction.operand1<<12)
 	case AUIPC:
-		c.WriteRegister(instruction.operand0, uint32(int32(c.PC)+int32(instruction.operand1)))
+		c.WriteRegister(instruction.operand0, instruction.address+instruction.operand1<<12)
 	case JAL:
 		c.WriteRegister(instruction.operand0, c.PC)
-		c.PC = uint32((int32(c.PC) - 4 + int32(instruction.operand1)))
-	case BEQ:
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		if val0 == val1 {
-			c.PC = uint32(int32(c.PC) - 4 + int32(instruction.operand2))
-		}
-	case BNE:
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		if val0 != val1 {
-			c.PC = uint32(int32(c.PC) - 4 + int32(instruction.operand2))
-		}
-	case BLT:
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		if val0 < val1 {
-			c.PC = uint32(int32(c.PC) - 4 + int32(instruction.operand2))
-		}
-	case BGE:
+		c.PC = instruction.address + instruction.operand1
+	case BEQ, BNE, BLT, BGE, BLTU, BGEU:
 		val0, err0 := c.ReadRegister(instruction.operand0)
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err0, err1)
 		}
-		if val0 >= val1 {
-			c.PC = uint32(int32(c.PC) - 4 + int32(instruction.operand2))
-		}
-	case BLTU:
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		if val0 < val1 {
-			c.PC += uint32(int32(instruction.operand2) - 4)
-		}
-	case BGEU:
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		if val0 >= val1 {
-			c.PC += uint32(int32(instruction.operand2) - 4)
+		if branchTaken(instruction.value, val0, val1) {
+			c.PC = instruction.address + instruction.operand2
 		}
 	case JALR:
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, c.PC+4)
-		c.PC = uint32(int32(val1) + int32(instruction.operand2))
-	case LB:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		retVal, err := c.Memory.ReadSingleByte(uint32(int32(val1) + int32(instruction.operand2)*2))
-		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err1)
 		}
-		c.WriteRegister(instruction.operand0, retVal)
-	case LH:
+		c.WriteRegister(instruction.operand0, c.PC)
+		c.PC = (val1 + instruction.operand2) &^ 1
+	case LB, LH, LW, LBU, LHU:
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err1)
 		}
-		retVal, err := c.Memory.ReadHalfWord(uint32(int32(val1) + int32(instruction.operand2)*2))
+		retVal, err := c.load(val1+instruction.operand2, accessSize(instruction.value))
 		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return -1, err
 		}
-		c.WriteRegister(instruction.operand0, retVal)
-	case LW:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
+		c.WriteRegister(instruction.operand0, extendLoad[uint32](instruction.value, uint64(retVal)))
+	case SB, SH, SW:
+		val2, err2 := c.ReadRegister(instruction.operand2)
+		val0, err0 := c.ReadRegister(instruction.operand0)
+		if err0 != nil || err2 != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err0, err2)
 		}
-		retVal, err := c.Memory.ReadWord(uint32(int32(val1) + int32(instruction.operand2)*2))
+		err := c.store(val2+instruction.operand1, accessSize(instruction.value), val0)
 		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return -1, err
 		}
-		c.WriteRegister(instruction.operand0, retVal)
-	case LBU:
+	case ADDI, SLTI, SLTIU, XORI, ORI, ANDI, SLLI, SRLI, SRAI:
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err1)
 		}
-		retVal, err := c.Memory.ReadSingleByte(val1 + instruction.operand2*2)
-		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		c.WriteRegister(instruction.operand0, retVal)
-	case LHU:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
+		result, _ := computeInteger(instruction.value, val1, instruction.operand2)
+		c.WriteRegister(instruction.operand0, result)
+	case EBREAK:
+		if c.personality() == PERSONALITY_SEMIHOSTING && c.isSemihostingCall(instruction) {
+			return c.executeSemihosting()
 		}
-		retVal, err := c.Memory.ReadHalfWord(val1 + instruction.operand2*2)
-		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		if c.hasTrapHandler(CAUSE_BREAKPOINT) {
+			return -1, &Exception{Cause: CAUSE_BREAKPOINT, Tval: instruction.address}
 		}
-		c.WriteRegister(instruction.operand0, retVal)
-	case SB:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
+		return E_BREAK, nil
+	case ECALL:
+		if c.personality() == PERSONALITY_LINUX && c.emulatesECALL() {
+			return c.HandleECALL()
 		}
-		err := c.Memory.WriteSingleByte(uint32(int32(val1)+int32(instruction.operand2)*2), val0)
+		return -1, &Exception{Cause: CAUSE_ECALL_FROM_U + c.privilege}
+	case MRET:
+		err := c.executeMRET(instruction)
 		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return -1, err
 		}
-	case SH:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		err := c.Memory.WriteHalfWord(uint32(int32(val1)+int32(instruction.operand2)*2), val0)
+	case SRET:
+		err := c.executeSRET(instruction)
 		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return -1, err
 		}
-	case SW:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val0, err0 := c.ReadRegister(instruction.operand0)
-		if err0 != nil || err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err0, err1)
-		}
-		err := c.Memory.WriteWord(uint32(int32(val1)+int32(instruction.operand2)*2), val0)
+	case WFI:
+		err := c.executeWFI(instruction)
 		if err != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-	case ADDI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, uint32(int32(val1)+int32(instruction.operand2)))
-	case SLTI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		var b uint32 = 0
-		if int32(val1) < int32(instruction.operand2) {
-			b = 1
-		}
-		c.WriteRegister(instruction.operand0, b)
-	case SLTIU:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		var b uint32 = 0
-		if val1 < instruction.operand2 {
-			b = 1
-		}
-		c.WriteRegister(instruction.operand0, b)
-	case XORI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, val1^instruction.operand2)
-	case ORI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, val1|instruction.operand2)
-	case ANDI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, val1&instruction.operand2)
-	case SLLI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, val1<<instruction.operand2)
-	case SRLI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, val1>>instruction.operand2)
-	case SRAI:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		if err1 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err1)
-		}
-		c.WriteRegister(instruction.operand0, uint32(int32(val1)>>int32(instruction.operand2)))
-	case EBREAK:
-		return 1, nil
-	case ECALL:
-		return c.HandleECALL()
-	case ADD:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
-		}
-		c.WriteRegister(instruction.operand0, val1+val2)
-	case SUB:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+			return -1, err
 		}
-		c.WriteRegister(instruction.operand0, val1-val2)
-	case SLL:
+	case SFENCE_VMA:
+		return c.executeSFENCE(instruction)
+	case CSRRW, CSRRS, CSRRC, CSRRWI, CSRRSI, CSRRCI:
+		return c.executeCSR(instruction)
+	case ADD, SUB, SLL, SLT, SLTU, XOR, SRL, SRA, OR, AND, MUL, MULH, MULHSU, MULHU, DIV, DIVU, REM, REMU:
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		val2, err2 := c.ReadRegister(instruction.operand2)
 		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err1, err2)
 		}
-		c.WriteRegister(instruction.operand0, val1<<val2)
-	case SLT:
+		result, _ := computeInteger(instruction.value, val1, val2)
+		c.WriteRegister(instruction.operand0, result)
+	case LR_W:
 		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		if err1 != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err1)
 		}
-		var b uint32 = 0
-		if int32(val1) < int32(val2) {
-			b = 1
+		if val1%4 != 0 {
+			return -1, &Exception{Cause: CAUSE_LOAD_MISALIGNED, Tval: val1}
 		}
-		c.WriteRegister(instruction.operand0, b)
-	case SLTU:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		phys, err := c.translateAndCheck(val1, 4, ACCESS_LOAD)
+		if err != nil {
+			return -1, err
 		}
-		var b uint32 = 0
-		if val1 < val2 {
-			b = 1
+		retVal, err := c.Memory.LoadReserved(c.HartID, phys)
+		if err != nil {
+			return -1, &Exception{Cause: CAUSE_LOAD_ACCESS_FAULT, Tval: val1, Err: err}
 		}
-		c.WriteRegister(instruction.operand0, b)
-	case XOR:
+		c.WriteRegister(instruction.operand0, retVal)
+	case SC_W:
 		val1, err1 := c.ReadRegister(instruction.operand1)
 		val2, err2 := c.ReadRegister(instruction.operand2)
 		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err1, err2)
 		}
-		c.WriteRegister(instruction.operand0, val1^val2)
-	case SRL:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		if val1%4 != 0 {
+			return -1, &Exception{Cause: CAUSE_STORE_MISALIGNED, Tval: val1}
 		}
-		c.WriteRegister(instruction.operand0, val1>>val2)
-	case SRA:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		phys, err := c.translateAndCheck(val1, 4, ACCESS_STORE)
+		if err != nil {
+			return -1, err
 		}
-		c.WriteRegister(instruction.operand0, uint32(int32(val1)>>int32(val2)))
-	case OR:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		stored, err := c.Memory.StoreConditional(c.HartID, phys, val2)
+		if err != nil {
+			return -1, &Exception{Cause: CAUSE_STORE_ACCESS_FAULT, Tval: val1, Err: err}
 		}
-		c.WriteRegister(instruction.operand0, val1|val2)
-	case AND:
-		val1, err1 := c.ReadRegister(instruction.operand1)
-		val2, err2 := c.ReadRegister(instruction.operand2)
-		if err1 != nil || err2 != nil {
-			return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", c.PC-4, err1, err2)
+		if stored {
+			c.WriteRegister(instruction.operand0, 0)
+		} else {
+			c.WriteRegister(instruction.operand0, 1)
 		}
-		c.WriteRegister(instruction.operand0, val1&val2)
+	case AMOSWAP_W, AMOADD_W, AMOXOR_W, AMOAND_W, AMOOR_W, AMOMIN_W, AMOMAX_W, AMOMINU_W, AMOMAXU_W:
+		return c.executeAMO(instruction)
 	case NOP:
 		fallthrough
 	default:
@@ -503,6 +640,52 @@ func (c *CPU) ExecuteSingle() (int, error) {
 	return OK, nil
 }
 
+// executeAMO performs an atomic read-modify-write of the word at rs1, combining it with rs2.
+// The original memory value is written to rd.
+func (c *CPU) executeAMO(instruction Instruction) (int, error) {
+	val1, err1 := c.ReadRegister(instruction.operand1)
+	val2, err2 := c.ReadRegister(instruction.operand2)
+	if err1 != nil || err2 != nil {
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err1, err2)
+	}
+	var op func(old uint32) uint32
+	switch instruction.value {
+	case AMOSWAP_W:
+		op = func(old uint32) uint32 { return val2 }
+	case AMOADD_W:
+		op = func(old uint32) uint32 { return old + val2 }
+	case AMOXOR_W:
+		op = func(old uint32) uint32 { return old ^ val2 }
+	case AMOAND_W:
+		op = func(old uint32) uint32 { return old & val2 }
+	case AMOOR_W:
+		op = func(old uint32) uint32 { return old | val2 }
+	case AMOMIN_W:
+		op = func(old uint32) uint32 { return uint32(min(int32(old), int32(val2))) }
+	case AMOMAX_W:
+		op = func(old uint32) uint32 { return uint32(max(int32(old), int32(val2))) }
+	case AMOMINU_W:
+		op = func(old uint32) uint32 { return min(old, val2) }
+	case AMOMAXU_W:
+		op = func(old uint32) uint32 { return max(old, val2) }
+	default:
+		return UNKNOWN_INSTRUCTION, nil
+	}
+	if val1%4 != 0 {
+		return -1, &Exception{Cause: CAUSE_STORE_MISALIGNED, Tval: val1}
+	}
+	phys, err := c.translateAndCheck(val1, 4, ACCESS_STORE)
+	if err != nil {
+		return -1, err
+	}
+	old, err := c.Memory.AtomicModifyWord(phys, op)
+	if err != nil {
+		return -1, &Exception{Cause: CAUSE_STORE_ACCESS_FAULT, Tval: val1, Err: err}
+	}
+	c.WriteRegister(instruction.operand0, old)
+	return OK, nil
+}
+
 func (c *CPU) ReadRegister(reg uint32) (uint32, error) {
 	if reg == 0 {
 		return 0, nil
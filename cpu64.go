@@ -0,0 +1,417 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CPU64 is an RV64IMC hart. It shares the decoder, the integer instructions, the memory and the
+// syscall emulation with CPU. The physical address space of Memory stays 32-bit, so accesses beyond 4GiB fault.
+// CPU64 has no privileged architecture: exceptions stop execution with an error,
+// and instructions from the other extensions are illegal.
+type CPU64 struct {
+	Memory    *Memory
+	Registers [32]uint64
+	PC        uint64
+	HartID    uint32
+
+	Cycles              uint64
+	InstructionsRetired uint64
+
+	// ELF is the ELF file loaded by LoadFile, nil for other formats.
+	ELF *ELFFile
+
+	// Personality selects how ECALL is serviced, as for CPU. Semihosting is not available on RV64.
+	Personality Personality
+	// Kernel services the syscalls of the Linux personality, as for CPU.
+	Kernel *MicroKernel
+}
+
+func NewCPU64(mem *Memory) *CPU64 {
+	return &CPU64{
+		Memory: mem,
+		Kernel: NewMicroKernel(),
+	}
+}
+
+// NewCPU64WithKernel creates a CPU64 whose Linux syscalls are serviced by k, like NewCPUWithKernel.
+func NewCPU64WithKernel(mem *Memory, k *MicroKernel) *CPU64 {
+	c := NewCPU64(mem)
+	c.Kernel = k
+	return c
+}
+
+// LoadFile loads an ELF64, Intel HEX, S-record or flat binary file like CPU.LoadFile.
+func (c *CPU64) LoadFile(path string) error {
+	elf, img, err := readProgram(path, defaultLoadAddress(c.Memory))
+	if err != nil {
+		return err
+	}
+	if elf != nil {
+		return c.loadELF(elf)
+	}
+	return c.LoadImage(img)
+}
+
+// LoadImage copies an image to memory and points PC at its entry point.
+func (c *CPU64) LoadImage(img *Image) error {
+	err := img.CopyToMemory(c.Memory)
+	if err != nil {
+		return err
+	}
+	c.PC = uint64(img.Entry)
+	c.ELF = nil
+	return nil
+}
+
+// LoadELF loads the size bytes of an ELF64 file read from r.
+func (c *CPU64) LoadELF(r io.ReaderAt, size int64) error {
+	elf, err := ReadELF(r, size)
+	if err != nil {
+		return err
+	}
+	return c.loadELF(elf)
+}
+
+// loadELF copies the segments of elf to memory and points PC at its entry point.
+func (c *CPU64) loadELF(elf *ELFFile) error {
+	if elf.Class != ELFCLASS64 {
+		return fmt.Errorf("ELF class %d cannot run on an RV64 CPU, use CPU", elf.Class)
+	}
+	err := elf.CopyToMemory(c.Memory)
+	if err != nil {
+		return err
+	}
+	c.PC = uint64(elf.Entry)
+	c.ELF = elf
+	return nil
+}
+
+func (c *CPU64) ExecuteFile(path string) error {
+	err := c.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	state := OK
+	for state == OK || state == E_BREAK { //ignore breakpoints in normal execution mode
+		state, err = c.ExecuteSingle()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExecuteSingle decodes and executes the instruction at PC.
+func (c *CPU64) ExecuteSingle() (int, error) {
+	pc := c.PC
+	instruction, err := c.FetchInstruction(pc)
+	if err != nil {
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%w", pc, err)
+	}
+	c.Cycles++
+	state, err := c.execute(instruction)
+	if err != nil {
+		c.PC = pc
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%w", pc, err)
+	}
+	c.InstructionsRetired++
+	return state, nil
+}
+
+// FetchInstruction decodes the instruction at addr, expanding compressed (16-bit) encodings.
+func (c *CPU64) FetchInstruction(addr uint64) (Instruction, error) {
+	if addr%2 != 0 {
+		return Instruction{}, &Exception{Cause: CAUSE_INSTRUCTION_MISALIGNED, Tval: uint32(addr)}
+	}
+	raw, err := c.fetchHalfWord(addr)
+	if err != nil {
+		return Instruction{}, err
+	}
+	length := uint32(2)
+	if !IsCompressed(raw) { // 32-bit encodings are only 2-byte aligned
+		high, err := c.fetchHalfWord(addr + 2)
+		if err != nil {
+			return Instruction{}, err
+		}
+		raw, length = high<<16|raw, 4
+	}
+	val := raw
+	if length == 2 {
+		val, err = ExpandCompressed64(uint16(raw))
+		if err != nil {
+			return Instruction{}, &Exception{Cause: CAUSE_ILLEGAL_INSTRUCTION, Tval: raw, Err: err}
+		}
+	}
+	instruction, err := DecodeInstruction(val)
+	if err != nil {
+		return Instruction{}, &Exception{Cause: CAUSE_ILLEGAL_INSTRUCTION, Tval: raw, Err: err}
+	}
+	instruction.address = uint32(addr)
+	instruction.length = length
+	instruction.raw = raw
+	return instruction, nil
+}
+
+// fetchHalfWord reads half of an instruction at addr.
+func (c *CPU64) fetchHalfWord(addr uint64) (uint32, error) {
+	phys, err := c.physical(addr, 2, ACCESS_FETCH)
+	if err != nil {
+		return 0, err
+	}
+	val, err := c.Memory.ReadHalfWord(phys)
+	if err != nil {
+		return 0, accessFault(ACCESS_FETCH, phys, err)
+	}
+	return val, nil
+}
+
+// physical checks an access of size bytes at addr and returns its 32-bit physical address.
+func (c *CPU64) physical(addr uint64, size uint32, access AccessType) (uint32, error) {
+	if addr+uint64(size) > 1<<32 {
+		return 0, accessFault(access, uint32(addr), fmt.Errorf("address 0x%x is beyond the 32-bit physical address space", addr))
+	}
+	err := c.Memory.CheckAccess(uint32(addr), size, access)
+	if err != nil {
+		return 0, accessFault(access, uint32(addr), err)
+	}
+	return uint32(addr), nil
+}
+
+// load reads size bytes at addr on behalf of a load instruction, zero-extended.
+func (c *CPU64) load(addr uint64, size uint32) (uint64, error) {
+	if addr%uint64(size) != 0 {
+		return 0, &Exception{Cause: CAUSE_LOAD_MISALIGNED, Tval: uint32(addr)}
+	}
+	phys, err := c.physical(addr, size, ACCESS_LOAD)
+	if err != nil {
+		return 0, err
+	}
+	var val uint64
+	for i := uint32(0); i < size; i += min(size, 4) { // double words are read as two words
+		var word uint32
+		switch min(size, 4) {
+		case 1:
+			word, err = c.Memory.ReadSingleByte(phys + i)
+		case 2:
+			word, err = c.Memory.ReadHalfWord(phys + i)
+		default:
+			word, err = c.Memory.ReadWord(phys + i)
+		}
+		if err != nil {
+			return 0, &Exception{Cause: CAUSE_LOAD_ACCESS_FAULT, Tval: uint32(addr), Err: err}
+		}
+		val |= uint64(word) << (8 * i)
+	}
+	return val, nil
+}
+
+// store writes the low size bytes of val at addr on behalf of a store instruction.
+func (c *CPU64) store(addr uint64, size uint32, val uint64) error {
+	if addr%uint64(size) != 0 {
+		return &Exception{Cause: CAUSE_STORE_MISALIGNED, Tval: uint32(addr)}
+	}
+	phys, err := c.physical(addr, size, ACCESS_STORE)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < size; i += min(size, 4) {
+		word := uint32(val >> (8 * i))
+		switch min(size, 4) {
+		case 1:
+			err = c.Memory.WriteSingleByte(phys+i, word)
+		case 2:
+			err = c.Memory.WriteHalfWord(phys+i, word)
+		default:
+			err = c.Memory.WriteWord(phys+i, word)
+		}
+		if err != nil {
+			return &Exception{Cause: CAUSE_STORE_ACCESS_FAULT, Tval: uint32(addr), Err: err}
+		}
+	}
+	return nil
+}
+
+// signExtend32 sign extends the low word of val, as done by the W instructions.
+func signExtend32(val uint64) uint64 {
+	return uint64(int64(int32(val)))
+}
+
+// execute runs an already fetched instruction. The integer instructions are computed
+// by the helpers shared with CPU, the W instructions on the low words of their operands.
+func (c *CPU64) execute(instruction Instruction) (int, error) {
+	pc := c.PC
+	c.PC += uint64(instruction.length)
+	rd := instruction.operand0
+	imm := signExtend32(uint64(instruction.operand2)) // I-type immediate and B-type offset
+	switch instruction.value {
+	case LUI:
+		c.WriteRegister(rd, signExtend32(uint64(instruction.operand1<<12)))
+	case AUIPC:
+		c.WriteRegister(rd, pc+signExtend32(uint64(instruction.operand1<<12)))
+	case JAL:
+		c.WriteRegister(rd, c.PC)
+		c.PC = pc + signExtend32(uint64(instruction.operand1))
+	case JALR:
+		rs1, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, err
+		}
+		c.WriteRegister(rd, c.PC)
+		c.PC = (rs1 + imm) &^ 1
+	case BEQ, BNE, BLT, BGE, BLTU, BGEU:
+		val0, err0 := c.ReadRegister(instruction.operand0)
+		val1, err1 := c.ReadRegister(instruction.operand1)
+		if err := errors.Join(err0, err1); err != nil {
+			return -1, err
+		}
+		if branchTaken(instruction.value, val0, val1) {
+			c.PC = pc + imm
+		}
+	case LB, LH, LW, LD, LBU, LHU, LWU:
+		rs1, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, err
+		}
+		val, err := c.load(rs1+imm, accessSize(instruction.value))
+		if err != nil {
+			return -1, err
+		}
+		c.WriteRegister(rd, extendLoad[uint64](instruction.value, val))
+	case SB, SH, SW, SD:
+		base, err2 := c.ReadRegister(instruction.operand2)
+		val, err0 := c.ReadRegister(instruction.operand0)
+		if err := errors.Join(err0, err2); err != nil {
+			return -1, err
+		}
+		err := c.store(base+signExtend32(uint64(instruction.operand1)), accessSize(instruction.value), val)
+		if err != nil {
+			return -1, err
+		}
+	case ADDI, SLTI, SLTIU, XORI, ORI, ANDI, SLLI, SRLI, SRAI:
+		rs1, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, err
+		}
+		result, _ := computeInteger(instruction.value, rs1, imm)
+		c.WriteRegister(rd, result)
+	case ADDIW, SLLIW, SRLIW, SRAIW:
+		rs1, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, err
+		}
+		op, _ := wordOperation(instruction.value)
+		result, _ := computeInteger(op, uint32(rs1), instruction.operand2)
+		c.WriteRegister(rd, signExtend32(uint64(result)))
+	case ADD, SUB, SLL, SLT, SLTU, XOR, SRL, SRA, OR, AND, MUL, MULH, MULHSU, MULHU, DIV, DIVU, REM, REMU:
+		rs1, err1 := c.ReadRegister(instruction.operand1)
+		rs2, err2 := c.ReadRegister(instruction.operand2)
+		if err := errors.Join(err1, err2); err != nil {
+			return -1, err
+		}
+		result, _ := computeInteger(instruction.value, rs1, rs2)
+		c.WriteRegister(rd, result)
+	case ADDW, SUBW, SLLW, SRLW, SRAW, MULW, DIVW, DIVUW, REMW, REMUW:
+		rs1, err1 := c.ReadRegister(instruction.operand1)
+		rs2, err2 := c.ReadRegister(instruction.operand2)
+		if err := errors.Join(err1, err2); err != nil {
+			return -1, err
+		}
+		op, _ := wordOperation(instruction.value)
+		result, _ := computeInteger(op, uint32(rs1), uint32(rs2))
+		c.WriteRegister(rd, signExtend32(uint64(result)))
+	case EBREAK:
+		return E_BREAK, nil
+	case ECALL:
+		personality := c.Personality
+		if personality == PERSONALITY_AUTO && c.ELF != nil {
+			personality = PersonalityForABI(c.ELF.OSABI)
+		}
+		if personality != PERSONALITY_AUTO && personality != PERSONALITY_LINUX {
+			return -1, &Exception{Cause: CAUSE_ECALL_FROM_M}
+		}
+		return c.HandleECALL()
+	case NOP:
+	default:
+		return -1, illegalInstruction(instruction, fmt.Errorf("%s is not supported on RV64", RISCVInstructionToString(instruction.value)))
+	}
+	return OK, nil
+}
+
+// kernel returns the kernel servicing the syscalls of the CPU.
+func (c *CPU64) kernel() *MicroKernel {
+	if c.Kernel == nil {
+		return &Kernel
+	}
+	return c.Kernel
+}
+
+// HandleECALL performs the Linux syscall whose number is in a7 like CPU.HandleECALL,
+// with 64-bit pointers, sizes and offsets. Results are sign extended, so that -errno stays negative.
+func (c *CPU64) HandleECALL() (int, error) {
+	return c.kernel().syscall(c)
+}
+
+func (c *CPU64) xlen() uint {
+	return 64
+}
+
+func (c *CPU64) syscallArgument(n uint32) uint64 {
+	return c.Registers[ARG_ZERO+n]
+}
+
+func (c *CPU64) setSyscallResult(val uint64) {
+	c.WriteRegister(ARG_ZERO, val)
+}
+
+func (c *CPU64) readVirtual(addr uint64, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	for i := range buf {
+		b, err := c.load(addr+uint64(i), 1)
+		if err != nil {
+			return nil, err
+		}
+		buf[i] = byte(b)
+	}
+	return buf, nil
+}
+
+func (c *CPU64) writeVirtual(addr uint64, data []byte) error {
+	for i, b := range data {
+		err := c.store(addr+uint64(i), 1, uint64(b))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CPU64) ReadRegister(reg uint32) (uint64, error) {
+	if reg == 0 {
+		return 0, nil
+	}
+	if reg >= uint32(len(c.Registers)) {
+		return 0, fmt.Errorf("read register out of range at PC=%d", c.PC)
+	}
+	return c.Registers[reg], nil
+}
+
+func (c *CPU64) WriteRegister(reg uint32, val uint64) {
+	if reg == 0 || reg >= uint32(len(c.Registers)) {
+		return
+	}
+	c.Registers[reg] = val
+}
+
+// isRV64Instruction reports whether an instruction only exists on RV64, including
+// shifts by 32 or more, so that CPU raises an illegal instruction exception for it.
+func isRV64Instruction(instruction Instruction) bool {
+	switch instruction.value {
+	case LD, SD, LWU, ADDIW, SLLIW, SRLIW, SRAIW, ADDW, SUBW, SLLW, SRLW, SRAW, MULW, DIVW, DIVUW, REMW, REMUW:
+		return true
+	case SLLI, SRLI, SRAI:
+		return instruction.operand2 >= 32
+	}
+	return false
+}
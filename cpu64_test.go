@@ -0,0 +1,294 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runProgram64 writes program at address 0 and runs it until it stops.
+func runProgram64(t *testing.T, cpu *CPU64, program []uint32) int {
+	t.Helper()
+	for i, word := range program {
+		if err := cpu.Memory.WriteWord(uint32(i*4), word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for steps := 0; steps < 10000; steps++ {
+		state, err := cpu.ExecuteSingle()
+		if err != nil {
+			t.Fatalf("step %d: %v", steps, err)
+		}
+		if state != OK {
+			return state
+		}
+	}
+	t.Fatal("program did not stop")
+	return OK
+}
+
+// halfWords packs 16-bit instructions, two per word.
+func halfWords(halves ...uint16) []uint32 {
+	words := make([]uint32, (len(halves)+1)/2)
+	for i, half := range halves {
+		words[i/2] |= uint32(half) << (16 * (i % 2))
+	}
+	return words
+}
+
+func TestCPU64Instructions(t *testing.T) {
+	const MIN = 1 << 63
+	tests := []struct {
+		name        string
+		instruction uint32
+		a1, a2      uint64
+		want        uint64
+	}{
+		{"addw wraps and sign extends", 0x00c5853b, 0x7FFFFFFF, 1, 0xFFFFFFFF80000000},
+		{"subw ignores the high words", 0x40c5853b, 0x1_00000000, 1, 0xFFFFFFFFFFFFFFFF},
+		{"addiw", 0xfff5851b, 0x1_00000000, 0, 0xFFFFFFFFFFFFFFFF},
+		{"slliw", 0x01f5951b, 1, 0, 0xFFFFFFFF80000000},
+		{"srliw", 0x0045d51b, 0xFFFFFFFF_80000000, 0, 0x08000000},
+		{"sraiw", 0x4045d51b, 0x80000000, 0, 0xFFFFFFFFF8000000},
+		{"sllw masks the shift amount to 5 bits", 0x00c5953b, 1, 33, 2},
+		{"srlw", 0x00c5d53b, 0x80000000, 31, 1},
+		{"sraw", 0x40c5d53b, 0x80000000, 31, 0xFFFFFFFFFFFFFFFF},
+		{"slli by 63", 0x03f59513, 1, 0, MIN},
+		{"srli by 40", 0x0285d513, MIN, 0, 0x800000},
+		{"srai by 40", 0x4285d513, MIN, 0, 0xFFFFFFFFFF800000},
+		{"sll masks the shift amount to 6 bits", 0x00c59533, 1, 65, 2},
+		{"srl", 0x00c5d533, MIN, 63, 1},
+		{"sra", 0x40c5d533, MIN, 63, 0xFFFFFFFFFFFFFFFF},
+		{"slt", 0x00c5a533, MIN, 0, 1},
+		{"sltu", 0x00c5b533, MIN, 0, 0},
+		{"mul", 0x02c58533, 0x1_00000001, 0x1_00000001, 0x2_00000001},
+		{"mulh", 0x02c59533, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF, 0},
+		{"mulh of the most negative values", 0x02c59533, MIN, MIN, 1 << 62},
+		{"mulhsu", 0x02c5a533, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF},
+		{"mulhu", 0x02c5b533, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFE},
+		{"div", 0x02c5c533, 0xFFFFFFFFFFFFFFF9, 2, 0xFFFFFFFFFFFFFFFD},
+		{"div by zero", 0x02c5c533, 7, 0, 0xFFFFFFFFFFFFFFFF},
+		{"div overflow", 0x02c5c533, MIN, 0xFFFFFFFFFFFFFFFF, MIN},
+		{"divu", 0x02c5d533, 0xFFFFFFFFFFFFFFFF, 2, 0x7FFFFFFFFFFFFFFF},
+		{"rem", 0x02c5e533, 0xFFFFFFFFFFFFFFF9, 2, 0xFFFFFFFFFFFFFFFF},
+		{"rem overflow", 0x02c5e533, MIN, 0xFFFFFFFFFFFFFFFF, 0},
+		{"remu by zero", 0x02c5f533, 7, 0, 7},
+		{"mulw", 0x02c5853b, 0x10000, 0x10000, 0},
+		{"divw", 0x02c5c53b, 0x1_FFFFFFF9, 2, 0xFFFFFFFFFFFFFFFD},
+		{"divw overflow", 0x02c5c53b, 0x80000000, 0xFFFFFFFF, 0xFFFFFFFF80000000},
+		{"divuw by zero", 0x02c5d53b, 7, 0x1_00000000, 0xFFFFFFFFFFFFFFFF},
+		{"remw by zero", 0x02c5e53b, 0x80000000, 0, 0xFFFFFFFF80000000},
+		{"remuw", 0x02c5f53b, 0xFFFFFFFF, 0x10, 0xF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU64(NewMemory())
+			cpu.Registers[ARG_ONE] = test.a1
+			cpu.Registers[ARG_TWO] = test.a2
+			runProgram64(t, cpu, []uint32{test.instruction, EBREAK_WORD})
+			if got := cpu.Registers[ARG_ZERO]; got != test.want {
+				t.Errorf("a0 = 0x%x, want 0x%x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCPU64LoadsAndStores(t *testing.T) {
+	cpu := NewCPU64(NewMemory())
+	cpu.Registers[ARG_ONE] = 0x1000
+	cpu.Registers[ARG_TWO] = 0x8877665544332211
+	cpu.Memory.WriteWord(0x1000, 0x80000000)
+	runProgram64(t, cpu, []uint32{
+		0x00c5b823, // sd a2, 16(a1)
+		0x0105b683, // ld a3, 16(a1)
+		0x0005e703, // lwu a4, 0(a1)
+		0x0005a783, // lw a5, 0(a1)
+		0x0145a803, // lw a6, 20(a1)
+		EBREAK_WORD,
+	})
+	want := map[uint32]uint64{
+		ARG_THREE: 0x8877665544332211,
+		ARG_FOUR:  0x80000000,
+		ARG_FIVE:  0xFFFFFFFF80000000,
+		ARG_SIX:   0xFFFFFFFF88776655,
+	}
+	for reg, val := range want {
+		if got, _ := cpu.ReadRegister(reg); got != val {
+			t.Errorf("x%d = 0x%x, want 0x%x", reg, got, val)
+		}
+	}
+	if high, _ := cpu.Memory.ReadWord(0x1014); high != 0x88776655 {
+		t.Errorf("high word of the double word = 0x%x", high)
+	}
+
+	cpu = NewCPU64(NewMemory())
+	cpu.Registers[ARG_ONE] = 0x1_00000000
+	cpu.Memory.WriteWord(0, 0x0005b503) // ld a0, 0(a1)
+	if _, err := cpu.ExecuteSingle(); err == nil {
+		t.Error("load beyond the 32-bit physical address space succeeded")
+	}
+}
+
+func TestCPU64Compressed(t *testing.T) {
+	cpu := NewCPU64(NewMemory())
+	cpu.Registers[STACK_POINTER] = 0x1000
+	cpu.Registers[ARG_ZERO] = 0x7FFFFFFF
+	cpu.Registers[ARG_ONE] = 0x2000
+	cpu.Registers[ARG_TWO] = 0x1122334455667788
+	state := runProgram64(t, cpu, halfWords(
+		0xe990, // c.sd a2, 16(a1)
+		0x6994, // c.ld a3, 16(a1)
+		0xfc36, // c.sdsp a3, 56(sp)
+		0x7762, // c.ldsp a4, 56(sp)
+		0x2505, // c.addiw a0, 1
+		0x177e, // c.slli a4, 63
+		0x9f0d, // c.subw a4, a1
+		0x9002, // c.ebreak
+	))
+	if state != E_BREAK {
+		t.Fatalf("state = %d, want E_BREAK", state)
+	}
+	want := map[uint32]uint64{
+		ARG_ZERO:  0xFFFFFFFF80000000,
+		ARG_THREE: 0x1122334455667788,
+		ARG_FOUR:  0xFFFFFFFFFFFFE000,
+	}
+	for reg, val := range want {
+		if got, _ := cpu.ReadRegister(reg); got != val {
+			t.Errorf("x%d = 0x%x, want 0x%x", reg, got, val)
+		}
+	}
+	if cpu.PC != 16 {
+		t.Errorf("PC = %d, want 16 after eight 2-byte instructions", cpu.PC)
+	}
+}
+
+func TestExpandCompressed64(t *testing.T) {
+	tests := []struct {
+		compressed uint16
+		want       uint32
+		want32     uint32 // expansion on RV32, 0 when illegal
+	}{
+		{0x6588, 0x0085b503, 0x0085a507}, // c.ld a0, 8(a1), c.flw on RV32
+		{0xe990, 0x00c5b823, 0x00c5a827}, // c.sd a2, 16(a1), c.fsw on RV32
+		{0x757e, 0x1f813503, 0x0fc12507}, // c.ldsp a0, 504(sp), c.flwsp on RV32
+		{0xffaa, 0x1ea13c23, 0x0ea12e27}, // c.sdsp a0, 504(sp), c.fswsp on RV32
+		{0x3501, 0xfe05051b, 0xe01ff0ef}, // c.addiw a0, -32, c.jal -512 on RV32
+		{0x9d0d, 0x40b5053b, 0},          // c.subw a0, a1
+		{0x9d2d, 0x00b5053b, 0},          // c.addw a0, a1
+		{0x157e, 0x03f51513, 0},          // c.slli a0, 63
+		{0x9121, 0x02855513, 0},          // c.srli a0, 40
+		{0x95a1, 0x4285d593, 0},          // c.srai a1, 40
+		{0x41c8, 0x0045a503, 0x0045a503}, // c.lw a0, 4(a1)
+	}
+	for _, test := range tests {
+		got, err := ExpandCompressed64(test.compressed)
+		if err != nil || got != test.want {
+			t.Errorf("0x%04x expands to 0x%08x, %v on RV64, want 0x%08x", test.compressed, got, err, test.want)
+		}
+		got, err = ExpandCompressed(test.compressed)
+		if (err == nil) != (test.want32 != 0) || got != test.want32 {
+			t.Errorf("0x%04x expands to 0x%08x, %v on RV32, want 0x%08x", test.compressed, got, err, test.want32)
+		}
+	}
+	for _, illegal := range []uint16{0x2001, 0x9c4d, 0x6002} { // c.addiw x0, c.subw reserved encoding, c.ldsp x0
+		if got, err := ExpandCompressed64(illegal); err == nil {
+			t.Errorf("0x%04x expands to 0x%08x, want an illegal instruction", illegal, got)
+		}
+	}
+}
+
+func TestCPU64Syscalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, []byte("abcdefgh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	const ERRNO = 1 << 64 // -errno is sign extended to 64 bits
+	tests := []struct {
+		name string
+		args []uint64 // a0..a3
+		a7   uint64
+		want uint64
+	}{
+		{"getcwd", []uint64{0x200, 16}, GETCWD, 2},
+		{"getcwd beyond 4GiB", []uint64{0x1_00000200, 16}, GETCWD, ERRNO - EFAULT},
+		{"pread64 with a 64-bit offset in a3", []uint64{3, 0x300, 4, 2}, PREAD64, 4},
+		{"pread64 at an offset beyond 4GiB", []uint64{3, 0x300, 4, 0x1_00000000}, PREAD64, 0},
+		{"lseek beyond 4GiB", []uint64{3, 0x1_00000000, 0}, LSEEK, 0x1_00000000},
+		{"openat with a path beyond 4GiB", []uint64{1<<64 + AT_FDCWD, 0x1_00000000, O_RDONLY, 0}, OPENAT, ERRNO - EFAULT},
+		{"unknown syscall", nil, 1000, ERRNO - ENOSYS},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU64(NewMemory())
+			cpu.Kernel.CWD = "/"
+			cpu.Kernel.allocate(&FileDescriptor{Path: path, File: file, Flags: O_RDONLY})
+			copy(cpu.Registers[ARG_ZERO:], test.args)
+			cpu.Registers[ARG_SEVEN] = test.a7
+			runProgram64(t, cpu, []uint32{0x00000073, EBREAK_WORD}) // ecall
+			if got := cpu.Registers[ARG_ZERO]; got != test.want {
+				t.Errorf("a0 = 0x%x, want 0x%x", got, test.want)
+			}
+			if cwd, _ := cpu.Memory.ReadString(0x200); test.a7 == GETCWD && test.want == 2 && cwd != "/" {
+				t.Errorf("getcwd wrote %q", cwd)
+			}
+			if buf, _ := cpu.Memory.ReadWord(0x300); test.a7 == PREAD64 && test.want == 4 && buf != 0x66656463 {
+				t.Errorf("pread64 read 0x%x, want \"cdef\"", buf)
+			}
+		})
+	}
+}
+
+func TestCPU64LoadELF(t *testing.T) {
+	file := testELF{
+		class: ELFCLASS64,
+		entry: 0x100,
+		segments: []testSegment{{vaddr: 0x100, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(
+			0xfff00513, // li a0, -1
+			0x00155513, // srli a0, a0, 1
+			EBREAK_WORD,
+		)}},
+	}
+	data := file.build()
+	cpu := NewCPU64(NewMemory())
+	if err := cpu.LoadELF(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	state := OK
+	for state == OK {
+		var err error
+		if state, err = cpu.ExecuteSingle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.Registers[ARG_ZERO] != 0x7FFFFFFFFFFFFFFF {
+		t.Errorf("a0 = 0x%x, want 0x7fffffffffffffff", cpu.Registers[ARG_ZERO])
+	}
+
+	file.class = ELFCLASS32
+	data = file.build()
+	if err := NewCPU64(NewMemory()).LoadELF(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("an ELF32 file was loaded on RV64")
+	}
+}
+
+func TestCPU64ReadRegister(t *testing.T) {
+	cpu := NewCPU64(NewMemory())
+	cpu.WriteRegister(0, 1)
+	cpu.WriteRegister(ARG_ZERO, 1<<40)
+	if val, err := cpu.ReadRegister(0); val != 0 || err != nil {
+		t.Errorf("x0 = %d, %v", val, err)
+	}
+	if val, err := cpu.ReadRegister(ARG_ZERO); val != 1<<40 || err != nil {
+		t.Errorf("a0 = 0x%x, %v", val, err)
+	}
+	if _, err := cpu.ReadRegister(32); err == nil {
+		t.Error("read of x32 succeeded")
+	}
+}
@@ -0,0 +1,288 @@
+package core
+
+import "testing"
+
+const EBREAK_WORD = 0x00100073
+
+// cpuTest runs a program loaded at address 0 until it leaves the OK state.
+type cpuTest struct {
+	name          string
+	program       []uint32
+	registers     map[uint32]uint32 // initial registers
+	memory        map[uint32]uint32 // initial memory words
+	wantRegisters map[uint32]uint32
+	wantMemory    map[uint32]uint32
+}
+
+func runCPUTests(t *testing.T, tests []cpuTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			for addr, val := range test.memory {
+				if err := cpu.Memory.WriteWord(addr, val); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for reg, val := range test.registers {
+				cpu.Registers[reg] = val
+			}
+			runProgram(t, cpu, test.program)
+			for reg, want := range test.wantRegisters {
+				if got := cpu.Registers[reg]; got != want {
+					t.Errorf("x%d = 0x%08x, want 0x%08x", reg, got, want)
+				}
+			}
+			for addr, want := range test.wantMemory {
+				got, err := cpu.Memory.ReadWord(addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("memory at 0x%08x = 0x%08x, want 0x%08x", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+// runProgram copies a program at address 0 and executes it until it stops, returning the last state.
+func runProgram(t *testing.T, cpu *CPU, program []uint32) int {
+	t.Helper()
+	for i, word := range program {
+		if err := cpu.Memory.WriteWord(uint32(i*4), word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for steps := 0; steps < 10000; steps++ {
+		state, err := cpu.ExecuteSingle()
+		if err != nil {
+			t.Fatalf("step %d: %v", steps, err)
+		}
+		if state != OK {
+			return state
+		}
+	}
+	t.Fatal("program did not stop")
+	return OK
+}
+
+func TestLoadStoreAddressing(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name: "loads",
+			program: []uint32{
+				0x0085a503, // lw a0, 8(a1)
+				0x0055c603, // lbu a2, 5(a1)
+				0xffe5d683, // lhu a3, -2(a1)
+				EBREAK_WORD,
+			},
+			registers:     map[uint32]uint32{ARG_ONE: 0x100},
+			memory:        map[uint32]uint32{0xFC: 0xCAFE0000, 0x104: 0x0000AB00, 0x108: 0x12345678},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 0x12345678, ARG_TWO: 0xAB, ARG_THREE: 0xCAFE},
+		},
+		{
+			name: "stores",
+			program: []uint32{
+				0xfea12e23, // sw a0, -4(sp)
+				0x00a11123, // sh a0, 2(sp)
+				0x00a102a3, // sb a0, 5(sp)
+				EBREAK_WORD,
+			},
+			registers:  map[uint32]uint32{ARG_ZERO: 0x12345678, STACK_POINTER: 0x200},
+			wantMemory: map[uint32]uint32{0x1FC: 0x12345678, 0x200: 0x56780000, 0x204: 0x00007800},
+		},
+	})
+}
+
+func TestSignedBranches(t *testing.T) {
+	program := []uint32{
+		0x00b54463, // blt a0, a1, 8
+		0x00100613, // li a2, 1
+		0x00b55463, // bge a0, a1, 8
+		0x00100693, // li a3, 1
+		0x00b56463, // bltu a0, a1, 8
+		0x00100713, // li a4, 1
+		EBREAK_WORD,
+	}
+	runCPUTests(t, []cpuTest{
+		{
+			name:          "negative and positive",
+			program:       program,
+			registers:     map[uint32]uint32{ARG_ZERO: 0xFFFFFFFF, ARG_ONE: 1},
+			wantRegisters: map[uint32]uint32{ARG_TWO: 0, ARG_THREE: 1, ARG_FOUR: 1},
+		},
+		{
+			name:          "positive and negative",
+			program:       program,
+			registers:     map[uint32]uint32{ARG_ZERO: 1, ARG_ONE: 0xFFFFFFFF},
+			wantRegisters: map[uint32]uint32{ARG_TWO: 1, ARG_THREE: 0, ARG_FOUR: 0},
+		},
+		{
+			name:          "equal",
+			program:       program,
+			registers:     map[uint32]uint32{ARG_ZERO: 0x80000000, ARG_ONE: 0x80000000},
+			wantRegisters: map[uint32]uint32{ARG_TWO: 1, ARG_THREE: 0, ARG_FOUR: 1},
+		},
+	})
+}
+
+func TestJumpsAndSignExtension(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name: "jalr and auipc",
+			program: []uint32{
+				0x01100293, // li t0, 17
+				0x00001517, // auipc a0, 1
+				0x000280e7, // jalr ra, 0(t0)
+				EBREAK_WORD,
+				0x00100593, // li a1, 1
+				EBREAK_WORD,
+			},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 0x1004, RETURN_ADDRESS: 12, ARG_ONE: 1},
+		},
+		{
+			name: "signed loads",
+			program: []uint32{
+				0x00058503, // lb a0, 0(a1)
+				0x00059603, // lh a2, 0(a1)
+				0x00258683, // lb a3, 2(a1)
+				0x00259703, // lh a4, 2(a1)
+				EBREAK_WORD,
+			},
+			registers: map[uint32]uint32{ARG_ONE: 0x100},
+			memory:    map[uint32]uint32{0x100: 0x7F0080FF},
+			wantRegisters: map[uint32]uint32{
+				ARG_ZERO:  0xFFFFFFFF,
+				ARG_TWO:   0xFFFF80FF,
+				ARG_THREE: 0,
+				ARG_FOUR:  0x7F00,
+			},
+		},
+	})
+}
+
+func TestMultiplyDivide(t *testing.T) {
+	const (
+		MIN = 0x80000000
+		NEG = 0xFFFFFFFF
+	)
+	tests := []struct {
+		name     string
+		funct3   uint32
+		rs1, rs2 uint32
+		want     uint32
+	}{
+		{"mul", 0, 7, 0xFFFFFFFD, 0xFFFFFFEB},
+		{"mul overflow", 0, 0x10000, 0x10000, 0},
+		{"mulh min*min", 1, MIN, MIN, 0x40000000},
+		{"mulh -1*-1", 1, NEG, NEG, 0},
+		{"mulh -1*1", 1, NEG, 1, NEG},
+		{"mulhsu -1*max", 2, NEG, NEG, NEG},
+		{"mulhsu 2*max", 2, 2, NEG, 1},
+		{"mulhu max*max", 3, NEG, NEG, 0xFFFFFFFE},
+		{"div", 4, 0xFFFFFFF9, 2, 0xFFFFFFFD},
+		{"div by zero", 4, 7, 0, NEG},
+		{"div overflow", 4, MIN, NEG, MIN},
+		{"divu", 5, NEG, 2, 0x7FFFFFFF},
+		{"divu by zero", 5, 7, 0, NEG},
+		{"rem", 6, 0xFFFFFFF9, 2, NEG},
+		{"rem by zero", 6, 0xFFFFFFF9, 0, 0xFFFFFFF9},
+		{"rem overflow", 6, MIN, NEG, 0},
+		{"remu", 7, NEG, 10, 5},
+		{"remu by zero", 7, 7, 0, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			cpu.Registers[ARG_ONE] = test.rs1
+			cpu.Registers[ARG_TWO] = test.rs2
+			runProgram(t, cpu, []uint32{encodeRType(0b0110011, ARG_ZERO, test.funct3, ARG_ONE, ARG_TWO, 1), EBREAK_WORD})
+			if got := cpu.Registers[ARG_ZERO]; got != test.want {
+				t.Errorf("got 0x%08x, want 0x%08x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAtomicMemoryOperations(t *testing.T) {
+	const OLD = 0xFFFFFFF0 // -16
+	tests := []struct {
+		name   string
+		funct5 uint32
+		val    uint32
+		want   uint32 // memory after the operation
+	}{
+		{"amoswap", 0x01, 5, 5},
+		{"amoadd", 0x00, 0x20, 0x10},
+		{"amoxor", 0x04, 0xFF, 0xFFFFFF0F},
+		{"amoand", 0x0C, 0x3C, 0x30},
+		{"amoor", 0x08, 0x0F, 0xFFFFFFFF},
+		{"amomin", 0x10, 1, OLD},
+		{"amomax", 0x14, 1, 1},
+		{"amominu", 0x18, 1, 1},
+		{"amomaxu", 0x1C, 1, OLD},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runCPUTests(t, []cpuTest{{
+				name: test.name,
+				program: []uint32{
+					encodeRType(0b0101111, ARG_ZERO, 2, ARG_ONE, ARG_TWO, test.funct5<<2),
+					EBREAK_WORD,
+				},
+				registers:     map[uint32]uint32{ARG_ONE: 0x100, ARG_TWO: test.val},
+				memory:        map[uint32]uint32{0x100: OLD},
+				wantRegisters: map[uint32]uint32{ARG_ZERO: OLD},
+				wantMemory:    map[uint32]uint32{0x100: test.want},
+			}})
+		})
+	}
+}
+
+func TestLoadReservedStoreConditional(t *testing.T) {
+	lr := encodeRType(0b0101111, ARG_ZERO, 2, ARG_ONE, 0, 0x02<<2)
+	sc := encodeRType(0b0101111, ARG_THREE, 2, ARG_ONE, ARG_TWO, 0x03<<2)
+	sw := uint32(0x00c5a223) // sw a2, 4(a1)
+	runCPUTests(t, []cpuTest{
+		{
+			name:          "reserved",
+			program:       []uint32{lr, sc, EBREAK_WORD},
+			registers:     map[uint32]uint32{ARG_ONE: 0x100, ARG_TWO: 7},
+			memory:        map[uint32]uint32{0x100: 3},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 3, ARG_THREE: 0},
+			wantMemory:    map[uint32]uint32{0x100: 7},
+		},
+		{
+			name:          "without reservation",
+			program:       []uint32{sc, EBREAK_WORD},
+			registers:     map[uint32]uint32{ARG_ONE: 0x100, ARG_TWO: 7},
+			memory:        map[uint32]uint32{0x100: 3},
+			wantRegisters: map[uint32]uint32{ARG_THREE: 1},
+			wantMemory:    map[uint32]uint32{0x100: 3},
+		},
+		{
+			name:          "reservation released by the first sc",
+			program:       []uint32{lr, sc, sc, EBREAK_WORD},
+			registers:     map[uint32]uint32{ARG_ONE: 0x100, ARG_TWO: 7},
+			wantRegisters: map[uint32]uint32{ARG_THREE: 1},
+		},
+		{
+			name:          "store to another word keeps the reservation",
+			program:       []uint32{lr, sw, sc, EBREAK_WORD},
+			registers:     map[uint32]uint32{ARG_ONE: 0x100, ARG_TWO: 7},
+			wantRegisters: map[uint32]uint32{ARG_THREE: 0},
+			wantMemory:    map[uint32]uint32{0x100: 7, 0x104: 7},
+		},
+	})
+}
+
+func TestMisalignedAtomicCrashes(t *testing.T) {
+	cpu := NewCPU(NewMemory())
+	cpu.Registers[ARG_ONE] = 0x102
+	cpu.Memory.WriteWord(0, encodeRType(0b0101111, ARG_ZERO, 2, ARG_ONE, 0, 0x02<<2))
+	_, err := cpu.ExecuteSingle()
+	if err == nil {
+		t.Fatal("misaligned lr.w did not fail")
+	}
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"fmt"
+)
+
+// Control and status register addresses.
+const (
+	CSR_FFLAGS     = 0x001
+	CSR_FRM        = 0x002
+	CSR_FCSR       = 0x003
+	CSR_CYCLE      = 0xC00
+	CSR_TIME       = 0xC01
+	CSR_INSTRET    = 0xC02
+	CSR_CYCLEH     = 0xC80
+	CSR_TIMEH      = 0xC81
+	CSR_INSTRETH   = 0xC82
+	CSR_MVENDORID  = 0xF11
+	CSR_MARCHID    = 0xF12
+	CSR_MIMPID     = 0xF13
+	CSR_MHARTID    = 0xF14
+	CSR_SSTATUS    = 0x100
+	CSR_SIE        = 0x104
+	CSR_STVEC      = 0x105
+	CSR_SCOUNTEREN = 0x106
+	CSR_SSCRATCH   = 0x140
+	CSR_SEPC       = 0x141
+	CSR_SCAUSE     = 0x142
+	CSR_STVAL      = 0x143
+	CSR_SIP        = 0x144
+	CSR_SATP       = 0x180
+	CSR_MSTATUS    = 0x300
+	CSR_MISA       = 0x301
+	CSR_MEDELEG    = 0x302
+	CSR_MIDELEG    = 0x303
+	CSR_MIE        = 0x304
+	CSR_MTVEC      = 0x305
+	CSR_MCOUNTEREN = 0x306
+	CSR_MSCRATCH   = 0x340
+	CSR_MEPC       = 0x341
+	CSR_MCAUSE     = 0x342
+	CSR_MTVAL      = 0x343
+	CSR_MIP        = 0x344
+	CSR_MCYCLE     = 0xB00
+	CSR_MINSTRET   = 0xB02
+	CSR_MCYCLEH    = 0xB80
+	CSR_MINSTRETH  = 0xB82
+	CSR_PMPCFG0    = 0x3A0
+	CSR_PMPADDR0   = 0x3B0
+)
+
+// misaValue advertises RV32 (MXL=1) with the implemented extensions. misa is WARL and read-only here.
+const misaValue = 1<<30 | 1<<('A'-'A') | 1<<('C'-'A') | 1<<('D'-'A') | 1<<('F'-'A') | 1<<('I'-'A') | 1<<('M'-'A') |
+	1<<('S'-'A') | 1<<('U'-'A')
+
+// Writable bits of mstatus and of its supervisor view, sstatus.
+const (
+	mstatusWritable = MSTATUS_SIE | MSTATUS_MIE | MSTATUS_SPIE | MSTATUS_MPIE | MSTATUS_SPP | MSTATUS_MPP | MSTATUS_FS |
+		MSTATUS_MPRV | MSTATUS_SUM | MSTATUS_MXR | MSTATUS_TVM | MSTATUS_TW | MSTATUS_TSR
+	sstatusMask = MSTATUS_SIE | MSTATUS_SPIE | MSTATUS_SPP | MSTATUS_FS | MSTATUS_SUM | MSTATUS_MXR | MSTATUS_SD
+)
+
+// medelegWritable lists the exceptions that can be delegated to supervisor mode.
+// Environment calls from M-mode always stay in machine mode.
+const medelegWritable = 0xFFFF &^ (1<<CAUSE_ECALL_FROM_M | 1<<10 | 1<<14)
+
+// mieWritable lists the interrupts that can be enabled.
+const mieWritable = MIP_SSIP | MIP_MSIP | MIP_STIP | MIP_MTIP | MIP_SEIP | MIP_MEIP
+
+// mipWritable lists the pending bits software can set, the others are driven by the interrupt controllers.
+const mipWritable = MIP_SSIP | MIP_STIP | MIP_SEIP
+
+// midelegWritable lists the supervisor interrupts that can be delegated (SSIP, STIP, SEIP).
+const midelegWritable = 1<<1 | 1<<5 | 1<<9
+
+// isReadOnlyCSR reports whether a CSR address lies in one of the read-only ranges (bits 11:10 set).
+func isReadOnlyCSR(addr uint32) bool {
+	return (addr>>10)&0b11 == 0b11
+}
+
+// csrAccessAllowed checks the privilege level needed to access a CSR, which is encoded in bits 9:8
+// of its address, along with the counter enables and the trapping of satp accesses (mstatus.TVM).
+func (c *CPU) csrAccessAllowed(addr uint32) error {
+	if c.privilege < (addr>>8)&0b11 {
+		return fmt.Errorf("CSR 0x%03x is not accessible from privilege level %d", addr, c.privilege)
+	}
+	if addr == CSR_SATP && c.privilege == PRIVILEGE_SUPERVISOR && c.mstatus&MSTATUS_TVM != 0 {
+		return fmt.Errorf("satp access trapped by mstatus.TVM")
+	}
+	if (addr >= CSR_CYCLE && addr < CSR_CYCLE+32) || (addr >= CSR_CYCLEH && addr < CSR_CYCLEH+32) {
+		counter := uint32(1) << (addr & 0x1F)
+		if (c.privilege < PRIVILEGE_MACHINE && c.mcounteren&counter == 0) ||
+			(c.privilege == PRIVILEGE_USER && c.scounteren&counter == 0) {
+			return fmt.Errorf("counter CSR 0x%03x is not enabled", addr)
+		}
+	}
+	return nil
+}
+
+// ReadCSR returns the value of a control and status register.
+// Accessing a CSR that does not exist is an illegal instruction.
+func (c *CPU) ReadCSR(addr uint32) (uint32, error) {
+	switch addr {
+	case CSR_FFLAGS:
+		return c.FCSR & 0x1F, nil
+	case CSR_FRM:
+		return (c.FCSR >> 5) & 0b111, nil
+	case CSR_FCSR:
+		return c.FCSR & 0xFF, nil
+	case CSR_CYCLE, CSR_MCYCLE:
+		return uint32(c.Cycles), nil
+	case CSR_CYCLEH, CSR_MCYCLEH:
+		return uint32(c.Cycles >> 32), nil
+	case CSR_TIME:
+		return uint32(c.time()), nil
+	case CSR_TIMEH:
+		return uint32(c.time() >> 32), nil
+	case CSR_INSTRET, CSR_MINSTRET:
+		return uint32(c.InstructionsRetired), nil
+	case CSR_INSTRETH, CSR_MINSTRETH:
+		return uint32(c.InstructionsRetired >> 32), nil
+	case CSR_MVENDORID, CSR_MARCHID, CSR_MIMPID:
+		return 0, nil
+	case CSR_MHARTID:
+		return c.HartID, nil
+	case CSR_MISA:
+		return misaValue, nil
+	case CSR_MSTATUS:
+		if c.mstatus&MSTATUS_FS == MSTATUS_FS {
+			return c.mstatus | MSTATUS_SD, nil
+		}
+		return c.mstatus, nil
+	case CSR_MTVEC:
+		return c.mtvec, nil
+	case CSR_MSCRATCH:
+		return c.mscratch, nil
+	case CSR_MEPC:
+		return c.mepc, nil
+	case CSR_MCAUSE:
+		return c.mcause, nil
+	case CSR_MTVAL:
+		return c.mtval, nil
+	case CSR_MEDELEG:
+		return c.medeleg, nil
+	case CSR_MIDELEG:
+		return c.mideleg, nil
+	case CSR_MCOUNTEREN:
+		return c.mcounteren, nil
+	case CSR_MIE:
+		return c.mie, nil
+	case CSR_MIP:
+		return c.pendingInterrupts(), nil
+	case CSR_SIE:
+		return c.mie & c.mideleg, nil
+	case CSR_SIP:
+		return c.pendingInterrupts() & c.mideleg, nil
+	case CSR_SSTATUS:
+		mstatus, _ := c.ReadCSR(CSR_MSTATUS)
+		return mstatus & sstatusMask, nil
+	case CSR_STVEC:
+		return c.stvec, nil
+	case CSR_SCOUNTEREN:
+		return c.scounteren, nil
+	case CSR_SSCRATCH:
+		return c.sscratch, nil
+	case CSR_SEPC:
+		return c.sepc, nil
+	case CSR_SCAUSE:
+		return c.scause, nil
+	case CSR_STVAL:
+		return c.stval, nil
+	case CSR_SATP:
+		return c.satp, nil
+	default:
+		if isPMPCSR(addr) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("illegal read of unknown CSR 0x%03x", addr)
+	}
+}
+
+// WriteCSR sets a control and status register. WARL fields only keep legal values,
+// and writing a read-only CSR is an illegal instruction.
+func (c *CPU) WriteCSR(addr uint32, val uint32) error {
+	if isReadOnlyCSR(addr) {
+		return fmt.Errorf("illegal write to read-only CSR 0x%03x", addr)
+	}
+	switch addr {
+	case CSR_FFLAGS:
+		c.FCSR = c.FCSR&^0x1F | val&0x1F
+	case CSR_FRM:
+		c.FCSR = c.FCSR&^0xE0 | (val&0b111)<<5
+	case CSR_FCSR:
+		c.FCSR = val & 0xFF
+	case CSR_MCYCLE:
+		c.Cycles = c.Cycles&^0xFFFFFFFF | uint64(val)
+	case CSR_MCYCLEH:
+		c.Cycles = c.Cycles&0xFFFFFFFF | uint64(val)<<32
+	case CSR_MINSTRET:
+		c.InstructionsRetired = c.InstructionsRetired&^0xFFFFFFFF | uint64(val)
+	case CSR_MINSTRETH:
+		c.InstructionsRetired = c.InstructionsRetired&0xFFFFFFFF | uint64(val)<<32
+	case CSR_MISA:
+		// WARL: the set of extensions cannot be changed, writes are ignored.
+	case CSR_MSTATUS:
+		if (val&MSTATUS_MPP)>>11 == 2 { // reserved privilege level, MPP keeps its value
+			val = val&^MSTATUS_MPP | c.mstatus&MSTATUS_MPP
+		}
+		c.mstatus = val & mstatusWritable
+	case CSR_MTVEC:
+		c.mtvec = legalTrapVector(val)
+	case CSR_MEDELEG:
+		c.medeleg = val & medelegWritable
+	case CSR_MIDELEG:
+		c.mideleg = val & midelegWritable
+	case CSR_MCOUNTEREN:
+		c.mcounteren = val & 0b111
+	case CSR_MIE:
+		c.mie = val & mieWritable
+	case CSR_MIP:
+		c.mip = val & mipWritable
+	case CSR_SIE:
+		c.mie = c.mie&^c.mideleg | val&c.mideleg&mieWritable
+	case CSR_SIP:
+		// Supervisor software can only raise or clear its own software interrupt.
+		writable := c.mideleg & MIP_SSIP
+		c.mip = c.mip&^writable | val&writable
+	case CSR_SSTATUS:
+		c.mstatus = c.mstatus&^sstatusMask | val&sstatusMask&mstatusWritable
+	case CSR_STVEC:
+		c.stvec = legalTrapVector(val)
+	case CSR_SCOUNTEREN:
+		c.scounteren = val & 0b111
+	case CSR_SSCRATCH:
+		c.sscratch = val
+	case CSR_SEPC:
+		c.sepc = val &^ 1
+	case CSR_SCAUSE:
+		c.scause = val
+	case CSR_STVAL:
+		c.stval = val
+	case CSR_SATP:
+		// MODE is a single bit on RV32 (bare or Sv32), so every value is legal.
+		// Cached translations are dropped as they may belong to the previous page table.
+		c.satp = val
+		c.FlushTLB(0, true, 0, true)
+	case CSR_MSCRATCH:
+		c.mscratch = val
+	case CSR_MEPC:
+		c.mepc = val &^ 1
+	case CSR_MCAUSE:
+		c.mcause = val
+	case CSR_MTVAL:
+		c.mtval = val
+	default:
+		if isPMPCSR(addr) {
+			// Physical memory protection is not implemented, its registers are hardwired to zero.
+			return nil
+		}
+		return fmt.Errorf("illegal write to unknown CSR 0x%03x", addr)
+	}
+	return nil
+}
+
+// time returns the value of the time CSR: mtime when a CLINT is attached, the cycle count otherwise.
+func (c *CPU) time() uint64 {
+	if c.Clint != nil {
+		return c.Clint.Time()
+	}
+	return c.Cycles
+}
+
+// isPMPCSR reports whether addr is one of the pmpcfg or pmpaddr registers.
+func isPMPCSR(addr uint32) bool {
+	return (addr >= CSR_PMPCFG0 && addr < CSR_PMPCFG0+4) || (addr >= CSR_PMPADDR0 && addr < CSR_PMPADDR0+16)
+}
+
+// legalTrapVector returns the WARL value of mtvec or stvec: reserved modes fall back to direct.
+func legalTrapVector(val uint32) uint32 {
+	if val&0b11 > 1 {
+		return val &^ 0b11
+	}
+	return val
+}
+
+// executeCSR executes the Zicsr instructions, which atomically read and modify a CSR.
+// CSRRW does not read the CSR when rd is x0, and the set/clear forms do not write it
+// when rs1 is x0 (or the immediate is 0), so that such accesses have no side effects.
+func (c *CPU) executeCSR(instruction Instruction) (int, error) {
+	addr := instruction.operand2
+	err := c.csrAccessAllowed(addr)
+	if err != nil {
+		return -1, illegalInstruction(instruction, err)
+	}
+	var src uint32
+	switch instruction.value {
+	case CSRRW, CSRRS, CSRRC:
+		val, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		src = val
+	default:
+		src = instruction.operand1 // zero-extended 5-bit immediate
+	}
+
+	var old uint32
+	if instruction.operand0 != 0 || (instruction.value != CSRRW && instruction.value != CSRRWI) {
+		val, err := c.ReadCSR(addr)
+		if err != nil {
+			return -1, illegalInstruction(instruction, err)
+		}
+		old = val
+	}
+
+	write := true
+	var val uint32
+	switch instruction.value {
+	case CSRRW, CSRRWI:
+		val = src
+	case CSRRS, CSRRSI:
+		val = old | src
+		write = instruction.operand1 != 0
+	case CSRRC, CSRRCI:
+		val = old &^ src
+		write = instruction.operand1 != 0
+	}
+	if write {
+		err := c.WriteCSR(addr, val)
+		if err != nil {
+			return -1, illegalInstruction(instruction, err)
+		}
+	}
+	c.WriteRegister(instruction.operand0, old)
+	return OK, nil
+}
@@ -0,0 +1,158 @@
+package core
+
+import "testing"
+
+func TestCSRInstructions(t *testing.T) {
+	runCPUTests(t, []cpuTest{
+		{
+			name: "read-modify-write",
+			program: []uint32{
+				0x34059573, // csrrw a0, mscratch, a1
+				0x3406a673, // csrrs a2, mscratch, a3
+				0x3407b773, // csrrc a4, mscratch, a5
+				0x34002873, // csrr a6, mscratch
+				EBREAK_WORD,
+			},
+			registers: map[uint32]uint32{ARG_ONE: 0xF0, ARG_THREE: 0x0F, ARG_FIVE: 0x11},
+			wantRegisters: map[uint32]uint32{
+				ARG_ZERO:  0,
+				ARG_TWO:   0xF0,
+				ARG_FOUR:  0xFF,
+				ARG_SIX:   0xEE,
+				ARG_ONE:   0xF0,
+				ARG_THREE: 0x0F,
+			},
+		},
+		{
+			name: "immediate forms",
+			program: []uint32{
+				0x3402d573, // csrrwi a0, mscratch, 5
+				0x340565f3, // csrrsi a1, mscratch, 10
+				0x3400f673, // csrrci a2, mscratch, 1
+				0x340026f3, // csrr a3, mscratch
+				EBREAK_WORD,
+			},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 0, ARG_ONE: 5, ARG_TWO: 15, ARG_THREE: 14},
+		},
+		{
+			name: "fcsr fields",
+			program: []uint32{
+				0x00159073, // fsflags a1
+				0x0021d073, // fsrmi 3
+				0x00302573, // frcsr a0
+				0x00202673, // frrm a2
+				EBREAK_WORD,
+			},
+			registers:     map[uint32]uint32{ARG_ONE: 0xFF},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 3<<5 | 0x1F, ARG_TWO: 3},
+		},
+		{
+			name: "counters",
+			program: []uint32{
+				0x00000013, // nop
+				0x00000013, // nop
+				0xb0202573, // csrr a0, minstret
+				0xc00025f3, // rdcycle a1
+				EBREAK_WORD,
+			},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 2, ARG_ONE: 4},
+		},
+		{
+			name: "WARL fields",
+			program: []uint32{
+				0x30559073, // csrw mtvec, a1
+				0x30502573, // csrr a0, mtvec
+				0x30101073, // csrw misa, zero
+				0x30102673, // csrr a2, misa
+				0x34169073, // csrw mepc, a3
+				0x341026f3, // csrr a3, mepc
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			registers:     map[uint32]uint32{ARG_ONE: 0x1003, ARG_THREE: 0x2001},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 0x1000, ARG_TWO: misaValue, ARG_THREE: 0x2000},
+		},
+		{
+			name: "reading a read-only counter without writing it",
+			program: []uint32{
+				0xc0002573, // csrrs a0, cycle, zero
+				EBREAK_WORD,
+			},
+			wantRegisters: map[uint32]uint32{ARG_ZERO: 1},
+		},
+	})
+}
+
+func TestIllegalCSRAccesses(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint32
+		setup       func(c *CPU)
+	}{
+		{
+			name:        "write to a read-only CSR",
+			instruction: 0xc0059073, // csrw cycle, a1
+		},
+		{
+			name:        "unknown CSR",
+			instruction: 0x7ff02573, // csrr a0, 0x7ff
+		},
+		{
+			name:        "machine CSR from user mode",
+			instruction: 0x34002573, // csrr a0, mscratch
+			setup:       func(c *CPU) { c.privilege = PRIVILEGE_USER },
+		},
+		{
+			name:        "machine CSR from supervisor mode",
+			instruction: 0x30002573, // csrr a0, mstatus
+			setup:       func(c *CPU) { c.privilege = PRIVILEGE_SUPERVISOR },
+		},
+		{
+			name:        "disabled counter",
+			instruction: 0xc0002573, // rdcycle a0
+			setup:       func(c *CPU) { c.privilege = PRIVILEGE_USER },
+		},
+		{
+			name:        "counter enabled by mcounteren only",
+			instruction: 0xc0002573, // rdcycle a0
+			setup: func(c *CPU) {
+				c.privilege = PRIVILEGE_USER
+				c.mcounteren = 1
+			},
+		},
+		{
+			name:        "satp trapped by mstatus.TVM",
+			instruction: 0x18002573, // csrr a0, satp
+			setup: func(c *CPU) {
+				c.privilege = PRIVILEGE_SUPERVISOR
+				c.mstatus |= MSTATUS_TVM
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			if test.setup != nil {
+				test.setup(cpu)
+			}
+			cpu.Memory.WriteWord(0, test.instruction)
+			if _, err := cpu.ExecuteSingle(); err == nil {
+				t.Error("the access was allowed")
+			}
+		})
+	}
+}
+
+func TestCounterEnables(t *testing.T) {
+	cpu := NewCPU(NewMemory())
+	cpu.privilege = PRIVILEGE_USER
+	cpu.mcounteren = 1
+	cpu.scounteren = 1
+	cpu.Memory.WriteWord(0, 0xc0002573) // rdcycle a0
+	if _, err := cpu.ExecuteSingle(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers[ARG_ZERO] != 1 {
+		t.Errorf("cycle = %d, want 1", cpu.Registers[ARG_ZERO])
+	}
+}
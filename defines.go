@@ -47,6 +47,104 @@ const (
 	SRA
 	OR
 	AND
+	MUL
+	MULH
+	MULHSU
+	MULHU
+	DIV
+	DIVU
+	REM
+	REMU
+	LR_W
+	SC_W
+	AMOSWAP_W
+	AMOADD_W
+	AMOXOR_W
+	AMOAND_W
+	AMOOR_W
+	AMOMIN_W
+	AMOMAX_W
+	AMOMINU_W
+	AMOMAXU_W
+	FLW
+	FSW
+	FLD
+	FSD
+	FMADD_S
+	FMSUB_S
+	FNMSUB_S
+	FNMADD_S
+	FADD_S
+	FSUB_S
+	FMUL_S
+	FDIV_S
+	FSQRT_S
+	FSGNJ_S
+	FSGNJN_S
+	FSGNJX_S
+	FMIN_S
+	FMAX_S
+	FEQ_S
+	FLT_S
+	FLE_S
+	FCVT_W_S
+	FCVT_WU_S
+	FCVT_S_W
+	FCVT_S_WU
+	FMADD_D
+	FMSUB_D
+	FNMSUB_D
+	FNMADD_D
+	FADD_D
+	FSUB_D
+	FMUL_D
+	FDIV_D
+	FSQRT_D
+	FSGNJ_D
+	FSGNJN_D
+	FSGNJX_D
+	FMIN_D
+	FMAX_D
+	FEQ_D
+	FLT_D
+	FLE_D
+	FCVT_W_D
+	FCVT_WU_D
+	FCVT_D_W
+	FCVT_D_WU
+	FMV_X_W
+	FMV_W_X
+	FCVT_S_D
+	FCVT_D_S
+	FCLASS_S
+	FCLASS_D
+	CSRRW
+	CSRRS
+	CSRRC
+	CSRRWI
+	CSRRSI
+	CSRRCI
+	MRET
+	SRET
+	WFI
+	SFENCE_VMA
+	LD
+	SD
+	LWU
+	ADDIW
+	SLLIW
+	SRLIW
+	SRAIW
+	ADDW
+	SUBW
+	SLLW
+	SRLW
+	SRAW
+	MULW
+	DIVW
+	DIVUW
+	REMW
+	REMUW
 	NOP
 )
 
@@ -55,6 +153,11 @@ type Instruction struct {
 	operand0 uint32
 	operand1 uint32
 	operand2 uint32
+	operand3 uint32 // rs3 of the fused multiply-add instructions
+	rm       uint32 // floating point rounding mode
+	address  uint32 // address the instruction was fetched from
+	length   uint32 // encoded size in bytes, 2 for compressed instructions
+	raw      uint32 // encoding as fetched, before expansion of compressed instructions
 }
 
 const (
@@ -64,6 +167,7 @@ const (
 	B
 	U
 	J
+	R4
 )
 
 var OpToType = map[OpCode]OpType{
@@ -73,9 +177,19 @@ var OpToType = map[OpCode]OpType{
 	0b1100111: I,
 	0b0000011: I,
 	0b0010011: I,
+	0b0011011: I, // RV64 OP-IMM-32
 	0b1110011: I,
 	0b0100011: S,
 	0b0110011: R,
+	0b0111011: R, // RV64 OP-32
+	0b0101111: R,
+	0b1010011: R,
+	0b0000111: I,
+	0b0100111: S,
+	0b1000011: R4,
+	0b1000111: R4,
+	0b1001011: R4,
+	0b1001111: R4,
 	0b0000000: R,
 	0b1101111: J,
 }
@@ -160,6 +274,202 @@ func RISCVInstructionToString(instruction RISCVInstruction) string {
 		return "OR"
 	case AND:
 		return "AND"
+	case MUL:
+		return "MUL"
+	case MULH:
+		return "MULH"
+	case MULHSU:
+		return "MULHSU"
+	case MULHU:
+		return "MULHU"
+	case DIV:
+		return "DIV"
+	case DIVU:
+		return "DIVU"
+	case REM:
+		return "REM"
+	case REMU:
+		return "REMU"
+	case LR_W:
+		return "LR.W"
+	case SC_W:
+		return "SC.W"
+	case AMOSWAP_W:
+		return "AMOSWAP.W"
+	case AMOADD_W:
+		return "AMOADD.W"
+	case AMOXOR_W:
+		return "AMOXOR.W"
+	case AMOAND_W:
+		return "AMOAND.W"
+	case AMOOR_W:
+		return "AMOOR.W"
+	case AMOMIN_W:
+		return "AMOMIN.W"
+	case AMOMAX_W:
+		return "AMOMAX.W"
+	case AMOMINU_W:
+		return "AMOMINU.W"
+	case AMOMAXU_W:
+		return "AMOMAXU.W"
+	case FLW:
+		return "FLW"
+	case FSW:
+		return "FSW"
+	case FLD:
+		return "FLD"
+	case FSD:
+		return "FSD"
+	case FMADD_S:
+		return "FMADD.S"
+	case FMSUB_S:
+		return "FMSUB.S"
+	case FNMSUB_S:
+		return "FNMSUB.S"
+	case FNMADD_S:
+		return "FNMADD.S"
+	case FADD_S:
+		return "FADD.S"
+	case FSUB_S:
+		return "FSUB.S"
+	case FMUL_S:
+		return "FMUL.S"
+	case FDIV_S:
+		return "FDIV.S"
+	case FSQRT_S:
+		return "FSQRT.S"
+	case FSGNJ_S:
+		return "FSGNJ.S"
+	case FSGNJN_S:
+		return "FSGNJN.S"
+	case FSGNJX_S:
+		return "FSGNJX.S"
+	case FMIN_S:
+		return "FMIN.S"
+	case FMAX_S:
+		return "FMAX.S"
+	case FEQ_S:
+		return "FEQ.S"
+	case FLT_S:
+		return "FLT.S"
+	case FLE_S:
+		return "FLE.S"
+	case FCVT_W_S:
+		return "FCVT.W.S"
+	case FCVT_WU_S:
+		return "FCVT.WU.S"
+	case FCVT_S_W:
+		return "FCVT.S.W"
+	case FCVT_S_WU:
+		return "FCVT.S.WU"
+	case FMADD_D:
+		return "FMADD.D"
+	case FMSUB_D:
+		return "FMSUB.D"
+	case FNMSUB_D:
+		return "FNMSUB.D"
+	case FNMADD_D:
+		return "FNMADD.D"
+	case FADD_D:
+		return "FADD.D"
+	case FSUB_D:
+		return "FSUB.D"
+	case FMUL_D:
+		return "FMUL.D"
+	case FDIV_D:
+		return "FDIV.D"
+	case FSQRT_D:
+		return "FSQRT.D"
+	case FSGNJ_D:
+		return "FSGNJ.D"
+	case FSGNJN_D:
+		return "FSGNJN.D"
+	case FSGNJX_D:
+		return "FSGNJX.D"
+	case FMIN_D:
+		return "FMIN.D"
+	case FMAX_D:
+		return "FMAX.D"
+	case FEQ_D:
+		return "FEQ.D"
+	case FLT_D:
+		return "FLT.D"
+	case FLE_D:
+		return "FLE.D"
+	case FCVT_W_D:
+		return "FCVT.W.D"
+	case FCVT_WU_D:
+		return "FCVT.WU.D"
+	case FCVT_D_W:
+		return "FCVT.D.W"
+	case FCVT_D_WU:
+		return "FCVT.D.WU"
+	case FMV_X_W:
+		return "FMV.X.W"
+	case FMV_W_X:
+		return "FMV.W.X"
+	case FCVT_S_D:
+		return "FCVT.S.D"
+	case FCVT_D_S:
+		return "FCVT.D.S"
+	case FCLASS_S:
+		return "FCLASS.S"
+	case FCLASS_D:
+		return "FCLASS.D"
+	case CSRRW:
+		return "CSRRW"
+	case CSRRS:
+		return "CSRRS"
+	case CSRRC:
+		return "CSRRC"
+	case CSRRWI:
+		return "CSRRWI"
+	case CSRRSI:
+		return "CSRRSI"
+	case CSRRCI:
+		return "CSRRCI"
+	case MRET:
+		return "MRET"
+	case SRET:
+		return "SRET"
+	case WFI:
+		return "WFI"
+	case SFENCE_VMA:
+		return "SFENCE.VMA"
+	case LD:
+		return "LD"
+	case SD:
+		return "SD"
+	case LWU:
+		return "LWU"
+	case ADDIW:
+		return "ADDIW"
+	case SLLIW:
+		return "SLLIW"
+	case SRLIW:
+		return "SRLIW"
+	case SRAIW:
+		return "SRAIW"
+	case ADDW:
+		return "ADDW"
+	case SUBW:
+		return "SUBW"
+	case SLLW:
+		return "SLLW"
+	case SRLW:
+		return "SRLW"
+	case SRAW:
+		return "SRAW"
+	case MULW:
+		return "MULW"
+	case DIVW:
+		return "DIVW"
+	case DIVUW:
+		return "DIVUW"
+	case REMW:
+		return "REMW"
+	case REMUW:
+		return "REMUW"
 	default:
 	}
 	return "Unknown instruction"
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"container/heap"
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SourceLine is a row of the DWARF line table: the source position of the code starting at Address.
+type SourceLine struct {
+	Address  uint32
+	File     string
+	Line     int
+	Function string // enclosing function, empty if unknown
+
+	isStmt      bool // recommended breakpoint location
+	endSequence bool // first address after a contiguous block of code
+}
+
+// Function is a function described in .debug_info, covering the addresses [Low, High).
+type Function struct {
+	Name string
+	Low  uint32
+	High uint32
+}
+
+// DebugInfo maps addresses to source lines and functions using the DWARF sections of an ELF file.
+type DebugInfo struct {
+	Lines     []SourceLine // sorted by address
+	Functions []Function   // sorted by address
+
+	elf           *ELFFile
+	functionIndex []functionRange // disjoint ranges sorted by address, see indexFunctions
+}
+
+// functionRange attributes the addresses [low, high) to the innermost function covering them.
+type functionRange struct {
+	low      uint32
+	high     uint32
+	function int // index in Functions
+}
+
+// ErrNoDebugInfo is returned by ReadDebugInfo for files built without debugging information.
+var ErrNoDebugInfo = errors.New("no DWARF debugging information")
+
+// ReadDebugInfo decodes the .debug_line and .debug_info sections of the file.
+func (elf *ELFFile) ReadDebugInfo() (*DebugInfo, error) {
+	section := func(name string) []byte {
+		if sh, ok := elf.Section(name); ok {
+			return sh.Data
+		}
+		return nil
+	}
+	if section(".debug_info") == nil {
+		return nil, ErrNoDebugInfo
+	}
+	data, err := dwarf.New(section(".debug_abbrev"), section(".debug_aranges"), section(".debug_frame"),
+		section(".debug_info"), section(".debug_line"), section(".debug_pubnames"), section(".debug_ranges"),
+		section(".debug_str"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DWARF data: %w", err)
+	}
+	for _, name := range []string{".debug_addr", ".debug_line_str", ".debug_str_offsets", ".debug_rnglists"} { // DWARF 5
+		if contents := section(name); contents != nil {
+			err = data.AddSection(name, contents)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DWARF section %s: %w", name, err)
+			}
+		}
+	}
+
+	info := &DebugInfo{elf: elf}
+	err = info.readFunctions(data)
+	if err != nil {
+		return nil, err
+	}
+	err = info.readLines(data)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readFunctions collects the address ranges of every subprogram.
+func (d *DebugInfo) readFunctions(data *dwarf.Data) error {
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("invalid .debug_info: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		ranges, err := data.Ranges(entry)
+		if err != nil || len(ranges) == 0 {
+			continue // declarations and functions removed by the linker
+		}
+		name := functionName(data, entry)
+		for _, r := range ranges {
+			d.Functions = append(d.Functions, Function{Name: name, Low: uint32(r[0]), High: uint32(r[1])})
+		}
+	}
+	sort.SliceStable(d.Functions, func(i, j int) bool { return d.Functions[i].Low < d.Functions[j].Low })
+	d.indexFunctions()
+	return nil
+}
+
+// indexFunctions splits the address ranges of the functions, which may nest or overlap,
+// into disjoint ranges attributed to the innermost function: the smallest one, or the first
+// of the smallest ones. Functions must be sorted by address.
+func (d *DebugInfo) indexFunctions() {
+	var bounds []uint32
+	for _, f := range d.Functions {
+		if f.Low < f.High {
+			bounds = append(bounds, f.Low, f.High)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	d.functionIndex = nil
+	active := &functionHeap{functions: d.Functions}
+	next := 0
+	for i := 0; i+1 < len(bounds); i++ {
+		low, high := bounds[i], bounds[i+1]
+		if low == high {
+			continue
+		}
+		for next < len(d.Functions) && d.Functions[next].Low <= low {
+			heap.Push(active, next)
+			next++
+		}
+		for active.Len() > 0 && d.Functions[active.indexes[0]].High <= low {
+			heap.Pop(active)
+		}
+		if active.Len() == 0 {
+			continue
+		}
+		function := active.indexes[0]
+		if n := len(d.functionIndex); n > 0 && d.functionIndex[n-1].high == low && d.functionIndex[n-1].function == function {
+			d.functionIndex[n-1].high = high
+			continue
+		}
+		d.functionIndex = append(d.functionIndex, functionRange{low: low, high: high, function: function})
+	}
+}
+
+// functionHeap orders indexes in functions from the smallest function to the largest, then by index.
+type functionHeap struct {
+	functions []Function
+	indexes   []int
+}
+
+func (h *functionHeap) Len() int { return len(h.indexes) }
+
+func (h *functionHeap) Less(i, j int) bool {
+	a, b := h.functions[h.indexes[i]], h.functions[h.indexes[j]]
+	if a.High-a.Low != b.High-b.Low {
+		return a.High-a.Low < b.High-b.Low
+	}
+	return h.indexes[i] < h.indexes[j]
+}
+
+func (h *functionHeap) Swap(i, j int) { h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i] }
+
+func (h *functionHeap) Push(x any) { h.indexes = append(h.indexes, x.(int)) }
+
+func (h *functionHeap) Pop() any {
+	last := h.indexes[len(h.indexes)-1]
+	h.indexes = h.indexes[:len(h.indexes)-1]
+	return last
+}
+
+// functionName returns the name of a subprogram, following the declaration it completes if needed.
+func functionName(data *dwarf.Data, entry *dwarf.Entry) string {
+	for i := 0; i < 4 && entry != nil; i++ { // bounded in case of malformed references
+		if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+			return name
+		}
+		offset, ok := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			offset, ok = entry.Val(dwarf.AttrSpecification).(dwarf.Offset)
+		}
+		if !ok {
+			return ""
+		}
+		reader := data.Reader()
+		reader.Seek(offset)
+		entry, _ = reader.Next()
+	}
+	return ""
+}
+
+// readLines collects the rows of the line table of every compilation unit.
+func (d *DebugInfo) readLines(data *dwarf.Data) error {
+	reader := data.Reader()
+	for {
+		unit, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("invalid .debug_info: %w", err)
+		}
+		if unit == nil {
+			break
+		}
+		if unit.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+			continue
+		}
+		lines, err := data.LineReader(unit)
+		reader.SkipChildren()
+		if err != nil {
+			return fmt.Errorf("invalid .debug_line: %w", err)
+		}
+		if lines == nil {
+			continue
+		}
+		var row dwarf.LineEntry
+		for {
+			err = lines.Next(&row)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("invalid .debug_line: %w", err)
+			}
+			line := SourceLine{Address: uint32(row.Address), Line: row.Line, isStmt: row.IsStmt, endSequence: row.EndSequence}
+			if row.File != nil {
+				line.File = row.File.Name
+			}
+			if !row.EndSequence {
+				line.Function = d.functionName(line.Address)
+			}
+			d.Lines = append(d.Lines, line)
+		}
+	}
+	// At equal addresses the end of a sequence comes before the start of the next one.
+	sort.SliceStable(d.Lines, func(i, j int) bool {
+		if d.Lines[i].Address != d.Lines[j].Address {
+			return d.Lines[i].Address < d.Lines[j].Address
+		}
+		return d.Lines[i].endSequence && !d.Lines[j].endSequence
+	})
+	return nil
+}
+
+// FunctionAt returns the innermost function containing addr.
+func (d *DebugInfo) FunctionAt(addr uint32) (Function, bool) {
+	i := sort.Search(len(d.functionIndex), func(i int) bool { return d.functionIndex[i].high > addr })
+	if i == len(d.functionIndex) || d.functionIndex[i].low > addr {
+		return Function{}, false
+	}
+	return d.Functions[d.functionIndex[i].function], true
+}
+
+// functionName names the function containing addr, falling back to the symbol table.
+func (d *DebugInfo) functionName(addr uint32) string {
+	if f, ok := d.FunctionAt(addr); ok {
+		return f.Name
+	}
+	if sym, _, ok := d.elf.SymbolAt(addr); ok && sym.Type() == STT_FUNC && (sym.Size == 0 || addr-sym.Value < sym.Size) {
+		return sym.Name
+	}
+	return ""
+}
+
+// LineAt returns the source position of the instruction at addr.
+func (d *DebugInfo) LineAt(addr uint32) (SourceLine, bool) {
+	i := sort.Search(len(d.Lines), func(i int) bool { return d.Lines[i].Address > addr })
+	if i == 0 || d.Lines[i-1].endSequence {
+		return SourceLine{}, false
+	}
+	return d.Lines[i-1], true
+}
+
+// AddressesOf returns the addresses where breakpoints should be placed to stop at a line of file.
+// File matches either the full path recorded by the compiler or a trailing part of it, such as "main.c".
+// The result is empty if no code was generated for that line.
+func (d *DebugInfo) AddressesOf(file string, line int) []uint32 {
+	var addrs []uint32
+	for i, l := range d.Lines {
+		if l.endSequence || !l.isStmt || l.Line != line || !sameFile(l.File, file) {
+			continue
+		}
+		if i > 0 && !d.Lines[i-1].endSequence && d.Lines[i-1].Line == line && sameFile(d.Lines[i-1].File, file) {
+			continue // still the same line, only its first instruction is a breakpoint location
+		}
+		addrs = append(addrs, l.Address)
+	}
+	return addrs
+}
+
+// sameFile reports whether the file recorded in the line table is the one a user named.
+func sameFile(recorded string, name string) bool {
+	recorded = path.Clean(strings.ReplaceAll(recorded, "\\", "/"))
+	name = path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	return recorded == name || strings.HasSuffix(recorded, "/"+name)
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// DWARF 4 encodings used by dwarfELF.
+const (
+	DW_TAG_compile_unit = 0x11
+	DW_TAG_subprogram   = 0x2e
+	DW_AT_name          = 0x03
+	DW_AT_stmt_list     = 0x10
+	DW_AT_low_pc        = 0x11
+	DW_AT_high_pc       = 0x12
+	DW_FORM_addr        = 0x01
+	DW_FORM_data4       = 0x06
+	DW_FORM_string      = 0x08
+	DW_FORM_sec_offset  = 0x17
+)
+
+// testFunctions are the subprograms of dwarfELF: main and helper nest inside outer.
+var testFunctions = []Function{
+	{Name: "outer", Low: 0x100, High: 0x130},
+	{Name: "main", Low: 0x100, High: 0x120},
+	{Name: "helper", Low: 0x120, High: 0x128},
+}
+
+// dwarfELF returns an executable with the .debug_abbrev, .debug_info and .debug_line sections
+// a compiler would emit for /src/main.c. Its line table has two sequences:
+//
+//	0x100 line 10, 0x108 line 11, 0x10C line 11, 0x110 line 12 (not a statement),
+//	0x120 line 15, ending at 0x128
+//	0x200 line 10, ending at 0x204
+func dwarfELF() testELF {
+	le := binary.LittleEndian
+	abbrev := []byte{
+		1, DW_TAG_compile_unit, 1, // with children
+		DW_AT_name, DW_FORM_string, DW_AT_stmt_list, DW_FORM_sec_offset,
+		DW_AT_low_pc, DW_FORM_addr, DW_AT_high_pc, DW_FORM_data4, 0, 0,
+		2, DW_TAG_subprogram, 0,
+		DW_AT_name, DW_FORM_string, DW_AT_low_pc, DW_FORM_addr, DW_AT_high_pc, DW_FORM_data4, 0, 0,
+		0,
+	}
+	die := func(abbrev byte, name string, low uint32, size uint32, stmtList bool) []byte {
+		entry := append([]byte{abbrev}, name+"\x00"...)
+		if stmtList {
+			entry = le.AppendUint32(entry, 0)
+		}
+		return le.AppendUint32(le.AppendUint32(entry, low), size)
+	}
+	units := die(1, "main.c", 0x100, 0x104, true)
+	for _, f := range testFunctions {
+		units = append(units, die(2, f.Name, f.Low, f.High-f.Low, false)...)
+	}
+	units = append(units, 0)
+	info := le.AppendUint32(nil, uint32(7+len(units)))
+	info = le.AppendUint16(info, 4)
+	info = le.AppendUint32(info, 0) // abbreviations offset
+	info = append(append(info, 4), units...)
+
+	header := []byte{1, 1, 1, 0xFB, 14, 13} // instruction length, operations, default is_stmt, line base -5, line range, opcode base
+	header = append(header, 0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1)
+	header = append(header, "/src\x00\x00main.c\x00\x01\x00\x00\x00"...)
+	setAddress := func(addr uint32) []byte { return le.AppendUint32([]byte{0, 5, 2}, addr) }
+	const COPY, ADVANCE_PC, ADVANCE_LINE, NEGATE_STMT = 1, 2, 3, 6
+	endSequence := []byte{0, 1, 1}
+	var program []byte
+	program = append(program, setAddress(0x100)...)
+	program = append(program, ADVANCE_LINE, 9, COPY)
+	program = append(program, ADVANCE_PC, 8, ADVANCE_LINE, 1, COPY)
+	program = append(program, ADVANCE_PC, 4, COPY)
+	program = append(program, ADVANCE_PC, 4, NEGATE_STMT, ADVANCE_LINE, 1, COPY, NEGATE_STMT)
+	program = append(program, ADVANCE_PC, 0x10, ADVANCE_LINE, 3, COPY)
+	program = append(program, ADVANCE_PC, 8)
+	program = append(program, endSequence...)
+	program = append(program, setAddress(0x200)...)
+	program = append(program, ADVANCE_LINE, 9, COPY, ADVANCE_PC, 4)
+	program = append(program, endSequence...)
+	line := le.AppendUint32(nil, uint32(2+4+len(header)+len(program)))
+	line = le.AppendUint16(line, 4)
+	line = le.AppendUint32(line, uint32(len(header)))
+	line = append(append(line, header...), program...)
+
+	return testELF{
+		entry: 0x100,
+		sections: []testSection{
+			{name: ".text", typ: SHT_PROGBITS, addr: 0x100, data: make([]byte, 0x30)},
+			{name: ".debug_abbrev", typ: SHT_PROGBITS, data: abbrev},
+			{name: ".debug_info", typ: SHT_PROGBITS, data: info},
+			{name: ".debug_line", typ: SHT_PROGBITS, data: line},
+		},
+	}
+}
+
+// readDebugInfo parses the debugging information of a test executable.
+func readDebugInfo(t *testing.T, file testELF) *DebugInfo {
+	t.Helper()
+	elf, err := ReadELFBytes(file.build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := elf.ReadDebugInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestLineAt(t *testing.T) {
+	info := readDebugInfo(t, dwarfELF())
+	tests := []struct {
+		addr         uint32
+		wantLine     int
+		wantFunction string
+	}{
+		{0x100, 10, "main"},
+		{0x10A, 11, "main"},
+		{0x110, 12, "main"},
+		{0x124, 15, "helper"},
+		{0x128, 0, ""}, // end of the sequence
+		{0x203, 10, ""},
+		{0x0FC, 0, ""},
+		{0x300, 0, ""},
+	}
+	for _, test := range tests {
+		line, ok := info.LineAt(test.addr)
+		if ok != (test.wantLine != 0) || line.Line != test.wantLine || line.Function != test.wantFunction {
+			t.Errorf("LineAt(0x%x) = line %d in %q, %t, want line %d in %q", test.addr, line.Line, line.Function, ok, test.wantLine, test.wantFunction)
+		}
+		if ok && line.File != "/src/main.c" {
+			t.Errorf("LineAt(0x%x) is in %q, want /src/main.c", test.addr, line.File)
+		}
+	}
+}
+
+func TestAddressesOf(t *testing.T) {
+	info := readDebugInfo(t, dwarfELF())
+	tests := []struct {
+		file string
+		line int
+		want []uint32
+	}{
+		{"main.c", 10, []uint32{0x100, 0x200}},
+		{"/src/main.c", 11, []uint32{0x108}}, // the second row of the line is skipped
+		{"src/main.c", 15, []uint32{0x120}},
+		{"main.c", 12, nil}, // not a statement
+		{"ain.c", 11, nil},
+		{"other.c", 10, nil},
+		{"main.c", 13, nil},
+	}
+	for _, test := range tests {
+		if got := info.AddressesOf(test.file, test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("AddressesOf(%q, %d) = %x, want %x", test.file, test.line, got, test.want)
+		}
+	}
+}
+
+func TestFunctionAt(t *testing.T) {
+	info := readDebugInfo(t, dwarfELF())
+	tests := []struct {
+		addr uint32
+		want string
+	}{
+		{0x100, "main"},
+		{0x11F, "main"},
+		{0x120, "helper"},
+		{0x128, "outer"},
+		{0x12F, "outer"},
+		{0x130, ""},
+		{0x0FF, ""},
+	}
+	for _, test := range tests {
+		f, ok := info.FunctionAt(test.addr)
+		if ok != (test.want != "") || f.Name != test.want {
+			t.Errorf("FunctionAt(0x%x) = %q, %t, want %q", test.addr, f.Name, ok, test.want)
+		}
+	}
+}
+
+// TestFunctionIndex compares the index of randomly nested and overlapping functions
+// against a scan of every function.
+func TestFunctionIndex(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	d := &DebugInfo{}
+	for i := 0; i < 300; i++ {
+		low := uint32(random.Intn(0x1000))
+		d.Functions = append(d.Functions, Function{Name: string(rune('a' + i%26)), Low: low, High: low + uint32(random.Intn(0x100))})
+	}
+	d.Functions = append(d.Functions, Function{Name: "empty", Low: 0x500, High: 0x500})
+	sort.SliceStable(d.Functions, func(i, j int) bool { return d.Functions[i].Low < d.Functions[j].Low })
+	d.indexFunctions()
+	for addr := uint32(0); addr < 0x1200; addr++ {
+		var want Function
+		found := false
+		for _, f := range d.Functions {
+			if f.Low <= addr && addr < f.High && (!found || f.High-f.Low < want.High-want.Low) {
+				want, found = f, true
+			}
+		}
+		got, ok := d.FunctionAt(addr)
+		if ok != found || got != want {
+			t.Fatalf("FunctionAt(0x%x) = %+v, %t, want %+v, %t", addr, got, ok, want, found)
+		}
+	}
+}
+
+func TestNoDebugInfo(t *testing.T) {
+	elf, err := ReadELFBytes(symbolELF(ELFCLASS32).build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := elf.ReadDebugInfo(); !errors.Is(err, ErrNoDebugInfo) {
+		t.Errorf("error = %v, want ErrNoDebugInfo", err)
+	}
+}
+
+func TestMalformedDebugInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(sections []testSection)
+	}{
+		{"truncated .debug_info", func(sections []testSection) { sections[2].data = sections[2].data[:9] }},
+		{"unknown abbreviation", func(sections []testSection) { sections[2].data[11] = 9 }},
+		{"unsupported line table version", func(sections []testSection) { sections[3].data[4] = 1 }},
+		{"truncated .debug_line", func(sections []testSection) { sections[3].data = sections[3].data[:12] }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := dwarfELF()
+			test.mutate(file.sections)
+			elf, err := ReadELFBytes(file.build())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := elf.ReadDebugInfo(); err == nil {
+				t.Error("the debugging information was accepted")
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package core
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"sort"
 )
 
 type ELFFile struct {
@@ -31,9 +35,15 @@ type ELFFile struct {
 
 	// Program headers and section headers
 	ProgramHeaders []ProgramHeader
+	SectionHeaders []SectionHeader
 
 	// Machine code (raw data) from sections
 	MachineCode [][]byte
+
+	// Symbols from .symtab and .dynsym
+	Symbols        []Symbol
+	DynamicSymbols []Symbol
+	symbolsByAddr  []Symbol // defined symbols sorted by address, for SymbolAt
 }
 
 // ProgramHeader represents a program header in the ELF file.
@@ -48,38 +58,143 @@ type ProgramHeader struct {
 	Align    uint32
 }
 
+// SectionHeader represents a section header in the ELF file.
+type SectionHeader struct {
+	Name      string // resolved from .shstrtab
+	NameIndex uint32
+	Type      uint32
+	Flags     uint32
+	Addr      uint32
+	Offset    uint32
+	Size      uint32
+	Link      uint32
+	Info      uint32
+	AddrAlign uint32
+	EntSize   uint32
+	Data      []byte // section contents, nil for SHT_NOBITS sections such as .bss
+}
+
+// Section types.
+const (
+	SHT_NULL     = 0
+	SHT_PROGBITS = 1
+	SHT_SYMTAB   = 2
+	SHT_STRTAB   = 3
+	SHT_NOBITS   = 8
+	SHT_DYNSYM   = 11
+)
+
+// Symbol represents an entry of .symtab or .dynsym.
+type Symbol struct {
+	Name    string // resolved from the linked string table
+	Value   uint32
+	Size    uint32
+	Info    byte // binding in the high nibble, type in the low nibble
+	Other   byte
+	Section uint16 // index of the section the symbol is defined in, 0 if undefined
+}
+
+// Symbol types and bindings.
+const (
+	STT_NOTYPE  = 0
+	STT_OBJECT  = 1
+	STT_FUNC    = 2
+	STT_SECTION = 3
+	STT_FILE    = 4
+	STB_LOCAL   = 0
+	STB_GLOBAL  = 1
+	STB_WEAK    = 2
+)
+
+func (s Symbol) Type() byte {
+	return s.Info & 0xF
+}
+
+func (s Symbol) Binding() byte {
+	return s.Info >> 4
+}
+
+func ReadSectionHeader(bytes []byte, byteOrder binary.ByteOrder) *SectionHeader {
+	sh := &SectionHeader{}
+	sh.NameIndex = byteOrder.Uint32(bytes[0:4])
+	sh.Type = byteOrder.Uint32(bytes[4:8])
+	sh.Flags = byteOrder.Uint32(bytes[8:12])
+	sh.Addr = byteOrder.Uint32(bytes[12:16])
+	sh.Offset = byteOrder.Uint32(bytes[16:20])
+	sh.Size = byteOrder.Uint32(bytes[20:24])
+	sh.Link = byteOrder.Uint32(bytes[24:28])
+	sh.Info = byteOrder.Uint32(bytes[28:32])
+	sh.AddrAlign = byteOrder.Uint32(bytes[32:36])
+	sh.EntSize = byteOrder.Uint32(bytes[36:40])
+	return sh
+}
+
 func ReadProgramHeader(bytes []byte) *ProgramHeader {
+	return readProgramHeader(bytes, binary.LittleEndian)
+}
+
+func readProgramHeader(bytes []byte, byteOrder binary.ByteOrder) *ProgramHeader {
 	ph := &ProgramHeader{}
-	ph.Type = binary.LittleEndian.Uint32(bytes[0:4])
-	ph.Offset = binary.LittleEndian.Uint32(bytes[4:8])
-	ph.VAddr = binary.LittleEndian.Uint32(bytes[8:12])
-	ph.PAddr = binary.LittleEndian.Uint32(bytes[12:16])
-	ph.FileSize = binary.LittleEndian.Uint32(bytes[16:20])
-	ph.MemSize = binary.LittleEndian.Uint32(bytes[20:24])
-	ph.Flags = binary.LittleEndian.Uint32(bytes[24:28])
-	ph.Align = binary.LittleEndian.Uint32(bytes[28:32])
+	ph.Type = byteOrder.Uint32(bytes[0:4])
+	ph.Offset = byteOrder.Uint32(bytes[4:8])
+	ph.VAddr = byteOrder.Uint32(bytes[8:12])
+	ph.PAddr = byteOrder.Uint32(bytes[12:16])
+	ph.FileSize = byteOrder.Uint32(bytes[16:20])
+	ph.MemSize = byteOrder.Uint32(bytes[20:24])
+	ph.Flags = byteOrder.Uint32(bytes[24:28])
+	ph.Align = byteOrder.Uint32(bytes[28:32])
 	return ph
 }
 
+// Sizes of the ELF32 structures.
+const (
+	ELF32_HEADER_SIZE         = 52
+	ELF32_PROGRAM_HEADER_SIZE = 32
+	ELF32_SECTION_HEADER_SIZE = 40
+)
+
+// Sizes of the ELF64 structures.
+const (
+	ELF64_HEADER_SIZE         = 64
+	ELF64_PROGRAM_HEADER_SIZE = 56
+	ELF64_SECTION_HEADER_SIZE = 64
+)
+
+// ELF classes.
+const (
+	ELFCLASS32 = 1
+	ELFCLASS64 = 2
+)
+
 func ReadELFFile(filePath string) (*ELFFile, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
-	defer func() {
-		err = file.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return ReadELF(file, info.Size())
+}
 
+// ReadELFBytes parses an ELF file held in memory, such as one embedded with go:embed.
+func ReadELFBytes(data []byte) (*ELFFile, error) {
+	return ReadELF(bytes.NewReader(data), int64(len(data)))
+}
+
+// ReadELF parses the size bytes of an ELF file read from r.
+// Every offset and size found in the file is checked against size, so truncated or
+// malformed files are reported with an error.
+// ELF64 files are accepted as long as their addresses fit in the 32-bit physical address space.
+func ReadELF(r io.ReaderAt, size int64) (*ELFFile, error) {
 	var elf ELFFile
-	var offset int32 = 0
-	var buffer []byte = make([]byte, 1048576) // 1MB buffer
-	_, err = file.Read(buffer)
+	buffer, err := readRange(r, size, 0, 16, "ELF identification")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
 	}
+	var offset int32 = 0
 	if string(buffer[0:4]) != "\x7fELF" { // Wrong file, exit here
 		return nil, errors.New("invalid ELF magic number")
 	}
@@ -87,9 +202,18 @@ func ReadELFFile(filePath string) (*ELFFile, error) {
 	offset += 4
 	elf.Class = buffer[offset]
 	offset++
-	if elf.Class != 1 {
+	headerSize := uint64(ELF32_HEADER_SIZE)
+	switch elf.Class {
+	case ELFCLASS32:
+	case ELFCLASS64:
+		headerSize = ELF64_HEADER_SIZE
+	default:
 		return nil, fmt.Errorf("unsupported ELF class: %d", elf.Class)
 	}
+	buffer, err = readRange(r, size, 0, headerSize, "ELF header")
+	if err != nil {
+		return nil, err
+	}
 
 	elf.Data = buffer[offset]
 	offset++
@@ -109,11 +233,8 @@ func ReadELFFile(filePath string) (*ELFFile, error) {
 		return nil, fmt.Errorf("unsupported ELF version: %d", elf.Version)
 	}
 
-	elf.OSABI = buffer[offset]
+	elf.OSABI = buffer[offset] // any ABI is accepted, it selects the default Personality
 	offset++
-	if elf.OSABI != 0x3 { // Linux
-		return nil, fmt.Errorf("OSABI is different from 0x03/Linux: %d", elf.OSABI)
-	}
 	elf.ABIVersion = buffer[offset]
 	offset += 8 // 1 for ABI Version and 7 for padding
 	elf.Padding = [7]byte{}
@@ -126,16 +247,29 @@ func ReadELFFile(filePath string) (*ELFFile, error) {
 	elf.Machine = byteOrder.Uint16(buffer[offset : offset+2])
 	offset += 2
 	if elf.Machine != 0xf3 {
-		return nil, fmt.Errorf("sachine is different from 0xF3/RISC-V: %d", elf.Machine)
+		return nil, fmt.Errorf("machine is different from 0xF3/RISC-V: %d", elf.Machine)
 	}
 	elf.Version2 = byteOrder.Uint32(buffer[offset : offset+4])
 	offset += 4
-	elf.Entry = byteOrder.Uint32(buffer[offset : offset+4])
-	offset += 4
-	elf.PhOff = byteOrder.Uint32(buffer[offset : offset+4])
-	offset += 4
-	elf.ShOff = byteOrder.Uint32(buffer[offset : offset+4])
-	offset += 4
+	addrSize := int32(4)
+	if elf.Class == ELFCLASS64 {
+		addrSize = 8
+	}
+	elf.Entry, err = elf.narrow(buffer[offset:], byteOrder, "entry point")
+	if err != nil {
+		return nil, err
+	}
+	offset += addrSize
+	elf.PhOff, err = elf.narrow(buffer[offset:], byteOrder, "program header offset")
+	if err != nil {
+		return nil, err
+	}
+	offset += addrSize
+	elf.ShOff, err = elf.narrow(buffer[offset:], byteOrder, "section header offset")
+	if err != nil {
+		return nil, err
+	}
+	offset += addrSize
 	elf.Flags = byteOrder.Uint32(buffer[offset : offset+4])
 	offset += 4
 	elf.Ehsize = byteOrder.Uint16(buffer[offset : offset+2])
@@ -143,32 +277,344 @@ func ReadELFFile(filePath string) (*ELFFile, error) {
 	elf.Phentsize = byteOrder.Uint16(buffer[offset : offset+2])
 	offset += 2
 	elf.Phnum = byteOrder.Uint16(buffer[offset : offset+2])
-	offset += 8 // We ignore Sections as they are not relevant for execution
+	offset += 2
+	elf.Shentsize = byteOrder.Uint16(buffer[offset : offset+2])
+	offset += 2
+	elf.Shnum = byteOrder.Uint16(buffer[offset : offset+2])
+	offset += 2
+	elf.Shstrndx = byteOrder.Uint16(buffer[offset : offset+2])
 
-	elf.ProgramHeaders = make([]ProgramHeader, elf.Phnum)
-	for i := range int(elf.Phnum) {
-		phbuffer := make([]byte, elf.Phentsize)
-		copy(phbuffer, buffer[offset:])
-		offset += int32(elf.Phentsize)
-		elf.ProgramHeaders[i] = *ReadProgramHeader(phbuffer)
+	err = elf.readSegments(r, size, byteOrder)
+	if err != nil {
+		return nil, err
+	}
+	err = elf.readSections(r, size, byteOrder)
+	if err != nil {
+		return nil, err
+	}
+	return &elf, nil
+}
+
+// narrow reads an address or offset, 8 bytes long in ELF64 files, which must fit in 32 bits.
+func (elf *ELFFile) narrow(bytes []byte, byteOrder binary.ByteOrder, what string) (uint32, error) {
+	if elf.Class != ELFCLASS64 {
+		return byteOrder.Uint32(bytes[0:4]), nil
 	}
+	val := byteOrder.Uint64(bytes[0:8])
+	if val > math.MaxUint32 {
+		return 0, fmt.Errorf("%s 0x%x is beyond the 32-bit address space", what, val)
+	}
+	return uint32(val), nil
+}
+
+// readProgramHeader64 reads an ELF64 program header, whose addresses and sizes must fit in 32 bits.
+func (elf *ELFFile) readProgramHeader64(bytes []byte, byteOrder binary.ByteOrder, index int) (*ProgramHeader, error) {
+	ph := &ProgramHeader{}
+	ph.Type = byteOrder.Uint32(bytes[0:4])
+	ph.Flags = byteOrder.Uint32(bytes[4:8])
+	fields := []*uint32{&ph.Offset, &ph.VAddr, &ph.PAddr, &ph.FileSize, &ph.MemSize}
+	names := []string{"offset", "address", "physical address", "file size", "memory size"}
+	for i, field := range fields {
+		val, err := elf.narrow(bytes[8+8*i:], byteOrder, fmt.Sprintf("segment %d %s", index, names[i]))
+		if err != nil && ph.Type == PT_LOAD {
+			return nil, err
+		}
+		*field = val
+	}
+	ph.Align = uint32(min(byteOrder.Uint64(bytes[48:56]), math.MaxUint32))
+	return ph, nil
+}
 
+// readSectionHeader64 reads an ELF64 section header, whose addresses and sizes must fit in 32 bits.
+func (elf *ELFFile) readSectionHeader64(bytes []byte, byteOrder binary.ByteOrder, index int) (*SectionHeader, error) {
+	sh := &SectionHeader{}
+	sh.NameIndex = byteOrder.Uint32(bytes[0:4])
+	sh.Type = byteOrder.Uint32(bytes[4:8])
+	sh.Flags = uint32(byteOrder.Uint64(bytes[8:16]))
+	fields := []*uint32{&sh.Addr, &sh.Offset, &sh.Size}
+	names := []string{"address", "offset", "size"}
+	for i, field := range fields {
+		val, err := elf.narrow(bytes[16+8*i:], byteOrder, fmt.Sprintf("section %d %s", index, names[i]))
+		if err != nil {
+			return nil, err
+		}
+		*field = val
+	}
+	sh.Link = byteOrder.Uint32(bytes[40:44])
+	sh.Info = byteOrder.Uint32(bytes[44:48])
+	sh.AddrAlign = uint32(min(byteOrder.Uint64(bytes[48:56]), math.MaxUint32))
+	sh.EntSize = uint32(min(byteOrder.Uint64(bytes[56:64]), math.MaxUint32))
+	return sh, nil
+}
+
+// readRange reads length bytes at offset, failing if they extend past the size bytes of the file.
+func readRange(r io.ReaderAt, size int64, offset uint64, length uint64, what string) ([]byte, error) {
+	if offset > uint64(size) || length > uint64(size)-offset {
+		return nil, fmt.Errorf("%s out of range: %d bytes at offset %d in a file of %d bytes", what, length, offset, size)
+	}
+	data := make([]byte, length)
+	_, err := r.ReadAt(data, int64(offset))
+	if err != nil && !(errors.Is(err, io.EOF) && offset+length == uint64(size)) {
+		return nil, fmt.Errorf("failed to read %s: %w", what, err)
+	}
+	return data, nil
+}
+
+// readSegments parses the program header table and reads the file contents of every segment.
+func (elf *ELFFile) readSegments(r io.ReaderAt, size int64, byteOrder binary.ByteOrder) error {
+	if elf.Phnum == 0 {
+		return nil
+	}
+	entrySize := uint16(ELF32_PROGRAM_HEADER_SIZE)
+	if elf.Class == ELFCLASS64 {
+		entrySize = ELF64_PROGRAM_HEADER_SIZE
+	}
+	if elf.Phentsize < entrySize {
+		return fmt.Errorf("invalid program header size: %d", elf.Phentsize)
+	}
+	table, err := readRange(r, size, uint64(elf.PhOff), uint64(elf.Phnum)*uint64(elf.Phentsize), "program header table")
+	if err != nil {
+		return err
+	}
+	elf.ProgramHeaders = make([]ProgramHeader, elf.Phnum)
 	elf.MachineCode = make([][]byte, elf.Phnum)
-	for i := range int(elf.Phnum) {
-		code := make([]byte, elf.ProgramHeaders[i].FileSize)
-		copy(code, buffer[elf.ProgramHeaders[i].Offset:])
-		elf.MachineCode[i] = code
+	for i := range elf.ProgramHeaders {
+		start := i * int(elf.Phentsize)
+		ph := readProgramHeader(table[start:start+ELF32_PROGRAM_HEADER_SIZE], byteOrder)
+		if elf.Class == ELFCLASS64 {
+			ph, err = elf.readProgramHeader64(table[start:start+ELF64_PROGRAM_HEADER_SIZE], byteOrder, i)
+			if err != nil {
+				return err
+			}
+		}
+		elf.ProgramHeaders[i] = *ph
+		elf.MachineCode[i], err = readRange(r, size, uint64(ph.Offset), uint64(ph.FileSize), fmt.Sprintf("segment %d", i))
+		if err != nil {
+			return err
+		}
 	}
-	return &elf, nil
+	return nil
 }
 
+// readSections parses the section header table, resolves section names through .shstrtab
+// and loads the symbol tables.
+func (elf *ELFFile) readSections(r io.ReaderAt, size int64, byteOrder binary.ByteOrder) error {
+	if elf.Shnum == 0 {
+		return nil
+	}
+	entrySize := uint16(ELF32_SECTION_HEADER_SIZE)
+	if elf.Class == ELFCLASS64 {
+		entrySize = ELF64_SECTION_HEADER_SIZE
+	}
+	if elf.Shentsize < entrySize {
+		return fmt.Errorf("invalid section header size: %d", elf.Shentsize)
+	}
+	table, err := readRange(r, size, uint64(elf.ShOff), uint64(elf.Shnum)*uint64(elf.Shentsize), "section header table")
+	if err != nil {
+		return err
+	}
+	elf.SectionHeaders = make([]SectionHeader, elf.Shnum)
+	for i := range elf.SectionHeaders {
+		start := i * int(elf.Shentsize)
+		sh := ReadSectionHeader(table[start:start+ELF32_SECTION_HEADER_SIZE], byteOrder)
+		if elf.Class == ELFCLASS64 {
+			sh, err = elf.readSectionHeader64(table[start:start+ELF64_SECTION_HEADER_SIZE], byteOrder, i)
+			if err != nil {
+				return err
+			}
+		}
+		if sh.Type != SHT_NOBITS && sh.Type != SHT_NULL {
+			sh.Data, err = readRange(r, size, uint64(sh.Offset), uint64(sh.Size), fmt.Sprintf("section %d", i))
+			if err != nil {
+				return err
+			}
+		}
+		elf.SectionHeaders[i] = *sh
+	}
+
+	if int(elf.Shstrndx) >= len(elf.SectionHeaders) {
+		return fmt.Errorf("section name table index %d out of range, the file has %d sections", elf.Shstrndx, elf.Shnum)
+	}
+	if elf.Shstrndx != 0 {
+		names := elf.SectionHeaders[elf.Shstrndx].Data
+		for i := range elf.SectionHeaders {
+			elf.SectionHeaders[i].Name = stringAt(names, elf.SectionHeaders[i].NameIndex)
+		}
+	}
+
+	for _, sh := range elf.SectionHeaders {
+		if sh.Type != SHT_SYMTAB && sh.Type != SHT_DYNSYM {
+			continue
+		}
+		if sh.Link >= uint32(len(elf.SectionHeaders)) {
+			return fmt.Errorf("symbol table %s links to missing section %d", sh.Name, sh.Link)
+		}
+		readTable := readSymbols
+		if elf.Class == ELFCLASS64 {
+			readTable = readSymbols64
+		}
+		symbols := readTable(sh.Data, elf.SectionHeaders[sh.Link].Data, byteOrder)
+		if sh.Type == SHT_SYMTAB {
+			elf.Symbols = append(elf.Symbols, symbols...)
+		} else {
+			elf.DynamicSymbols = append(elf.DynamicSymbols, symbols...)
+		}
+	}
+
+	for _, sym := range append(elf.Symbols, elf.DynamicSymbols...) {
+		if sym.Section != 0 && sym.Name != "" && sym.Type() != STT_SECTION && sym.Type() != STT_FILE {
+			elf.symbolsByAddr = append(elf.symbolsByAddr, sym)
+		}
+	}
+	sort.SliceStable(elf.symbolsByAddr, func(i, j int) bool {
+		return elf.symbolsByAddr[i].Value < elf.symbolsByAddr[j].Value
+	})
+	return nil
+}
+
+// readSymbols decodes the 16-byte entries of a symbol table, skipping the null symbol.
+func readSymbols(table []byte, names []byte, byteOrder binary.ByteOrder) []Symbol {
+	var symbols []Symbol
+	for start := 16; start+16 <= len(table); start += 16 {
+		entry := table[start : start+16]
+		symbols = append(symbols, Symbol{
+			Name:    stringAt(names, byteOrder.Uint32(entry[0:4])),
+			Value:   byteOrder.Uint32(entry[4:8]),
+			Size:    byteOrder.Uint32(entry[8:12]),
+			Info:    entry[12],
+			Other:   entry[13],
+			Section: byteOrder.Uint16(entry[14:16]),
+		})
+	}
+	return symbols
+}
+
+// readSymbols64 decodes the 24-byte entries of an ELF64 symbol table, skipping the null symbol
+// and the symbols beyond the 32-bit address space.
+func readSymbols64(table []byte, names []byte, byteOrder binary.ByteOrder) []Symbol {
+	var symbols []Symbol
+	for start := 24; start+24 <= len(table); start += 24 {
+		entry := table[start : start+24]
+		value := byteOrder.Uint64(entry[8:16])
+		if value > math.MaxUint32 {
+			continue
+		}
+		symbols = append(symbols, Symbol{
+			Name:    stringAt(names, byteOrder.Uint32(entry[0:4])),
+			Info:    entry[4],
+			Other:   entry[5],
+			Section: byteOrder.Uint16(entry[6:8]),
+			Value:   uint32(value),
+			Size:    uint32(min(byteOrder.Uint64(entry[16:24]), math.MaxUint32)),
+		})
+	}
+	return symbols
+}
+
+// stringAt returns the null-terminated string at index in a string table.
+func stringAt(table []byte, index uint32) string {
+	if index >= uint32(len(table)) {
+		return ""
+	}
+	end := bytes.IndexByte(table[index:], 0)
+	if end < 0 {
+		return string(table[index:])
+	}
+	return string(table[index : index+uint32(end)])
+}
+
+// Section returns the section with the given name.
+func (elf *ELFFile) Section(name string) (*SectionHeader, bool) {
+	for i := range elf.SectionHeaders {
+		if elf.SectionHeaders[i].Name == name {
+			return &elf.SectionHeaders[i], true
+		}
+	}
+	return nil, false
+}
+
+// LookupSymbol returns the defined symbol with the given name, searching .symtab before .dynsym.
+func (elf *ELFFile) LookupSymbol(name string) (Symbol, bool) {
+	for _, sym := range append(elf.Symbols, elf.DynamicSymbols...) {
+		if sym.Name == name && sym.Section != 0 {
+			return sym, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// SymbolAt returns the symbol closest below addr along with the offset of addr inside it.
+// Functions and objects are preferred over untyped labels at the same address.
+func (elf *ELFFile) SymbolAt(addr uint32) (Symbol, uint32, bool) {
+	i := sort.Search(len(elf.symbolsByAddr), func(i int) bool { return elf.symbolsByAddr[i].Value > addr })
+	if i == 0 {
+		return Symbol{}, 0, false
+	}
+	best := elf.symbolsByAddr[i-1]
+	for j := i - 2; j >= 0 && elf.symbolsByAddr[j].Value == best.Value; j-- {
+		if best.Type() == STT_NOTYPE && elf.symbolsByAddr[j].Type() != STT_NOTYPE {
+			best = elf.symbolsByAddr[j]
+		}
+	}
+	return best, addr - best.Value, true
+}
+
+// PT_LOAD is the type of the program headers describing segments to load in memory.
+const PT_LOAD = 1
+
+// CopyToMemory loads the PT_LOAD segments at their addresses, which must lie in the memory regions,
+// and protects them with the permissions of their program header flags, replacing the protections
+// of any previously loaded program.
+// The MemSize-FileSize bytes following the file contents of a segment, such as .bss, are zeroed.
+// Nothing is written unless every segment fits in memory and no two segments overlap.
 func (ELFFile *ELFFile) CopyToMemory(mem *Memory) error {
+	err := ELFFile.validateSegments(mem)
+	if err != nil {
+		return err
+	}
+	mem.ClearProtections()
 	for i, ph := range ELFFile.ProgramHeaders {
-		if ph.Type != 1 { // PT_LOAD
+		if ph.Type != PT_LOAD {
 			continue
 		}
-		copy(mem.mem[ph.VAddr:], ELFFile.MachineCode[i])
+		err := mem.LoadBytes(ph.VAddr, ELFFile.MachineCode[i])
+		if err != nil {
+			return fmt.Errorf("failed to load segment %d at 0x%08x: %w", i, ph.VAddr, err)
+		}
+		err = mem.ZeroBytes(ph.VAddr+ph.FileSize, ph.MemSize-ph.FileSize)
+		if err != nil {
+			return fmt.Errorf("failed to zero segment %d at 0x%08x: %w", i, ph.VAddr+ph.FileSize, err)
+		}
+		if ph.MemSize != 0 {
+			mem.Protect(ph.VAddr, ph.MemSize, ph.Flags&(PERMISSION_R|PERMISSION_W|PERMISSION_X))
+		}
 	}
 
 	return nil
 }
+
+// validateSegments checks that the PT_LOAD segments fit in the address space and in mem, and do not overlap.
+func (ELFFile *ELFFile) validateSegments(mem *Memory) error {
+	for i, ph := range ELFFile.ProgramHeaders {
+		if ph.Type != PT_LOAD {
+			continue
+		}
+		if ph.FileSize > ph.MemSize {
+			return fmt.Errorf("segment %d is larger in the file (%d bytes) than in memory (%d bytes)", i, ph.FileSize, ph.MemSize)
+		}
+		end := uint64(ph.VAddr) + uint64(ph.MemSize)
+		if end > 1<<32 {
+			return fmt.Errorf("segment %d at 0x%08x of %d bytes exceeds the 32-bit address space", i, ph.VAddr, ph.MemSize)
+		}
+		if !mem.Loadable(ph.VAddr, ph.MemSize) {
+			return fmt.Errorf("segment %d at 0x%08x-0x%08x does not fit in memory", i, ph.VAddr, end)
+		}
+		for j, other := range ELFFile.ProgramHeaders[:i] {
+			if other.Type == PT_LOAD && uint64(other.VAddr) < end && uint64(ph.VAddr) < uint64(other.VAddr)+uint64(other.MemSize) {
+				return fmt.Errorf("segment %d at 0x%08x-0x%08x overlaps segment %d at 0x%08x-0x%08x",
+					i, ph.VAddr, end, j, other.VAddr, uint64(other.VAddr)+uint64(other.MemSize))
+			}
+		}
+	}
+	return nil
+}
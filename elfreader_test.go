@@ -0,0 +1,643 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSegment is a PT_LOAD segment of a testELF.
+type testSegment struct {
+	vaddr   uint32
+	flags   uint32
+	data    []byte
+	memSize uint32 // len(data) when 0
+}
+
+// testSection is a section of a testELF.
+type testSection struct {
+	name    string
+	typ     uint32
+	addr    uint32
+	data    []byte
+	size    uint32 // len(data) when 0, sets the size of SHT_NOBITS sections
+	link    uint32
+	entSize uint32
+}
+
+// testELF describes a little-endian RISC-V executable built by the tests.
+type testELF struct {
+	class    byte // ELFCLASS32 unless set
+	entry    uint32
+	segments []testSegment
+	sections []testSection // section 0 is the null section, .shstrtab is added last
+}
+
+// build lays out the header, the program headers, the segment and section contents
+// and the section header table, in that order.
+func (e testELF) build() []byte {
+	le := binary.LittleEndian
+	is64 := e.class == ELFCLASS64
+	ehsize, phsize, shsize := ELF32_HEADER_SIZE, ELF32_PROGRAM_HEADER_SIZE, ELF32_SECTION_HEADER_SIZE
+	if is64 {
+		ehsize, phsize, shsize = ELF64_HEADER_SIZE, ELF64_PROGRAM_HEADER_SIZE, ELF64_SECTION_HEADER_SIZE
+	}
+	// put writes an address or offset, 4 or 8 bytes long depending on the class
+	put := func(buf []byte, val uint32) int {
+		if is64 {
+			le.PutUint64(buf, uint64(val))
+			return 8
+		}
+		le.PutUint32(buf, val)
+		return 4
+	}
+
+	sections := append([]testSection{{}}, e.sections...)
+	names := []byte{0}
+	nameIndex := make([]uint32, len(sections)+1)
+	for i, section := range sections[1:] {
+		nameIndex[i+1] = uint32(len(names))
+		names = append(append(names, section.name...), 0)
+	}
+	nameIndex[len(sections)] = uint32(len(names))
+	names = append(names, ".shstrtab\x00"...)
+	sections = append(sections, testSection{name: ".shstrtab", typ: SHT_STRTAB, data: names})
+
+	file := make([]byte, ehsize+phsize*len(e.segments))
+	segmentOffsets := make([]uint32, len(e.segments))
+	for i, segment := range e.segments {
+		segmentOffsets[i] = uint32(len(file))
+		file = append(file, segment.data...)
+	}
+	sectionOffsets := make([]uint32, len(sections))
+	for i, section := range sections {
+		sectionOffsets[i] = uint32(len(file))
+		file = append(file, section.data...)
+	}
+	for len(file)%8 != 0 {
+		file = append(file, 0)
+	}
+	shoff := uint32(len(file))
+	file = append(file, make([]byte, shsize*len(sections))...)
+
+	copy(file, "\x7fELF")
+	file[4] = max(e.class, ELFCLASS32)
+	file[5] = 1 // little-endian
+	file[6] = 1
+	le.PutUint16(file[16:], 2) // executable
+	le.PutUint16(file[18:], 0xF3)
+	le.PutUint32(file[20:], 1)
+	off := 24
+	off += put(file[off:], e.entry)
+	off += put(file[off:], uint32(ehsize))
+	off += put(file[off:], shoff)
+	off += 4 // flags
+	for _, field := range []int{ehsize, phsize, len(e.segments), shsize, len(sections), len(sections) - 1} {
+		le.PutUint16(file[off:], uint16(field))
+		off += 2
+	}
+
+	for i, segment := range e.segments {
+		memSize := segment.memSize
+		if memSize == 0 {
+			memSize = uint32(len(segment.data))
+		}
+		ph := file[ehsize+i*phsize:]
+		le.PutUint32(ph, PT_LOAD)
+		off := 4
+		if is64 {
+			le.PutUint32(ph[4:], segment.flags)
+			off = 8
+		}
+		for _, field := range []uint32{segmentOffsets[i], segment.vaddr, segment.vaddr, uint32(len(segment.data)), memSize} {
+			off += put(ph[off:], field)
+		}
+		if !is64 {
+			le.PutUint32(ph[off:], segment.flags)
+			off += 4
+		}
+		put(ph[off:], 4)
+	}
+
+	for i, section := range sections {
+		size := section.size
+		if size == 0 {
+			size = uint32(len(section.data))
+		}
+		sh := file[int(shoff)+i*shsize:]
+		le.PutUint32(sh, nameIndex[i])
+		le.PutUint32(sh[4:], section.typ)
+		off := 8
+		off += put(sh[off:], 0) // flags
+		off += put(sh[off:], section.addr)
+		off += put(sh[off:], sectionOffsets[i])
+		off += put(sh[off:], size)
+		le.PutUint32(sh[off:], section.link)
+		off += 8 // link and info
+		off += put(sh[off:], 1)
+		put(sh[off:], section.entSize)
+	}
+	return file
+}
+
+// wordBytes returns instruction words in little-endian order, as segment or section contents.
+func wordBytes(words ...uint32) []byte {
+	data := make([]byte, 4*len(words))
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(data[4*i:], word)
+	}
+	return data
+}
+
+func TestCopyToMemoryAtRAMBase(t *testing.T) {
+	tests := []struct {
+		name    string
+		vaddr   uint32
+		wantErr bool
+	}{
+		{"start of RAM", 0x80000000, false},
+		{"end of RAM", 0x8000FFF8, false},
+		{"below RAM", 0x7FFFFFFC, true},
+		{"across the end of RAM", 0x8000FFFC, true},
+		{"address 0", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, err := NewMemoryWithConfig(MemoryConfig{Regions: []MemoryRegion{{Base: 0x80000000, Size: 0x10000}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := testELF{
+				entry: test.vaddr,
+				segments: []testSegment{
+					{vaddr: test.vaddr, flags: PERMISSION_R | PERMISSION_X, data: []byte{0x13, 0, 0, 0, 0x73, 0, 0x10, 0}},
+				},
+			}.build()
+			elf, err := ReadELFBytes(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = elf.CopyToMemory(mem)
+			if test.wantErr {
+				if err == nil {
+					t.Error("the segment was loaded outside RAM")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := mem.ReadWord(test.vaddr + 4); got != EBREAK_WORD {
+				t.Errorf("read 0x%08x at 0x%08x, want the ebreak of the segment", got, test.vaddr+4)
+			}
+			cpu := NewCPU(mem)
+			cpu.PC = elf.Entry
+			state := OK
+			for steps := 0; steps < 2 && state == OK; steps++ {
+				state, err = cpu.ExecuteSingle()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if state != E_BREAK || cpu.PC != test.vaddr+8 {
+				t.Errorf("state %d at PC=0x%08x, want E_BREAK before 0x%08x", state, cpu.PC, test.vaddr+8)
+			}
+		})
+	}
+}
+
+// symbolTable encodes symbols after the null symbol, along with the string table holding their names.
+func symbolTable(class byte, symbols []Symbol) (table []byte, names []byte) {
+	le := binary.LittleEndian
+	names = []byte{0}
+	entrySize := 16
+	if class == ELFCLASS64 {
+		entrySize = 24
+	}
+	table = make([]byte, entrySize*(len(symbols)+1))
+	for i, sym := range symbols {
+		entry := table[entrySize*(i+1):]
+		le.PutUint32(entry, uint32(len(names)))
+		names = append(append(names, sym.Name...), 0)
+		if class == ELFCLASS64 {
+			entry[4] = sym.Info
+			entry[5] = sym.Other
+			le.PutUint16(entry[6:], sym.Section)
+			le.PutUint64(entry[8:], uint64(sym.Value))
+			le.PutUint64(entry[16:], uint64(sym.Size))
+			continue
+		}
+		le.PutUint32(entry[4:], sym.Value)
+		le.PutUint32(entry[8:], sym.Size)
+		entry[12] = sym.Info
+		entry[13] = sym.Other
+		le.PutUint16(entry[14:], sym.Section)
+	}
+	return table, names
+}
+
+// testSymbols are defined in the .text (1) and .bss (2) sections of symbolELF.
+var testSymbols = []Symbol{
+	{Name: "crt.S", Info: STT_FILE, Section: 0xFFF1},
+	{Name: "_start", Value: 0x100, Info: STB_GLOBAL<<4 | STT_NOTYPE, Section: 1},
+	{Name: "main", Value: 0x100, Size: 0x20, Info: STB_GLOBAL<<4 | STT_FUNC, Section: 1},
+	{Name: "helper", Value: 0x120, Size: 0x10, Info: STB_LOCAL<<4 | STT_FUNC, Section: 1},
+	{Name: "counter", Value: 0x1000, Size: 4, Info: STB_GLOBAL<<4 | STT_OBJECT, Section: 2},
+	{Name: "puts", Info: STB_GLOBAL<<4 | STT_FUNC}, // undefined
+}
+
+// symbolELF returns an executable with .text, .bss, .symtab and .strtab sections.
+func symbolELF(class byte) testELF {
+	table, names := symbolTable(class, testSymbols)
+	entrySize := uint32(16)
+	if class == ELFCLASS64 {
+		entrySize = 24
+	}
+	return testELF{
+		class: class,
+		entry: 0x100,
+		sections: []testSection{
+			{name: ".text", typ: SHT_PROGBITS, addr: 0x100, data: wordBytes(0x00000013, EBREAK_WORD)},
+			{name: ".bss", typ: SHT_NOBITS, addr: 0x1000, size: 0x40},
+			{name: ".symtab", typ: SHT_SYMTAB, data: table, link: 4, entSize: entrySize},
+			{name: ".strtab", typ: SHT_STRTAB, data: names},
+		},
+	}
+}
+
+func TestReadSections(t *testing.T) {
+	for _, class := range []byte{ELFCLASS32, ELFCLASS64} {
+		elf, err := ReadELFBytes(symbolELF(class).build())
+		if err != nil {
+			t.Fatalf("class %d: %v", class, err)
+		}
+		text, ok := elf.Section(".text")
+		if !ok || text.Addr != 0x100 || text.Type != SHT_PROGBITS || string(text.Data) != string(wordBytes(0x00000013, EBREAK_WORD)) {
+			t.Errorf("class %d: .text = %+v", class, text)
+		}
+		bss, ok := elf.Section(".bss")
+		if !ok || bss.Size != 0x40 || bss.Data != nil {
+			t.Errorf("class %d: .bss = %+v, want 64 bytes without contents", class, bss)
+		}
+		if _, ok := elf.Section(".data"); ok {
+			t.Errorf("class %d: found a missing section", class)
+		}
+		if len(elf.Symbols) != len(testSymbols) {
+			t.Errorf("class %d: %d symbols, want %d", class, len(elf.Symbols), len(testSymbols))
+		}
+	}
+}
+
+func TestLookupSymbol(t *testing.T) {
+	elf, err := ReadELFBytes(symbolELF(ELFCLASS32).build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		wantValue uint32
+		wantFound bool
+	}{
+		{"main", 0x100, true},
+		{"counter", 0x1000, true},
+		{"puts", 0, false}, // undefined
+		{"missing", 0, false},
+	}
+	for _, test := range tests {
+		sym, ok := elf.LookupSymbol(test.name)
+		if ok != test.wantFound || sym.Value != test.wantValue {
+			t.Errorf("LookupSymbol(%q) = 0x%x, %t, want 0x%x, %t", test.name, sym.Value, ok, test.wantValue, test.wantFound)
+		}
+	}
+	if sym, _ := elf.LookupSymbol("main"); sym.Type() != STT_FUNC || sym.Binding() != STB_GLOBAL || sym.Size != 0x20 {
+		t.Errorf("main = %+v, want a global function of 32 bytes", sym)
+	}
+}
+
+func TestSymbolAt(t *testing.T) {
+	for _, class := range []byte{ELFCLASS32, ELFCLASS64} {
+		elf, err := ReadELFBytes(symbolELF(class).build())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			addr       uint32
+			wantName   string
+			wantOffset uint32
+		}{
+			{0x100, "main", 0}, // preferred over the untyped _start
+			{0x11C, "main", 0x1C},
+			{0x124, "helper", 4},
+			{0x2000, "counter", 0x1000},
+			{0xFF, "", 0},
+		}
+		for _, test := range tests {
+			sym, offset, ok := elf.SymbolAt(test.addr)
+			if ok != (test.wantName != "") || sym.Name != test.wantName || offset != test.wantOffset {
+				t.Errorf("class %d: SymbolAt(0x%x) = %s+0x%x, %t, want %s+0x%x", class, test.addr, sym.Name, offset, ok, test.wantName, test.wantOffset)
+			}
+		}
+	}
+}
+
+func TestSymbolsBeyond32Bits(t *testing.T) {
+	file := symbolELF(ELFCLASS64).build()
+	elf, err := ReadELFBytes(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symtab, _ := elf.Section(".symtab")
+	binary.LittleEndian.PutUint64(file[symtab.Offset+24*3+8:], 0x100000000) // value of main
+	elf, err = ReadELFBytes(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := elf.LookupSymbol("main"); ok {
+		t.Error("a symbol beyond the 32-bit address space was kept")
+	}
+	if _, ok := elf.LookupSymbol("helper"); !ok {
+		t.Error("the symbols following it were dropped")
+	}
+}
+
+func TestMalformedSections(t *testing.T) {
+	le := binary.LittleEndian
+	// ELF32 header fields and section header fields
+	const (
+		SHOFF      = 32
+		SHENTSIZE  = 46
+		SHNUM      = 48
+		SHSTRNDX   = 50
+		SH_OFFSET  = 16
+		SH_SIZE    = 20
+		SH_LINK    = 24
+		SYMTAB_IDX = 3
+	)
+	tests := []struct {
+		name   string
+		mutate func(file []byte, shoff uint32)
+	}{
+		{"section name table index out of range", func(file []byte, shoff uint32) { le.PutUint16(file[SHSTRNDX:], 9) }},
+		{"section header table past the end", func(file []byte, shoff uint32) { le.PutUint16(file[SHNUM:], 200) }},
+		{"section header table offset past the end", func(file []byte, shoff uint32) { le.PutUint32(file[SHOFF:], 0xFFFFFF00) }},
+		{"section headers too small", func(file []byte, shoff uint32) { le.PutUint16(file[SHENTSIZE:], 20) }},
+		{"section contents past the end", func(file []byte, shoff uint32) {
+			le.PutUint32(file[shoff+1*ELF32_SECTION_HEADER_SIZE+SH_SIZE:], 0x10000)
+		}},
+		{"section offset overflowing", func(file []byte, shoff uint32) {
+			le.PutUint32(file[shoff+1*ELF32_SECTION_HEADER_SIZE+SH_OFFSET:], 0xFFFFFFFF)
+		}},
+		{"symbol table linked to a missing section", func(file []byte, shoff uint32) {
+			le.PutUint32(file[shoff+SYMTAB_IDX*ELF32_SECTION_HEADER_SIZE+SH_LINK:], 42)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := symbolELF(ELFCLASS32).build()
+			test.mutate(file, le.Uint32(file[SHOFF:]))
+			if _, err := ReadELFBytes(file); err == nil {
+				t.Error("the file was accepted")
+			}
+		})
+	}
+
+	t.Run("truncated symbol and string tables", func(t *testing.T) {
+		file := symbolELF(ELFCLASS32).build()
+		shoff := le.Uint32(file[SHOFF:])
+		le.PutUint32(file[shoff+SYMTAB_IDX*ELF32_SECTION_HEADER_SIZE+SH_SIZE:], 16*2+7) // _start cut short
+		le.PutUint32(file[shoff+4*ELF32_SECTION_HEADER_SIZE+SH_SIZE:], 3)               // names cut short
+		elf, err := ReadELFBytes(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elf.Symbols) != 1 || elf.Symbols[0].Name != "cr" {
+			t.Errorf("symbols %+v, want only the file symbol with a truncated name", elf.Symbols)
+		}
+	})
+
+	t.Run("ELF64 section beyond 32 bits", func(t *testing.T) {
+		file := symbolELF(ELFCLASS64).build()
+		shoff := le.Uint64(file[40:])
+		le.PutUint64(file[shoff+1*ELF64_SECTION_HEADER_SIZE+16:], 0x100000000) // address of .text
+		if _, err := ReadELFBytes(file); err == nil {
+			t.Error("the file was accepted")
+		}
+	})
+}
+
+func TestMalformedELF(t *testing.T) {
+	le := binary.LittleEndian
+	// ELF32 header fields and program header fields
+	const (
+		CLASS      = 4
+		DATA       = 5
+		VERSION    = 6
+		TYPE       = 16
+		MACHINE    = 18
+		PHOFF      = 28
+		PHENTSIZE  = 42
+		PHNUM      = 44
+		PH_OFFSET  = 4
+		PH_FILESZ  = 16
+		PH_MEMSZ   = 20
+		PH64_VADDR = 16
+	)
+	program := testELF{segments: []testSegment{{vaddr: 0x100, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(EBREAK_WORD)}}}
+	tests := []struct {
+		name   string
+		class  byte
+		mutate func(file []byte)
+	}{
+		{"bad magic", ELFCLASS32, func(file []byte) { file[1] = 'X' }},
+		{"unknown class", ELFCLASS32, func(file []byte) { file[CLASS] = 3 }},
+		{"unknown data encoding", ELFCLASS32, func(file []byte) { file[DATA] = 0 }},
+		{"unknown version", ELFCLASS32, func(file []byte) { file[VERSION] = 2 }},
+		{"relocatable file", ELFCLASS32, func(file []byte) { le.PutUint16(file[TYPE:], 1) }},
+		{"other machine", ELFCLASS32, func(file []byte) { le.PutUint16(file[MACHINE:], 0x3E) }},
+		{"program headers too small", ELFCLASS32, func(file []byte) { le.PutUint16(file[PHENTSIZE:], 16) }},
+		{"program header table past the end", ELFCLASS32, func(file []byte) { le.PutUint16(file[PHNUM:], 1000) }},
+		{"program header offset overflowing", ELFCLASS32, func(file []byte) { le.PutUint32(file[PHOFF:], 0xFFFFFFF0) }},
+		{"segment contents past the end", ELFCLASS32, func(file []byte) {
+			le.PutUint32(file[ELF32_HEADER_SIZE+PH_FILESZ:], 0x100000)
+			le.PutUint32(file[ELF32_HEADER_SIZE+PH_MEMSZ:], 0x100000)
+		}},
+		{"segment offset past the end", ELFCLASS32, func(file []byte) { le.PutUint32(file[ELF32_HEADER_SIZE+PH_OFFSET:], 0x7FFFFFFF) }},
+		{"ELF64 entry point beyond 32 bits", ELFCLASS64, func(file []byte) { le.PutUint64(file[24:], 0x100000000) }},
+		{"ELF64 segment beyond 32 bits", ELFCLASS64, func(file []byte) { le.PutUint64(file[ELF64_HEADER_SIZE+PH64_VADDR:], 0x80000000_00000000) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := program
+			file.class = test.class
+			data := file.build()
+			test.mutate(data)
+			if elf, err := ReadELFBytes(data); err == nil {
+				t.Errorf("the file was accepted: %+v", elf.ProgramHeaders)
+			}
+		})
+	}
+}
+
+func TestTruncatedELF(t *testing.T) {
+	for _, class := range []byte{ELFCLASS32, ELFCLASS64} {
+		file := symbolELF(class)
+		file.segments = []testSegment{{vaddr: 0x100, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(0x00000013, EBREAK_WORD)}}
+		data := file.build()
+		if _, err := ReadELFBytes(data); err != nil {
+			t.Fatal(err)
+		}
+		for size := 0; size < len(data); size++ {
+			if _, err := ReadELFBytes(data[:size]); err == nil {
+				t.Errorf("class %d: file truncated to %d of %d bytes was accepted", class, size, len(data))
+			}
+		}
+	}
+}
+
+// failingReader fails every read past limit.
+type failingReader struct {
+	data  []byte
+	limit int64
+}
+
+func (r failingReader) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.limit {
+		return 0, errors.New("disk error")
+	}
+	return copy(p, r.data[off:]), nil
+}
+
+func TestReadELF(t *testing.T) {
+	data := symbolELF(ELFCLASS32).build()
+	elf, err := ReadELF(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elf.Entry != 0x100 || len(elf.SectionHeaders) != 6 {
+		t.Errorf("entry 0x%x with %d sections, want 0x100 and 6", elf.Entry, len(elf.SectionHeaders))
+	}
+
+	_, err = ReadELF(failingReader{data: data, limit: ELF32_HEADER_SIZE}, int64(len(data)))
+	if err == nil || !strings.Contains(err.Error(), "disk error") {
+		t.Errorf("error = %v, want the error of the reader", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "program.elf")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadELFFile(path); err != nil {
+		t.Error(err)
+	}
+	if _, err := ReadELFFile(filepath.Join(t.TempDir(), "missing.elf")); err == nil {
+		t.Error("a missing file was read")
+	}
+}
+
+func TestZeroFill(t *testing.T) {
+	m := NewMemory()
+	for addr := uint32(0x1000); addr < 0x1100; addr += 4 {
+		m.WriteWord(addr, 0xFFFFFFFF) // left over by a previous run
+	}
+	elf, err := ReadELFBytes(testELF{segments: []testSegment{
+		{vaddr: 0x1000, flags: PERMISSION_R | PERMISSION_W, data: []byte{1, 2, 3, 4, 5, 6}, memSize: 0xF0},
+	}}.build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := elf.CopyToMemory(m); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0x04030201, 0x00000605}
+	for addr := uint32(0x1008); addr < 0x10F0; addr += 4 {
+		want = append(want, 0)
+	}
+	for i, w := range want {
+		if got, _ := m.ReadWord(0x1000 + uint32(4*i)); got != w {
+			t.Errorf("word at 0x%x = 0x%08x, want 0x%08x", 0x1000+4*i, got, w)
+		}
+	}
+	if got, _ := m.ReadWord(0x10F0); got != 0xFFFFFFFF {
+		t.Errorf("word after the segment = 0x%08x, it was overwritten", got)
+	}
+}
+
+func TestInvalidSegments(t *testing.T) {
+	le := binary.LittleEndian
+	const PH_FILESZ = 16
+	tests := []struct {
+		name     string
+		segments []testSegment
+		mutate   func(file []byte)
+	}{
+		{
+			name: "overlapping segments",
+			segments: []testSegment{
+				{vaddr: 0x1000, flags: PERMISSION_R, data: make([]byte, 0x10), memSize: 0x100},
+				{vaddr: 0x10F0, flags: PERMISSION_R, data: make([]byte, 0x10)},
+			},
+		},
+		{
+			name: "segment inside another one",
+			segments: []testSegment{
+				{vaddr: 0x1000, flags: PERMISSION_R, data: make([]byte, 0x100)},
+				{vaddr: 0x1010, flags: PERMISSION_R, data: make([]byte, 0x10)},
+			},
+		},
+		{
+			name:     "segment past the end of memory",
+			segments: []testSegment{{vaddr: 0xFFF00, flags: PERMISSION_R, data: make([]byte, 0x10), memSize: 0x200}},
+		},
+		{
+			name:     "segment past the end of the address space",
+			segments: []testSegment{{vaddr: 0xFFFFFF00, flags: PERMISSION_R, data: make([]byte, 0x10), memSize: 0x200}},
+		},
+		{
+			name:     "file size larger than memory size",
+			segments: []testSegment{{vaddr: 0x1000, flags: PERMISSION_R, data: make([]byte, 0x10)}},
+			mutate:   func(file []byte) { le.PutUint32(file[ELF32_HEADER_SIZE+PH_FILESZ:], 0x11) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segments := append([]testSegment{{vaddr: 0x200, flags: PERMISSION_R, data: []byte{1, 2, 3, 4}}}, test.segments...)
+			file := testELF{segments: segments}.build()
+			if test.mutate != nil {
+				test.mutate(file[ELF32_PROGRAM_HEADER_SIZE:]) // skip the valid first segment
+			}
+			elf, err := ReadELFBytes(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := NewMemory()
+			if err := elf.CopyToMemory(m); err == nil {
+				t.Fatal("the segments were loaded")
+			}
+			if got, _ := m.ReadWord(0x200); got != 0 {
+				t.Error("memory was written although the file was rejected")
+			}
+		})
+	}
+}
+
+func TestEmptySegments(t *testing.T) {
+	elf, err := ReadELFBytes(testELF{segments: []testSegment{
+		{vaddr: 0x1000, flags: PERMISSION_R | PERMISSION_W},
+		{vaddr: 0x1000, flags: PERMISSION_R, data: []byte{1}},
+	}}.build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemory()
+	if err := elf.CopyToMemory(m); err != nil {
+		t.Fatalf("an empty segment overlapped another one: %v", err)
+	}
+	if got := m.Protections(); len(got) != 1 {
+		t.Errorf("protected ranges %+v, want only the non-empty segment", got)
+	}
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"fmt"
+)
+
+// isFloatInstruction reports whether an instruction belongs to the F or D extension.
+func isFloatInstruction(value RISCVInstruction) bool {
+	return value >= FLW && value <= FCLASS_D
+}
+
+// floatFormatOf returns the format an F or D instruction operates on.
+func floatFormatOf(value RISCVInstruction) floatFormat {
+	switch {
+	case value >= FMADD_D && value <= FCVT_D_WU, value == FLD, value == FSD, value == FCVT_D_S, value == FCLASS_D:
+		return doubleFormat
+	default:
+		return singleFormat
+	}
+}
+
+// ReadFloatRegister returns the raw content of a floating point register.
+func (c *CPU) ReadFloatRegister(reg uint32) (uint64, error) {
+	if uint32(len(c.FRegisters)) <= reg {
+		return 0, fmt.Errorf("read float register out of range at PC=%d", c.PC)
+	}
+	return c.FRegisters[reg], nil
+}
+
+// WriteFloatRegister sets the raw content of a floating point register.
+func (c *CPU) WriteFloatRegister(reg uint32, val uint64) {
+	if uint32(len(c.FRegisters)) <= reg {
+		return
+	}
+	c.FRegisters[reg] = val
+}
+
+// readFloat reads a register as a value of the given format.
+// Single-precision values must be NaN-boxed, anything else reads as the canonical NaN.
+func (c *CPU) readFloat(f floatFormat, reg uint32) (uint64, error) {
+	val, err := c.ReadFloatRegister(reg)
+	if err != nil {
+		return 0, err
+	}
+	if f == singleFormat {
+		if val>>32 != 0xFFFFFFFF {
+			return singleFormat.canonicalNaN(), nil
+		}
+		return val & 0xFFFFFFFF, nil
+	}
+	return val, nil
+}
+
+// writeFloat writes a value of the given format, NaN-boxing single-precision values.
+func (c *CPU) writeFloat(f floatFormat, reg uint32, val uint64) {
+	if f == singleFormat {
+		val = 0xFFFFFFFF00000000 | val&0xFFFFFFFF
+	}
+	c.WriteFloatRegister(reg, val)
+}
+
+// roundingMode resolves the rounding mode of an instruction, reading fcsr.frm for the dynamic mode.
+func (c *CPU) roundingMode(rm uint32) (uint32, error) {
+	if rm == ROUND_DYNAMIC {
+		rm = (c.FCSR >> 5) & 0b111
+	}
+	if rm > ROUND_NEAREST_MAX {
+		return 0, fmt.Errorf("invalid rounding mode %d", rm)
+	}
+	return rm, nil
+}
+
+// raiseFloatFlags accumulates exception flags into fcsr.fflags.
+func (c *CPU) raiseFloatFlags(flags uint32) {
+	c.FCSR |= flags & 0x1F
+}
+
+// executeFloat executes an instruction of the F or D extension.
+func (c *CPU) executeFloat(instruction Instruction) (int, error) {
+	f := floatFormatOf(instruction.value)
+
+	switch instruction.value {
+	case FLW, FLD:
+		base, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		addr := base + instruction.operand2
+		if instruction.value == FLW {
+			val, err := c.load(addr, 4)
+			if err != nil {
+				return -1, err
+			}
+			c.writeFloat(singleFormat, instruction.operand0, uint64(val))
+			return OK, nil
+		}
+		if addr%8 != 0 {
+			return -1, &Exception{Cause: CAUSE_LOAD_MISALIGNED, Tval: addr}
+		}
+		low, err := c.load(addr, 4)
+		if err != nil {
+			return -1, err
+		}
+		high, err := c.load(addr+4, 4)
+		if err != nil {
+			return -1, err
+		}
+		c.writeFloat(doubleFormat, instruction.operand0, uint64(high)<<32|uint64(low))
+		return OK, nil
+	case FSW, FSD:
+		base, err := c.ReadRegister(instruction.operand2)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		val, err := c.ReadFloatRegister(instruction.operand0)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		addr := base + instruction.operand1
+		if instruction.value == FSW {
+			return OK, c.store(addr, 4, uint32(val))
+		}
+		if addr%8 != 0 {
+			return -1, &Exception{Cause: CAUSE_STORE_MISALIGNED, Tval: addr}
+		}
+		err = c.store(addr, 4, uint32(val))
+		if err != nil {
+			return -1, err
+		}
+		return OK, c.store(addr+4, 4, uint32(val>>32))
+	case FMV_X_W:
+		val, err := c.ReadFloatRegister(instruction.operand1)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		c.WriteRegister(instruction.operand0, uint32(val))
+		return OK, nil
+	case FMV_W_X:
+		val, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		c.writeFloat(singleFormat, instruction.operand0, uint64(val))
+		return OK, nil
+	case FCVT_S_W, FCVT_S_WU, FCVT_D_W, FCVT_D_WU:
+		val, err := c.ReadRegister(instruction.operand1)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		rm, err := c.roundingMode(instruction.rm)
+		if err != nil {
+			return -1, illegalInstruction(instruction, err)
+		}
+		signed := instruction.value == FCVT_S_W || instruction.value == FCVT_D_W
+		result, flags := intToFloat(f, val, rm, signed)
+		c.raiseFloatFlags(flags)
+		c.writeFloat(f, instruction.operand0, result)
+		return OK, nil
+	}
+
+	// Every remaining instruction reads its operands from the FP register file.
+	from := f
+	if instruction.value == FCVT_S_D {
+		from = doubleFormat
+	}
+	if instruction.value == FCVT_D_S {
+		from = singleFormat
+	}
+	a, err0 := c.readFloat(from, instruction.operand1)
+	b, err1 := c.readFloat(from, instruction.operand2)
+	if err0 != nil || err1 != nil {
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err0, err1)
+	}
+	rm, err := c.roundingMode(instruction.rm)
+	if err != nil {
+		return -1, illegalInstruction(instruction, err)
+	}
+
+	var result uint64
+	var flags uint32
+	switch instruction.value {
+	case FMADD_S, FMSUB_S, FNMSUB_S, FNMADD_S, FMADD_D, FMSUB_D, FNMSUB_D, FNMADD_D:
+		addend, err := c.readFloat(f, instruction.operand3)
+		if err != nil {
+			return -1, fmt.Errorf("crash at PC=%d with error:\n%s", instruction.address, err)
+		}
+		switch instruction.value {
+		case FMSUB_S, FMSUB_D:
+			addend ^= f.signBit()
+		case FNMSUB_S, FNMSUB_D:
+			a ^= f.signBit()
+		case FNMADD_S, FNMADD_D:
+			a ^= f.signBit()
+			addend ^= f.signBit()
+		}
+		result, flags = floatFMA(f, a, b, addend, rm)
+	case FADD_S, FADD_D:
+		result, flags = floatAdd(f, a, b, rm)
+	case FSUB_S, FSUB_D:
+		result, flags = floatSub(f, a, b, rm)
+	case FMUL_S, FMUL_D:
+		result, flags = floatMul(f, a, b, rm)
+	case FDIV_S, FDIV_D:
+		result, flags = floatDiv(f, a, b, rm)
+	case FSQRT_S, FSQRT_D:
+		result, flags = floatSqrt(f, a, rm)
+	case FSGNJ_S, FSGNJ_D:
+		result = a&^f.signBit() | b&f.signBit()
+	case FSGNJN_S, FSGNJN_D:
+		result = a&^f.signBit() | ^b&f.signBit()
+	case FSGNJX_S, FSGNJX_D:
+		result = a ^ b&f.signBit()
+	case FMIN_S, FMIN_D:
+		result, flags = floatMinMax(f, a, b, false)
+	case FMAX_S, FMAX_D:
+		result, flags = floatMinMax(f, a, b, true)
+	case FCVT_S_D, FCVT_D_S:
+		result, flags = floatConvert(from, f, a, rm)
+	case FEQ_S, FEQ_D, FLT_S, FLT_D, FLE_S, FLE_D:
+		var res bool
+		switch instruction.value {
+		case FEQ_S, FEQ_D:
+			res, flags = floatCompare(f, a, b, 0, false, false)
+		case FLT_S, FLT_D:
+			res, flags = floatCompare(f, a, b, -1, false, true)
+		default:
+			res, flags = floatCompare(f, a, b, -1, true, true)
+		}
+		c.raiseFloatFlags(flags)
+		if res {
+			c.WriteRegister(instruction.operand0, 1)
+		} else {
+			c.WriteRegister(instruction.operand0, 0)
+		}
+		return OK, nil
+	case FCVT_W_S, FCVT_WU_S, FCVT_W_D, FCVT_WU_D:
+		signed := instruction.value == FCVT_W_S || instruction.value == FCVT_W_D
+		val, flags := floatToInt(f, a, rm, signed)
+		c.raiseFloatFlags(flags)
+		c.WriteRegister(instruction.operand0, val)
+		return OK, nil
+	case FCLASS_S, FCLASS_D:
+		c.WriteRegister(instruction.operand0, floatClassify(f, a))
+		return OK, nil
+	default:
+		return UNKNOWN_INSTRUCTION, nil
+	}
+	c.raiseFloatFlags(flags)
+	c.writeFloat(f, instruction.operand0, result)
+	return OK, nil
+}
@@ -0,0 +1,168 @@
+package core
+
+import "testing"
+
+const (
+	FA0 = 10
+	FA1 = 11
+	FA2 = 12
+)
+
+// boxed NaN-boxes a single precision value.
+func boxed(val uint32) uint64 {
+	return 0xFFFFFFFF00000000 | uint64(val)
+}
+
+func TestFloatInstructions(t *testing.T) {
+	tests := []struct {
+		name       string
+		program    []uint32
+		fregisters map[uint32]uint64
+		registers  map[uint32]uint32
+		memory     map[uint32]uint32
+		fcsr       uint32
+		wantF      map[uint32]uint64
+		wantX      map[uint32]uint32
+		wantMemory map[uint32]uint32
+		wantFCSR   uint32
+	}{
+		{
+			name:       "static rounding mode",
+			program:    []uint32{0x18c59553}, // fdiv.s fa0, fa1, fa2, rtz
+			fregisters: map[uint32]uint64{FA1: boxed(S_ONE), FA2: boxed(S_THREE)},
+			wantF:      map[uint32]uint64{FA0: boxed(0x3EAAAAAA)},
+			wantFCSR:   FLAG_INEXACT,
+		},
+		{
+			name:       "dynamic rounding mode",
+			program:    []uint32{0x18c5f553}, // fdiv.s fa0, fa1, fa2, dyn
+			fregisters: map[uint32]uint64{FA1: boxed(S_ONE), FA2: boxed(S_THREE)},
+			fcsr:       ROUND_UP << 5,
+			wantF:      map[uint32]uint64{FA0: boxed(0x3EAAAAAB)},
+			wantFCSR:   ROUND_UP<<5 | FLAG_INEXACT,
+		},
+		{
+			name:       "flags accumulate",
+			program:    []uint32{0x18c5f553}, // fdiv.s fa0, fa1, fa2
+			fregisters: map[uint32]uint64{FA1: boxed(S_ONE), FA2: boxed(0)},
+			fcsr:       FLAG_INEXACT,
+			wantF:      map[uint32]uint64{FA0: boxed(S_INF)},
+			wantFCSR:   FLAG_INEXACT | FLAG_DIVIDE_BY_ZERO,
+		},
+		{
+			name:       "unboxed single reads as NaN",
+			program:    []uint32{0x00c5f553}, // fadd.s fa0, fa1, fa2
+			fregisters: map[uint32]uint64{FA1: S_ONE, FA2: boxed(S_ONE)},
+			wantF:      map[uint32]uint64{FA0: boxed(S_QNAN)},
+		},
+		{
+			name: "single loads and stores",
+			program: []uint32{
+				0x0085a507, // flw fa0, 8(a1)
+				0x00a5a627, // fsw fa0, 12(a1)
+			},
+			registers:  map[uint32]uint32{ARG_ONE: 0x100},
+			memory:     map[uint32]uint32{0x108: S_TWO},
+			wantF:      map[uint32]uint64{FA0: boxed(S_TWO)},
+			wantMemory: map[uint32]uint32{0x10C: S_TWO},
+		},
+		{
+			name: "double loads and stores",
+			program: []uint32{
+				0x0105b507, // fld fa0, 16(a1)
+				0x00a5bc27, // fsd fa0, 24(a1)
+			},
+			registers:  map[uint32]uint32{ARG_ONE: 0x100},
+			memory:     map[uint32]uint32{0x110: 0x55555555, 0x114: 0x3FD55555},
+			wantF:      map[uint32]uint64{FA0: 0x3FD5555555555555},
+			wantMemory: map[uint32]uint32{0x118: 0x55555555, 0x11C: 0x3FD55555},
+		},
+		{
+			name: "moves keep the bits",
+			program: []uint32{
+				0xe0058553, // fmv.x.w a0, fa1
+				0xf0058553, // fmv.w.x fa0, a1
+			},
+			fregisters: map[uint32]uint64{FA1: boxed(S_SNAN)},
+			registers:  map[uint32]uint32{ARG_ONE: 0x7F800002},
+			wantX:      map[uint32]uint32{ARG_ZERO: S_SNAN},
+			wantF:      map[uint32]uint64{FA0: boxed(0x7F800002)},
+		},
+		{
+			name:       "convert to integer",
+			program:    []uint32{0xc005f553}, // fcvt.w.s a0, fa1
+			fregisters: map[uint32]uint64{FA1: boxed(0xC0200000)},
+			wantX:      map[uint32]uint32{ARG_ZERO: 0xFFFFFFFE},
+			wantFCSR:   FLAG_INEXACT,
+		},
+		{
+			name:       "widen single to double",
+			program:    []uint32{0x42058553}, // fcvt.d.s fa0, fa1
+			fregisters: map[uint32]uint64{FA1: boxed(0x3FC00000)},
+			wantF:      map[uint32]uint64{FA0: 0x3FF8000000000000},
+		},
+		{
+			name:       "double add",
+			program:    []uint32{0x02c5f553}, // fadd.d fa0, fa1, fa2
+			fregisters: map[uint32]uint64{FA1: 0x3FB999999999999A, FA2: 0x3FC999999999999A},
+			wantF:      map[uint32]uint64{FA0: 0x3FD3333333333334},
+			wantFCSR:   FLAG_INEXACT,
+		},
+		{
+			name:       "compare",
+			program:    []uint32{0xa0c5a553}, // feq.s a0, fa1, fa2
+			fregisters: map[uint32]uint64{FA1: boxed(0), FA2: boxed(S_NEG_ZERO)},
+			wantX:      map[uint32]uint32{ARG_ZERO: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			for reg, val := range test.fregisters {
+				cpu.FRegisters[reg] = val
+			}
+			for reg, val := range test.registers {
+				cpu.Registers[reg] = val
+			}
+			for addr, val := range test.memory {
+				cpu.Memory.WriteWord(addr, val)
+			}
+			cpu.FCSR = test.fcsr
+			runProgram(t, cpu, append(test.program, EBREAK_WORD))
+			for reg, want := range test.wantF {
+				if got := cpu.FRegisters[reg]; got != want {
+					t.Errorf("f%d = 0x%016x, want 0x%016x", reg, got, want)
+				}
+			}
+			for reg, want := range test.wantX {
+				if got := cpu.Registers[reg]; got != want {
+					t.Errorf("x%d = 0x%08x, want 0x%08x", reg, got, want)
+				}
+			}
+			for addr, want := range test.wantMemory {
+				if got, _ := cpu.Memory.ReadWord(addr); got != want {
+					t.Errorf("memory at 0x%08x = 0x%08x, want 0x%08x", addr, got, want)
+				}
+			}
+			if cpu.FCSR != test.wantFCSR {
+				t.Errorf("fcsr = 0x%02x, want 0x%02x", cpu.FCSR, test.wantFCSR)
+			}
+		})
+	}
+}
+
+func TestReservedRoundingModeIsIllegal(t *testing.T) {
+	for _, rm := range []uint32{5, 6} {
+		cpu := NewCPU(NewMemory())
+		cpu.Memory.WriteWord(0, 0x18c5f553&^(0b111<<12)|rm<<12) // fdiv.s fa0, fa1, fa2 with a reserved rm
+		if _, err := cpu.ExecuteSingle(); err == nil {
+			t.Errorf("rounding mode %d was accepted", rm)
+		}
+	}
+	cpu := NewCPU(NewMemory())
+	cpu.FCSR = 5 << 5
+	cpu.Memory.WriteWord(0, 0x18c5f553) // fdiv.s fa0, fa1, fa2, dyn
+	if _, err := cpu.ExecuteSingle(); err == nil {
+		t.Error("reserved frm was accepted")
+	}
+}
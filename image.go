@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Program file formats recognized by DetectFormat.
+const (
+	FORMAT_BINARY    = iota // flat binary, as produced by objcopy -O binary
+	FORMAT_ELF              // ELF executable
+	FORMAT_INTEL_HEX        // Intel HEX, objcopy -O ihex
+	FORMAT_SREC             // Motorola S-record, objcopy -O srec
+)
+
+// Intel HEX record types.
+const (
+	IHEX_DATA                  = 0
+	IHEX_END_OF_FILE           = 1
+	IHEX_EXTENDED_SEGMENT      = 2 // bits 4-19 of the address of the following records, which wrap around within 64 KiB
+	IHEX_START_SEGMENT_ADDRESS = 3 // CS:IP entry point
+	IHEX_EXTENDED_LINEAR       = 4 // bits 16-31 of the address of the following records
+	IHEX_START_LINEAR_ADDRESS  = 5 // 32-bit entry point
+)
+
+// ihexPayloadSize is the number of data bytes of the Intel HEX records that are not IHEX_DATA.
+var ihexPayloadSize = map[byte]int{
+	IHEX_EXTENDED_SEGMENT:      2,
+	IHEX_START_SEGMENT_ADDRESS: 4,
+	IHEX_EXTENDED_LINEAR:       2,
+	IHEX_START_LINEAR_ADDRESS:  4,
+}
+
+// ImageSegment is a run of contiguous bytes of a memory image.
+type ImageSegment struct {
+	Address uint32
+	Data    []byte
+}
+
+// Image is a program stored without headers: a flat binary, an Intel HEX or a Motorola S-record file.
+type Image struct {
+	Format   int
+	Segments []ImageSegment // in file order, contiguous records are merged
+	// Entry is the start address recorded in the file. Without one, it is the address of the first segment.
+	Entry uint32
+}
+
+// DetectFormat guesses the format of a program file from its first bytes.
+// Files that are neither ELF nor text in the Intel HEX or S-record format are flat binaries.
+func DetectFormat(data []byte) int {
+	if bytes.HasPrefix(data, []byte("\x7fELF")) {
+		return FORMAT_ELF
+	}
+	line := bytes.TrimSpace(data)
+	if i := bytes.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	switch {
+	case len(line) >= 11 && line[0] == ':' && isHex(line[1:]):
+		return FORMAT_INTEL_HEX
+	case len(line) >= 10 && line[0] == 'S' && line[1] >= '0' && line[1] <= '9' && isHex(line[2:]):
+		return FORMAT_SREC
+	}
+	return FORMAT_BINARY
+}
+
+// isHex reports whether text only holds hexadecimal digits.
+func isHex(text []byte) bool {
+	for _, c := range text {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadImageFile reads an Intel HEX, S-record or flat binary file, flat binaries being placed at base.
+func ReadImageFile(filePath string, base uint32) (*Image, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return ReadImage(data, base)
+}
+
+// ReadImage parses an Intel HEX, S-record or flat binary file held in memory, flat binaries being placed at base.
+func ReadImage(data []byte, base uint32) (*Image, error) {
+	switch DetectFormat(data) {
+	case FORMAT_ELF:
+		return nil, fmt.Errorf("ELF files are read with ReadELF")
+	case FORMAT_INTEL_HEX:
+		return ReadIntelHex(data)
+	case FORMAT_SREC:
+		return ReadSRecord(data)
+	default:
+		return ReadBinary(data, base)
+	}
+}
+
+// ReadBinary places the contents of a flat binary at base, which is also its entry point.
+func ReadBinary(data []byte, base uint32) (*Image, error) {
+	if uint64(base)+uint64(len(data)) > 1<<32 {
+		return nil, fmt.Errorf("binary of %d bytes at 0x%08x exceeds the 32-bit address space", len(data), base)
+	}
+	return &Image{Format: FORMAT_BINARY, Segments: []ImageSegment{{Address: base, Data: data}}, Entry: base}, nil
+}
+
+// ReadIntelHex parses an Intel HEX file. Every record is checked, and the file must end with an end of file record.
+func ReadIntelHex(data []byte) (*Image, error) {
+	img := &Image{Format: FORMAT_INTEL_HEX}
+	var upper uint32   // address of the records set by the extended address records
+	segmented := false // the address was set by an extended segment address record
+	hasEntry := false
+	for number, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d does not start with ':'", number+1)
+		}
+		record, err := decodeRecord(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d: %w", number+1, err)
+		}
+		if len(record) < 5 || int(record[0]) != len(record)-5 {
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d has a wrong length", number+1)
+		}
+		if checksum(record) != 0 {
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d has a wrong checksum", number+1)
+		}
+		offset := uint32(record[1])<<8 | uint32(record[2])
+		payload := record[4 : len(record)-1]
+		if n, ok := ihexPayloadSize[record[3]]; ok && len(payload) != n {
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d: record type %d needs %d bytes, got %d", number+1, record[3], n, len(payload))
+		}
+		switch record[3] {
+		case IHEX_DATA:
+			if n := 0x10000 - offset; segmented && uint32(len(payload)) > n { // wraps around within the 64 KiB segment
+				img.add(upper+offset, payload[:n])
+				img.add(upper, payload[n:])
+			} else {
+				img.add(upper+offset, payload)
+			}
+		case IHEX_END_OF_FILE:
+			if !hasEntry && len(img.Segments) > 0 {
+				img.Entry = img.Segments[0].Address
+			}
+			return img, nil
+		case IHEX_EXTENDED_SEGMENT:
+			upper = bigEndian(payload) << 4
+			segmented = true
+		case IHEX_START_SEGMENT_ADDRESS:
+			img.Entry = bigEndian(payload[:2])<<4 + bigEndian(payload[2:])
+			hasEntry = true
+		case IHEX_EXTENDED_LINEAR:
+			upper = bigEndian(payload) << 16
+			segmented = false
+		case IHEX_START_LINEAR_ADDRESS:
+			img.Entry = bigEndian(payload)
+			hasEntry = true
+		default:
+			return nil, fmt.Errorf("invalid Intel HEX file: line %d has an unknown record type %d", number+1, record[3])
+		}
+	}
+	return nil, fmt.Errorf("invalid Intel HEX file: missing end of file record, the file may be truncated")
+}
+
+// ReadSRecord parses a Motorola S-record file. Every record is checked, and the file must end with
+// a termination record (S7, S8 or S9), which holds the entry point.
+func ReadSRecord(data []byte) (*Image, error) {
+	img := &Image{Format: FORMAT_SREC}
+	for number, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 2 || line[0] != 'S' {
+			return nil, fmt.Errorf("invalid S-record file: line %d does not start with 'S'", number+1)
+		}
+		kind := line[1]
+		record, err := decodeRecord(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid S-record file: line %d: %w", number+1, err)
+		}
+		if len(record) < 2 || int(record[0]) != len(record)-1 {
+			return nil, fmt.Errorf("invalid S-record file: line %d has a wrong length", number+1)
+		}
+		if checksum(record) != 0xFF {
+			return nil, fmt.Errorf("invalid S-record file: line %d has a wrong checksum", number+1)
+		}
+		var width int // size of the address field
+		switch kind {
+		case '0', '1', '5', '9':
+			width = 2
+		case '2', '6', '8':
+			width = 3
+		case '3', '7':
+			width = 4
+		default:
+			return nil, fmt.Errorf("invalid S-record file: line %d has an unknown record type S%c", number+1, kind)
+		}
+		if len(record)-2 < width {
+			return nil, fmt.Errorf("invalid S-record file: line %d is too short for an S%c record", number+1, kind)
+		}
+		address := bigEndian(record[1 : 1+width])
+		payload := record[1+width : len(record)-1]
+		switch kind {
+		case '1', '2', '3':
+			img.add(address, payload)
+		case '7', '8', '9':
+			img.Entry = address
+			return img, nil
+		}
+		// S0 headers and S5/S6 record counts carry no data
+	}
+	return nil, fmt.Errorf("invalid S-record file: missing termination record, the file may be truncated")
+}
+
+// decodeRecord decodes the hexadecimal digits of a record.
+func decodeRecord(digits []byte) ([]byte, error) {
+	record := make([]byte, hex.DecodedLen(len(digits)))
+	_, err := hex.Decode(record, digits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hexadecimal digits: %w", err)
+	}
+	return record, nil
+}
+
+// checksum returns the low byte of the sum of the bytes of a record.
+func checksum(record []byte) byte {
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	return sum
+}
+
+// bigEndian decodes an address field of up to 4 bytes.
+func bigEndian(field []byte) uint32 {
+	var val uint32
+	for _, b := range field {
+		val = val<<8 | uint32(b)
+	}
+	return val
+}
+
+// add appends the data of a record, extending the last segment when the record follows it.
+func (img *Image) add(address uint32, data []byte) {
+	if n := len(img.Segments); n > 0 {
+		last := &img.Segments[n-1]
+		if uint64(last.Address)+uint64(len(last.Data)) == uint64(address) {
+			last.Data = append(last.Data, data...)
+			return
+		}
+	}
+	img.Segments = append(img.Segments, ImageSegment{Address: address, Data: append([]byte(nil), data...)})
+}
+
+// CopyToMemory loads the segments at their addresses, which must lie in the memory regions.
+// Nothing is written unless every segment fits in memory. Unlike ELF segments, they are not protected,
+// and the protections of a previously loaded ELF file are removed.
+func (img *Image) CopyToMemory(mem *Memory) error {
+	for i, s := range img.Segments {
+		end := uint64(s.Address) + uint64(len(s.Data))
+		if end > 1<<32 {
+			return fmt.Errorf("segment %d at 0x%08x of %d bytes exceeds the 32-bit address space", i, s.Address, len(s.Data))
+		}
+		if !mem.Loadable(s.Address, uint32(len(s.Data))) {
+			return fmt.Errorf("segment %d at 0x%08x-0x%08x does not fit in memory", i, s.Address, end)
+		}
+	}
+	mem.ClearProtections()
+	for i, s := range img.Segments {
+		err := mem.LoadBytes(s.Address, s.Data)
+		if err != nil {
+			return fmt.Errorf("failed to load segment %d at 0x%08x: %w", i, s.Address, err)
+		}
+	}
+	return nil
+}
+
+// defaultLoadAddress is where LoadFile places flat binaries: the start of the lowest memory region,
+// or 0 for a memory without regions.
+func defaultLoadAddress(mem *Memory) uint32 {
+	regions := mem.Regions()
+	if len(regions) == 0 {
+		return 0
+	}
+	base := regions[0].Base
+	for _, region := range regions[1:] {
+		base = min(base, region.Base)
+	}
+	return base
+}
+
+// readProgram reads an ELF file or, for any other format, an image whose flat binaries are placed at base.
+func readProgram(filePath string, base uint32) (*ELFFile, *Image, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if DetectFormat(data) == FORMAT_ELF {
+		elf, err := ReadELFBytes(data)
+		return elf, nil, err
+	}
+	img, err := ReadImage(data, base)
+	return nil, img, err
+}
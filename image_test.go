@@ -0,0 +1,178 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The files of testdata hold the same 20 bytes: li a0, 42; addi a1, a0, 1; ebreak and the bytes 0 to 7.
+// They were assembled with llvm-mc and converted with llvm-objcopy -O ihex and objcopy -O srec
+// (--set-start for the entry point), the .text section being placed at the address of the file:
+//
+//	program.hex, program.srec  0x80000000, extended linear address and S3 records
+//	low.hex, low.srec          0x1000, start segment address and S1 records
+//	segment.hex                0x1FFF8, extended segment address records around 0x20000
+//
+// bad_checksum.* have a data record with a wrong checksum and truncated.* lack their last record.
+var fixtureData = []byte{0x13, 0x05, 0xa0, 0x02, 0x93, 0x05, 0x15, 0x00, 0x73, 0x00, 0x10, 0x00, 0, 1, 2, 3, 4, 5, 6, 7}
+
+// ihexRecord formats an Intel HEX record with its checksum.
+func ihexRecord(kind byte, offset uint16, payload ...byte) string {
+	record := append([]byte{byte(len(payload)), byte(offset >> 8), byte(offset), kind}, payload...)
+	return fmt.Sprintf(":%X%02X\n", record, -checksum(record))
+}
+
+func TestReadImageFixtures(t *testing.T) {
+	tests := []struct {
+		file   string
+		format int
+		addr   uint32
+		entry  uint32
+	}{
+		{"program.hex", FORMAT_INTEL_HEX, 0x80000000, 0x80000000},
+		{"program.srec", FORMAT_SREC, 0x80000000, 0x80000000},
+		{"low.hex", FORMAT_INTEL_HEX, 0x1000, 0x1000},
+		{"low.srec", FORMAT_SREC, 0x1000, 0x1000},
+		{"segment.hex", FORMAT_INTEL_HEX, 0x1FFF8, 0x1FFF8},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			img, err := ReadImageFile(filepath.Join("testdata", test.file), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []ImageSegment{{Address: test.addr, Data: fixtureData}}
+			if img.Format != test.format || img.Entry != test.entry || !reflect.DeepEqual(img.Segments, want) {
+				t.Errorf("read format %d, entry 0x%x, segments %x, want format %d, entry 0x%x, segments %x",
+					img.Format, img.Entry, img.Segments, test.format, test.entry, want)
+			}
+		})
+	}
+}
+
+func TestMalformedImageFixtures(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"bad_checksum.hex", "line 3 has a wrong checksum"},
+		{"bad_checksum.srec", "line 3 has a wrong checksum"},
+		{"truncated.hex", "missing end of file record"},
+		{"truncated.srec", "missing termination record"},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			img, err := ReadImageFile(filepath.Join("testdata", test.file), 0)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("read %+v, %v, want an error about %q", img, err, test.want)
+			}
+		})
+	}
+}
+
+func TestIntelHexAddressing(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		name    string
+		records []string
+		want    []ImageSegment
+	}{
+		{
+			name:    "extended segment address wraps around within the segment",
+			records: []string{ihexRecord(IHEX_EXTENDED_SEGMENT, 0, 0x10, 0x00), ihexRecord(IHEX_DATA, 0xFFFC, data...)},
+			want:    []ImageSegment{{Address: 0x1FFFC, Data: data[:4]}, {Address: 0x10000, Data: data[4:]}},
+		},
+		{
+			name:    "extended linear address does not wrap",
+			records: []string{ihexRecord(IHEX_EXTENDED_LINEAR, 0, 0x00, 0x01), ihexRecord(IHEX_DATA, 0xFFFC, data...)},
+			want:    []ImageSegment{{Address: 0x1FFFC, Data: data}},
+		},
+		{
+			name: "linear address after a segment address",
+			records: []string{
+				ihexRecord(IHEX_EXTENDED_SEGMENT, 0, 0x10, 0x00),
+				ihexRecord(IHEX_EXTENDED_LINEAR, 0, 0x00, 0x02),
+				ihexRecord(IHEX_DATA, 0xFFFC, data...),
+			},
+			want: []ImageSegment{{Address: 0x2FFFC, Data: data}},
+		},
+		{
+			name:    "no extended address",
+			records: []string{ihexRecord(IHEX_DATA, 0x100, data...)},
+			want:    []ImageSegment{{Address: 0x100, Data: data}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := strings.Join(test.records, "") + ihexRecord(IHEX_END_OF_FILE, 0)
+			img, err := ReadIntelHex([]byte(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(img.Segments, test.want) {
+				t.Errorf("segments %x, want %x", img.Segments, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int
+	}{
+		{[]byte("\x7fELF\x01\x01"), FORMAT_ELF},
+		{[]byte(":00000001FF\r\n"), FORMAT_INTEL_HEX},
+		{[]byte("\n  S9031000EC\n"), FORMAT_SREC},
+		{[]byte(":0000"), FORMAT_BINARY},
+		{[]byte{0x13, 0x05, 0xa0, 0x02}, FORMAT_BINARY},
+	}
+	for _, test := range tests {
+		if got := DetectFormat(test.data); got != test.want {
+			t.Errorf("DetectFormat(%q) = %d, want %d", test.data, got, test.want)
+		}
+	}
+}
+
+func TestLoadImageFile(t *testing.T) {
+	cpu := NewCPU(NewMemory())
+	protected := testELF{segments: []testSegment{{vaddr: 0x1000, flags: PERMISSION_R, data: make([]byte, 32)}}}
+	path := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(path, protected.build(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(cpu.Memory.Protections()) == 0 {
+		t.Fatal("the ELF segment is not protected")
+	}
+	if err := cpu.LoadFile(filepath.Join("testdata", "low.hex")); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.ELF != nil || cpu.PC != 0x1000 {
+		t.Errorf("ELF %v, PC 0x%x after loading low.hex, want no ELF file and its entry point", cpu.ELF, cpu.PC)
+	}
+	if got := cpu.Memory.Protections(); len(got) != 0 {
+		t.Errorf("protections %+v of the previous ELF file were kept", got)
+	}
+	if err := cpu.Memory.CheckAccess(0x1000, 4, ACCESS_STORE); err != nil {
+		t.Errorf("the segment of the previous ELF file is still protected: %v", err)
+	}
+	state := OK
+	for state == OK {
+		var err error
+		if state, err = cpu.ExecuteSingle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantRegisters(t, cpu, map[uint32]uint32{ARG_ZERO: 42, ARG_ONE: 43})
+
+	if err := cpu.LoadFile(filepath.Join("testdata", "program.srec")); err == nil {
+		t.Error("an image at 0x80000000 was loaded outside memory")
+	}
+}
@@ -17,9 +17,11 @@ func DecodeInstruction(inst uint32) (Instruction, error) {
 	case R:
 		return decodeRType(inst, opcode)
 	case S:
-		return decodeSType(inst)
+		return decodeSType(inst, opcode)
 	case U:
 		return decodeUType(inst, opcode)
+	case R4:
+		return decodeR4Type(inst, opcode)
 	default:
 		return Instruction{}, errors.New("unknown opcode")
 	}
@@ -73,6 +75,7 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 	var value RISCVInstruction
 	func3 := (inst >> 5) & 0b111
 	func7 := (inst >> 18) & 0b1111111
+	func6 := (inst >> 19) & 0b111111 // RV64 shifts take the low bit of func7 as the 6th bit of shamt
 	switch code {
 	case 0b1100111:
 		value = JALR
@@ -88,12 +91,30 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 		case 0x2:
 			value = LW
 
+		case 0x3:
+			value = LD
+
 		case 0x4:
 			value = LBU
 
 		case 0x5:
 			value = LHU
 
+		case 0x6:
+			value = LWU
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+
+	case 0b0000111:
+		switch func3 {
+		case 0x2:
+			value = FLW
+
+		case 0x3:
+			value = FLD
+
 		default:
 			return Instruction{}, errors.New("unknown function")
 		}
@@ -104,6 +125,9 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 			value = ADDI
 
 		case 0x1:
+			if func6 != 0x00 {
+				return Instruction{}, errors.New("unknown function")
+			}
 			value = SLLI
 
 		case 0x2:
@@ -116,11 +140,11 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 			value = XORI
 
 		case 0x5:
-			switch func7 {
+			switch func6 {
 			case 0x00:
 				value = SRLI
 
-			case 0x20:
+			case 0x10:
 				value = SRAI
 
 			default:
@@ -134,13 +158,73 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 		default:
 			return Instruction{}, errors.New("unknown function")
 		}
-	case 0b1110011:
-		switch (inst >> 13) & 0xFFF {
+	case 0b0011011:
+		switch func3 {
+		case 0x0:
+			value = ADDIW
+
 		case 0x1:
-			value = EBREAK
+			if func7 != 0x00 {
+				return Instruction{}, errors.New("unknown function")
+			}
+			value = SLLIW
+
+		case 0x5:
+			switch func7 {
+			case 0x00:
+				value = SRLIW
+
+			case 0x20:
+				value = SRAIW
 
+			default:
+				return Instruction{}, errors.New("unknown function")
+			}
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0b1110011:
+		switch func3 {
 		case 0x0:
-			value = ECALL
+			switch (inst >> 13) & 0xFFF {
+			case 0x1:
+				value = EBREAK
+
+			case 0x0:
+				value = ECALL
+
+			case 0x102:
+				value = SRET
+
+			case 0x105:
+				value = WFI
+
+			case 0x302:
+				value = MRET
+
+			default:
+				if (inst>>18)&0x7F != 0b0001001 {
+					return Instruction{}, errors.New("unknown function")
+				}
+				value = SFENCE_VMA // rs2 is kept in the low bits of operand2
+			}
+		case 0x1:
+			value = CSRRW
+
+		case 0x2:
+			value = CSRRS
+
+		case 0x3:
+			value = CSRRC
+
+		case 0x5:
+			value = CSRRWI
+
+		case 0x6:
+			value = CSRRSI
+
+		case 0x7:
+			value = CSRRCI
 
 		default:
 			return Instruction{}, errors.New("unknown function")
@@ -158,8 +242,14 @@ func decodeIType(inst uint32, code OpCode) (Instruction, error) {
 
 	switch value {
 	case SLLI, SRLI, SRAI:
+		result.operand2 = result.operand2 & 0x3F // shamt values above 31 are only legal on RV64
+
+	case SLLIW, SRLIW, SRAIW:
 		result.operand2 = result.operand2 & 0x1F
 
+	case CSRRW, CSRRS, CSRRC, CSRRWI, CSRRSI, CSRRCI:
+		result.operand2 = result.operand2 & 0xFFF // CSR addresses are not sign extended
+
 	default:
 	}
 
@@ -184,9 +274,21 @@ func decodeJType(inst uint32) (Instruction, error) {
 
 func decodeRType(inst uint32, code OpCode) (Instruction, error) {
 	if code == 0 {
-		return Instruction{NOP, 0, 0, 0}, nil
+		return Instruction{value: NOP}, nil
+	}
+	if code == 0b0101111 {
+		return decodeAExtension(inst)
+	}
+	if code == 0b1010011 {
+		return decodeFloatOp(inst)
 	}
 	var func7 = (inst >> 18) & 0b1111111
+	if code == 0b0111011 {
+		return decodeRType32(inst, func7)
+	}
+	if func7 == 0x01 {
+		return decodeMExtension(inst)
+	}
 	var value RISCVInstruction
 	switch (inst >> 5) & 0b111 {
 	case 0x0:
@@ -257,25 +359,91 @@ func decodeRType(inst uint32, code OpCode) (Instruction, error) {
 	}, nil
 }
 
-func decodeSType(inst uint32) (Instruction, error) {
+// decodeRType32 decodes the RV64 register-register instructions operating on 32-bit words (OP-32).
+func decodeRType32(inst uint32, func7 uint32) (Instruction, error) {
 	var value RISCVInstruction
-	switch (inst >> 5) & 0b111 {
-	case 0x0:
-		value = SB
+	switch func7<<3 | (inst>>5)&0b111 {
+	case 0x00<<3 | 0x0:
+		value = ADDW
 
-	case 0x1:
-		value = SH
+	case 0x20<<3 | 0x0:
+		value = SUBW
 
-	case 0x2:
-		value = SW
+	case 0x00<<3 | 0x1:
+		value = SLLW
+
+	case 0x00<<3 | 0x5:
+		value = SRLW
+
+	case 0x20<<3 | 0x5:
+		value = SRAW
+
+	case 0x01<<3 | 0x0:
+		value = MULW
+
+	case 0x01<<3 | 0x4:
+		value = DIVW
+
+	case 0x01<<3 | 0x5:
+		value = DIVUW
+
+	case 0x01<<3 | 0x6:
+		value = REMW
+
+	case 0x01<<3 | 0x7:
+		value = REMUW
 
 	default:
 		return Instruction{}, errors.New("unknown function")
 	}
 
+	return Instruction{
+		value:    value,
+		operand0: inst & 0b11111,
+		operand1: (inst >> 8) & 0b11111,
+		operand2: (inst >> 13) & 0b11111,
+	}, nil
+}
+
+func decodeSType(inst uint32, code OpCode) (Instruction, error) {
+	var value RISCVInstruction
+	switch code {
+	case 0b0100011:
+		switch (inst >> 5) & 0b111 {
+		case 0x0:
+			value = SB
+
+		case 0x1:
+			value = SH
+
+		case 0x2:
+			value = SW
+
+		case 0x3:
+			value = SD
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0b0100111:
+		switch (inst >> 5) & 0b111 {
+		case 0x2:
+			value = FSW
+
+		case 0x3:
+			value = FSD
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	default:
+		return Instruction{}, errors.New("unknown opcode")
+	}
+
 	imm := (inst >> 18) & 0b1111111
 	imm <<= 5
 	imm |= inst & 0b11111
+	imm = uint32(int32(imm<<20) >> 20) // sign extend trick
 
 	return Instruction{
 		value:    value,
@@ -301,3 +469,297 @@ func decodeUType(inst uint32, code OpCode) (Instruction, error) {
 		operand2: 0,
 	}, nil
 }
+
+// decodeMExtension decodes the RV32M multiply/divide instructions (R-type, func7 = 0x01).
+func decodeMExtension(inst uint32) (Instruction, error) {
+	var value RISCVInstruction
+	switch (inst >> 5) & 0b111 {
+	case 0x0:
+		value = MUL
+
+	case 0x1:
+		value = MULH
+
+	case 0x2:
+		value = MULHSU
+
+	case 0x3:
+		value = MULHU
+
+	case 0x4:
+		value = DIV
+
+	case 0x5:
+		value = DIVU
+
+	case 0x6:
+		value = REM
+
+	case 0x7:
+		value = REMU
+
+	}
+
+	return Instruction{
+		value:    value,
+		operand0: inst & 0b11111,
+		operand1: (inst >> 8) & 0b11111,
+		operand2: (inst >> 13) & 0b11111,
+	}, nil
+}
+
+// decodeAExtension decodes the RV32A atomic instructions (opcode 0b0101111).
+// The aq/rl ordering bits are ignored as memory accesses are performed in program order.
+func decodeAExtension(inst uint32) (Instruction, error) {
+	if (inst>>5)&0b111 != 0x2 {
+		return Instruction{}, errors.New("unknown function")
+	}
+	var value RISCVInstruction
+	switch (inst >> 20) & 0b11111 {
+	case 0b00010:
+		if (inst>>13)&0b11111 != 0 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = LR_W
+
+	case 0b00011:
+		value = SC_W
+
+	case 0b00001:
+		value = AMOSWAP_W
+
+	case 0b00000:
+		value = AMOADD_W
+
+	case 0b00100:
+		value = AMOXOR_W
+
+	case 0b01100:
+		value = AMOAND_W
+
+	case 0b01000:
+		value = AMOOR_W
+
+	case 0b10000:
+		value = AMOMIN_W
+
+	case 0b10100:
+		value = AMOMAX_W
+
+	case 0b11000:
+		value = AMOMINU_W
+
+	case 0b11100:
+		value = AMOMAXU_W
+
+	default:
+		return Instruction{}, errors.New("unknown function")
+	}
+
+	return Instruction{
+		value:    value,
+		operand0: inst & 0b11111,
+		operand1: (inst >> 8) & 0b11111,
+		operand2: (inst >> 13) & 0b11111,
+	}, nil
+}
+
+// decodeR4Type decodes the fused multiply-add instructions, which carry a third source register (rs3).
+func decodeR4Type(inst uint32, code OpCode) (Instruction, error) {
+	var value RISCVInstruction
+	double := (inst>>18)&0b11 == 0x1
+	if (inst>>18)&0b11 > 0x1 {
+		return Instruction{}, errors.New("unknown format")
+	}
+	switch code {
+	case 0b1000011:
+		value = FMADD_S
+
+	case 0b1000111:
+		value = FMSUB_S
+
+	case 0b1001011:
+		value = FNMSUB_S
+
+	case 0b1001111:
+		value = FNMADD_S
+
+	default:
+		return Instruction{}, errors.New("unknown opcode")
+	}
+	if double {
+		value += FMADD_D - FMADD_S
+	}
+	rm := (inst >> 5) & 0b111
+	if !isValidRoundingMode(rm) {
+		return Instruction{}, errors.New("invalid rounding mode")
+	}
+
+	return Instruction{
+		value:    value,
+		operand0: inst & 0b11111,
+		operand1: (inst >> 8) & 0b11111,
+		operand2: (inst >> 13) & 0b11111,
+		operand3: (inst >> 20) & 0b11111,
+		rm:       rm,
+	}, nil
+}
+
+// decodeFloatOp decodes the OP-FP instructions of the F and D extensions (opcode 0b1010011).
+func decodeFloatOp(inst uint32) (Instruction, error) {
+	var value RISCVInstruction
+	func3 := (inst >> 5) & 0b111
+	func7 := (inst >> 18) & 0b1111111
+	rs2 := (inst >> 13) & 0b11111
+	usesRoundingMode := false
+	switch func7 {
+	case 0x00, 0x01:
+		value = FADD_S
+		usesRoundingMode = true
+
+	case 0x04, 0x05:
+		value = FSUB_S
+		usesRoundingMode = true
+
+	case 0x08, 0x09:
+		value = FMUL_S
+		usesRoundingMode = true
+
+	case 0x0C, 0x0D:
+		value = FDIV_S
+		usesRoundingMode = true
+
+	case 0x2C, 0x2D:
+		if rs2 != 0 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = FSQRT_S
+		usesRoundingMode = true
+
+	case 0x10, 0x11:
+		switch func3 {
+		case 0x0:
+			value = FSGNJ_S
+
+		case 0x1:
+			value = FSGNJN_S
+
+		case 0x2:
+			value = FSGNJX_S
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0x14, 0x15:
+		switch func3 {
+		case 0x0:
+			value = FMIN_S
+
+		case 0x1:
+			value = FMAX_S
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0x50, 0x51:
+		switch func3 {
+		case 0x0:
+			value = FLE_S
+
+		case 0x1:
+			value = FLT_S
+
+		case 0x2:
+			value = FEQ_S
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0x60, 0x61:
+		switch rs2 {
+		case 0x0:
+			value = FCVT_W_S
+
+		case 0x1:
+			value = FCVT_WU_S
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+		usesRoundingMode = true
+
+	case 0x68, 0x69:
+		switch rs2 {
+		case 0x0:
+			value = FCVT_S_W
+
+		case 0x1:
+			value = FCVT_S_WU
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+		usesRoundingMode = true
+
+	case 0x20:
+		if rs2 != 0x1 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = FCVT_S_D
+		usesRoundingMode = true
+
+	case 0x21:
+		if rs2 != 0x0 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = FCVT_D_S
+		usesRoundingMode = true
+
+	case 0x70:
+		switch {
+		case func3 == 0x0 && rs2 == 0:
+			value = FMV_X_W
+
+		case func3 == 0x1 && rs2 == 0:
+			value = FCLASS_S
+
+		default:
+			return Instruction{}, errors.New("unknown function")
+		}
+	case 0x71:
+		if func3 != 0x1 || rs2 != 0 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = FCLASS_D
+
+	case 0x78:
+		if func3 != 0x0 || rs2 != 0 {
+			return Instruction{}, errors.New("unknown function")
+		}
+		value = FMV_W_X
+
+	default:
+		return Instruction{}, errors.New("unknown function")
+	}
+
+	// Odd func7 values select the double-precision variant of the single-precision instructions above.
+	if func7&0x1 == 0x1 && value >= FMADD_S && value < FMADD_D {
+		value += FMADD_D - FMADD_S
+	}
+	if usesRoundingMode && !isValidRoundingMode(func3) {
+		return Instruction{}, errors.New("invalid rounding mode")
+	}
+
+	return Instruction{
+		value:    value,
+		operand0: inst & 0b11111,
+		operand1: (inst >> 8) & 0b11111,
+		operand2: rs2,
+		rm:       func3,
+	}, nil
+}
+
+// isValidRoundingMode reports whether rm is a rounding mode the instruction encoding may carry.
+func isValidRoundingMode(rm uint32) bool {
+	return rm <= ROUND_NEAREST_MAX || rm == ROUND_DYNAMIC
+}
@@ -2,95 +2,284 @@ package core
 
 import (
 	"fmt"
+	"sync"
 )
 
+// MemoryRegion is a block of RAM or ROM in the physical address space.
+type MemoryRegion struct {
+	Base     uint32
+	Size     uint32
+	ReadOnly bool // ROM: programs cannot write to it, loaders such as CopyToMemory can
+}
+
+// MemoryConfig lists the regions backing a Memory. Regions cannot overlap.
+type MemoryConfig struct {
+	Regions []MemoryRegion
+	// Sparse backs every address that is neither in a region nor claimed by a device
+	// with pages allocated on first write, covering the whole address space.
+	Sparse bool
+}
+
+// DefaultMemoryConfig is the historical layout: 1MB of RAM at address 0.
+func DefaultMemoryConfig() MemoryConfig {
+	return MemoryConfig{Regions: []MemoryRegion{{Base: 0, Size: 1048576}}}
+}
+
+// memoryBlock is a region along with its backing storage.
+type memoryBlock struct {
+	MemoryRegion
+	ram *RAM
+}
+
 type Memory struct {
-	mem []byte
+	blocks []memoryBlock
+	sparse *SparseStore // nil unless MemoryConfig.Sparse is set
+
+	// Bus maps the memory regions along with any device attached to it.
+	// Accesses outside the memory regions are dispatched to the bus.
+	Bus *Bus
+
+	// protections restrict the accesses programs make to the loaded segments, see Protect.
+	protections protections
+	// IgnorePermissions disables the segment permissions, e.g. to experiment with self-modifying code.
+	IgnorePermissions bool
+
+	// reservations holds the address reserved by LR.W for every hart, keyed by hart ID.
+	// Any store overlapping a reserved word breaks the reservation.
+	reservations map[uint32]uint32
+	lock         sync.Mutex
 }
 
 func NewMemory() *Memory {
-	return &Memory{
-		mem: make([]byte, 1048576), //1MB
+	m, _ := NewMemoryWithConfig(DefaultMemoryConfig())
+	return m
+}
+
+// NewSparseMemory creates a memory spanning the whole 4GiB address space,
+// only allocating the 4KiB pages that are written to.
+func NewSparseMemory() *Memory {
+	m, _ := NewMemoryWithConfig(MemoryConfig{Sparse: true})
+	return m
+}
+
+// NewMemoryWithConfig creates a memory made of the given RAM and ROM regions.
+// A typical RISC-V board places its RAM at 0x80000000.
+func NewMemoryWithConfig(config MemoryConfig) (*Memory, error) {
+	m := &Memory{
+		Bus:          NewBus(),
+		reservations: make(map[uint32]uint32),
+	}
+	for _, region := range config.Regions {
+		ram := &RAM{Data: make([]byte, region.Size), ReadOnly: region.ReadOnly}
+		err := m.Bus.Attach(region.Base, region.Size, ram)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory configuration: %w", err)
+		}
+		m.blocks = append(m.blocks, memoryBlock{MemoryRegion: region, ram: ram})
 	}
+	if config.Sparse {
+		m.sparse = NewSparseStore()
+	}
+	return m, nil
 }
-func (m *Memory) ReadSingleByte(addr uint32) (uint32, error) {
-	if uint32(len(m.mem))-1 < addr {
-		return 0, fmt.Errorf("read single byte out of range at addr=%d", addr)
+
+// Sparse returns the sparse store backing unclaimed addresses, or nil if the memory is not sparse.
+func (m *Memory) Sparse() *SparseStore {
+	return m.sparse
+}
+
+// Regions returns the RAM and ROM regions of the memory.
+func (m *Memory) Regions() []MemoryRegion {
+	regions := make([]MemoryRegion, len(m.blocks))
+	for i, block := range m.blocks {
+		regions[i] = block.MemoryRegion
 	}
-	return uint32(m.mem[addr]), nil
+	return regions
 }
 
-func (m *Memory) ReadByte(addr uint32) (byte, error) {
-	if uint32(len(m.mem))-1 < addr {
-		return 0, fmt.Errorf("read byte out of range at addr=%d", addr)
+// find returns the bytes backing size bytes at addr, or nil when they are not in a memory region.
+func (m *Memory) find(addr uint32, size uint32) ([]byte, *memoryBlock) {
+	for i := range m.blocks {
+		block := &m.blocks[i]
+		if addr >= block.Base && uint64(addr-block.Base)+uint64(size) <= uint64(block.Size) {
+			return block.ram.Data[addr-block.Base : addr-block.Base+size], block
+		}
 	}
-	return m.mem[addr], nil
+	return nil, nil
 }
 
-func (m *Memory) WriteSingleByte(addr uint32, val uint32) error {
-	if uint32(len(m.mem))-1 < addr {
-		return fmt.Errorf("write single byte out of range at addr=%d", addr)
+// writable returns the bytes backing size bytes at addr for a store,
+// or nil when the store must go to the bus. Stores to ROM fail.
+func (m *Memory) writable(addr uint32, size uint32) ([]byte, error) {
+	data, block := m.find(addr, size)
+	if block != nil && block.ReadOnly {
+		return nil, fmt.Errorf("write to read-only memory at addr=%d", addr)
 	}
-	m.mem[addr] = byte(val)
-	return nil
+	return data, nil
 }
 
-func (m *Memory) WriteByte(addr uint32, val byte) error {
-	if uint32(len(m.mem))-1 < addr {
-		return fmt.Errorf("write byte out of range at addr=%d", addr)
+// outside returns where accesses outside the memory regions go: the device claiming addr
+// on the bus, or the sparse store. It returns nil if addr is unmapped.
+func (m *Memory) outside(addr uint32) Device {
+	if m.Bus != nil {
+		if _, ok := m.Bus.Find(addr); ok || m.sparse == nil {
+			return m.Bus
+		}
+	}
+	if m.sparse != nil {
+		return m.sparse
 	}
-	m.mem[addr] = val
 	return nil
 }
 
+// load reads from a device or the sparse store when addr is outside the memory regions.
+func (m *Memory) load(addr uint32, size uint32) (uint32, error) {
+	target := m.outside(addr)
+	if target == nil {
+		return 0, fmt.Errorf("read of %d bytes out of range at addr=%d", size, addr)
+	}
+	return target.Load(addr, size)
+}
+
+// store writes to a device or the sparse store when addr is outside the memory regions.
+func (m *Memory) store(addr uint32, size uint32, val uint32) error {
+	target := m.outside(addr)
+	if target == nil {
+		return fmt.Errorf("write of %d bytes out of range at addr=%d", size, addr)
+	}
+	return target.Store(addr, size, val)
+}
+
+func (m *Memory) ReadSingleByte(addr uint32) (uint32, error) {
+	data, _ := m.find(addr, 1)
+	if data == nil {
+		return m.load(addr, 1)
+	}
+	return uint32(data[0]), nil
+}
+
+func (m *Memory) ReadByte(addr uint32) (byte, error) {
+	val, err := m.ReadSingleByte(addr)
+	return byte(val), err
+}
+
+func (m *Memory) WriteSingleByte(addr uint32, val uint32) error {
+	return m.write(addr, 1, val)
+}
+
+func (m *Memory) WriteByte(addr uint32, val byte) error {
+	return m.WriteSingleByte(addr, uint32(val))
+}
+
 func (m *Memory) ReadHalfWord(addr uint32) (uint32, error) {
-	if uint32(len(m.mem)) < addr {
-		return 0, fmt.Errorf("read half-word out of range at addr=%d", addr)
+	data, _ := m.find(addr, 2)
+	if data == nil {
+		return m.load(addr, 2)
 	}
-	return uint32(m.mem[addr]) | uint32(m.mem[addr+1])<<8, nil
+	return uint32(data[0]) | uint32(data[1])<<8, nil
 }
 
 func (m *Memory) WriteHalfWord(addr uint32, val uint32) error {
-	if uint32(len(m.mem)) < addr {
-		return fmt.Errorf("write half-word out of range at addr=%d", addr)
-	}
-	m.mem[addr] = byte(val)
-	m.mem[addr+1] = byte(val >> 8)
-	return nil
+	return m.write(addr, 2, val)
 }
 
 func (m *Memory) ReadWord(addr uint32) (uint32, error) {
-	if uint32(len(m.mem)) < addr+2 {
-		return 0, fmt.Errorf("read word out of range at addr=%d", addr)
+	data, _ := m.find(addr, 4)
+	if data == nil {
+		return m.load(addr, 4)
 	}
-	return uint32(m.mem[addr]) | uint32(m.mem[addr+1])<<8 | uint32(m.mem[addr+2])<<16 | uint32(m.mem[addr+3])<<24, nil
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24, nil
 }
 
 func (m *Memory) WriteWord(addr uint32, val uint32) error {
-	if uint32(len(m.mem)) < addr+2 {
-		return fmt.Errorf("write word out of range at addr=%d", addr)
+	return m.write(addr, 4, val)
+}
+
+// write stores size bytes of val at addr. The overlapping reservations are broken under m.lock
+// along with the store, so no LR.W of another hart can reserve the address in between.
+func (m *Memory) write(addr uint32, size uint32, val uint32) error {
+	if m.onBus(addr, size) {
+		m.invalidateReservations(addr, size)
+		return m.Bus.Store(addr, size, val)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.storeLocked(addr, size, val)
+}
+
+// LoadBytes copies data into memory at addr, including into ROM regions.
+// It is meant for loaders and fails if any byte is outside the memory regions,
+// unless the memory is sparse.
+func (m *Memory) LoadBytes(addr uint32, data []byte) error {
+	m.invalidateReservations(addr, uint32(len(data)))
+	for len(data) > 0 {
+		_, block := m.find(addr, 1)
+		if block == nil && m.sparse != nil && m.outside(addr) == Device(m.sparse) {
+			n := min(uint32(len(data)), PAGE_SIZE-addr%PAGE_SIZE)
+			m.sparse.LoadBytes(addr, data[:n])
+			data = data[n:]
+			addr += n
+			continue
+		}
+		if block == nil {
+			return fmt.Errorf("load out of range at addr=%d", addr)
+		}
+		n := copy(block.ram.Data[addr-block.Base:], data)
+		data = data[n:]
+		addr += uint32(n)
 	}
-	m.mem[addr] = byte(val)
-	m.mem[addr+1] = byte(val >> 8)
-	m.mem[addr+2] = byte(val >> 16)
-	m.mem[addr+3] = byte(val >> 24)
 	return nil
 }
 
-func (m *Memory) ReadString(addr uint32) (string, error) {
-	maxInRange := 256
-	if uint32(len(m.mem)) < addr+255 {
-		maxInRange = int(uint32(len(m.mem)) - addr)
-		if maxInRange <= 0 {
-			return "", fmt.Errorf("read string out of range at addr=%d", addr)
+// ZeroBytes clears size bytes at addr with the same rules as LoadBytes.
+func (m *Memory) ZeroBytes(addr uint32, size uint32) error {
+	zeros := make([]byte, min(size, PAGE_SIZE))
+	for size > 0 {
+		n := min(size, PAGE_SIZE)
+		err := m.LoadBytes(addr, zeros[:n])
+		if err != nil {
+			return err
+		}
+		addr += n
+		size -= n
+	}
+	return nil
+}
+
+// Loadable reports whether LoadBytes can write size bytes at addr.
+func (m *Memory) Loadable(addr uint32, size uint32) bool {
+	for size > 0 {
+		_, block := m.find(addr, 1)
+		if block != nil {
+			n := uint64(block.Size) - uint64(addr-block.Base)
+			if n >= uint64(size) {
+				return true
+			}
+			addr += uint32(n)
+			size -= uint32(n)
+			continue
 		}
+		if m.sparse == nil || m.outside(addr) != Device(m.sparse) {
+			return false
+		}
+		n := min(size, PAGE_SIZE-addr%PAGE_SIZE)
+		addr += n
+		size -= n
 	}
+	return true
+}
 
-	strbytes := make([]byte, 0, maxInRange)
-	for i := 0; i < maxInRange; i++ {
+// ReadString reads a null-terminated string of at most 256 bytes.
+// The string stops early at the end of the mapped memory.
+func (m *Memory) ReadString(addr uint32) (string, error) {
+	strbytes := make([]byte, 0, 256)
+	for i := 0; i < 256; i++ {
 		b, err := m.ReadByte(addr + uint32(i))
 		if err != nil {
-			return string(strbytes), fmt.Errorf("read string error at index %d: %w", i, err)
+			if i == 0 {
+				return "", fmt.Errorf("read string out of range at addr=%d", addr)
+			}
+			break
 		}
 		if b == 0 { // Null terminator, string is fully read
 			break
@@ -100,3 +289,131 @@ func (m *Memory) ReadString(addr uint32) (string, error) {
 
 	return string(strbytes), nil
 }
+
+// LoadReserved reads the word at addr and registers a reservation on it for the given hart (LR.W).
+func (m *Memory) LoadReserved(hart uint32, addr uint32) (uint32, error) {
+	if addr%4 != 0 {
+		return 0, fmt.Errorf("load-reserved misaligned at addr=%d", addr)
+	}
+	if m.onBus(addr, 4) {
+		val, err := m.Bus.Load(addr, 4)
+		if err != nil {
+			return 0, err
+		}
+		m.lock.Lock()
+		m.reserve(hart, addr)
+		m.lock.Unlock()
+		return val, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	val, err := m.ReadWord(addr)
+	if err != nil {
+		return 0, err
+	}
+	m.reserve(hart, addr)
+	return val, nil
+}
+
+// reserve registers a reservation on addr for the given hart, the caller must hold m.lock.
+func (m *Memory) reserve(hart uint32, addr uint32) {
+	if m.reservations == nil {
+		m.reservations = make(map[uint32]uint32)
+	}
+	m.reservations[hart] = addr
+}
+
+// StoreConditional writes val at addr if the hart still holds a reservation on it (SC.W).
+// The hart's reservation is always released. Returns true if the store was performed.
+func (m *Memory) StoreConditional(hart uint32, addr uint32, val uint32) (bool, error) {
+	if addr%4 != 0 {
+		return false, fmt.Errorf("store-conditional misaligned at addr=%d", addr)
+	}
+	m.lock.Lock()
+	reserved, ok := m.reservations[hart]
+	delete(m.reservations, hart)
+	if !ok || reserved != addr {
+		m.lock.Unlock()
+		return false, nil
+	}
+	if m.onBus(addr, 4) {
+		m.breakReservations(addr, 4)
+		m.lock.Unlock()
+		err := m.Bus.Store(addr, 4, val)
+		return err == nil, err
+	}
+	err := m.storeLocked(addr, 4, val)
+	m.lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AtomicModifyWord atomically replaces the word at addr with op(old) and returns the old value (AMO*.W).
+// On devices the read and the write are two separate accesses.
+func (m *Memory) AtomicModifyWord(addr uint32, op func(old uint32) uint32) (uint32, error) {
+	if addr%4 != 0 {
+		return 0, fmt.Errorf("atomic memory operation misaligned at addr=%d", addr)
+	}
+	if m.onBus(addr, 4) {
+		old, err := m.Bus.Load(addr, 4)
+		if err != nil {
+			return 0, err
+		}
+		m.invalidateReservations(addr, 4)
+		return old, m.Bus.Store(addr, 4, op(old))
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, err := m.ReadWord(addr)
+	if err != nil {
+		return 0, err
+	}
+	err = m.storeLocked(addr, 4, op(old))
+	if err != nil {
+		return 0, err
+	}
+	return old, nil
+}
+
+// onBus reports whether an access goes to a device attached to the bus rather than to RAM,
+// ROM or the sparse store. m.lock is never held while a device runs, since a device may
+// access the memory itself.
+func (m *Memory) onBus(addr uint32, size uint32) bool {
+	data, _ := m.find(addr, size)
+	return data == nil && m.Bus != nil && m.outside(addr) == Device(m.Bus)
+}
+
+// storeLocked writes size bytes to RAM or the sparse store and breaks overlapping reservations,
+// the caller must hold m.lock.
+func (m *Memory) storeLocked(addr uint32, size uint32, val uint32) error {
+	m.breakReservations(addr, size)
+	data, err := m.writable(addr, size)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return m.store(addr, size, val)
+	}
+	for i := range data {
+		data[i] = byte(val >> (8 * i))
+	}
+	return nil
+}
+
+// invalidateReservations breaks every reservation overlapping the size bytes written at addr.
+func (m *Memory) invalidateReservations(addr uint32, size uint32) {
+	m.lock.Lock()
+	m.breakReservations(addr, size)
+	m.lock.Unlock()
+}
+
+// breakReservations is invalidateReservations for callers already holding m.lock.
+func (m *Memory) breakReservations(addr uint32, size uint32) {
+	for hart, reserved := range m.reservations {
+		if addr < reserved+4 && reserved < addr+size {
+			delete(m.reservations, hart)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemoryBounds(t *testing.T) {
+	m := NewMemory()
+	const end = 1048576
+	tests := []struct {
+		name    string
+		access  func() error
+		wantErr bool
+	}{
+		{"last half-word", func() error { _, err := m.ReadHalfWord(end - 2); return err }, false},
+		{"half-word across the end", func() error { _, err := m.ReadHalfWord(end - 1); return err }, true},
+		{"last word", func() error { _, err := m.ReadWord(end - 4); return err }, false},
+		{"word across the end", func() error { _, err := m.ReadWord(end - 2); return err }, true},
+		{"word past the end", func() error { _, err := m.ReadWord(end); return err }, true},
+		{"word at the top of the address space", func() error { _, err := m.ReadWord(0xFFFFFFFE); return err }, true},
+		{"write half-word across the end", func() error { return m.WriteHalfWord(end-1, 0) }, true},
+		{"write word across the end", func() error { return m.WriteWord(end-3, 0) }, true},
+		{"write last word", func() error { return m.WriteWord(end-4, 0) }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.access()
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestReservations(t *testing.T) {
+	tests := []struct {
+		name   string
+		before func(m *Memory)
+		hart   uint32
+		want   bool
+	}{
+		{"held", func(m *Memory) {}, 0, true},
+		{"other hart", func(m *Memory) {}, 1, false},
+		{"overlapping byte store", func(m *Memory) { m.WriteSingleByte(0x103, 1) }, 0, false},
+		{"overlapping half-word store", func(m *Memory) { m.WriteHalfWord(0x0FF, 1) }, 0, false},
+		{"adjacent word store", func(m *Memory) { m.WriteWord(0x104, 1) }, 0, true},
+		{"atomic operation", func(m *Memory) {
+			m.AtomicModifyWord(0x100, func(old uint32) uint32 { return old })
+		}, 0, false},
+		{"other hart's store-conditional", func(m *Memory) {
+			m.LoadReserved(1, 0x100)
+			m.StoreConditional(1, 0x100, 9)
+		}, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMemory()
+			if _, err := m.LoadReserved(0, 0x100); err != nil {
+				t.Fatal(err)
+			}
+			test.before(m)
+			stored, err := m.StoreConditional(test.hart, 0x100, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != test.want {
+				t.Errorf("stored = %v, want %v", stored, test.want)
+			}
+		})
+	}
+}
+
+// TestReservationsConcurrentStores increments the low byte of a word with LR.W/SC.W while another
+// goroutine writes its high half-word. A store-conditional succeeding over such a store would undo it.
+func TestReservationsConcurrentStores(t *testing.T) {
+	m := NewMemory()
+	const N = 2000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= N; i++ {
+			m.WriteSingleByte(0x102, uint32(i))
+			m.WriteHalfWord(0x102, uint32(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < N; {
+			old, err := m.LoadReserved(0, 0x100)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if stored, _ := m.StoreConditional(0, 0x100, old&^0xFF|(old+1)&0xFF); stored {
+				i++
+			}
+		}
+	}()
+	wg.Wait()
+	if word, _ := m.ReadWord(0x100); word != N<<16|N&0xFF {
+		t.Errorf("word = 0x%08x, want the last half-word 0x%04x and %d increments", word, N, N&0xFF)
+	}
+}
+
+func TestMemoryConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		regions []MemoryRegion
+		wantErr bool
+	}{
+		{"RAM at 0x80000000", []MemoryRegion{{Base: 0x80000000, Size: 0x10000}}, false},
+		{"ROM and RAM", []MemoryRegion{{Base: 0x1000, Size: 0x1000, ReadOnly: true}, {Base: 0x80000000, Size: 0x1000}}, false},
+		{"region at the top of the address space", []MemoryRegion{{Base: 0xFFFF0000, Size: 0x10000}}, false},
+		{"overlapping regions", []MemoryRegion{{Base: 0x1000, Size: 0x2000}, {Base: 0x2000, Size: 0x1000}}, true},
+		{"region past the top of the address space", []MemoryRegion{{Base: 0xFFFF0000, Size: 0x20000}}, true},
+		{"empty region", []MemoryRegion{{Base: 0x1000}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMemoryWithConfig(MemoryConfig{Regions: test.regions})
+			if test.wantErr {
+				if err == nil {
+					t.Error("the configuration was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Regions(); len(got) != len(test.regions) {
+				t.Errorf("memory has %d regions, want %d", len(got), len(test.regions))
+			}
+		})
+	}
+}
+
+func TestMemoryRegions(t *testing.T) {
+	m, err := NewMemoryWithConfig(MemoryConfig{Regions: []MemoryRegion{
+		{Base: 0x1000, Size: 0x1000, ReadOnly: true},
+		{Base: 0x80000000, Size: 0x1000},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadBytes(0x1000, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("loading ROM failed: %v", err)
+	}
+	tests := []struct {
+		name    string
+		access  func() error
+		wantErr bool
+	}{
+		{"write RAM", func() error { return m.WriteWord(0x80000FFC, 0x12345678) }, false},
+		{"read RAM", func() error {
+			val, err := m.ReadWord(0x80000FFC)
+			if err == nil && val != 0x12345678 {
+				t.Errorf("read 0x%x, want 0x12345678", val)
+			}
+			return err
+		}, false},
+		{"read ROM", func() error {
+			val, err := m.ReadWord(0x1000)
+			if err == nil && val != 0x04030201 {
+				t.Errorf("read 0x%x, want 0x04030201", val)
+			}
+			return err
+		}, false},
+		{"write ROM", func() error { return m.WriteWord(0x1000, 0) }, true},
+		{"byte write to ROM", func() error { return m.WriteSingleByte(0x1FFF, 0) }, true},
+		{"read below RAM", func() error { _, err := m.ReadWord(0x7FFFFFFC); return err }, true},
+		{"read past RAM", func() error { _, err := m.ReadSingleByte(0x80001000); return err }, true},
+		{"read between regions", func() error { _, err := m.ReadWord(0x2000); return err }, true},
+		{"write at address 0", func() error { return m.WriteWord(0, 0) }, true},
+		{"load across the end of RAM", func() error { return m.LoadBytes(0x80000FFE, []byte{1, 2, 3, 4}) }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.access()
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package core
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 )
 
 const (
@@ -13,264 +18,569 @@ const (
 	FCHDIR   = 50
 	OPENAT   = 56
 	CLOSE    = 57
+	LSEEK    = 62 // lseek(fd, offset, whence) of newlib and libgloss, not the _llseek of RV32 Linux
 	READ     = 63
 	WRITE    = 64
+	PREAD64  = 67
+	PWRITE64 = 68
 	EXIT     = 93
 )
 
 const AT_FDCWD = -100
 
+const (
+	// MAX_TRANSFER is the largest number of bytes one read or write request moves between the program
+	// and the host. Larger requests complete partially and return a short count.
+	MAX_TRANSFER = 64 << 10
+	// PATH_MAX is the longest path accepted from the program, including the null byte.
+	PATH_MAX = 4096
+)
+
+// Linux errno values. A failed syscall returns -errno in a0.
+const (
+	EPERM        = 1
+	ENOENT       = 2
+	EIO          = 5
+	EBADF        = 9
+	EAGAIN       = 11
+	ENOMEM       = 12
+	EACCES       = 13
+	EFAULT       = 14
+	EBUSY        = 16
+	EEXIST       = 17
+	EXDEV        = 18
+	ENOTDIR      = 20
+	EISDIR       = 21
+	EINVAL       = 22
+	EMFILE       = 24
+	EFBIG        = 27
+	ENOSPC       = 28
+	ESPIPE       = 29
+	EROFS        = 30
+	EPIPE        = 32
+	ERANGE       = 34
+	ENAMETOOLONG = 36
+	ENOSYS       = 38
+	ENOTEMPTY    = 39
+	ELOOP        = 40
+	EOVERFLOW    = 75
+)
+
+// linuxErrno translates the errno values of the host, which differ between operating systems, to those of Linux.
+var linuxErrno = map[syscall.Errno]uint32{
+	syscall.EPERM:        EPERM,
+	syscall.ENOENT:       ENOENT,
+	syscall.EIO:          EIO,
+	syscall.EBADF:        EBADF,
+	syscall.EAGAIN:       EAGAIN,
+	syscall.ENOMEM:       ENOMEM,
+	syscall.EACCES:       EACCES,
+	syscall.EFAULT:       EFAULT,
+	syscall.EBUSY:        EBUSY,
+	syscall.EEXIST:       EEXIST,
+	syscall.EXDEV:        EXDEV,
+	syscall.ENOTDIR:      ENOTDIR,
+	syscall.EISDIR:       EISDIR,
+	syscall.EINVAL:       EINVAL,
+	syscall.EMFILE:       EMFILE,
+	syscall.EFBIG:        EFBIG,
+	syscall.ENOSPC:       ENOSPC,
+	syscall.ESPIPE:       ESPIPE,
+	syscall.EROFS:        EROFS,
+	syscall.EPIPE:        EPIPE,
+	syscall.ERANGE:       ERANGE,
+	syscall.ENAMETOOLONG: ENAMETOOLONG,
+	syscall.ENOSYS:       ENOSYS,
+	syscall.ENOTEMPTY:    ENOTEMPTY,
+	syscall.ELOOP:        ELOOP,
+	syscall.EOVERFLOW:    EOVERFLOW,
+}
+
+// Flags of OPENAT, with their Linux values.
+const (
+	O_RDONLY  = 0x0
+	O_WRONLY  = 0x1
+	O_RDWR    = 0x2
+	O_ACCMODE = 0x3 // mask of the access mode
+	O_CREAT   = 0x40
+	O_EXCL    = 0x80
+	O_TRUNC   = 0x200
+	O_APPEND  = 0x400
+)
+
+// FileDescriptor is a file opened by the program. The offset of sequential reads and writes is kept by File.
+type FileDescriptor struct {
+	Path  string
+	File  *os.File
+	Flags uint32 // flags given to OPENAT, including the access mode
+
+	inherited bool // a standard stream of the emulator, which the kernel never closes
+}
+
+// MicroKernel emulates the Linux syscalls of a program: its working directory and file descriptors.
+// Every CPU created by NewCPU has its own, so several programs can run in parallel.
 type MicroKernel struct {
-	CWD             string
-	FileDescriptors []string
+	CWD string // host directory of the relative paths
+	// FileDescriptors is indexed by file descriptor, closed ones are nil. 0, 1 and 2 are the standard streams.
+	FileDescriptors []*FileDescriptor
+
+	lock sync.Mutex // serializes the syscalls of CPUs sharing the kernel, but not their host reads and writes
+}
+
+// NewMicroKernel creates a kernel with the standard streams open in the working directory of the emulator.
+func NewMicroKernel() *MicroKernel {
+	k := &MicroKernel{}
+	k.Init()
+	return k
 }
 
+// Init closes the files left open by a previous program and resets the kernel.
 func (k *MicroKernel) Init() {
-	k.CWD = "/"
-	k.FileDescriptors = []string{"stdin", "stdout", "stderr"}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.closeFiles()
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = "/"
+	}
+	k.CWD = cwd
+	k.FileDescriptors = []*FileDescriptor{
+		{Path: "stdin", File: os.Stdin, Flags: O_RDONLY, inherited: true},
+		{Path: "stdout", File: os.Stdout, Flags: O_WRONLY, inherited: true},
+		{Path: "stderr", File: os.Stderr, Flags: O_WRONLY, inherited: true},
+	}
 }
 
+// Close closes the files the program left open, the standard streams of the emulator excepted.
+func (k *MicroKernel) Close() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.closeFiles()
+}
+
+// closeFiles is Close for callers holding k.lock.
+func (k *MicroKernel) closeFiles() {
+	for _, f := range k.FileDescriptors {
+		if f != nil && !f.inherited {
+			f.File.Close()
+		}
+	}
+	k.FileDescriptors = nil
+}
+
+// Kernel is the kernel of the CPUs whose Kernel field is nil. It is initialized when the package
+// is loaded, and Kernel.Init closes the files a previous program left open.
+//
+// Deprecated: CPUs created by NewCPU have their own kernel in CPU.Kernel. Set CPU.Kernel to &Kernel,
+// or to any *MicroKernel, to share one between CPUs.
 var Kernel MicroKernel
 
-func IsValidFileDescriptor(fd int32) bool {
-	return !(fd < 3 || fd >= int32(len(Kernel.FileDescriptors)) || Kernel.FileDescriptors[fd] == "")
+func init() {
+	Kernel.Init()
 }
 
-func IsSpecialFileDescriptor(fd int32) bool {
-	return fd == 0 || fd == 1 || fd == 2
+// stream returns the host file of the standard stream fd, or nil when the program has none.
+func (k *MicroKernel) stream(fd int32) *os.File {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if f := k.file(fd); f != nil && IsSpecialFileDescriptor(fd) {
+		return f.File
+	}
+	return nil
 }
 
-func GetPath(path string, dirfd int32) string {
+// IsValidFileDescriptor reports whether fd is a file opened by the program.
+func (k *MicroKernel) IsValidFileDescriptor(fd int32) bool {
+	f := k.file(fd)
+	return f != nil && !f.inherited
+}
+
+// file returns the open file fd, including the standard streams, or nil.
+func (k *MicroKernel) file(fd int32) *FileDescriptor {
+	if fd < 0 || fd >= int32(len(k.FileDescriptors)) {
+		return nil
+	}
+	return k.FileDescriptors[fd]
+}
+
+// allocate stores f at the lowest free file descriptor, which may be a closed standard stream, and returns it.
+func (k *MicroKernel) allocate(f *FileDescriptor) int32 {
+	for fd := 0; fd < len(k.FileDescriptors); fd++ {
+		if k.FileDescriptors[fd] == nil {
+			k.FileDescriptors[fd] = f
+			return int32(fd)
+		}
+	}
+	k.FileDescriptors = append(k.FileDescriptors, f)
+	return int32(len(k.FileDescriptors) - 1)
+}
 
-	if path[0] != '.' {
+// GetPath returns the host path of path: absolute paths are kept, relative ones are joined to the working
+// directory for AT_FDCWD or to the directory opened as dirfd. It returns "" when dirfd is not open.
+func (k *MicroKernel) GetPath(path string, dirfd int32) string {
+	if path == "" || filepath.IsAbs(path) {
 		return path
 	}
 	if dirfd == AT_FDCWD {
-		return "./" + Kernel.CWD + path[1:]
+		return filepath.Join(k.CWD, path)
 	}
-	if !IsValidFileDescriptor(dirfd) {
+	if !k.IsValidFileDescriptor(dirfd) {
 		return ""
 	}
-	return Kernel.FileDescriptors[dirfd] + path[1:]
+	return filepath.Join(k.FileDescriptors[dirfd].Path, path)
 }
-func (c *CPU) HandleECALL() (int, error) {
-	a7, err := c.ReadRegister(ARG_SEVEN) // a7 contains the function we are trying to call
-	if err != nil {
-		return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+
+// hostPath returns the host path of a path relative to the working directory,
+// for the semihosting calls sharing the kernel.
+func (k *MicroKernel) hostPath(path string) string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.GetPath(path, AT_FDCWD)
+}
+
+// resolve returns the host path of a path relative to dirfd, or the errno of OPENAT and the like.
+func (k *MicroKernel) resolve(path string, dirfd int32) (string, uint32) {
+	if path == "" {
+		return "", ENOENT
 	}
-	switch a7 {
-	case GETCWD:
-		address, err := c.ReadRegister(ARG_ZERO) // Pointer to start of Buffer we write to
+	resolved := k.GetPath(path, dirfd)
+	if resolved == "" {
+		return "", EBADF
+	}
+	return resolved, 0
+}
+
+// openFlags translates the flags of OPENAT to those of os.OpenFile.
+func openFlags(flags uint32) int {
+	var mode int
+	switch flags & O_ACCMODE {
+	case O_WRONLY:
+		mode = os.O_WRONLY
+	case O_RDWR:
+		mode = os.O_RDWR
+	default:
+		mode = os.O_RDONLY
+	}
+	translations := [][2]int{{O_CREAT, os.O_CREATE}, {O_EXCL, os.O_EXCL}, {O_TRUNC, os.O_TRUNC}, {O_APPEND, os.O_APPEND}}
+	for _, t := range translations {
+		if flags&uint32(t[0]) != 0 {
+			mode |= t[1]
+		}
+	}
+	return mode
+}
+
+// readable reports whether the access mode of f allows reading.
+func (f *FileDescriptor) readable() bool {
+	return f.Flags&O_ACCMODE != O_WRONLY
+}
+
+// writable reports whether the access mode of f allows writing.
+func (f *FileDescriptor) writable() bool {
+	return f.Flags&O_ACCMODE != O_RDONLY
+}
+
+// IsValidFileDescriptor checks fd against the global Kernel.
+//
+// Deprecated: use the method of CPU.Kernel.
+func IsValidFileDescriptor(fd int32) bool {
+	return Kernel.IsValidFileDescriptor(fd)
+}
+
+func IsSpecialFileDescriptor(fd int32) bool {
+	return fd == 0 || fd == 1 || fd == 2
+}
+
+// GetPath resolves path against the global Kernel.
+//
+// Deprecated: use the method of CPU.Kernel.
+func GetPath(path string, dirfd int32) string {
+	return Kernel.GetPath(path, dirfd)
+}
+
+// kernel returns the kernel servicing the syscalls of the CPU: CPU.Kernel, or the deprecated
+// global Kernel for CPUs that were not created by NewCPU.
+func (c *CPU) kernel() *MicroKernel {
+	if c.Kernel == nil {
+		return &Kernel
+	}
+	return c.Kernel
+}
+
+// syscallHart is the view of a hart the microkernel needs to service a syscall:
+// its argument registers, in the width of the hart, and the memory of the program.
+type syscallHart interface {
+	// xlen returns the width of the registers in bits, 32 or 64.
+	xlen() uint
+	// syscallArgument returns the register a0+n.
+	syscallArgument(n uint32) uint64
+	// setSyscallResult writes the result of the syscall to a0, truncated to the register width.
+	setSyscallResult(val uint64)
+	// readVirtual and writeVirtual access the memory of the program at a virtual address.
+	readVirtual(addr uint64, size uint64) ([]byte, error)
+	writeVirtual(addr uint64, data []byte) error
+}
+
+func (c *CPU) xlen() uint {
+	return 32
+}
+
+func (c *CPU) syscallArgument(n uint32) uint64 {
+	return uint64(c.Registers[ARG_ZERO+n])
+}
+
+func (c *CPU) setSyscallResult(val uint64) {
+	c.WriteRegister(ARG_ZERO, uint32(val))
+}
+
+func (c *CPU) readVirtual(addr uint64, size uint64) ([]byte, error) {
+	return c.readBytes(uint32(addr), uint32(size))
+}
+
+func (c *CPU) writeVirtual(addr uint64, data []byte) error {
+	return c.writeBytes(uint32(addr), data)
+}
+
+// readPath reads the null-terminated path at the virtual address addr, returning EFAULT when
+// it is not mapped and ENAMETOOLONG when it is longer than PATH_MAX, null byte included.
+func readPath(h syscallHart, addr uint64) (string, uint32) {
+	path := make([]byte, 0, 64)
+	for len(path) < PATH_MAX {
+		b, err := h.readVirtual(addr+uint64(len(path)), 1)
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return "", EFAULT
 		}
-		cwd := []byte(Kernel.CWD)
-		for i := range len(cwd) {
-			c.Memory.WriteByte(address+uint32(i), cwd[i])
+		if b[0] == 0 {
+			return string(path), 0
 		}
-	case MKDIRAT:
-		dirfd, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		path = append(path, b[0])
+	}
+	return "", ENAMETOOLONG
+}
+
+// signedArgument returns the register a0+n sign extended from the register width.
+func signedArgument(h syscallHart, n uint32) int64 {
+	shift := 64 - h.xlen()
+	return int64(h.syscallArgument(n)<<shift) >> shift
+}
+
+// offsetArgument returns the 64-bit file offset of pread64 and pwrite64: a3 on RV64,
+// a3 (low half) and a4 (high half) on RV32.
+func offsetArgument(h syscallHart) int64 {
+	if h.xlen() == 32 {
+		return int64(h.syscallArgument(4)<<32 | h.syscallArgument(3))
+	}
+	return int64(h.syscallArgument(3))
+}
+
+// HandleECALL performs the Linux syscall whose number is in a7 and sets a0 to its result,
+// or to -errno when it fails. The returned state only differs from OK when the program exits.
+func (c *CPU) HandleECALL() (int, error) {
+	return c.kernel().syscall(c)
+}
+
+// syscall performs the syscall requested by h, see CPU.HandleECALL.
+func (k *MicroKernel) syscall(h syscallHart) (int, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	var result uint64
+	switch h.syscallArgument(7) { // a7 contains the function we are trying to call
+	case GETCWD:
+		address := h.syscallArgument(0) // Pointer to start of Buffer we write to
+		size := h.syscallArgument(1)
+		cwd := append([]byte(k.CWD), 0)
+		if uint64(len(cwd)) > size {
+			return failSyscall(h, ERANGE)
 		}
-		address, err := c.ReadRegister(ARG_ONE) // Pointer to start of string we are reading from
+		err := h.writeVirtual(address, cwd)
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return failSyscall(h, EFAULT)
 		}
-		mode, err := c.ReadRegister(ARG_TWO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		result = uint64(len(cwd)) // Return the length of the path, including the null byte
+	case MKDIRAT:
+		val, errno := readPath(h, h.syscallArgument(1)) // Pointer to start of string we are reading from
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		val, err := c.Memory.ReadString(address)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		path, errno := k.resolve(val, int32(h.syscallArgument(0)))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		path := GetPath(val, int32(dirfd))
-		err = os.Mkdir(path, os.FileMode(mode))
+		err := os.Mkdir(path, os.FileMode(h.syscallArgument(2)&0777))
 		if err != nil {
-			return IO_ERROR, nil
+			return failSyscall(h, errnoOf(err))
 		}
-		Kernel.FileDescriptors = append(Kernel.FileDescriptors, path)
-		c.Memory.WriteWord(address, uint32(len(Kernel.FileDescriptors)-1)) // Return the file descriptor as the return value
 	case UNLINKAT:
-		_, err := c.ReadRegister(ARG_ZERO) // Not used directly, but for completeness
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		val, errno := readPath(h, h.syscallArgument(1))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		address, err := c.ReadRegister(ARG_ONE) // Pointer to start of string we are reading from
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		path, errno := k.resolve(val, int32(h.syscallArgument(0)))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		val, err := c.Memory.ReadString(address)
+		err := os.Remove(path)
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return failSyscall(h, errnoOf(err))
 		}
-		zero, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+	case CHDIR:
+		val, errno := readPath(h, h.syscallArgument(0))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		path := GetPath(val, int32(zero))
-		err = os.Remove(path)
-		if err != nil {
-			return IO_ERROR, nil
+		path, errno := k.resolve(val, AT_FDCWD)
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-	case CHDIR:
-		address, err := c.ReadRegister(ARG_ZERO) // Pointer to start of string we are reading from
+		info, err := os.Stat(path)
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return failSyscall(h, errnoOf(err))
 		}
-		path, err := c.Memory.ReadString(address)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		if !info.IsDir() {
+			return failSyscall(h, ENOTDIR)
 		}
-		Kernel.CWD = path
+		k.CWD = filepath.Clean(path) // the checked directory, so that relative paths keep their meaning
 	case FCHDIR:
-		fdVal, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		fd := int32(h.syscallArgument(0))
+		if !k.IsValidFileDescriptor(fd) {
+			return failSyscall(h, EBADF)
 		}
-		fd := int32(fdVal)
-		if !IsValidFileDescriptor(fd) {
-			return IO_ERROR, nil
-		}
-		Kernel.CWD = Kernel.FileDescriptors[fd]
+		k.CWD = k.FileDescriptors[fd].Path
 	case OPENAT:
-		zero, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		val, errno := readPath(h, h.syscallArgument(1))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		address, err := c.ReadRegister(ARG_ONE) // Pointer to start of string we are reading from
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		val, err := c.Memory.ReadString(address)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		path, errno := k.resolve(val, int32(h.syscallArgument(0)))
+		if errno != 0 {
+			return failSyscall(h, errno)
 		}
-		path := GetPath(val, int32(zero))
-		flags, err := c.ReadRegister(ARG_TWO)
+		flags := uint32(h.syscallArgument(2))
+		mode := h.syscallArgument(3)
+		file, err := os.OpenFile(path, openFlags(flags), os.FileMode(mode&0777))
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		mode, err := c.ReadRegister(ARG_THREE)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		if flags&0x0100 != 0 { // O_CREAT
-			file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.FileMode(mode))
-			if err != nil {
-				return IO_ERROR, nil
-			}
-			file.Close()
+			return failSyscall(h, errnoOf(err))
 		}
-		Kernel.FileDescriptors = append(Kernel.FileDescriptors, path)
-		c.WriteRegister(ARG_ZERO, uint32(len(Kernel.FileDescriptors)-1)) // Return the file descriptor as the return value
+		result = uint64(k.allocate(&FileDescriptor{Path: path, File: file, Flags: flags})) // Return the file descriptor
 	case CLOSE:
-		fdVal, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		fd := int32(h.syscallArgument(0))
+		f := k.file(fd)
+		if f == nil {
+			return failSyscall(h, EBADF)
+		}
+		k.FileDescriptors[fd] = nil // a closed standard stream frees its descriptor, but the emulator keeps the stream
+		if !f.inherited {
+			if err := f.File.Close(); err != nil {
+				return failSyscall(h, errnoOf(err))
+			}
 		}
-		fd := int32(fdVal)
-		if !IsValidFileDescriptor(fd) {
-			return IO_ERROR, nil
+	case LSEEK:
+		// RV32 Linux defines syscall 62 as _llseek(fd, high, low, result, whence), but newlib and libgloss
+		// call it as lseek(fd, offset, whence) returning the offset in a0, which is the only form supported.
+		whence := h.syscallArgument(2)
+		f := k.file(int32(h.syscallArgument(0)))
+		if f == nil {
+			return failSyscall(h, EBADF)
 		}
-		Kernel.FileDescriptors[fd] = ""
-	case READ:
-		fdVal, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		dest, err := c.ReadRegister(ARG_ONE)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		if whence > io.SeekEnd {
+			return failSyscall(h, EINVAL)
 		}
-		size, err := c.ReadRegister(ARG_TWO)
+		position, err := f.File.Seek(signedArgument(h, 1), int(whence))
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		offset, err := c.ReadRegister(ARG_THREE)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		fd := int32(fdVal)
-		var file *os.File
-		if IsValidFileDescriptor(fd) {
-			file, err = os.OpenFile(Kernel.FileDescriptors[fd], os.O_RDONLY, 0)
-			if err != nil {
-				return IO_ERROR, nil
-			}
-			defer file.Close()
+			return failSyscall(h, errnoOf(err))
+		}
+		if position > math.MaxInt64>>(64-h.xlen()) { // the offset would look like -errno
+			return failSyscall(h, EOVERFLOW)
+		}
+		result = uint64(position) // Return the new offset
+	case READ, PREAD64:
+		dest := h.syscallArgument(1)
+		size := h.syscallArgument(2)
+		f := k.file(int32(h.syscallArgument(0)))
+		if f == nil || !f.readable() {
+			return failSyscall(h, EBADF)
+		}
+		buf := make([]byte, min(size, MAX_TRANSFER)) // larger reads return a short count
+		var amt int
+		var err error
+		// Reading stdin may block: release the kernel so that the other CPUs sharing it keep going.
+		k.lock.Unlock()
+		if h.syscallArgument(7) == PREAD64 { // reads at an offset, leaving the file offset unchanged
+			amt, err = f.File.ReadAt(buf, offsetArgument(h))
 		} else {
-			if fd != 0 {
-				return IO_ERROR, nil
-			}
-			file = os.Stdin
+			amt, err = f.File.Read(buf)
 		}
-		buf := make([]byte, offset+size)
-		amt, err := file.Read(buf)
-		if err != nil {
-			return IO_ERROR, nil
-		}
-		for i := 0; uint32(i) < size; i++ {
-			c.Memory.WriteByte(dest+uint32(i), buf[uint32(i)+offset])
+		k.lock.Lock()
+		if err != nil && err != io.EOF {
+			return failSyscall(h, errnoOf(err))
 		}
-		c.WriteRegister(ARG_ZERO, uint32(amt)) // Return the number of bytes read
-	case WRITE:
-		fdVal, err := c.ReadRegister(ARG_ZERO)
+		err = h.writeVirtual(dest, buf[:amt])
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+			return failSyscall(h, EFAULT)
 		}
-		source, err := c.ReadRegister(ARG_ONE)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
+		result = uint64(amt) // Return the number of bytes read
+	case WRITE, PWRITE64:
+		source := h.syscallArgument(1)
+		size := h.syscallArgument(2)
+		f := k.file(int32(h.syscallArgument(0)))
+		if f == nil || !f.writable() {
+			return failSyscall(h, EBADF)
 		}
-		size, err := c.ReadRegister(ARG_TWO)
+		buf, err := h.readVirtual(source, min(size, MAX_TRANSFER)) // larger writes return a short count
 		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		fd := int32(fdVal)
-		var file *os.File
-		if IsValidFileDescriptor(fd) {
-			file, err = os.OpenFile(Kernel.FileDescriptors[fd], os.O_RDONLY, 0)
-			if err != nil {
-				return IO_ERROR, nil
-			}
-			defer file.Close()
-		} else {
-			switch fd {
-			case 1:
-				file = os.Stdout
-			case 2:
-				file = os.Stderr
-			default:
-				return IO_ERROR, nil
-			}
+			return failSyscall(h, EFAULT)
 		}
-		buf := make([]byte, size)
-		for i := 0; uint32(i) < size; i++ {
-			buf[i], err = c.Memory.ReadByte(source + uint32(i))
-			if err != nil {
-				return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-			}
+		var written int
+		// As for reads, writing to a full pipe may block.
+		k.lock.Unlock()
+		if h.syscallArgument(7) == PWRITE64 && f.Flags&O_APPEND == 0 { // writes at an offset, leaving the file offset unchanged
+			written, err = f.File.WriteAt(buf, offsetArgument(h))
+		} else { // as on Linux, pwrite64 appends to files opened with O_APPEND
+			written, err = f.File.Write(buf)
 		}
-		written, err := file.Write(buf)
-		if err != nil {
-			return IO_ERROR, nil
+		k.lock.Lock()
+		if err != nil && written == 0 {
+			return failSyscall(h, errnoOf(err))
 		}
-		c.WriteRegister(ARG_ZERO, uint32(written)) // Return the number of bytes written
-
+		result = uint64(written) // Return the number of bytes written
 	case EXIT:
-		returnCode, err := c.ReadRegister(ARG_ZERO)
-		if err != nil {
-			return 0, fmt.Errorf("crash at PC=%d with error:\n%s", c.PC-4, err.Error())
-		}
-		if returnCode != 0 {
+		if h.syscallArgument(0) != 0 {
 			return PROGRAM_EXIT_FAILURE, nil
 		}
 		return PROGRAM_EXIT, nil
 
 	default:
-		return 0, nil
+		return failSyscall(h, ENOSYS)
+	}
+	h.setSyscallResult(result)
+	return OK, nil
+}
+
+// failSyscall makes the current syscall return -errno to the program, which keeps running.
+func failSyscall(h syscallHart, errno uint32) (int, error) {
+	h.setSyscallResult(uint64(-int64(errno)))
+	return OK, nil
+}
+
+// errnoOf returns the Linux errno value describing a host error, or EIO.
+func errnoOf(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if linux, ok := linuxErrno[errno]; ok {
+			return linux
+		}
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, os.ErrPermission):
+		return EACCES
+	case errors.Is(err, os.ErrExist):
+		return EEXIST
+	case errors.Is(err, os.ErrClosed):
+		return EBADF
+	case errors.Is(err, os.ErrInvalid):
+		return EINVAL
 	}
-	return 0, nil
+	return EIO
 }
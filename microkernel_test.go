@@ -0,0 +1,400 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// linuxSyscall runs an ecall requesting syscall number with the arguments in a0 to a5 and returns a0.
+func linuxSyscall(t *testing.T, cpu *CPU, number uint32, args ...uint32) uint32 {
+	t.Helper()
+	copy(cpu.Registers[ARG_ZERO:], args)
+	cpu.Registers[ARG_SEVEN] = number
+	cpu.PC = 0
+	if state := runProgram(t, cpu, []uint32{0x00000073, EBREAK_WORD}); state != E_BREAK { // ecall
+		t.Fatalf("syscall %d stopped the program with state %d", number, state)
+	}
+	return cpu.Registers[ARG_ZERO]
+}
+
+// getcwd returns the working directory of the program running on cpu.
+func getcwd(t *testing.T, cpu *CPU) string {
+	t.Helper()
+	if a0 := linuxSyscall(t, cpu, GETCWD, 0x1000, PATH_MAX); int32(a0) < 0 {
+		t.Fatalf("getcwd failed with errno %d", -int32(a0))
+	}
+	cwd, _ := cpu.Memory.ReadString(0x1000)
+	return cwd
+}
+
+func TestKernelInstances(t *testing.T) {
+	cpu, other := NewCPU(NewMemory()), NewCPU(NewMemory())
+	if cpu.Kernel == nil || cpu.kernel() != cpu.Kernel || cpu.Kernel == other.Kernel || cpu.Kernel == &Kernel {
+		t.Error("NewCPU does not give the CPU its own kernel")
+	}
+	if cpu64 := NewCPU64(NewMemory()); cpu64.Kernel == nil || cpu64.kernel() != cpu64.Kernel || cpu64.Kernel == &Kernel {
+		t.Error("NewCPU64 does not give the CPU its own kernel")
+	}
+	if cpu := (&CPU{Memory: NewMemory()}); cpu.kernel() != &Kernel {
+		t.Error("a CPU without a kernel does not fall back to the global Kernel")
+	}
+	if len(Kernel.FileDescriptors) < 3 || Kernel.FileDescriptors[1].File != os.Stdout {
+		t.Errorf("the global Kernel has the file descriptors %v, want the standard streams", Kernel.FileDescriptors)
+	}
+
+	cwd := Kernel.CWD
+	dirs := []string{t.TempDir(), t.TempDir()}
+	cpus := []*CPU{NewCPU(NewMemory()), NewCPU(NewMemory())}
+	for i, cpu := range cpus {
+		cpu.Memory.LoadBytes(0x800, append([]byte(dirs[i]), 0))
+		if a0 := linuxSyscall(t, cpu, CHDIR, 0x800); a0 != 0 {
+			t.Fatalf("chdir returned %d", int32(a0))
+		}
+	}
+	for i, cpu := range cpus {
+		if got := getcwd(t, cpu); got != dirs[i] {
+			t.Errorf("CPU %d has the working directory %q, want %q", i, got, dirs[i])
+		}
+	}
+	if Kernel.CWD != cwd {
+		t.Errorf("the global Kernel moved to %q", Kernel.CWD)
+	}
+
+	shared := NewMicroKernel()
+	path := filepath.Join(t.TempDir(), "file")
+	opener, closer := NewCPUWithKernel(NewMemory(), shared), NewCPUWithKernel(NewMemory(), shared)
+	opener.Memory.LoadBytes(0x800, append([]byte(path), 0))
+	fd := linuxSyscall(t, opener, OPENAT, 1<<32+AT_FDCWD, 0x800, O_CREAT|O_WRONLY, 0o644)
+	if fd != 3 {
+		t.Fatalf("openat returned %d, want 3", int32(fd))
+	}
+	if a0 := linuxSyscall(t, closer, CLOSE, fd); a0 != 0 {
+		t.Errorf("closing a file opened by another CPU of the kernel returned %d", int32(a0))
+	}
+}
+
+func TestKernelBlockingRead(t *testing.T) {
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer input.Close()
+	shared := NewMicroKernel()
+	shared.FileDescriptors[0].File = stdin
+	reader, other := NewCPUWithKernel(NewMemory(), shared), NewCPUWithKernel(NewMemory(), shared)
+
+	read := make(chan uint32)
+	go func() {
+		copy(reader.Registers[ARG_ZERO:], []uint32{0, 0x800, 1})
+		reader.Registers[ARG_SEVEN] = READ
+		reader.HandleECALL()
+		read <- reader.Registers[ARG_ZERO]
+	}()
+	done := make(chan string)
+	go func() {
+		copy(other.Registers[ARG_ZERO:], []uint32{0x1000, PATH_MAX})
+		other.Registers[ARG_SEVEN] = GETCWD
+		other.HandleECALL()
+		cwd, _ := other.Memory.ReadString(0x1000)
+		done <- cwd
+	}()
+	select {
+	case cwd := <-done:
+		if cwd != shared.CWD {
+			t.Errorf("getcwd returned %q, want %q", cwd, shared.CWD)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a read blocked on stdin holds the kernel")
+	}
+	input.Write([]byte("x"))
+	a0 := <-read
+	if b, _ := reader.Memory.ReadByte(0x800); a0 != 1 || b != 'x' {
+		t.Errorf("read returned %d and the byte %q, want 1 and 'x'", int32(a0), b)
+	}
+}
+
+func TestKernelInit(t *testing.T) {
+	k := NewMicroKernel()
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.CWD = "/tmp"
+	k.allocate(&FileDescriptor{Path: file.Name(), File: file, Flags: O_WRONLY})
+	k.Init()
+	if _, err := file.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("writing to a file left open returned %v, want it closed by Init", err)
+	}
+	if wd, _ := os.Getwd(); k.CWD != wd || len(k.FileDescriptors) != 3 || k.IsValidFileDescriptor(3) {
+		t.Errorf("Init left the working directory %q and %d file descriptors", k.CWD, len(k.FileDescriptors))
+	}
+}
+
+// errnoResult returns the value of a0 after a syscall failing with errno.
+func errnoResult(errno uint32) uint32 {
+	return -errno
+}
+
+func TestFileDescriptors(t *testing.T) {
+	const (
+		PATH    = 0x800
+		MISSING = 0xA00
+		TEXT    = 0xC00
+		BUFFER  = 0x1000
+		FDCWD   = 1<<32 + AT_FDCWD
+	)
+	dir := t.TempDir()
+	cpu := NewCPUWithKernel(NewMemory(), NewMicroKernel())
+	t.Cleanup(cpu.Kernel.Close)
+	cpu.Memory.LoadBytes(PATH, append([]byte(filepath.Join(dir, "file")), 0))
+	cpu.Memory.LoadBytes(MISSING, append([]byte(filepath.Join(dir, "missing")), 0))
+	cpu.Memory.LoadBytes(TEXT, []byte("hello world"))
+
+	steps := []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   uint32
+		read   string // bytes expected at BUFFER
+	}{
+		{"create", OPENAT, []uint32{FDCWD, PATH, O_CREAT | O_EXCL | O_WRONLY, 0o644}, 3, ""},
+		{"create an existing file", OPENAT, []uint32{FDCWD, PATH, O_CREAT | O_EXCL | O_WRONLY, 0o644}, errnoResult(EEXIST), ""},
+		{"open a missing file", OPENAT, []uint32{FDCWD, MISSING, O_RDONLY, 0}, errnoResult(ENOENT), ""},
+		{"write", WRITE, []uint32{3, TEXT, 11}, 11, ""},
+		{"read a write-only file", READ, []uint32{3, BUFFER, 4}, errnoResult(EBADF), ""},
+		{"open read-only", OPENAT, []uint32{FDCWD, PATH, O_RDONLY, 0}, 4, ""},
+		{"read", READ, []uint32{4, BUFFER, 5}, 5, "hello"},
+		{"read from the offset", READ, []uint32{4, BUFFER, 16}, 6, " world"},
+		{"read at the end", READ, []uint32{4, BUFFER, 16}, 0, ""},
+		{"write a read-only file", WRITE, []uint32{4, TEXT, 1}, errnoResult(EBADF), ""},
+		{"read a closed descriptor", READ, []uint32{5, BUFFER, 1}, errnoResult(EBADF), ""},
+		{"seek", LSEEK, []uint32{4, 6, 0}, 6, ""},
+		{"seek from the end", LSEEK, []uint32{4, 1<<32 - 2, 2}, 9, ""},
+		{"seek with an invalid whence", LSEEK, []uint32{4, 0, 3}, errnoResult(EINVAL), ""},
+		{"seek before the start", LSEEK, []uint32{4, 1<<32 - 20, 1}, errnoResult(EINVAL), ""},
+		{"pread64 at the offset in a3 and a4", PREAD64, []uint32{4, BUFFER, 5, 6, 0}, 5, "world"},
+		{"read after pread64", READ, []uint32{4, BUFFER, 2}, 2, "ld"},
+		{"pwrite64", PWRITE64, []uint32{3, TEXT, 5, 6, 0}, 5, ""},
+		{"close", CLOSE, []uint32{3}, 0, ""},
+		{"close a closed descriptor", CLOSE, []uint32{3}, errnoResult(EBADF), ""},
+		{"reuse the lowest descriptor", OPENAT, []uint32{FDCWD, PATH, O_WRONLY | O_APPEND, 0}, 3, ""},
+		{"pwrite64 appends with O_APPEND", PWRITE64, []uint32{3, TEXT + 5, 6, 0, 0}, 6, ""},
+		{"pread64 the whole file", PREAD64, []uint32{4, BUFFER, 32, 0, 0}, 17, "hello hello world"},
+		{"truncate", OPENAT, []uint32{FDCWD, PATH, O_WRONLY | O_TRUNC, 0}, 5, ""},
+		{"read a truncated file", PREAD64, []uint32{4, BUFFER, 32, 0, 0}, 0, ""},
+		{"seek to the largest offset", LSEEK, []uint32{4, 0x7FFFFFFF, 0}, 0x7FFFFFFF, ""},
+		{"seek to an offset overflowing a0", LSEEK, []uint32{4, 1, 1}, errnoResult(EOVERFLOW), ""},
+	}
+	for _, step := range steps {
+		if got := linuxSyscall(t, cpu, step.number, step.args...); got != step.want {
+			t.Fatalf("%s: a0 = %d, want %d", step.name, int32(got), int32(step.want))
+		}
+		read := make([]byte, len(step.read))
+		for i := range read {
+			read[i], _ = cpu.Memory.ReadByte(BUFFER + uint32(i))
+		}
+		if string(read) != step.read {
+			t.Fatalf("%s: read %q, want %q", step.name, read, step.read)
+		}
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU(NewMemory())
+	t.Cleanup(cpu.Kernel.Close)
+	cpu.Memory.LoadBytes(0x800, append([]byte(dir), 0))
+	cpu.Memory.LoadBytes(0x900, []byte("a\x00b\x00./x\x00"))
+	steps := []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   uint32
+	}{
+		{"chdir to an absolute path", CHDIR, []uint32{0x800}, 0},
+		{"chdir to a relative path", CHDIR, []uint32{0x900}, 0},
+		{"chdir relative to the previous one", CHDIR, []uint32{0x902}, 0},
+		{"open relative to the working directory", OPENAT, []uint32{1<<32 + AT_FDCWD, 0x904, O_CREAT | O_WRONLY, 0o644}, 3},
+	}
+	for _, step := range steps {
+		if got := linuxSyscall(t, cpu, step.number, step.args...); got != step.want {
+			t.Fatalf("%s: a0 = %d, want %d", step.name, int32(got), int32(step.want))
+		}
+	}
+	if want := filepath.Join(dir, "a", "b"); getcwd(t, cpu) != want {
+		t.Errorf("getcwd returned %q, want %q", getcwd(t, cpu), want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b", "x")); err != nil {
+		t.Errorf("the file was not created in the working directory: %v", err)
+	}
+}
+
+func TestCloseStandardStreams(t *testing.T) {
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	cpu := NewCPU(NewMemory())
+	t.Cleanup(cpu.Kernel.Close)
+	cpu.Kernel.FileDescriptors[1].File = stdout
+	path := filepath.Join(t.TempDir(), "file")
+	cpu.Memory.LoadBytes(0x800, append([]byte(path), 0))
+	cpu.Memory.LoadBytes(0x900, []byte("x"))
+	steps := []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   uint32
+	}{
+		{"close stdout", CLOSE, []uint32{1}, 0},
+		{"write to the closed stdout", WRITE, []uint32{1, 0x900, 1}, errnoResult(EBADF)},
+		{"close stdout again", CLOSE, []uint32{1}, errnoResult(EBADF)},
+		{"open takes the free descriptor", OPENAT, []uint32{1<<32 + AT_FDCWD, 0x800, O_CREAT | O_WRONLY, 0o644}, 1},
+		{"write to the new file", WRITE, []uint32{1, 0x900, 1}, 1},
+		{"close stdin", CLOSE, []uint32{0}, 0},
+	}
+	for _, step := range steps {
+		if got := linuxSyscall(t, cpu, step.number, step.args...); got != step.want {
+			t.Fatalf("%s: a0 = %d, want %d", step.name, int32(got), int32(step.want))
+		}
+	}
+	if _, err := stdout.Write([]byte("y")); err != nil {
+		t.Errorf("closing stdout closed the stream of the emulator: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "x" {
+		t.Errorf("the file opened as descriptor 1 holds %q (%v), want \"x\"", data, err)
+	}
+}
+
+func TestBoundedTransfers(t *testing.T) {
+	cpu := NewCPUWithKernel(NewMemory(), NewMicroKernel())
+	t.Cleanup(cpu.Kernel.Close)
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := uint32(cpu.Kernel.allocate(&FileDescriptor{Path: file.Name(), File: file, Flags: O_RDWR}))
+	tests := []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   uint32
+	}{
+		{"write", WRITE, []uint32{fd, 0x10000, 0x20000}, MAX_TRANSFER},
+		{"write beyond memory", WRITE, []uint32{fd, 0x10000, 0xFFFFFFFF}, MAX_TRANSFER},
+		{"pwrite64", PWRITE64, []uint32{fd, 0x10000, 0x20000, 0x20000, 0}, MAX_TRANSFER},
+		{"pread64", PREAD64, []uint32{fd, 0x10000, 0x30000, 0, 0}, MAX_TRANSFER},
+		{"read", READ, []uint32{fd, 0x10000, 0xFFFFFFFF}, MAX_TRANSFER},
+		{"read the rest", READ, []uint32{fd, 0x10000, 0x20000}, 0},
+	}
+	for _, test := range tests {
+		if got := linuxSyscall(t, cpu, test.number, test.args...); got != test.want {
+			t.Errorf("%s: a0 = %d, want %d", test.name, int32(got), int32(test.want))
+		}
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 3*MAX_TRANSFER {
+		t.Errorf("the file has %v bytes (%v), want %d", info.Size(), err, 3*MAX_TRANSFER)
+	}
+}
+
+func TestErrnoOf(t *testing.T) {
+	_, missing := os.Open(filepath.Join(t.TempDir(), "missing"))
+	file, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, notDir := os.Stat(filepath.Join(file.Name(), "child"))
+	file.Close()
+	_, closed := file.Write([]byte("x"))
+	tests := []struct {
+		name string
+		err  error
+		want uint32
+	}{
+		{"missing file", missing, ENOENT},
+		{"path through a file", notDir, ENOTDIR},
+		{"closed file", closed, EBADF},
+		{"host errno", &os.PathError{Op: "open", Path: "x", Err: syscall.ENAMETOOLONG}, ENAMETOOLONG},
+		{"permission", os.ErrPermission, EACCES},
+		{"existing file", os.ErrExist, EEXIST},
+		{"invalid argument", os.ErrInvalid, EINVAL},
+		{"other error", errors.New("disk on fire"), EIO},
+	}
+	for _, test := range tests {
+		if got := errnoOf(test.err); got != test.want {
+			t.Errorf("%s: errnoOf(%v) = %d, want %d", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestSyscallPaths(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const FDCWD = 1<<32 + AT_FDCWD
+	tests := []struct {
+		name   string
+		path   []byte // loaded at addr
+		addr   uint32
+		number uint32
+		args   []uint32 // arguments following the path, or preceding it for the *at syscalls
+		want   uint32
+	}{
+		{"chdir", []byte(dir + "\x00"), 0x800, CHDIR, nil, 0},
+		{"chdir to a missing directory", []byte(dir + "/missing\x00"), 0x800, CHDIR, nil, errnoResult(ENOENT)},
+		{"chdir to a file", []byte(file + "\x00"), 0x800, CHDIR, nil, errnoResult(ENOTDIR)},
+		{"chdir through a file", []byte(file + "/child\x00"), 0x800, CHDIR, nil, errnoResult(ENOTDIR)},
+		{"chdir to an empty path", []byte("\x00"), 0x800, CHDIR, nil, errnoResult(ENOENT)},
+		{"path longer than PATH_MAX", bytes.Repeat([]byte("a"), PATH_MAX), 0x800, CHDIR, nil, errnoResult(ENAMETOOLONG)},
+		{"path running off the end of memory", []byte("/tmp"), 0x100000 - 4, CHDIR, nil, errnoResult(EFAULT)},
+		{"path outside memory", nil, 0x40000000, CHDIR, nil, errnoResult(EFAULT)},
+		{"mkdirat", []byte(dir + "/new\x00"), 0x800, MKDIRAT, []uint32{FDCWD}, 0},
+		{"mkdirat an existing directory", []byte(dir + "\x00"), 0x800, MKDIRAT, []uint32{FDCWD}, errnoResult(EEXIST)},
+		{"mkdirat with a path outside memory", nil, 0x40000000, MKDIRAT, []uint32{FDCWD}, errnoResult(EFAULT)},
+		{"unlinkat a missing file", []byte(dir + "/missing\x00"), 0x800, UNLINKAT, []uint32{FDCWD}, errnoResult(ENOENT)},
+		{"unlinkat with a path longer than PATH_MAX", bytes.Repeat([]byte("a"), PATH_MAX), 0x800, UNLINKAT, []uint32{FDCWD}, errnoResult(ENAMETOOLONG)},
+		{"openat with a path outside memory", nil, 0x40000000, OPENAT, []uint32{FDCWD}, errnoResult(EFAULT)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPUWithKernel(NewMemory(), NewMicroKernel())
+			cpu.Memory.LoadBytes(test.addr, test.path)
+			args := append(append([]uint32(nil), test.args...), test.addr)
+			if got := linuxSyscall(t, cpu, test.number, args...); got != test.want {
+				t.Errorf("a0 = %d, want %d", int32(got), int32(test.want))
+			}
+			if wd, _ := os.Getwd(); test.number == CHDIR && test.want != 0 && cpu.Kernel.CWD != wd {
+				t.Errorf("a failed chdir moved to %q", cpu.Kernel.CWD)
+			}
+		})
+	}
+}
+
+func TestSyscallPathTranslation(t *testing.T) {
+	dir := t.TempDir()
+	cpu := newPagedCPU(t)
+	cpu.Kernel = NewMicroKernel()
+	cpu.privilege = PRIVILEGE_USER
+	cpu.Memory.LoadBytes(0x20000+0x10, append([]byte(dir), 0)) // USER_PAGE+0x10
+	cpu.Memory.LoadBytes(USER_PAGE+0x10, []byte("/missing\x00"))
+	if a0 := linuxSyscall(t, cpu, CHDIR, USER_PAGE+0x10); a0 != 0 || cpu.Kernel.CWD != dir {
+		t.Errorf("chdir returned %d and moved to %q, want the path of the mapped page %q", int32(a0), cpu.Kernel.CWD, dir)
+	}
+	// the path runs into KERNEL_PAGE, which user mode cannot access
+	cpu.Memory.LoadBytes(0x20FFC, []byte("/tmp"))
+	if a0 := linuxSyscall(t, cpu, CHDIR, KERNEL_PAGE-4); a0 != errnoResult(EFAULT) {
+		t.Errorf("chdir to a path crossing into a supervisor page returned %d, want -EFAULT", int32(a0))
+	}
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sv32 page table entry fields.
+const (
+	PTE_V = 1 << 0
+	PTE_R = 1 << 1
+	PTE_W = 1 << 2
+	PTE_X = 1 << 3
+	PTE_U = 1 << 4
+	PTE_G = 1 << 5
+	PTE_A = 1 << 6
+	PTE_D = 1 << 7
+)
+
+const (
+	PAGE_SIZE = 4096
+	SATP_MODE = 1 << 31 // Sv32 translation enabled
+	SATP_ASID = 0x1FF << 22
+	SATP_PPN  = 0x3FFFFF
+
+	TLB_SIZE = 64 // number of entries of the direct-mapped TLB
+)
+
+// AccessType is the kind of memory access being translated.
+type AccessType int
+
+const (
+	ACCESS_FETCH AccessType = iota
+	ACCESS_LOAD
+	ACCESS_STORE
+)
+
+// tlbEntry caches the translation of a single 4KiB virtual page.
+// Superpages are cached one 4KiB page at a time.
+type tlbEntry struct {
+	valid bool
+	vpn   uint32 // virtual page number
+	asid  uint32
+	ppn   uint32 // physical page number
+	pte   uint32 // leaf PTE, used for permission checks
+}
+
+// pageFault builds the page-fault exception matching the access type.
+func pageFault(access AccessType, addr uint32) *Exception {
+	switch access {
+	case ACCESS_FETCH:
+		return &Exception{Cause: CAUSE_INSTRUCTION_PAGE_FAULT, Tval: addr}
+	case ACCESS_LOAD:
+		return &Exception{Cause: CAUSE_LOAD_PAGE_FAULT, Tval: addr}
+	default:
+		return &Exception{Cause: CAUSE_STORE_PAGE_FAULT, Tval: addr}
+	}
+}
+
+// accessFault builds the access-fault exception matching the access type.
+func accessFault(access AccessType, addr uint32, err error) *Exception {
+	switch access {
+	case ACCESS_FETCH:
+		return &Exception{Cause: CAUSE_INSTRUCTION_ACCESS_FAULT, Tval: addr, Err: err}
+	case ACCESS_LOAD:
+		return &Exception{Cause: CAUSE_LOAD_ACCESS_FAULT, Tval: addr, Err: err}
+	default:
+		return &Exception{Cause: CAUSE_STORE_ACCESS_FAULT, Tval: addr, Err: err}
+	}
+}
+
+// effectivePrivilege returns the privilege level memory accesses of the given type are checked against.
+// With mstatus.MPRV set, loads and stores use the privilege level saved in mstatus.MPP.
+func (c *CPU) effectivePrivilege(access AccessType) uint32 {
+	if access != ACCESS_FETCH && c.mstatus&MSTATUS_MPRV != 0 {
+		return (c.mstatus & MSTATUS_MPP) >> 11
+	}
+	return c.privilege
+}
+
+// Translate converts a virtual address into a physical address.
+// Addresses are used as is in machine mode or when satp disables paging.
+func (c *CPU) Translate(addr uint32, access AccessType) (uint32, error) {
+	privilege := c.effectivePrivilege(access)
+	if c.satp&SATP_MODE == 0 || privilege == PRIVILEGE_MACHINE {
+		return addr, nil
+	}
+
+	vpn := addr / PAGE_SIZE
+	asid := (c.satp & SATP_ASID) >> 22
+	entry := &c.tlb[vpn%TLB_SIZE]
+	hit := entry.valid && entry.vpn == vpn && (entry.asid == asid || entry.pte&PTE_G != 0)
+	// A store through a clean page has to walk the page table again to set the D bit.
+	if !hit || (access == ACCESS_STORE && entry.pte&PTE_D == 0) {
+		err := c.walkPageTable(addr, access, privilege)
+		if err != nil {
+			return 0, err
+		}
+	} else if !c.permitted(entry.pte, access, privilege) {
+		return 0, pageFault(access, addr)
+	}
+	return entry.ppn*PAGE_SIZE + addr%PAGE_SIZE, nil
+}
+
+// permitted checks the permission bits of a leaf PTE against an access.
+func (c *CPU) permitted(pte uint32, access AccessType, privilege uint32) bool {
+	if privilege == PRIVILEGE_USER && pte&PTE_U == 0 {
+		return false
+	}
+	// Supervisor mode may only read and write user pages when mstatus.SUM is set, and never execute them.
+	if privilege == PRIVILEGE_SUPERVISOR && pte&PTE_U != 0 && (access == ACCESS_FETCH || c.mstatus&MSTATUS_SUM == 0) {
+		return false
+	}
+	switch access {
+	case ACCESS_FETCH:
+		return pte&PTE_X != 0
+	case ACCESS_LOAD:
+		return pte&PTE_R != 0 || (c.mstatus&MSTATUS_MXR != 0 && pte&PTE_X != 0)
+	default:
+		return pte&PTE_W != 0
+	}
+}
+
+// walkPageTable walks the two-level Sv32 page table for addr, updates the A and D bits
+// of the leaf PTE and stores the translation in the TLB.
+func (c *CPU) walkPageTable(addr uint32, access AccessType, privilege uint32) error {
+	vpn := [2]uint32{(addr >> 12) & 0x3FF, addr >> 22}
+	table := uint64(c.satp&SATP_PPN) * PAGE_SIZE
+	for level := 1; level >= 0; level-- {
+		pteAddr := table + uint64(vpn[level])*4
+		if pteAddr > 0xFFFFFFFF {
+			return accessFault(access, addr, fmt.Errorf("page table entry out of range at addr=%d", pteAddr))
+		}
+		pte, err := c.Memory.ReadWord(uint32(pteAddr))
+		if err != nil {
+			return accessFault(access, addr, err)
+		}
+		if pte&PTE_V == 0 || (pte&PTE_R == 0 && pte&PTE_W != 0) {
+			return pageFault(access, addr)
+		}
+		if pte&(PTE_R|PTE_X) == 0 { // pointer to the next level
+			table = uint64(pte>>10) * PAGE_SIZE
+			continue
+		}
+
+		if !c.permitted(pte, access, privilege) {
+			return pageFault(access, addr)
+		}
+		ppn := pte >> 10
+		if level == 1 {
+			if ppn&0x3FF != 0 { // misaligned superpage
+				return pageFault(access, addr)
+			}
+			ppn |= vpn[0]
+		}
+		if uint64(ppn)*PAGE_SIZE > 0xFFFFFFFF {
+			return accessFault(access, addr, fmt.Errorf("physical page out of range at addr=%d", addr))
+		}
+
+		updated := pte | PTE_A
+		if access == ACCESS_STORE {
+			updated |= PTE_D
+		}
+		if updated != pte {
+			old, err := c.Memory.AtomicModifyWord(uint32(pteAddr), func(old uint32) uint32 {
+				if old != pte {
+					return old
+				}
+				return updated
+			})
+			if err != nil {
+				return accessFault(access, addr, err)
+			}
+			if old != pte { // the PTE changed under us, translate again
+				return c.walkPageTable(addr, access, privilege)
+			}
+		}
+
+		c.tlb[(addr/PAGE_SIZE)%TLB_SIZE] = tlbEntry{
+			valid: true,
+			vpn:   addr / PAGE_SIZE,
+			asid:  (c.satp & SATP_ASID) >> 22,
+			ppn:   ppn,
+			pte:   updated,
+		}
+		return nil
+	}
+	return pageFault(access, addr)
+}
+
+// FlushTLB drops cached translations of the page holding addr, or of every page when allPages is set.
+// Unless allASIDs is set, only the non-global translations of asid are dropped.
+func (c *CPU) FlushTLB(addr uint32, allPages bool, asid uint32, allASIDs bool) {
+	for i := range c.tlb {
+		entry := &c.tlb[i]
+		if !allPages && entry.vpn != addr/PAGE_SIZE {
+			continue
+		}
+		if !allASIDs && (entry.asid != asid || entry.pte&PTE_G != 0) {
+			continue
+		}
+		entry.valid = false
+	}
+}
+
+// executeSFENCE orders page table updates with later translations by flushing the TLB.
+// rs1 selects a virtual address and rs2 an address space, x0 meaning all of them.
+func (c *CPU) executeSFENCE(instruction Instruction) (int, error) {
+	if c.privilege == PRIVILEGE_USER || (c.privilege == PRIVILEGE_SUPERVISOR && c.mstatus&MSTATUS_TVM != 0) {
+		return -1, illegalInstruction(instruction, errors.New("SFENCE.VMA not allowed at the current privilege level"))
+	}
+	rs1 := instruction.operand1
+	rs2 := instruction.operand2 & 0x1F
+	addr, err1 := c.ReadRegister(rs1)
+	asid, err2 := c.ReadRegister(rs2)
+	if err1 != nil || err2 != nil {
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%s%s", instruction.address, err1, err2)
+	}
+	c.FlushTLB(addr, rs1 == 0, asid&0x1FF, rs2 == 0)
+	return OK, nil
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	ROOT_TABLE  = 0x10000
+	LEAF_TABLE  = 0x11000
+	TEST_ASID   = 5
+	USER_PAGE   = 0x1000 // R|W|U, mapped to 0x20000
+	KERNEL_PAGE = 0x2000 // R|X, mapped to 0x21000
+	CLEAN_PAGE  = 0x3000 // R|W without A and D, mapped to 0x22000
+	EXEC_PAGE   = 0x6000 // X only, mapped to 0x23000
+	SUPERPAGE   = 0x00400000
+)
+
+// pte builds a page table entry pointing at a physical address.
+func pte(phys uint32, flags uint32) uint32 {
+	return phys/PAGE_SIZE<<10 | flags
+}
+
+// newPagedCPU returns a CPU in supervisor mode with Sv32 enabled and a small page table.
+func newPagedCPU(t *testing.T) *CPU {
+	t.Helper()
+	cpu := NewCPU(NewMemory())
+	entries := map[uint32]uint32{
+		ROOT_TABLE + 0*4: pte(LEAF_TABLE, PTE_V),
+		ROOT_TABLE + 1*4: pte(0x400000, PTE_V|PTE_R|PTE_W|PTE_A|PTE_D),
+		ROOT_TABLE + 2*4: pte(0x801000, PTE_V|PTE_R|PTE_A), // misaligned superpage
+		LEAF_TABLE + 0*4: pte(0, PTE_V|PTE_R|PTE_X|PTE_U|PTE_A),
+		LEAF_TABLE + 1*4: pte(0x20000, PTE_V|PTE_R|PTE_W|PTE_U|PTE_A|PTE_D),
+		LEAF_TABLE + 2*4: pte(0x21000, PTE_V|PTE_R|PTE_X|PTE_A),
+		LEAF_TABLE + 3*4: pte(0x22000, PTE_V|PTE_R|PTE_W),
+		LEAF_TABLE + 5*4: pte(0x24000, PTE_V|PTE_W|PTE_A|PTE_D), // reserved W without R
+		LEAF_TABLE + 6*4: pte(0x23000, PTE_V|PTE_X|PTE_A),
+	}
+	for addr, val := range entries {
+		if err := cpu.Memory.WriteWord(addr, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cpu.privilege = PRIVILEGE_SUPERVISOR
+	cpu.satp = SATP_MODE | TEST_ASID<<22 | ROOT_TABLE/PAGE_SIZE
+	return cpu
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name      string
+		privilege uint32
+		mstatus   uint32
+		addr      uint32
+		access    AccessType
+		want      uint32
+		wantCause uint32 // page fault cause, 0 when the translation succeeds
+	}{
+		{"supervisor fetch", PRIVILEGE_SUPERVISOR, 0, KERNEL_PAGE + 0x10, ACCESS_FETCH, 0x21010, 0},
+		{"user load", PRIVILEGE_USER, 0, USER_PAGE + 0x123, ACCESS_LOAD, 0x20123, 0},
+		{"user store", PRIVILEGE_USER, 0, USER_PAGE + 4, ACCESS_STORE, 0x20004, 0},
+		{"superpage", PRIVILEGE_SUPERVISOR, 0, SUPERPAGE + 0x3456, ACCESS_LOAD, 0x403456, 0},
+		{"machine mode is not translated", PRIVILEGE_MACHINE, 0, 0x5000, ACCESS_LOAD, 0x5000, 0},
+		{"user load of a supervisor page", PRIVILEGE_USER, 0, KERNEL_PAGE, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"user store to a read-only page", PRIVILEGE_USER, 0, 0x0, ACCESS_STORE, 0, CAUSE_STORE_PAGE_FAULT},
+		{"supervisor load of a user page", PRIVILEGE_SUPERVISOR, 0, USER_PAGE, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"supervisor load of a user page with SUM", PRIVILEGE_SUPERVISOR, MSTATUS_SUM, USER_PAGE, ACCESS_LOAD, 0x20000, 0},
+		{"supervisor fetch of a user page with SUM", PRIVILEGE_SUPERVISOR, MSTATUS_SUM, 0x0, ACCESS_FETCH, 0, CAUSE_INSTRUCTION_PAGE_FAULT},
+		{"load of an execute-only page", PRIVILEGE_SUPERVISOR, 0, EXEC_PAGE, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"load of an execute-only page with MXR", PRIVILEGE_SUPERVISOR, MSTATUS_MXR, EXEC_PAGE, ACCESS_LOAD, 0x23000, 0},
+		{"fetch of a non-executable page", PRIVILEGE_USER, 0, USER_PAGE, ACCESS_FETCH, 0, CAUSE_INSTRUCTION_PAGE_FAULT},
+		{"invalid entry", PRIVILEGE_SUPERVISOR, 0, 0x4000, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"reserved write-only entry", PRIVILEGE_SUPERVISOR, 0, 0x5000, ACCESS_STORE, 0, CAUSE_STORE_PAGE_FAULT},
+		{"misaligned superpage", PRIVILEGE_SUPERVISOR, 0, 0x00800000, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"unmapped superpage", PRIVILEGE_SUPERVISOR, 0, 0x00C00000, ACCESS_FETCH, 0, CAUSE_INSTRUCTION_PAGE_FAULT},
+		{"MPRV uses the MPP privilege", PRIVILEGE_MACHINE, MSTATUS_MPRV, KERNEL_PAGE, ACCESS_LOAD, 0, CAUSE_LOAD_PAGE_FAULT},
+		{"MPRV does not apply to fetches", PRIVILEGE_MACHINE, MSTATUS_MPRV, 0x5000, ACCESS_FETCH, 0x5000, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := newPagedCPU(t)
+			cpu.privilege = test.privilege
+			cpu.mstatus = test.mstatus
+			got, err := cpu.Translate(test.addr, test.access)
+			if test.wantCause == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("0x%08x translated to 0x%08x, want 0x%08x", test.addr, got, test.want)
+				}
+				return
+			}
+			var exception *Exception
+			if !errors.As(err, &exception) {
+				t.Fatalf("got 0x%08x, %v, want a page fault", got, err)
+			}
+			if exception.Cause != test.wantCause || exception.Tval != test.addr {
+				t.Errorf("cause %d tval 0x%x, want cause %d tval 0x%x", exception.Cause, exception.Tval, test.wantCause, test.addr)
+			}
+		})
+	}
+}
+
+func TestAccessedAndDirtyBits(t *testing.T) {
+	cpu := newPagedCPU(t)
+	entry := uint32(LEAF_TABLE + 3*4)
+	if _, err := cpu.Translate(CLEAN_PAGE, ACCESS_LOAD); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cpu.Memory.ReadWord(entry); got&(PTE_A|PTE_D) != PTE_A {
+		t.Errorf("after a load the PTE is 0x%x, want A set and D clear", got)
+	}
+	// the translation is cached without D, the store has to walk the table again
+	if _, err := cpu.Translate(CLEAN_PAGE, ACCESS_STORE); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cpu.Memory.ReadWord(entry); got&(PTE_A|PTE_D) != PTE_A|PTE_D {
+		t.Errorf("after a store the PTE is 0x%x, want A and D set", got)
+	}
+}
+
+func TestTLB(t *testing.T) {
+	remap := func(cpu *CPU) {
+		cpu.Memory.WriteWord(LEAF_TABLE+1*4, pte(0x30000, PTE_V|PTE_R|PTE_W|PTE_U|PTE_A|PTE_D))
+	}
+	tests := []struct {
+		name  string
+		flush func(cpu *CPU)
+		want  uint32
+	}{
+		{"cached translation", func(cpu *CPU) {}, 0x20000},
+		{"flush of the page", func(cpu *CPU) { cpu.FlushTLB(USER_PAGE, false, TEST_ASID, false) }, 0x30000},
+		{"flush of another page", func(cpu *CPU) { cpu.FlushTLB(KERNEL_PAGE, false, 0, true) }, 0x20000},
+		{"flush of another address space", func(cpu *CPU) { cpu.FlushTLB(0, true, TEST_ASID+1, false) }, 0x20000},
+		{"switch of address space", func(cpu *CPU) { cpu.satp += 1 << 22 }, 0x30000},
+		{"write to satp", func(cpu *CPU) { cpu.WriteCSR(CSR_SATP, cpu.satp) }, 0x30000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := newPagedCPU(t)
+			cpu.mstatus = MSTATUS_SUM
+			if _, err := cpu.Translate(USER_PAGE, ACCESS_LOAD); err != nil {
+				t.Fatal(err)
+			}
+			remap(cpu)
+			test.flush(cpu)
+			got, err := cpu.Translate(USER_PAGE, ACCESS_LOAD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("translated to 0x%08x, want 0x%08x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPageFaultDelegation(t *testing.T) {
+	cpu := newPagedCPU(t)
+	cpu.Personality = PERSONALITY_BARE_METAL
+	cpu.privilege = PRIVILEGE_USER
+	cpu.medeleg = 1 << CAUSE_LOAD_PAGE_FAULT
+	cpu.stvec = KERNEL_PAGE
+	handler := []uint32{
+		0x14202673, // csrr a2, scause
+		0x143026f3, // csrr a3, stval
+		EBREAK_WORD,
+	}
+	for i, word := range handler {
+		cpu.Memory.WriteWord(0x21000+uint32(i*4), word)
+	}
+	cpu.Registers[ARG_ONE] = 0x4000
+	state := runProgram(t, cpu, []uint32{
+		0x0045a503, // lw a0, 4(a1)
+	})
+	if state != E_BREAK {
+		t.Fatalf("state = %d, want E_BREAK", state)
+	}
+	wantRegisters(t, cpu, map[uint32]uint32{ARG_TWO: CAUSE_LOAD_PAGE_FAULT, ARG_THREE: 0x4004})
+	if cpu.Privilege() != PRIVILEGE_SUPERVISOR || cpu.sepc != 0 {
+		t.Errorf("privilege %d sepc 0x%x, want supervisor mode and sepc 0", cpu.Privilege(), cpu.sepc)
+	}
+}
@@ -0,0 +1,48 @@
+package core
+
+// ELF OS/ABI identifiers.
+const (
+	ELFOSABI_NONE       = 0 // System V, used by bare-metal toolchains such as riscv64-unknown-elf-gcc
+	ELFOSABI_LINUX      = 3
+	ELFOSABI_STANDALONE = 255
+)
+
+// Personality selects how a program requests services from its environment.
+type Personality int
+
+const (
+	// PERSONALITY_AUTO picks the personality matching the OS/ABI of the loaded ELF file, see PersonalityForABI.
+	PERSONALITY_AUTO Personality = iota
+	// PERSONALITY_LINUX services ECALL with the built-in microkernel, using Linux syscall numbers.
+	PERSONALITY_LINUX
+	// PERSONALITY_BARE_METAL provides no services: ECALL raises an environment call exception.
+	PERSONALITY_BARE_METAL
+	// PERSONALITY_SEMIHOSTING services the RISC-V semihosting sequence (slli x0, x0, 0x1f; ebreak; srai x0, x0, 7).
+	// ECALL raises an environment call exception.
+	PERSONALITY_SEMIHOSTING
+)
+
+// PersonalityForABI returns the default personality of programs built for an OS/ABI.
+// Only ELFOSABI_LINUX gets the Linux personality. ELFOSABI_NONE is also used by firmware built with
+// riscv64-unknown-elf-gcc, so it gets no services: set Personality to PERSONALITY_LINUX to run
+// newlib/libgloss programs making Linux-numbered syscalls, as LoadProcess does.
+func PersonalityForABI(osabi byte) Personality {
+	switch osabi {
+	case ELFOSABI_LINUX:
+		return PERSONALITY_LINUX
+	default:
+		return PERSONALITY_BARE_METAL
+	}
+}
+
+// personality resolves PERSONALITY_AUTO. Without a loaded ELF file, such as for raw binaries
+// written to memory, the Linux personality is used.
+func (c *CPU) personality() Personality {
+	if c.Personality != PERSONALITY_AUTO {
+		return c.Personality
+	}
+	if c.ELF == nil {
+		return PERSONALITY_LINUX
+	}
+	return PersonalityForABI(c.ELF.OSABI)
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Platform-level interrupt controller memory map, as laid out by SiFive and used by QEMU's virt machine.
+const (
+	PLIC_BASE      = 0x0C000000
+	PLIC_SIZE      = 0x4000000
+	PLIC_PRIORITY  = 0x000000 // one word per source
+	PLIC_PENDING   = 0x001000 // one bit per source
+	PLIC_ENABLE    = 0x002000 // one bit per source, 0x80 bytes per context
+	PLIC_CONTEXT   = 0x200000 // threshold and claim/complete, 0x1000 bytes per context
+	PLIC_THRESHOLD = 0x0
+	PLIC_CLAIM     = 0x4
+
+	PLIC_DEFAULT_SOURCES = 32 // sources of the PLIC created by NewCPU
+	PLIC_MAX_PRIORITY    = 7  // priorities and thresholds range from 0 (never interrupts) to 7
+)
+
+// PLIC routes the interrupt lines of devices to the harts. Every hart has two contexts:
+// context 2*hart raises the machine external interrupt and 2*hart+1 the supervisor one.
+// Source 0 does not exist, devices use sources 1 to sources-1.
+type PLIC struct {
+	lock      sync.Mutex
+	priority  []uint32
+	asserted  []bool // current level of every interrupt line
+	pending   []bool
+	inService []bool // claimed and not completed yet
+	enable    [][]bool
+	threshold []uint32
+}
+
+// NewPLIC creates a PLIC with the given number of interrupt sources and contexts.
+func NewPLIC(sources int, contexts int) *PLIC {
+	plic := &PLIC{
+		priority:  make([]uint32, sources),
+		asserted:  make([]bool, sources),
+		pending:   make([]bool, sources),
+		inService: make([]bool, sources),
+		enable:    make([][]bool, contexts),
+		threshold: make([]uint32, contexts),
+	}
+	for i := range plic.enable {
+		plic.enable[i] = make([]bool, sources)
+	}
+	return plic
+}
+
+// AssertIRQ raises the interrupt line of a source. Lines are level-triggered:
+// the source stays pending until it is claimed, and pends again on completion if still raised.
+func (p *PLIC) AssertIRQ(source uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if source == 0 || source >= uint32(len(p.asserted)) {
+		return
+	}
+	p.asserted[source] = true
+	if !p.inService[source] {
+		p.pending[source] = true
+	}
+}
+
+// DeassertIRQ lowers the interrupt line of a source.
+func (p *PLIC) DeassertIRQ(source uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if source == 0 || source >= uint32(len(p.asserted)) {
+		return
+	}
+	p.asserted[source] = false
+	p.pending[source] = false
+}
+
+// Interrupting reports whether a context has an enabled pending interrupt above its threshold.
+func (p *PLIC) Interrupting(context uint32) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.bestSource(context) != 0
+}
+
+// bestSource returns the enabled pending source of highest priority above the threshold
+// of a context, or 0 if there is none. Ties go to the lowest source number.
+func (p *PLIC) bestSource(context uint32) uint32 {
+	if context >= uint32(len(p.enable)) {
+		return 0
+	}
+	best := uint32(0)
+	for source := 1; source < len(p.pending); source++ {
+		if p.pending[source] && p.enable[context][source] && p.priority[source] > p.threshold[context] &&
+			(best == 0 || p.priority[source] > p.priority[best]) {
+			best = uint32(source)
+		}
+	}
+	return best
+}
+
+// Load reads a PLIC register. Only aligned word accesses are supported.
+// Reading the claim register claims the best pending interrupt of the context.
+func (p *PLIC) Load(offset uint32, size uint32) (uint32, error) {
+	if size != 4 || offset%4 != 0 {
+		return 0, fmt.Errorf("unsupported PLIC read of %d bytes at offset=%d", size, offset)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	sources := uint32(len(p.priority))
+	contexts := uint32(len(p.enable))
+	switch {
+	case offset < PLIC_PENDING:
+		if offset/4 < sources {
+			return p.priority[offset/4], nil
+		}
+	case offset < PLIC_ENABLE:
+		return packBits(p.pending, (offset-PLIC_PENDING)*8), nil
+	case offset < PLIC_CONTEXT:
+		context := (offset - PLIC_ENABLE) / 0x80
+		if context < contexts {
+			return packBits(p.enable[context], (offset-PLIC_ENABLE)%0x80*8), nil
+		}
+	default:
+		context := (offset - PLIC_CONTEXT) / 0x1000
+		if context >= contexts {
+			break
+		}
+		switch (offset - PLIC_CONTEXT) % 0x1000 {
+		case PLIC_THRESHOLD:
+			return p.threshold[context], nil
+		case PLIC_CLAIM:
+			source := p.bestSource(context)
+			if source != 0 {
+				p.pending[source] = false
+				p.inService[source] = true
+			}
+			return source, nil
+		}
+	}
+	return 0, nil
+}
+
+// Store writes a PLIC register. Only aligned word accesses are supported.
+// Writing a source number to the claim register completes its interrupt.
+func (p *PLIC) Store(offset uint32, size uint32, val uint32) error {
+	if size != 4 || offset%4 != 0 {
+		return fmt.Errorf("unsupported PLIC write of %d bytes at offset=%d", size, offset)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	sources := uint32(len(p.priority))
+	contexts := uint32(len(p.enable))
+	switch {
+	case offset < PLIC_PENDING:
+		if source := offset / 4; source != 0 && source < sources {
+			p.priority[source] = min(val, PLIC_MAX_PRIORITY)
+		}
+	case offset < PLIC_ENABLE:
+		// pending bits are read-only
+	case offset < PLIC_CONTEXT:
+		context := (offset - PLIC_ENABLE) / 0x80
+		if context < contexts {
+			unpackBits(p.enable[context], (offset-PLIC_ENABLE)%0x80*8, val)
+			p.enable[context][0] = false
+		}
+	default:
+		context := (offset - PLIC_CONTEXT) / 0x1000
+		if context >= contexts {
+			break
+		}
+		switch (offset - PLIC_CONTEXT) % 0x1000 {
+		case PLIC_THRESHOLD:
+			p.threshold[context] = min(val, PLIC_MAX_PRIORITY)
+		case PLIC_CLAIM:
+			if val != 0 && val < sources && p.inService[val] {
+				p.inService[val] = false
+				p.pending[val] = p.asserted[val]
+			}
+		}
+	}
+	return nil
+}
+
+// packBits returns the 32 flags starting at first as a word, one bit per flag.
+func packBits(flags []bool, first uint32) uint32 {
+	var word uint32
+	for i := uint32(0); i < 32; i++ {
+		if first+i < uint32(len(flags)) && flags[first+i] {
+			word |= 1 << i
+		}
+	}
+	return word
+}
+
+// unpackBits sets the 32 flags starting at first from the bits of a word.
+func unpackBits(flags []bool, first uint32, word uint32) {
+	for i := uint32(0); i < 32; i++ {
+		if first+i < uint32(len(flags)) {
+			flags[first+i] = word&(1<<i) != 0
+		}
+	}
+}
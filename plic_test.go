@@ -0,0 +1,213 @@
+package core
+
+import "testing"
+
+// plicContext returns the offset of a register of a context.
+func plicContext(context uint32, reg uint32) uint32 {
+	return PLIC_CONTEXT + context*0x1000 + reg
+}
+
+func TestPLICClaimComplete(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(p *PLIC)
+		context   uint32
+		wantClaim uint32
+	}{
+		{
+			name: "enabled source",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 1)
+				p.Store(PLIC_ENABLE, 4, 1<<3)
+				p.AssertIRQ(3)
+			},
+			wantClaim: 3,
+		},
+		{
+			name: "disabled source",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 1)
+				p.AssertIRQ(3)
+			},
+		},
+		{
+			name: "priority 0 never interrupts",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_ENABLE, 4, 1<<3)
+				p.AssertIRQ(3)
+			},
+		},
+		{
+			name: "priority at the threshold",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 2)
+				p.Store(PLIC_ENABLE, 4, 1<<3)
+				p.Store(plicContext(0, PLIC_THRESHOLD), 4, 2)
+				p.AssertIRQ(3)
+			},
+		},
+		{
+			name: "highest priority first",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 1)
+				p.Store(PLIC_PRIORITY+5*4, 4, 4)
+				p.Store(PLIC_ENABLE, 4, 1<<3|1<<5)
+				p.AssertIRQ(3)
+				p.AssertIRQ(5)
+			},
+			wantClaim: 5,
+		},
+		{
+			name: "ties go to the lowest source",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 2)
+				p.Store(PLIC_PRIORITY+5*4, 4, 2)
+				p.Store(PLIC_ENABLE, 4, 1<<3|1<<5)
+				p.AssertIRQ(5)
+				p.AssertIRQ(3)
+			},
+			wantClaim: 3,
+		},
+		{
+			name: "enables are per context",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 1)
+				p.Store(PLIC_ENABLE+0x80, 4, 1<<3)
+				p.AssertIRQ(3)
+			},
+			context:   1,
+			wantClaim: 3,
+		},
+		{
+			name: "deasserted before the claim",
+			setup: func(p *PLIC) {
+				p.Store(PLIC_PRIORITY+3*4, 4, 1)
+				p.Store(PLIC_ENABLE, 4, 1<<3)
+				p.AssertIRQ(3)
+				p.DeassertIRQ(3)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plic := NewPLIC(8, 2)
+			test.setup(plic)
+			if got := plic.Interrupting(test.context); got != (test.wantClaim != 0) {
+				t.Errorf("Interrupting(%d) = %t", test.context, got)
+			}
+			claim, err := plic.Load(plicContext(test.context, PLIC_CLAIM), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claim != test.wantClaim {
+				t.Errorf("claimed %d, want %d", claim, test.wantClaim)
+			}
+		})
+	}
+}
+
+func TestPLICLevelTriggered(t *testing.T) {
+	plic := NewPLIC(8, 2)
+	plic.Store(PLIC_PRIORITY+2*4, 4, 1)
+	plic.Store(PLIC_ENABLE, 4, 1<<2)
+	plic.AssertIRQ(2)
+	if pending, _ := plic.Load(PLIC_PENDING, 4); pending != 1<<2 {
+		t.Errorf("pending = 0x%x, want 0x4", pending)
+	}
+	if claim, _ := plic.Load(plicContext(0, PLIC_CLAIM), 4); claim != 2 {
+		t.Fatalf("claimed %d, want 2", claim)
+	}
+	if plic.Interrupting(0) {
+		t.Error("a claimed source is still interrupting")
+	}
+	plic.AssertIRQ(2) // still in service, does not pend again
+	if claim, _ := plic.Load(plicContext(0, PLIC_CLAIM), 4); claim != 0 {
+		t.Errorf("claimed %d while in service, want 0", claim)
+	}
+	plic.Store(plicContext(0, PLIC_CLAIM), 4, 2)
+	if !plic.Interrupting(0) {
+		t.Error("a line still raised did not pend again on completion")
+	}
+	plic.Load(plicContext(0, PLIC_CLAIM), 4)
+	plic.DeassertIRQ(2)
+	plic.Store(plicContext(0, PLIC_CLAIM), 4, 2)
+	if plic.Interrupting(0) {
+		t.Error("a lowered line pended again on completion")
+	}
+}
+
+func TestPLICRegisters(t *testing.T) {
+	plic := NewPLIC(40, 2)
+	plic.Store(PLIC_PRIORITY+1*4, 4, 100)
+	if got, _ := plic.Load(PLIC_PRIORITY+1*4, 4); got != PLIC_MAX_PRIORITY {
+		t.Errorf("priority = %d, want it clamped to %d", got, PLIC_MAX_PRIORITY)
+	}
+	plic.Store(PLIC_PRIORITY, 4, 1)
+	if got, _ := plic.Load(PLIC_PRIORITY, 4); got != 0 {
+		t.Errorf("priority of source 0 = %d, want 0", got)
+	}
+	plic.Store(PLIC_ENABLE+0x80+4, 4, 0xFFFFFFFF)
+	if got, _ := plic.Load(PLIC_ENABLE+0x80+4, 4); got != 0xFF {
+		t.Errorf("enables of sources 32-63 = 0x%x, want 0xff", got)
+	}
+	plic.Store(PLIC_ENABLE, 4, 0xFFFFFFFF)
+	if got, _ := plic.Load(PLIC_ENABLE, 4); got != 0xFFFFFFFE {
+		t.Errorf("enables of sources 0-31 = 0x%x, want source 0 disabled", got)
+	}
+	plic.AssertIRQ(35)
+	plic.AssertIRQ(40) // out of range
+	if got, _ := plic.Load(PLIC_PENDING+4, 4); got != 1<<3 {
+		t.Errorf("pending bits of sources 32-63 = 0x%x, want 0x8", got)
+	}
+	plic.Store(PLIC_PENDING+4, 4, 0)
+	if got, _ := plic.Load(PLIC_PENDING+4, 4); got != 1<<3 {
+		t.Error("the pending bits were written")
+	}
+	plic.Store(plicContext(1, PLIC_THRESHOLD), 4, 3)
+	if got, _ := plic.Load(plicContext(1, PLIC_THRESHOLD), 4); got != 3 {
+		t.Errorf("threshold = %d, want 3", got)
+	}
+	if _, err := plic.Load(PLIC_PRIORITY+2, 4); err == nil {
+		t.Error("misaligned read was accepted")
+	}
+	if err := plic.Store(PLIC_PRIORITY, 2, 1); err == nil {
+		t.Error("half word write was accepted")
+	}
+}
+
+func TestExternalInterrupts(t *testing.T) {
+	runTrapTests(t, []trapTest{
+		{
+			name: "machine external interrupt",
+			setup: func(c *CPU) {
+				c.Plic.Store(PLIC_PRIORITY+3*4, 4, 1)
+				c.Plic.Store(PLIC_ENABLE, 4, 1<<3)
+				c.Plic.AssertIRQ(3)
+				c.mtvec = HANDLER
+				c.mie = MIP_MEIP
+				c.mstatus |= MSTATUS_MIE
+			},
+			program: []uint32{0x0000006f}, // j .
+			handler: []uint32{
+				0x0c2002b7, // lui t0, 0xc200
+				0x0042a603, // lw a2, 4(t0)
+				0x342026f3, // csrr a3, mcause
+				0x00c2a223, // sw a2, 4(t0)
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: 3, ARG_THREE: 1<<31 | INTERRUPT_MACHINE_EXTERNAL})
+			},
+		},
+	})
+
+	cpu := NewCPU(NewMemory())
+	cpu.HartID = 1
+	cpu.Plic.Store(PLIC_PRIORITY+4*4, 4, 1)
+	cpu.Plic.Store(PLIC_ENABLE+3*0x80, 4, 1<<4) // supervisor context of hart 1
+	cpu.Plic.AssertIRQ(4)
+	if got := cpu.pendingInterrupts(); got&(MIP_SEIP|MIP_MEIP) != MIP_SEIP {
+		t.Errorf("mip = 0x%x, want SEIP set and MEIP clear", got)
+	}
+}
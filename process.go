@@ -0,0 +1,201 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// Auxiliary vector entry types passed to Linux programs.
+const (
+	AT_NULL   = 0
+	AT_PHDR   = 3 // address of the program headers
+	AT_PHENT  = 4 // size of a program header
+	AT_PHNUM  = 5 // number of program headers
+	AT_PAGESZ = 6
+	AT_ENTRY  = 9
+	AT_RANDOM = 25 // address of 16 random bytes
+)
+
+// PT_PHDR is the type of the program header locating the program headers in memory.
+const PT_PHDR = 6
+
+// DEFAULT_STACK_TOP is where the stack starts when the memory has no region to hold it, as on 32-bit Linux.
+const DEFAULT_STACK_TOP = 0xC0000000
+
+// ProcessConfig describes the command line and environment a program is started with.
+type ProcessConfig struct {
+	Args []string // argv, argv[0] being the program name
+	Env  []string // envp, as "KEY=value" strings
+
+	// StackTop is the address right above the initial stack. When zero, the stack
+	// starts at the end of the highest memory region, or at DEFAULT_STACK_TOP.
+	StackTop uint32
+	// Random fills the 16 bytes AT_RANDOM points to. When nil, they come from crypto/rand.
+	Random []byte
+}
+
+// LoadProcess loads an ELF file and sets up its initial stack like Linux does for a new process.
+// When config.Args is empty the program is started with argv[0] set to path. A PERSONALITY_AUTO
+// personality becomes PERSONALITY_LINUX, since processes make Linux syscalls whatever their OS/ABI.
+func (c *CPU) LoadProcess(path string, config ProcessConfig) error {
+	err := c.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	if c.Personality == PERSONALITY_AUTO {
+		c.Personality = PERSONALITY_LINUX
+	}
+	if len(config.Args) == 0 {
+		config.Args = []string{path}
+	}
+	return c.SetupProcess(config)
+}
+
+// SetupProcess writes argc, argv, envp and the auxiliary vector on the stack of the loaded program
+// and points sp at argc, as expected by the startup code of newlib and musl.
+// gp is set to __global_pointer$ when the program defines it.
+func (c *CPU) SetupProcess(config ProcessConfig) error {
+	if c.ELF == nil {
+		return fmt.Errorf("no program loaded")
+	}
+	top := config.StackTop
+	if top == 0 {
+		top = c.defaultStackTop()
+	}
+
+	// Strings and random bytes go in an area at the top of the stack, pointers below them.
+	var area []byte
+	pushString := func(s string) uint32 {
+		area = append(area, s...)
+		area = append(area, 0)
+		return uint32(len(area) - len(s) - 1)
+	}
+	argv := make([]uint32, len(config.Args))
+	for i, arg := range config.Args {
+		argv[i] = pushString(arg)
+	}
+	envp := make([]uint32, len(config.Env))
+	for i, env := range config.Env {
+		envp[i] = pushString(env)
+	}
+	random := config.Random
+	if random == nil {
+		random = make([]byte, 16)
+		_, err := rand.Read(random)
+		if err != nil {
+			return fmt.Errorf("failed to generate AT_RANDOM bytes: %w", err)
+		}
+	}
+	if len(random) != 16 {
+		return fmt.Errorf("AT_RANDOM needs 16 bytes, got %d", len(random))
+	}
+	randomOffset := uint32(len(area))
+	area = append(area, random...)
+	phdr, phdrMapped := c.ELF.programHeadersAddress()
+	phdrOffset := uint32(0)
+	if !phdrMapped { // no segment holds the program headers, give the program a copy
+		area = append(area, make([]byte, (4-len(area)%4)%4)...)
+		phdrOffset = uint32(len(area))
+		for _, ph := range c.ELF.ProgramHeaders {
+			area = binary.LittleEndian.AppendUint32(area, ph.Type)
+			area = binary.LittleEndian.AppendUint32(area, ph.Offset)
+			area = binary.LittleEndian.AppendUint32(area, ph.VAddr)
+			area = binary.LittleEndian.AppendUint32(area, ph.PAddr)
+			area = binary.LittleEndian.AppendUint32(area, ph.FileSize)
+			area = binary.LittleEndian.AppendUint32(area, ph.MemSize)
+			area = binary.LittleEndian.AppendUint32(area, ph.Flags)
+			area = binary.LittleEndian.AppendUint32(area, ph.Align)
+		}
+	}
+
+	if uint64(len(area))+4096 > uint64(top) {
+		return fmt.Errorf("arguments and environment do not fit below the stack top 0x%08x", top)
+	}
+	areaBase := (top - uint32(len(area))) &^ 15
+
+	phent := uint32(c.ELF.Phentsize)
+	if !phdrMapped {
+		phdr = areaBase + phdrOffset
+		phent = ELF32_PROGRAM_HEADER_SIZE
+	}
+	auxv := [][2]uint32{
+		{AT_PHDR, phdr},
+		{AT_PHENT, phent},
+		{AT_PHNUM, uint32(len(c.ELF.ProgramHeaders))},
+		{AT_PAGESZ, PAGE_SIZE},
+		{AT_ENTRY, c.ELF.Entry},
+		{AT_RANDOM, areaBase + randomOffset},
+		{AT_NULL, 0},
+	}
+
+	words := []uint32{uint32(len(argv))}
+	for _, offset := range argv {
+		words = append(words, areaBase+offset)
+	}
+	words = append(words, 0)
+	for _, offset := range envp {
+		words = append(words, areaBase+offset)
+	}
+	words = append(words, 0)
+	for _, entry := range auxv {
+		words = append(words, entry[0], entry[1])
+	}
+
+	if uint64(4*len(words))+16 > uint64(areaBase) {
+		return fmt.Errorf("%d argument, environment and auxiliary vector words do not fit below 0x%08x", len(words), areaBase)
+	}
+	sp := (areaBase - 4*uint32(len(words))) &^ 15
+	for i, ph := range c.ELF.ProgramHeaders {
+		end := uint64(ph.VAddr) + uint64(ph.MemSize)
+		if ph.Type == PT_LOAD && uint64(ph.VAddr) < uint64(top) && uint64(sp) < end {
+			return fmt.Errorf("the initial stack at 0x%08x-0x%08x overlaps segment %d at 0x%08x-0x%08x", sp, top, i, ph.VAddr, end)
+		}
+	}
+	block := make([]byte, top-sp)
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(block[4*i:], word)
+	}
+	copy(block[areaBase-sp:], area)
+	err := c.Memory.LoadBytes(sp, block)
+	if err != nil {
+		return fmt.Errorf("failed to write the initial stack at 0x%08x: %w", sp, err)
+	}
+
+	c.Registers[STACK_POINTER] = sp
+	if gp, ok := c.ELF.LookupSymbol("__global_pointer$"); ok {
+		c.Registers[GLOBAL_POINTER] = gp.Value
+	}
+	return nil
+}
+
+// defaultStackTop returns the end of the highest memory region, or DEFAULT_STACK_TOP without regions.
+func (c *CPU) defaultStackTop() uint32 {
+	var top uint64
+	for _, region := range c.Memory.Regions() {
+		if !region.ReadOnly {
+			top = max(top, uint64(region.Base)+uint64(region.Size))
+		}
+	}
+	if top == 0 {
+		return DEFAULT_STACK_TOP
+	}
+	return uint32(min(top, 1<<32-PAGE_SIZE))
+}
+
+// programHeadersAddress returns where the program headers are in memory: the address of the PT_PHDR
+// segment, or the address of the PT_LOAD segment whose file contents include them.
+func (elf *ELFFile) programHeadersAddress() (uint32, bool) {
+	for _, ph := range elf.ProgramHeaders {
+		if ph.Type == PT_PHDR {
+			return ph.VAddr, true
+		}
+	}
+	size := uint32(elf.Phnum) * uint32(elf.Phentsize)
+	for _, ph := range elf.ProgramHeaders {
+		if ph.Type == PT_LOAD && elf.PhOff >= ph.Offset && uint64(elf.PhOff)+uint64(size) <= uint64(ph.Offset)+uint64(ph.FileSize) {
+			return ph.VAddr + elf.PhOff - ph.Offset, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// processELF is a program whose entry point reads argc and the first character of argv[0].
+func processELF() testELF {
+	table, names := symbolTable(ELFCLASS32, []Symbol{
+		{Name: "__global_pointer$", Value: 0x1800, Info: STB_GLOBAL<<4 | STT_NOTYPE, Section: 1},
+	})
+	return testELF{
+		entry: 0x100,
+		segments: []testSegment{{vaddr: 0x100, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(
+			0x00012503, // lw a0, 0(sp)
+			0x00412583, // lw a1, 4(sp)
+			0x0005c603, // lbu a2, 0(a1)
+			EBREAK_WORD,
+		)}},
+		sections: []testSection{
+			{name: ".text", typ: SHT_PROGBITS, addr: 0x100, data: make([]byte, 16)},
+			{name: ".symtab", typ: SHT_SYMTAB, data: table, link: 3, entSize: 16},
+			{name: ".strtab", typ: SHT_STRTAB, data: names},
+		},
+	}
+}
+
+// loadProcessELF writes a test executable to a temporary file and loads it as a process.
+func loadProcessELF(t *testing.T, file testELF, config ProcessConfig) *CPU {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "program")
+	if err := os.WriteFile(path, file.build(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU(NewMemory())
+	if err := cpu.LoadProcess(path, config); err != nil {
+		t.Fatal(err)
+	}
+	return cpu
+}
+
+// stackWords reads n words starting at sp.
+func stackWords(t *testing.T, c *CPU, n int) []uint32 {
+	t.Helper()
+	words := make([]uint32, n)
+	for i := range words {
+		var err error
+		words[i], err = c.Memory.ReadWord(c.Registers[STACK_POINTER] + uint32(4*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return words
+}
+
+func TestInitialStack(t *testing.T) {
+	random := []byte("0123456789abcdef")
+	cpu := loadProcessELF(t, processELF(), ProcessConfig{
+		Args:   []string{"prog", "-v"},
+		Env:    []string{"HOME=/root"},
+		Random: random,
+	})
+	if cpu.Personality != PERSONALITY_LINUX {
+		t.Errorf("personality = %d, want PERSONALITY_LINUX for a process", cpu.Personality)
+	}
+	sp := cpu.Registers[STACK_POINTER]
+	if sp%16 != 0 || sp >= 0x100000 || sp < 0x100000-0x1000 {
+		t.Fatalf("sp = 0x%x, want a 16-byte aligned address right below the end of RAM", sp)
+	}
+	if gp := cpu.Registers[GLOBAL_POINTER]; gp != 0x1800 {
+		t.Errorf("gp = 0x%x, want __global_pointer$", gp)
+	}
+
+	words := stackWords(t, cpu, 20)
+	if words[0] != 2 || words[3] != 0 || words[5] != 0 {
+		t.Fatalf("stack %x, want argc 2 followed by argv, NULL, envp and NULL", words[:6])
+	}
+	wantStrings := map[uint32]string{words[1]: "prog", words[2]: "-v", words[4]: "HOME=/root"}
+	for addr, want := range wantStrings {
+		if got, _ := cpu.Memory.ReadString(addr); got != want {
+			t.Errorf("string at 0x%x = %q, want %q", addr, got, want)
+		}
+	}
+
+	auxv := map[uint32]uint32{}
+	for i := 6; i+1 < len(words); i += 2 {
+		auxv[words[i]] = words[i+1]
+		if words[i] == AT_NULL {
+			break
+		}
+	}
+	want := map[uint32]uint32{AT_PHENT: ELF32_PROGRAM_HEADER_SIZE, AT_PHNUM: 1, AT_PAGESZ: PAGE_SIZE, AT_ENTRY: 0x100, AT_NULL: 0}
+	for key, val := range want {
+		if got, ok := auxv[key]; !ok || got != val {
+			t.Errorf("auxv[%d] = 0x%x, %t, want 0x%x", key, got, ok, val)
+		}
+	}
+	got := make([]byte, 16)
+	for i := range got {
+		got[i], _ = cpu.Memory.ReadByte(auxv[AT_RANDOM] + uint32(i))
+	}
+	if !bytes.Equal(got, random) {
+		t.Errorf("AT_RANDOM bytes %q, want %q", got, random)
+	}
+	// no segment holds the program headers, AT_PHDR points at a copy on the stack
+	if ptype, _ := cpu.Memory.ReadWord(auxv[AT_PHDR]); ptype != PT_LOAD {
+		t.Errorf("AT_PHDR 0x%x points at a program header of type %d, want PT_LOAD", auxv[AT_PHDR], ptype)
+	}
+	if vaddr, _ := cpu.Memory.ReadWord(auxv[AT_PHDR] + 8); vaddr != 0x100 {
+		t.Errorf("AT_PHDR 0x%x points at a segment at 0x%x, want 0x100", auxv[AT_PHDR], vaddr)
+	}
+	for _, addr := range []uint32{auxv[AT_RANDOM], auxv[AT_PHDR], words[1], words[4]} {
+		if addr <= sp || addr >= 0x100000 {
+			t.Errorf("0x%x is not between sp and the top of the stack", addr)
+		}
+	}
+
+	state := runLoaded(t, cpu)
+	if state != E_BREAK {
+		t.Fatalf("state = %d, want E_BREAK", state)
+	}
+	wantRegisters(t, cpu, map[uint32]uint32{ARG_ZERO: 2, ARG_TWO: 'p'})
+}
+
+// runLoaded runs the loaded program until it stops.
+func runLoaded(t *testing.T, c *CPU) int {
+	t.Helper()
+	state := OK
+	for steps := 0; state == OK && steps < 10000; steps++ {
+		var err error
+		state, err = c.ExecuteSingle()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state
+}
+
+func TestProgramHeadersSegment(t *testing.T) {
+	file := processELF()
+	file.segments = append(file.segments, testSegment{vaddr: 0x2000, flags: PERMISSION_R, data: make([]byte, 32)})
+	data := file.build()
+	binary.LittleEndian.PutUint32(data[ELF32_HEADER_SIZE+ELF32_PROGRAM_HEADER_SIZE:], PT_PHDR)
+	path := filepath.Join(t.TempDir(), "program")
+	os.WriteFile(path, data, 0o644)
+	cpu := NewCPU(NewMemory())
+	if err := cpu.LoadProcess(path, ProcessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	words := stackWords(t, cpu, 16)
+	if argv0, _ := cpu.Memory.ReadString(words[1]); words[0] != 1 || argv0 != path {
+		t.Errorf("argc %d argv[0] %q, want the path of the program", words[0], argv0)
+	}
+	if words[4] != AT_PHDR || words[5] != 0x2000 {
+		t.Errorf("auxv starts with %d=0x%x, want AT_PHDR=0x2000 from PT_PHDR", words[4], words[5])
+	}
+}
+
+func TestSetupProcessErrors(t *testing.T) {
+	elf, err := ReadELFBytes(processELF().build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	withData := processELF()
+	withData.segments = append(withData.segments, testSegment{vaddr: 0x8000, flags: PERMISSION_R | PERMISSION_W, data: make([]byte, 0x100)})
+	dataELF, err := ReadELFBytes(withData.build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		elf    *ELFFile
+		config ProcessConfig
+	}{
+		{"no program", nil, ProcessConfig{Args: []string{"prog"}}},
+		{"short AT_RANDOM", elf, ProcessConfig{Args: []string{"prog"}, Random: []byte{1, 2, 3}}},
+		{"stack top too low", elf, ProcessConfig{Args: []string{"prog"}, StackTop: 0x800}},
+		{"stack outside memory", elf, ProcessConfig{Args: []string{"prog"}, StackTop: 0x40000000}},
+		{"too many arguments below the stack top", elf, ProcessConfig{Args: make([]string, 10000), StackTop: 0x3800}},
+		{"stack over a segment", dataELF, ProcessConfig{Args: []string{"prog"}, StackTop: 0x8080}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			cpu.ELF = test.elf
+			if err := cpu.SetupProcess(test.config); err == nil {
+				t.Errorf("the stack was set up at sp=0x%x", cpu.Registers[STACK_POINTER])
+			}
+		})
+	}
+}
+
+func TestDefaultStackTop(t *testing.T) {
+	tests := []struct {
+		name    string
+		regions []MemoryRegion
+		want    uint32
+	}{
+		{"default memory", DefaultMemoryConfig().Regions, 0x100000},
+		{"highest writable region", []MemoryRegion{{Base: 0x80000000, Size: 0x10000}, {Base: 0x1000, Size: 0x1000}, {Base: 0x90000000, Size: 0x1000, ReadOnly: true}}, 0x80010000},
+		{"region at the top of the address space", []MemoryRegion{{Base: 0xFFFF0000, Size: 0x10000}}, 0xFFFFF000},
+		{"no regions", nil, DEFAULT_STACK_TOP},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMemoryWithConfig(MemoryConfig{Regions: test.regions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := NewCPU(m).defaultStackTop(); got != test.want {
+				t.Errorf("stack top = 0x%x, want 0x%x", got, test.want)
+			}
+		})
+	}
+}
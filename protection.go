@@ -0,0 +1,87 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Segment permissions, using the bits of the ELF program header flags.
+const (
+	PERMISSION_X = 1 << 0
+	PERMISSION_W = 1 << 1
+	PERMISSION_R = 1 << 2
+)
+
+// Protection grants permissions to the addresses [Base, Base+Size).
+type Protection struct {
+	Base        uint32
+	Size        uint32
+	Permissions uint32 // PERMISSION_* bits
+}
+
+// protections holds the permissions of the loaded segments.
+type protections struct {
+	lock   sync.RWMutex
+	ranges []Protection
+}
+
+// Protect restricts the accesses made by programs to [base, base+size) to the given permissions.
+// Once a range is executable, instructions can only be fetched from executable ranges;
+// loads and stores outside every range are not restricted.
+func (m *Memory) Protect(base uint32, size uint32, permissions uint32) {
+	m.protections.lock.Lock()
+	defer m.protections.lock.Unlock()
+	m.protections.ranges = append(m.protections.ranges, Protection{Base: base, Size: size, Permissions: permissions})
+}
+
+// ClearProtections removes every range registered with Protect, leaving the memory unrestricted.
+// Loaders call it so the permissions of a previously loaded program do not apply to the next one.
+func (m *Memory) ClearProtections() {
+	m.protections.lock.Lock()
+	defer m.protections.lock.Unlock()
+	m.protections.ranges = nil
+}
+
+// Protections returns the ranges registered with Protect.
+func (m *Memory) Protections() []Protection {
+	m.protections.lock.RLock()
+	defer m.protections.lock.RUnlock()
+	return append([]Protection(nil), m.protections.ranges...)
+}
+
+// CheckAccess reports whether a program may access size bytes at addr.
+// Loaders and debuggers using the Read and Write methods directly are never restricted.
+func (m *Memory) CheckAccess(addr uint32, size uint32, access AccessType) error {
+	if m.IgnorePermissions {
+		return nil
+	}
+	m.protections.lock.RLock()
+	defer m.protections.lock.RUnlock()
+	executable := false
+	for _, p := range m.protections.ranges {
+		executable = executable || p.Permissions&PERMISSION_X != 0
+		if addr < p.Base || uint64(addr-p.Base)+uint64(size) > uint64(p.Size) {
+			continue
+		}
+		switch {
+		case access == ACCESS_FETCH && p.Permissions&PERMISSION_X != 0,
+			access == ACCESS_LOAD && p.Permissions&PERMISSION_R != 0,
+			access == ACCESS_STORE && p.Permissions&PERMISSION_W != 0:
+			return nil
+		}
+	}
+	if access == ACCESS_FETCH && executable {
+		return fmt.Errorf("instruction fetch from non-executable memory at addr=%d", addr)
+	}
+	for _, p := range m.protections.ranges {
+		if uint64(addr) < uint64(p.Base)+uint64(p.Size) && uint64(p.Base) < uint64(addr)+uint64(size) {
+			if access == ACCESS_LOAD {
+				return fmt.Errorf("read from non-readable memory at addr=%d", addr)
+			}
+			if access == ACCESS_STORE {
+				return fmt.Errorf("write to read-only memory at addr=%d", addr)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package core
+
+import "testing"
+
+func TestCheckAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    uint32
+		size    uint32
+		access  AccessType
+		wantErr bool
+	}{
+		{"fetch from text", 0x100, 2, ACCESS_FETCH, false},
+		{"load from text", 0x100, 4, ACCESS_LOAD, false},
+		{"store to text", 0x100, 4, ACCESS_STORE, true},
+		{"fetch from data", 0x1000, 2, ACCESS_FETCH, true},
+		{"store to data", 0x1000, 4, ACCESS_STORE, false},
+		{"load from an execute-only range", 0x2000, 4, ACCESS_LOAD, true},
+		{"store across text and data", 0x0FFE, 4, ACCESS_STORE, true},
+		{"store outside every range", 0x8000, 4, ACCESS_STORE, false},
+		{"fetch outside every range", 0x8000, 2, ACCESS_FETCH, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMemory()
+			m.Protect(0, 0x1000, PERMISSION_R|PERMISSION_X)
+			m.Protect(0x1000, 0x1000, PERMISSION_R|PERMISSION_W)
+			m.Protect(0x2000, 0x1000, PERMISSION_X)
+			err := m.CheckAccess(test.addr, test.size, test.access)
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %v", err, test.wantErr)
+			}
+			m.IgnorePermissions = true
+			if err := m.CheckAccess(test.addr, test.size, test.access); err != nil {
+				t.Errorf("IgnorePermissions did not allow the access: %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchesAreUnrestrictedWithoutExecutableRanges(t *testing.T) {
+	m := NewMemory()
+	m.Protect(0x1000, 0x1000, PERMISSION_R|PERMISSION_W)
+	if err := m.CheckAccess(0x8000, 2, ACCESS_FETCH); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadersReplaceProtections(t *testing.T) {
+	first := testELF{segments: []testSegment{
+		{vaddr: 0, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(EBREAK_WORD)},
+		{vaddr: 0x1000, flags: PERMISSION_R, data: make([]byte, 16)},
+	}}
+	second := testELF{segments: []testSegment{
+		{vaddr: 0x4000, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(EBREAK_WORD)},
+	}}
+	load := func(t *testing.T, m *Memory, file testELF) {
+		elf, err := ReadELFBytes(file.build())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := elf.CopyToMemory(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMemory()
+	load(t, m, first)
+	if got := len(m.Protections()); got != 2 {
+		t.Fatalf("%d protected ranges after loading the first file, want 2", got)
+	}
+	load(t, m, second)
+	if got := m.Protections(); len(got) != 1 || got[0].Base != 0x4000 {
+		t.Errorf("protected ranges %+v after loading the second file, want only 0x4000", got)
+	}
+	if err := m.CheckAccess(0x1000, 4, ACCESS_STORE); err != nil {
+		t.Errorf("the read-only segment of the first file is still protected: %v", err)
+	}
+
+	image := &Image{Segments: []ImageSegment{{Address: 0x8000, Data: []byte{1, 2, 3, 4}}}}
+	if err := image.CopyToMemory(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Protections(); len(got) != 0 {
+		t.Errorf("protected ranges %+v after loading an image, want none", got)
+	}
+
+	bad := testELF{segments: []testSegment{{vaddr: 0xFFFFF000, flags: PERMISSION_R, data: make([]byte, 4)}}}
+	load(t, m, first)
+	elf, _ := ReadELFBytes(bad.build())
+	if err := elf.CopyToMemory(m); err == nil {
+		t.Fatal("a segment outside memory was loaded")
+	}
+	if got := len(m.Protections()); got != 2 {
+		t.Errorf("a rejected file changed the protections: %d ranges, want 2", got)
+	}
+}
+
+func TestSegmentPermissionFaults(t *testing.T) {
+	handler := []uint32{
+		0x34202673, // csrr a2, mcause
+		0x343026f3, // csrr a3, mtval
+		0x30501073, // csrw mtvec, zero
+		EBREAK_WORD,
+	}
+	tests := []struct {
+		name              string
+		program           []uint32
+		ignorePermissions bool
+		wantCause         uint32
+		wantTval          uint32
+	}{
+		{
+			name:      "store to text",
+			program:   []uint32{0x00a02023}, // sw a0, 0(zero)
+			wantCause: CAUSE_STORE_ACCESS_FAULT,
+		},
+		{
+			name:      "fetch from data",
+			program:   []uint32{0x00058067}, // jr a1
+			wantCause: CAUSE_INSTRUCTION_ACCESS_FAULT,
+			wantTval:  0x1000,
+		},
+		{
+			name:      "load from text",
+			program:   []uint32{0x00002503, EBREAK_WORD}, // lw a0, 0(zero)
+			wantCause: CAUSE_BREAKPOINT,
+			wantTval:  4,
+		},
+		{
+			name:              "store to text with IgnorePermissions",
+			program:           []uint32{0x00a02023, EBREAK_WORD}, // sw a0, 0(zero)
+			ignorePermissions: true,
+			wantCause:         CAUSE_BREAKPOINT,
+			wantTval:          4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text := make([]uint32, HANDLER/4)
+			copy(text, test.program)
+			text = append(text, handler...)
+			elf, err := ReadELFBytes(testELF{segments: []testSegment{
+				{vaddr: 0, flags: PERMISSION_R | PERMISSION_X, data: wordBytes(text...)},
+				{vaddr: 0x1000, flags: PERMISSION_R | PERMISSION_W, data: wordBytes(EBREAK_WORD)},
+			}}.build())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpu := NewCPU(NewMemory())
+			cpu.Personality = PERSONALITY_BARE_METAL
+			if err := elf.CopyToMemory(cpu.Memory); err != nil {
+				t.Fatal(err)
+			}
+			cpu.Memory.IgnorePermissions = test.ignorePermissions
+			cpu.mtvec = HANDLER
+			cpu.Registers[ARG_ONE] = 0x1000
+			state := OK
+			for steps := 0; state == OK && steps < 100; steps++ {
+				state, err = cpu.ExecuteSingle()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if state != E_BREAK {
+				t.Fatalf("state = %d, want E_BREAK", state)
+			}
+			wantRegisters(t, cpu, map[uint32]uint32{ARG_TWO: test.wantCause, ARG_THREE: test.wantTval})
+		})
+	}
+}
+
+func TestSegmentPermissionFaultWithoutHandler(t *testing.T) {
+	cpu := NewCPU(NewMemory())
+	cpu.Memory.Protect(0, 0x1000, PERMISSION_R|PERMISSION_X)
+	cpu.Memory.WriteWord(0, 0x00a02023) // sw a0, 0(zero)
+	if _, err := cpu.ExecuteSingle(); err == nil || cpu.PC != 0 {
+		t.Errorf("the store to text did not stop execution at PC=0: PC=%d, %v", cpu.PC, err)
+	}
+}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Instructions surrounding the EBREAK of a semihosting call.
+const (
+	SEMIHOSTING_ENTRY = 0x01f01013 // slli x0, x0, 0x1f
+	SEMIHOSTING_EXIT  = 0x40705013 // srai x0, x0, 7
+)
+
+// Semihosting operations, passed in a0. a1 holds the parameter or the address of the parameter block.
+const (
+	SYS_OPEN          = 0x01
+	SYS_CLOSE         = 0x02
+	SYS_WRITEC        = 0x03
+	SYS_WRITE0        = 0x04
+	SYS_WRITE         = 0x05
+	SYS_READ          = 0x06
+	SYS_READC         = 0x07
+	SYS_ISERROR       = 0x08
+	SYS_ISTTY         = 0x09
+	SYS_SEEK          = 0x0A
+	SYS_FLEN          = 0x0C
+	SYS_REMOVE        = 0x0E
+	SYS_CLOCK         = 0x10
+	SYS_TIME          = 0x11
+	SYS_ERRNO         = 0x13
+	SYS_EXIT          = 0x18
+	SYS_EXIT_EXTENDED = 0x20
+)
+
+// ADP_STOPPED_APPLICATION_EXIT is the SYS_EXIT reason of a program exiting normally.
+const ADP_STOPPED_APPLICATION_EXIT = 0x20026
+
+// semihostFile is a file opened with SYS_OPEN.
+type semihostFile struct {
+	file    *os.File
+	console bool // ":tt", never closed
+}
+
+// semihosting holds the state of the semihosting personality of a CPU.
+type semihosting struct {
+	files map[uint32]*semihostFile // keyed by handle
+	next  uint32
+	errno uint32
+	start time.Time
+}
+
+// semihostOpenFlags translates the fopen modes of SYS_OPEN ("r", "rb", "r+", "r+b", "w", ...).
+var semihostOpenFlags = [12]int{
+	os.O_RDONLY, os.O_RDONLY, os.O_RDWR, os.O_RDWR,
+	os.O_WRONLY | os.O_CREATE | os.O_TRUNC, os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	os.O_RDWR | os.O_CREATE | os.O_TRUNC, os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	os.O_WRONLY | os.O_CREATE | os.O_APPEND, os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	os.O_RDWR | os.O_CREATE | os.O_APPEND, os.O_RDWR | os.O_CREATE | os.O_APPEND,
+}
+
+// isSemihostingCall reports whether an EBREAK is surrounded by the semihosting entry and exit instructions.
+func (c *CPU) isSemihostingCall(instruction Instruction) bool {
+	if instruction.length != 4 {
+		return false
+	}
+	entry, length, err := c.fetchRaw(instruction.address - 4)
+	if err != nil || length != 4 || entry != SEMIHOSTING_ENTRY {
+		return false
+	}
+	exit, length, err := c.fetchRaw(instruction.address + 4)
+	return err == nil && length == 4 && exit == SEMIHOSTING_EXIT
+}
+
+// executeSemihosting performs the operation in a0 and writes its result to a0.
+// Execution resumes at the SRAI following the EBREAK, which has no effect.
+func (c *CPU) executeSemihosting() (int, error) {
+	if c.semihost == nil {
+		c.semihost = &semihosting{files: make(map[uint32]*semihostFile), next: 1, start: time.Now()}
+	}
+	op := c.Registers[ARG_ZERO]
+	param := c.Registers[ARG_ONE]
+	args := func(n int) ([]uint32, error) { // words of the parameter block
+		words := make([]uint32, n)
+		for i := range words {
+			val, err := c.load(param+4*uint32(i), 4)
+			if err != nil {
+				return nil, err
+			}
+			words[i] = val
+		}
+		return words, nil
+	}
+
+	result := uint32(0xFFFFFFFF)
+	switch op {
+	case SYS_OPEN:
+		a, err := args(3)
+		if err != nil {
+			return -1, err
+		}
+		if a[2] >= PATH_MAX {
+			c.semihost.errno = ENAMETOOLONG
+			break
+		}
+		name, err := c.readBytes(a[0], a[2])
+		if err != nil {
+			return -1, err
+		}
+		result = c.semihost.open(string(name), a[1], c.kernel())
+	case SYS_CLOSE:
+		a, err := args(1)
+		if err != nil {
+			return -1, err
+		}
+		if f, ok := c.semihost.files[a[0]]; ok {
+			delete(c.semihost.files, a[0])
+			result = 0
+			if !f.console {
+				result = c.semihost.check(f.file.Close())
+			}
+		}
+	case SYS_WRITEC:
+		b, err := c.load(param, 1)
+		if err != nil {
+			return -1, err
+		}
+		c.kernel().stream(1).Write([]byte{byte(b)})
+		return OK, nil // a0 is preserved
+	case SYS_WRITE0:
+		stdout := c.kernel().stream(1)
+		var buf []byte
+		for addr := param; ; addr++ {
+			b, err := c.load(addr, 1)
+			if err != nil {
+				return -1, err
+			}
+			if b == 0 {
+				break
+			}
+			buf = append(buf, byte(b))
+			if len(buf) == MAX_TRANSFER { // long strings are written in pieces
+				stdout.Write(buf)
+				buf = buf[:0]
+			}
+		}
+		stdout.Write(buf)
+		return OK, nil
+	case SYS_WRITE:
+		a, err := args(3)
+		if err != nil {
+			return -1, err
+		}
+		buf, err := c.readBytes(a[1], min(a[2], MAX_TRANSFER)) // larger writes are short
+		if err != nil {
+			return -1, err
+		}
+		result = a[2]
+		if f, ok := c.semihost.files[a[0]]; ok {
+			n, err := f.file.Write(buf)
+			c.semihost.check(err)
+			result = a[2] - uint32(n) // number of bytes not written
+		}
+	case SYS_READ:
+		a, err := args(3)
+		if err != nil {
+			return -1, err
+		}
+		result = a[2]
+		if f, ok := c.semihost.files[a[0]]; ok {
+			buf := make([]byte, min(a[2], MAX_TRANSFER)) // larger reads are short
+			n, err := f.file.Read(buf)
+			if err != io.EOF {
+				c.semihost.check(err)
+			}
+			err = c.writeBytes(a[1], buf[:n])
+			if err != nil {
+				return -1, err
+			}
+			result = a[2] - uint32(n) // number of bytes not read
+		}
+	case SYS_READC:
+		buf := make([]byte, 1)
+		if _, err := c.kernel().stream(0).Read(buf); err == nil {
+			result = uint32(buf[0])
+		}
+	case SYS_ISERROR:
+		a, err := args(1)
+		if err != nil {
+			return -1, err
+		}
+		result = 0
+		if int32(a[0]) < 0 {
+			result = 1
+		}
+	case SYS_ISTTY:
+		a, err := args(1)
+		if err != nil {
+			return -1, err
+		}
+		result = 0
+		if f, ok := c.semihost.files[a[0]]; ok && f.console {
+			result = 1
+		}
+	case SYS_SEEK:
+		a, err := args(2)
+		if err != nil {
+			return -1, err
+		}
+		if f, ok := c.semihost.files[a[0]]; ok {
+			_, err := f.file.Seek(int64(a[1]), io.SeekStart)
+			result = c.semihost.check(err)
+		}
+	case SYS_FLEN:
+		a, err := args(1)
+		if err != nil {
+			return -1, err
+		}
+		if f, ok := c.semihost.files[a[0]]; ok {
+			info, err := f.file.Stat()
+			if c.semihost.check(err) == 0 {
+				result = uint32(info.Size())
+			}
+		}
+	case SYS_REMOVE:
+		a, err := args(2)
+		if err != nil {
+			return -1, err
+		}
+		if a[1] >= PATH_MAX {
+			c.semihost.errno = ENAMETOOLONG
+			break
+		}
+		name, err := c.readBytes(a[0], a[1])
+		if err != nil {
+			return -1, err
+		}
+		result = c.semihost.check(os.Remove(c.kernel().hostPath(string(name))))
+	case SYS_CLOCK:
+		result = uint32(time.Since(c.semihost.start) / (10 * time.Millisecond)) // centiseconds
+	case SYS_TIME:
+		result = uint32(time.Now().Unix())
+	case SYS_ERRNO:
+		result = c.semihost.errno
+	case SYS_EXIT:
+		c.semihost.close()
+		if param == ADP_STOPPED_APPLICATION_EXIT {
+			return PROGRAM_EXIT, nil
+		}
+		return PROGRAM_EXIT_FAILURE, nil
+	case SYS_EXIT_EXTENDED:
+		a, err := args(2)
+		if err != nil {
+			return -1, err
+		}
+		c.semihost.close()
+		if a[0] == ADP_STOPPED_APPLICATION_EXIT && a[1] == 0 {
+			return PROGRAM_EXIT, nil
+		}
+		return PROGRAM_EXIT_FAILURE, nil
+	}
+	c.WriteRegister(ARG_ZERO, result)
+	return OK, nil
+}
+
+// open implements SYS_OPEN, where ":tt" names the console: the standard streams of k.
+// Other names are relative to the working directory of k. It returns the new handle or -1.
+func (s *semihosting) open(name string, mode uint32, k *MicroKernel) uint32 {
+	if mode >= uint32(len(semihostOpenFlags)) {
+		return 0xFFFFFFFF
+	}
+	f := &semihostFile{console: name == ":tt"}
+	switch {
+	case f.console && mode < 4:
+		f.file = k.stream(0)
+	case f.console && mode < 8:
+		f.file = k.stream(1)
+	case f.console:
+		f.file = k.stream(2)
+	default:
+		file, err := os.OpenFile(k.hostPath(name), semihostOpenFlags[mode], 0644)
+		if s.check(err) != 0 {
+			return 0xFFFFFFFF
+		}
+		f.file = file
+	}
+	handle := s.next
+	s.next++
+	s.files[handle] = f
+	return handle
+}
+
+// close closes the files the program left open when it exits.
+func (s *semihosting) close() {
+	for handle, f := range s.files {
+		if !f.console {
+			f.file.Close()
+		}
+		delete(s.files, handle)
+	}
+}
+
+// check records the error of a host operation for SYS_ERRNO and returns the matching result: 0 or -1.
+func (s *semihosting) check(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	s.errno = errnoOf(err)
+	return 0xFFFFFFFF
+}
+
+// readBytes reads size bytes at the virtual address addr on behalf of the program.
+// The buffer grows as bytes are read, so a bad size fails on memory before allocating it.
+func (c *CPU) readBytes(addr uint32, size uint32) ([]byte, error) {
+	buf := make([]byte, 0, min(size, MAX_TRANSFER))
+	for i := uint32(0); i < size; i++ {
+		b, err := c.load(addr+i, 1)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, byte(b))
+	}
+	return buf, nil
+}
+
+// writeBytes writes data at the virtual address addr on behalf of the program.
+func (c *CPU) writeBytes(addr uint32, data []byte) error {
+	for i, b := range data {
+		err := c.store(addr+uint32(i), 1, uint32(b))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
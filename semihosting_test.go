@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const PARAMETERS = 0x800 // parameter block of the semihosting calls
+
+// semihostingCall performs the semihosting operation op with a parameter block holding params,
+// or with the parameter itself for the operations taking a single value, and returns a0.
+func semihostingCall(t *testing.T, c *CPU, op uint32, params ...uint32) uint32 {
+	t.Helper()
+	for i, word := range []uint32{SEMIHOSTING_ENTRY, EBREAK_WORD, SEMIHOSTING_EXIT, EBREAK_WORD} {
+		c.Memory.WriteWord(uint32(4*i), word)
+	}
+	c.Registers[ARG_ONE] = PARAMETERS
+	if op == SYS_WRITEC || op == SYS_WRITE0 || op == SYS_EXIT {
+		c.Registers[ARG_ONE] = params[0]
+	}
+	for i, param := range params {
+		c.Memory.WriteWord(PARAMETERS+uint32(4*i), param)
+	}
+	c.Registers[ARG_ZERO] = op
+	c.PC = 0
+	for steps := 0; steps < 4; steps++ {
+		state, err := c.ExecuteSingle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != OK {
+			if state != E_BREAK || c.PC != 16 {
+				t.Fatalf("state = %d at PC=%d, want E_BREAK after the call", state, c.PC)
+			}
+			break
+		}
+	}
+	return c.Registers[ARG_ZERO]
+}
+
+// newSemihostingCPU returns a semihosting CPU whose standard streams are files in a temporary directory.
+func newSemihostingCPU(t *testing.T, input string) (cpu *CPU, stdout *os.File) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stdin"), []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err = os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stdin.Close(); stdout.Close() })
+	cpu = NewCPU(NewMemory())
+	cpu.Personality = PERSONALITY_SEMIHOSTING
+	cpu.Kernel.FileDescriptors[0].File = stdin
+	cpu.Kernel.FileDescriptors[1].File = stdout
+	return cpu, stdout
+}
+
+func TestSemihostingConsole(t *testing.T) {
+	cpu, stdout := newSemihostingCPU(t, "q")
+	cpu.Memory.LoadBytes(0x1000, []byte("x\x00hello\n\x00:tt\x00hi"))
+	if a0 := semihostingCall(t, cpu, SYS_WRITEC, 0x1000); a0 != SYS_WRITEC {
+		t.Errorf("SYS_WRITEC changed a0 to 0x%x", a0)
+	}
+	semihostingCall(t, cpu, SYS_WRITE0, 0x1002)
+	handle := semihostingCall(t, cpu, SYS_OPEN, 0x1009, 4, 3) // ":tt" opened with "w"
+	if handle == 0xFFFFFFFF {
+		t.Fatal("the console could not be opened")
+	}
+	if a0 := semihostingCall(t, cpu, SYS_ISTTY, handle); a0 != 1 {
+		t.Errorf("SYS_ISTTY = %d, want 1", a0)
+	}
+	if a0 := semihostingCall(t, cpu, SYS_WRITE, handle, 0x100D, 2); a0 != 0 {
+		t.Errorf("SYS_WRITE left %d bytes unwritten", a0)
+	}
+	if a0 := semihostingCall(t, cpu, SYS_READC, 0); a0 != 'q' {
+		t.Errorf("SYS_READC = 0x%x, want 'q' from the standard input of the kernel", a0)
+	}
+	output, _ := os.ReadFile(stdout.Name())
+	if string(output) != "xhello\nhi" {
+		t.Errorf("standard output of the kernel is %q, want %q", output, "xhello\nhi")
+	}
+}
+
+func TestSemihostingFiles(t *testing.T) {
+	cpu, _ := newSemihostingCPU(t, "")
+	name := filepath.Join(t.TempDir(), "data")
+	cpu.Memory.LoadBytes(0x1000, append([]byte(name), 0))
+	const BUFFER = 0x10000
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*MAX_TRANSFER/16)
+	cpu.Memory.LoadBytes(BUFFER, data)
+
+	handle := semihostingCall(t, cpu, SYS_OPEN, 0x1000, 6, uint32(len(name))) // "w+"
+	if handle == 0xFFFFFFFF {
+		t.Fatalf("SYS_OPEN failed with errno %d", semihostingCall(t, cpu, SYS_ERRNO, 0))
+	}
+	tests := []struct {
+		name   string
+		op     uint32
+		params []uint32
+		want   uint32
+	}{
+		{"write is short beyond MAX_TRANSFER", SYS_WRITE, []uint32{handle, BUFFER, 2 * MAX_TRANSFER}, MAX_TRANSFER},
+		{"flen", SYS_FLEN, []uint32{handle}, MAX_TRANSFER},
+		{"seek", SYS_SEEK, []uint32{handle, 16}, 0},
+		{"read is short beyond MAX_TRANSFER", SYS_READ, []uint32{handle, 0x40000, 0xFFFFFFFF}, 0xFFFFFFFF - (MAX_TRANSFER - 16)},
+		{"read at the end of the file", SYS_READ, []uint32{handle, 0x40000, 8}, 8},
+		{"write of a size beyond memory", SYS_WRITE, []uint32{handle, 0xF0000, 0xFFFFFFFF}, 0xFFFFFFFF - MAX_TRANSFER},
+		{"close", SYS_CLOSE, []uint32{handle}, 0},
+		{"read of a closed handle", SYS_READ, []uint32{handle, 0x40000, 8}, 8},
+		{"remove", SYS_REMOVE, []uint32{0x1000, uint32(len(name))}, 0},
+		{"remove of a missing file", SYS_REMOVE, []uint32{0x1000, uint32(len(name))}, 0xFFFFFFFF},
+		{"errno", SYS_ERRNO, []uint32{0}, ENOENT},
+		{"open of a name longer than PATH_MAX", SYS_OPEN, []uint32{0x1000, 0, PATH_MAX}, 0xFFFFFFFF},
+		{"errno of a long name", SYS_ERRNO, []uint32{0}, ENAMETOOLONG},
+	}
+	for _, test := range tests {
+		if got := semihostingCall(t, cpu, test.op, test.params...); got != test.want {
+			t.Errorf("%s: a0 = 0x%x, want 0x%x", test.name, got, test.want)
+		}
+	}
+	got := make([]byte, MAX_TRANSFER-16)
+	for i := range got {
+		got[i], _ = cpu.Memory.ReadByte(0x40000 + uint32(i))
+	}
+	if !bytes.Equal(got, data[16:MAX_TRANSFER]) {
+		t.Error("SYS_READ did not read the file back")
+	}
+}
+
+func TestSemihostingRelativePaths(t *testing.T) {
+	cpu, _ := newSemihostingCPU(t, "")
+	cpu.Kernel.CWD = t.TempDir()
+	cpu.Memory.LoadBytes(0x1000, []byte("data\x00"))
+	handle := semihostingCall(t, cpu, SYS_OPEN, 0x1000, 4, 4) // "w"
+	if handle == 0xFFFFFFFF {
+		t.Fatalf("SYS_OPEN failed with errno %d", semihostingCall(t, cpu, SYS_ERRNO, 0))
+	}
+	if a0 := semihostingCall(t, cpu, SYS_CLOSE, handle); a0 != 0 {
+		t.Errorf("SYS_CLOSE returned 0x%x", a0)
+	}
+	if _, err := os.Stat(filepath.Join(cpu.Kernel.CWD, "data")); err != nil {
+		t.Errorf("SYS_OPEN did not create the file in the working directory of the kernel: %v", err)
+	}
+	if a0 := semihostingCall(t, cpu, SYS_REMOVE, 0x1000, 4); a0 != 0 {
+		t.Errorf("SYS_REMOVE of the relative name failed with errno %d", semihostingCall(t, cpu, SYS_ERRNO, 0))
+	}
+}
+
+func TestSemihostingExit(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     uint32
+		params []uint32
+		want   int
+	}{
+		{"exit", SYS_EXIT, []uint32{ADP_STOPPED_APPLICATION_EXIT}, PROGRAM_EXIT},
+		{"exit with another reason", SYS_EXIT, []uint32{0x20023}, PROGRAM_EXIT_FAILURE},
+		{"extended exit", SYS_EXIT_EXTENDED, []uint32{ADP_STOPPED_APPLICATION_EXIT, 0}, PROGRAM_EXIT},
+		{"extended exit with a status", SYS_EXIT_EXTENDED, []uint32{ADP_STOPPED_APPLICATION_EXIT, 1}, PROGRAM_EXIT_FAILURE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu, _ := newSemihostingCPU(t, "")
+			name := filepath.Join(t.TempDir(), "left open")
+			cpu.Memory.LoadBytes(0x1000, []byte(name))
+			handle := semihostingCall(t, cpu, SYS_OPEN, 0x1000, 4, uint32(len(name))) // "w"
+			file := cpu.semihost.files[handle].file
+			cpu.PC = 0
+			cpu.Registers[ARG_ZERO] = test.op
+			cpu.Registers[ARG_ONE] = PARAMETERS
+			if test.op == SYS_EXIT {
+				cpu.Registers[ARG_ONE] = test.params[0]
+			}
+			for i, param := range test.params {
+				cpu.Memory.WriteWord(PARAMETERS+uint32(4*i), param)
+			}
+			state := runProgram(t, cpu, []uint32{SEMIHOSTING_ENTRY, EBREAK_WORD, SEMIHOSTING_EXIT})
+			if state != test.want {
+				t.Errorf("state = %d, want %d", state, test.want)
+			}
+			if _, err := file.Write([]byte("x")); !errors.Is(err, os.ErrClosed) || len(cpu.semihost.files) != 0 {
+				t.Errorf("the file left open was not closed on exit: %v", err)
+			}
+		})
+	}
+}
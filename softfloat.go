@@ -0,0 +1,496 @@
+package core
+
+import (
+	"math"
+	"math/big"
+)
+
+// Floating point exception flags, as accumulated in fcsr.fflags.
+const (
+	FLAG_INEXACT        = 0x01
+	FLAG_UNDERFLOW      = 0x02
+	FLAG_OVERFLOW       = 0x04
+	FLAG_DIVIDE_BY_ZERO = 0x08
+	FLAG_INVALID        = 0x10
+)
+
+// Rounding modes, as encoded in the rm field of an instruction and in fcsr.frm.
+const (
+	ROUND_NEAREST_EVEN = 0
+	ROUND_TOWARD_ZERO  = 1
+	ROUND_DOWN         = 2
+	ROUND_UP           = 3
+	ROUND_NEAREST_MAX  = 4
+	ROUND_DYNAMIC      = 7
+)
+
+var bigRoundingModes = [...]big.RoundingMode{
+	ROUND_NEAREST_EVEN: big.ToNearestEven,
+	ROUND_TOWARD_ZERO:  big.ToZero,
+	ROUND_DOWN:         big.ToNegativeInf,
+	ROUND_UP:           big.ToPositiveInf,
+	ROUND_NEAREST_MAX:  big.ToNearestAway,
+}
+
+// guardBits is the extra precision intermediate results are computed with before the final rounding.
+const guardBits = 8
+
+// floatFormat describes an IEEE-754 binary interchange format.
+// Arithmetic is carried out on exact big.Float values which are then rounded to the format,
+// so that every rounding mode and exception flag behaves as the standard requires.
+type floatFormat struct {
+	mantissaBits uint
+	exponentBits uint
+	minExp       int // big.Float exponent of the smallest normal number
+	maxExp       int // big.Float exponent of the largest finite number
+}
+
+var (
+	singleFormat = floatFormat{mantissaBits: 23, exponentBits: 8, minExp: -125, maxExp: 128}
+	doubleFormat = floatFormat{mantissaBits: 52, exponentBits: 11, minExp: -1021, maxExp: 1024}
+)
+
+func (f floatFormat) precision() uint {
+	return f.mantissaBits + 1
+}
+
+func (f floatFormat) signBit() uint64 {
+	return 1 << (f.mantissaBits + f.exponentBits)
+}
+
+func (f floatFormat) exponentField(bits uint64) uint64 {
+	return (bits >> f.mantissaBits) & (1<<f.exponentBits - 1)
+}
+
+func (f floatFormat) mantissaField(bits uint64) uint64 {
+	return bits & (1<<f.mantissaBits - 1)
+}
+
+func (f floatFormat) sign(bits uint64) bool {
+	return bits&f.signBit() != 0
+}
+
+func (f floatFormat) isNaN(bits uint64) bool {
+	return f.exponentField(bits) == 1<<f.exponentBits-1 && f.mantissaField(bits) != 0
+}
+
+func (f floatFormat) isSignalingNaN(bits uint64) bool {
+	return f.isNaN(bits) && bits&(1<<(f.mantissaBits-1)) == 0
+}
+
+func (f floatFormat) isInf(bits uint64) bool {
+	return f.exponentField(bits) == 1<<f.exponentBits-1 && f.mantissaField(bits) == 0
+}
+
+func (f floatFormat) isZero(bits uint64) bool {
+	return bits&^f.signBit() == 0
+}
+
+func (f floatFormat) canonicalNaN() uint64 {
+	return (1<<f.exponentBits-1)<<f.mantissaBits | 1<<(f.mantissaBits-1)
+}
+
+func (f floatFormat) infinity(neg bool) uint64 {
+	bits := uint64(1<<f.exponentBits-1) << f.mantissaBits
+	if neg {
+		bits |= f.signBit()
+	}
+	return bits
+}
+
+func (f floatFormat) zero(neg bool) uint64 {
+	if neg {
+		return f.signBit()
+	}
+	return 0
+}
+
+func (f floatFormat) maxFinite(neg bool) uint64 {
+	return f.infinity(neg) - 1
+}
+
+// invalidIfSignaling returns FLAG_INVALID if any operand is a signaling NaN.
+func (f floatFormat) invalidIfSignaling(operands ...uint64) uint32 {
+	for _, bits := range operands {
+		if f.isSignalingNaN(bits) {
+			return FLAG_INVALID
+		}
+	}
+	return 0
+}
+
+// value returns the exact value of a finite floating point number.
+func (f floatFormat) value(bits uint64) *big.Float {
+	if f == singleFormat {
+		return new(big.Float).SetFloat64(float64(math.Float32frombits(uint32(bits))))
+	}
+	return new(big.Float).SetFloat64(math.Float64frombits(bits))
+}
+
+// pack encodes x, which must already be representable in the format.
+func (f floatFormat) pack(x *big.Float) uint64 {
+	v, _ := x.Float64()
+	if f == singleFormat {
+		return uint64(math.Float32bits(float32(v)))
+	}
+	return math.Float64bits(v)
+}
+
+// round rounds x to the format according to the RISC-V rounding mode rm.
+// Tininess is detected after rounding, as the RISC-V specification requires.
+func (f floatFormat) round(x *big.Float, rm uint32) (uint64, uint32) {
+	neg := x.Signbit()
+	if x.Sign() == 0 {
+		return f.zero(neg), 0
+	}
+	mode := bigRoundingModes[rm]
+	r := new(big.Float).SetMode(mode).SetPrec(f.precision()).Set(x)
+	exp := r.MantExp(nil)
+	if exp > f.maxExp {
+		switch {
+		case rm == ROUND_TOWARD_ZERO, rm == ROUND_DOWN && !neg, rm == ROUND_UP && neg:
+			return f.maxFinite(neg), FLAG_OVERFLOW | FLAG_INEXACT
+		default:
+			return f.infinity(neg), FLAG_OVERFLOW | FLAG_INEXACT
+		}
+	}
+	if exp < f.minExp {
+		// Re-round on the fixed grid of subnormal numbers.
+		scale := int(f.precision()) - f.minExp
+		n := roundIntegral(new(big.Float).SetMantExp(x, scale), mode)
+		r = new(big.Float).SetMantExp(n, -scale)
+		if r.Cmp(x) != 0 {
+			return f.pack(r), FLAG_UNDERFLOW | FLAG_INEXACT
+		}
+		return f.pack(r), 0
+	}
+	if r.Cmp(x) != 0 {
+		return f.pack(r), FLAG_INEXACT
+	}
+	return f.pack(r), 0
+}
+
+// nudge moves an approximation of a result a quarter of its last place towards the exact value.
+// The approximation must be within half a unit of the exact value and carry at least two more
+// bits than the target format: the nudged value then rounds exactly like the exact one would.
+func nudge(x *big.Float, up bool) *big.Float {
+	prec := x.Prec()
+	quarter := new(big.Float).SetMantExp(big.NewFloat(1), x.MantExp(nil)-int(prec)-2)
+	if !up {
+		quarter.Neg(quarter)
+	}
+	return new(big.Float).SetPrec(prec+2).Add(x, quarter)
+}
+
+// sticky nudges a rounded intermediate result according to its accuracy.
+func sticky(x *big.Float) *big.Float {
+	switch x.Acc() {
+	case big.Below:
+		return nudge(x, true)
+	case big.Above:
+		return nudge(x, false)
+	default:
+		return x
+	}
+}
+
+// roundIntegral rounds x to an integral value with the given rounding mode.
+func roundIntegral(x *big.Float, mode big.RoundingMode) *big.Float {
+	if x.IsInt() {
+		return x
+	}
+	exp := x.MantExp(nil)
+	if exp > 0 {
+		return new(big.Float).SetMode(mode).SetPrec(uint(exp)).Set(x)
+	}
+	// |x| < 1, the result is either zero or one in magnitude.
+	neg := x.Signbit()
+	half := new(big.Float).Abs(x).Cmp(big.NewFloat(0.5))
+	one := false
+	switch mode {
+	case big.ToNearestEven:
+		one = half > 0
+	case big.ToNearestAway:
+		one = half >= 0
+	case big.ToNegativeInf:
+		one = neg
+	case big.ToPositiveInf:
+		one = !neg
+	}
+	result := new(big.Float)
+	if one {
+		result.SetInt64(1)
+	}
+	if neg {
+		result.Neg(result)
+	}
+	return result
+}
+
+// exactZero returns the zero an exact sum of a and b yields: the common sign of two equal-signed
+// zeros, otherwise +0 (or -0 when rounding down).
+func (f floatFormat) exactZero(a, b uint64, rm uint32) uint64 {
+	if f.isZero(a) && f.isZero(b) && f.sign(a) == f.sign(b) {
+		return a
+	}
+	return f.zero(rm == ROUND_DOWN)
+}
+
+func (f floatFormat) intermediate() *big.Float {
+	return new(big.Float).SetPrec(f.precision() + guardBits).SetMode(big.ToZero)
+}
+
+func floatAdd(f floatFormat, a, b uint64, rm uint32) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.canonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	if f.isInf(a) && f.isInf(b) && f.sign(a) != f.sign(b) {
+		return f.canonicalNaN(), FLAG_INVALID
+	}
+	if f.isInf(a) {
+		return a, 0
+	}
+	if f.isInf(b) {
+		return b, 0
+	}
+	sum := f.intermediate().Add(f.value(a), f.value(b))
+	if sum.Sign() == 0 {
+		return f.exactZero(a, b, rm), 0
+	}
+	return f.round(sticky(sum), rm)
+}
+
+func floatSub(f floatFormat, a, b uint64, rm uint32) (uint64, uint32) {
+	return floatAdd(f, a, b^f.signBit(), rm)
+}
+
+func floatMul(f floatFormat, a, b uint64, rm uint32) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.canonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	neg := f.sign(a) != f.sign(b)
+	if f.isInf(a) || f.isInf(b) {
+		if f.isZero(a) || f.isZero(b) {
+			return f.canonicalNaN(), FLAG_INVALID
+		}
+		return f.infinity(neg), 0
+	}
+	if f.isZero(a) || f.isZero(b) {
+		return f.zero(neg), 0
+	}
+	product := new(big.Float).SetPrec(2*f.precision()).Mul(f.value(a), f.value(b))
+	return f.round(product, rm)
+}
+
+func floatDiv(f floatFormat, a, b uint64, rm uint32) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.canonicalNaN(), f.invalidIfSignaling(a, b)
+	}
+	neg := f.sign(a) != f.sign(b)
+	switch {
+	case f.isInf(a) && f.isInf(b), f.isZero(a) && f.isZero(b):
+		return f.canonicalNaN(), FLAG_INVALID
+	case f.isInf(a):
+		return f.infinity(neg), 0
+	case f.isInf(b), f.isZero(a):
+		return f.zero(neg), 0
+	case f.isZero(b):
+		return f.infinity(neg), FLAG_DIVIDE_BY_ZERO
+	}
+	quotient := f.intermediate().Quo(f.value(a), f.value(b))
+	return f.round(sticky(quotient), rm)
+}
+
+func floatSqrt(f floatFormat, a uint64, rm uint32) (uint64, uint32) {
+	switch {
+	case f.isNaN(a):
+		return f.canonicalNaN(), f.invalidIfSignaling(a)
+	case f.isZero(a):
+		return a, 0
+	case f.sign(a):
+		return f.canonicalNaN(), FLAG_INVALID
+	case f.isInf(a):
+		return a, 0
+	}
+	x := f.value(a)
+	root := f.intermediate().Sqrt(x)
+	// big.Float does not report the accuracy of Sqrt, square the root to find it.
+	square := new(big.Float).SetPrec(2*root.Prec()).Mul(root, root)
+	switch square.Cmp(x) {
+	case -1:
+		root = nudge(root, true)
+	case 1:
+		root = nudge(root, false)
+	}
+	return f.round(root, rm)
+}
+
+// floatFMA computes a*b+c with a single rounding.
+func floatFMA(f floatFormat, a, b, c uint64, rm uint32) (uint64, uint32) {
+	productInvalid := (f.isInf(a) && f.isZero(b)) || (f.isZero(a) && f.isInf(b))
+	if f.isNaN(a) || f.isNaN(b) || f.isNaN(c) {
+		if productInvalid {
+			return f.canonicalNaN(), FLAG_INVALID
+		}
+		return f.canonicalNaN(), f.invalidIfSignaling(a, b, c)
+	}
+	if productInvalid {
+		return f.canonicalNaN(), FLAG_INVALID
+	}
+	productNeg := f.sign(a) != f.sign(b)
+	if f.isInf(a) || f.isInf(b) {
+		if f.isInf(c) && f.sign(c) != productNeg {
+			return f.canonicalNaN(), FLAG_INVALID
+		}
+		return f.infinity(productNeg), 0
+	}
+	if f.isInf(c) {
+		return c, 0
+	}
+	product := new(big.Float).SetPrec(2*f.precision()).Mul(f.value(a), f.value(b))
+	sum := f.intermediate().Add(product, f.value(c))
+	if sum.Sign() == 0 {
+		if f.isZero(a) || f.isZero(b) {
+			return f.exactZero(f.zero(productNeg), c, rm), 0
+		}
+		return f.zero(rm == ROUND_DOWN), 0
+	}
+	return f.round(sticky(sum), rm)
+}
+
+// floatMinMax implements FMIN/FMAX: a NaN operand is ignored in favour of the other one and -0 < +0.
+func floatMinMax(f floatFormat, a, b uint64, maximum bool) (uint64, uint32) {
+	flags := f.invalidIfSignaling(a, b)
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.canonicalNaN(), flags
+	case f.isNaN(a):
+		return b, flags
+	case f.isNaN(b):
+		return a, flags
+	case f.isZero(a) && f.isZero(b):
+		if f.sign(a) != maximum {
+			return a, flags
+		}
+		return b, flags
+	}
+	less := f.value(a).Cmp(f.value(b)) < 0
+	if less != maximum {
+		return a, flags
+	}
+	return b, flags
+}
+
+// floatCompare implements FEQ (quiet), FLT and FLE (signaling). cmp is the result of comparing a to b
+// that makes the instruction return true (0 for FEQ, -1 for FLT) and orEqual extends it for FLE.
+func floatCompare(f floatFormat, a, b uint64, cmp int, orEqual bool, signaling bool) (bool, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		if signaling {
+			return false, FLAG_INVALID
+		}
+		return false, f.invalidIfSignaling(a, b)
+	}
+	var result int
+	switch {
+	case f.isZero(a) && f.isZero(b):
+		result = 0
+	case f.isInf(a) || f.isInf(b):
+		fa, fb := f.float64(a), f.float64(b)
+		switch {
+		case fa < fb:
+			result = -1
+		case fa > fb:
+			result = 1
+		}
+	default:
+		result = f.value(a).Cmp(f.value(b))
+	}
+	return result == cmp || (orEqual && result == 0), 0
+}
+
+func (f floatFormat) float64(bits uint64) float64 {
+	if f == singleFormat {
+		return float64(math.Float32frombits(uint32(bits)))
+	}
+	return math.Float64frombits(bits)
+}
+
+// floatClassify returns the FCLASS bit mask of a value.
+func floatClassify(f floatFormat, a uint64) uint32 {
+	neg := f.sign(a)
+	switch {
+	case f.isSignalingNaN(a):
+		return 1 << 8
+	case f.isNaN(a):
+		return 1 << 9
+	case f.isInf(a) && neg:
+		return 1 << 0
+	case f.isInf(a):
+		return 1 << 7
+	case f.isZero(a) && neg:
+		return 1 << 3
+	case f.isZero(a):
+		return 1 << 4
+	case f.exponentField(a) == 0 && neg:
+		return 1 << 2
+	case f.exponentField(a) == 0:
+		return 1 << 5
+	case neg:
+		return 1 << 1
+	default:
+		return 1 << 6
+	}
+}
+
+// floatToInt converts a to a 32-bit integer, saturating out of range values and NaN.
+func floatToInt(f floatFormat, a uint64, rm uint32, signed bool) (uint32, uint32) {
+	var lowest, highest int64 = 0, math.MaxUint32
+	if signed {
+		lowest, highest = math.MinInt32, math.MaxInt32
+	}
+	switch {
+	case f.isNaN(a):
+		return uint32(highest), FLAG_INVALID
+	case f.isInf(a) && f.sign(a):
+		return uint32(lowest), FLAG_INVALID
+	case f.isInf(a):
+		return uint32(highest), FLAG_INVALID
+	}
+	x := f.value(a)
+	n := roundIntegral(x, bigRoundingModes[rm])
+	if n.Cmp(big.NewFloat(float64(lowest))) < 0 {
+		return uint32(lowest), FLAG_INVALID
+	}
+	if n.Cmp(big.NewFloat(float64(highest))) > 0 {
+		return uint32(highest), FLAG_INVALID
+	}
+	val, _ := n.Int64()
+	if n.Cmp(x) != 0 {
+		return uint32(val), FLAG_INEXACT
+	}
+	return uint32(val), 0
+}
+
+// intToFloat converts a 32-bit integer to the format.
+func intToFloat(f floatFormat, val uint32, rm uint32, signed bool) (uint64, uint32) {
+	x := new(big.Float)
+	if signed {
+		x.SetInt64(int64(int32(val)))
+	} else {
+		x.SetInt64(int64(val))
+	}
+	return f.round(x, rm)
+}
+
+// floatConvert converts a value between formats, rounding when narrowing.
+func floatConvert(from, to floatFormat, a uint64, rm uint32) (uint64, uint32) {
+	switch {
+	case from.isNaN(a):
+		return to.canonicalNaN(), from.invalidIfSignaling(a)
+	case from.isInf(a):
+		return to.infinity(from.sign(a)), 0
+	case from.isZero(a):
+		return to.zero(from.sign(a)), 0
+	}
+	return to.round(from.value(a), rm)
+}
@@ -0,0 +1,191 @@
+package core
+
+import "testing"
+
+// Single and double precision bit patterns used by the vectors.
+const (
+	S_ONE       = 0x3F800000
+	S_TWO       = 0x40000000
+	S_THREE     = 0x40400000
+	S_HALF      = 0x3F000000
+	S_MAX       = 0x7F7FFFFF
+	S_MIN_SUB   = 0x00000001
+	S_MIN_NORM  = 0x00800000
+	S_INF       = 0x7F800000
+	S_QNAN      = 0x7FC00000
+	S_SNAN      = 0x7F800001
+	S_NEG_ZERO  = 0x80000000
+	S_TWO_POW31 = 0x4F000000
+	D_ONE       = 0x3FF0000000000000
+	D_THREE     = 0x4008000000000000
+	D_QNAN      = 0x7FF8000000000000
+)
+
+func TestSoftFloatArithmetic(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func() (uint64, uint32)
+		want      uint64
+		wantFlags uint32
+	}{
+		{"add tie to even", func() (uint64, uint32) { return floatAdd(singleFormat, S_ONE, 0x33800000, ROUND_NEAREST_EVEN) }, S_ONE, FLAG_INEXACT},
+		{"add tie away", func() (uint64, uint32) { return floatAdd(singleFormat, S_ONE, 0x33800000, ROUND_NEAREST_MAX) }, 0x3F800001, FLAG_INEXACT},
+		{"add round up", func() (uint64, uint32) { return floatAdd(singleFormat, S_ONE, 0x33000000, ROUND_UP) }, 0x3F800001, FLAG_INEXACT},
+		{"sub exact zero", func() (uint64, uint32) { return floatSub(singleFormat, S_ONE, S_ONE, ROUND_NEAREST_EVEN) }, 0, 0},
+		{"sub exact zero rounding down", func() (uint64, uint32) { return floatSub(singleFormat, S_ONE, S_ONE, ROUND_DOWN) }, S_NEG_ZERO, 0},
+		{"div 1/3 nearest", func() (uint64, uint32) { return floatDiv(singleFormat, S_ONE, S_THREE, ROUND_NEAREST_EVEN) }, 0x3EAAAAAB, FLAG_INEXACT},
+		{"div 1/3 toward zero", func() (uint64, uint32) { return floatDiv(singleFormat, S_ONE, S_THREE, ROUND_TOWARD_ZERO) }, 0x3EAAAAAA, FLAG_INEXACT},
+		{"div 1/3 down", func() (uint64, uint32) { return floatDiv(singleFormat, S_ONE, S_THREE, ROUND_DOWN) }, 0x3EAAAAAA, FLAG_INEXACT},
+		{"div 1/3 up", func() (uint64, uint32) { return floatDiv(singleFormat, S_ONE, S_THREE, ROUND_UP) }, 0x3EAAAAAB, FLAG_INEXACT},
+		{"div -1/3 down", func() (uint64, uint32) { return floatDiv(singleFormat, 0xBF800000, S_THREE, ROUND_DOWN) }, 0xBEAAAAAB, FLAG_INEXACT},
+		{"div -1/3 up", func() (uint64, uint32) { return floatDiv(singleFormat, 0xBF800000, S_THREE, ROUND_UP) }, 0xBEAAAAAA, FLAG_INEXACT},
+		{"div by zero", func() (uint64, uint32) { return floatDiv(singleFormat, S_ONE, 0, ROUND_NEAREST_EVEN) }, S_INF, FLAG_DIVIDE_BY_ZERO},
+		{"div 0/0", func() (uint64, uint32) { return floatDiv(singleFormat, 0, 0, ROUND_NEAREST_EVEN) }, S_QNAN, FLAG_INVALID},
+		{"mul overflow nearest", func() (uint64, uint32) { return floatMul(singleFormat, S_MAX, S_TWO, ROUND_NEAREST_EVEN) }, S_INF, FLAG_OVERFLOW | FLAG_INEXACT},
+		{"mul overflow toward zero", func() (uint64, uint32) { return floatMul(singleFormat, S_MAX, S_TWO, ROUND_TOWARD_ZERO) }, S_MAX, FLAG_OVERFLOW | FLAG_INEXACT},
+		{"mul overflow down", func() (uint64, uint32) { return floatMul(singleFormat, S_MAX, S_TWO, ROUND_DOWN) }, S_MAX, FLAG_OVERFLOW | FLAG_INEXACT},
+		{"mul underflow to zero", func() (uint64, uint32) { return floatMul(singleFormat, S_MIN_SUB, S_HALF, ROUND_NEAREST_EVEN) }, 0, FLAG_UNDERFLOW | FLAG_INEXACT},
+		{"mul underflow up", func() (uint64, uint32) { return floatMul(singleFormat, S_MIN_SUB, S_HALF, ROUND_UP) }, S_MIN_SUB, FLAG_UNDERFLOW | FLAG_INEXACT},
+		{"mul exact subnormal", func() (uint64, uint32) { return floatMul(singleFormat, S_MIN_NORM, S_HALF, ROUND_NEAREST_EVEN) }, 0x00400000, 0},
+		{"mul inf*0", func() (uint64, uint32) { return floatMul(singleFormat, S_INF, 0, ROUND_NEAREST_EVEN) }, S_QNAN, FLAG_INVALID},
+		{"sqrt 2", func() (uint64, uint32) { return floatSqrt(singleFormat, S_TWO, ROUND_NEAREST_EVEN) }, 0x3FB504F3, FLAG_INEXACT},
+		{"sqrt 4", func() (uint64, uint32) { return floatSqrt(singleFormat, 0x40800000, ROUND_NEAREST_EVEN) }, S_TWO, 0},
+		{"sqrt -0", func() (uint64, uint32) { return floatSqrt(singleFormat, S_NEG_ZERO, ROUND_NEAREST_EVEN) }, S_NEG_ZERO, 0},
+		{"sqrt -1", func() (uint64, uint32) { return floatSqrt(singleFormat, 0xBF800000, ROUND_NEAREST_EVEN) }, S_QNAN, FLAG_INVALID},
+		{"fma", func() (uint64, uint32) { return floatFMA(singleFormat, S_TWO, S_THREE, S_ONE, ROUND_NEAREST_EVEN) }, 0x40E00000, 0},
+		{"fma single rounding", func() (uint64, uint32) {
+			return floatFMA(singleFormat, 0x3F800001, 0x3F800001, 0xBF800002, ROUND_NEAREST_EVEN)
+		}, 0x28800000, 0},
+		{"add signaling NaN", func() (uint64, uint32) { return floatAdd(singleFormat, S_SNAN, S_ONE, ROUND_NEAREST_EVEN) }, S_QNAN, FLAG_INVALID},
+		{"add quiet NaN", func() (uint64, uint32) { return floatAdd(singleFormat, 0x7FC00001, S_ONE, ROUND_NEAREST_EVEN) }, S_QNAN, 0},
+		{"add inf-inf", func() (uint64, uint32) { return floatSub(singleFormat, S_INF, S_INF, ROUND_NEAREST_EVEN) }, S_QNAN, FLAG_INVALID},
+		{"double div 1/3", func() (uint64, uint32) { return floatDiv(doubleFormat, D_ONE, D_THREE, ROUND_NEAREST_EVEN) }, 0x3FD5555555555555, FLAG_INEXACT},
+		{"double add 0.1+0.2", func() (uint64, uint32) {
+			return floatAdd(doubleFormat, 0x3FB999999999999A, 0x3FC999999999999A, ROUND_NEAREST_EVEN)
+		}, 0x3FD3333333333334, FLAG_INEXACT},
+		{"double 0/0", func() (uint64, uint32) { return floatDiv(doubleFormat, 0, 0, ROUND_NEAREST_EVEN) }, D_QNAN, FLAG_INVALID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, flags := test.op()
+			if got != test.want || flags != test.wantFlags {
+				t.Errorf("got 0x%x flags 0x%02x, want 0x%x flags 0x%02x", got, flags, test.want, test.wantFlags)
+			}
+		})
+	}
+}
+
+func TestSoftFloatConversions(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        func() (uint64, uint32)
+		want      uint64
+		wantFlags uint32
+	}{
+		{"2.5 to int nearest", func() (uint64, uint32) { return toInt(0x40200000, ROUND_NEAREST_EVEN, true) }, 2, FLAG_INEXACT},
+		{"2.5 to int away", func() (uint64, uint32) { return toInt(0x40200000, ROUND_NEAREST_MAX, true) }, 3, FLAG_INEXACT},
+		{"2.5 to int up", func() (uint64, uint32) { return toInt(0x40200000, ROUND_UP, true) }, 3, FLAG_INEXACT},
+		{"-2.5 to int toward zero", func() (uint64, uint32) { return toInt(0xC0200000, ROUND_TOWARD_ZERO, true) }, 0xFFFFFFFE, FLAG_INEXACT},
+		{"-2.5 to int down", func() (uint64, uint32) { return toInt(0xC0200000, ROUND_DOWN, true) }, 0xFFFFFFFD, FLAG_INEXACT},
+		{"NaN to int", func() (uint64, uint32) { return toInt(S_QNAN, ROUND_NEAREST_EVEN, true) }, 0x7FFFFFFF, FLAG_INVALID},
+		{"-inf to uint", func() (uint64, uint32) { return toInt(0xFF800000, ROUND_NEAREST_EVEN, false) }, 0, FLAG_INVALID},
+		{"-1 to uint", func() (uint64, uint32) { return toInt(0xBF800000, ROUND_NEAREST_EVEN, false) }, 0, FLAG_INVALID},
+		{"2^31 to int", func() (uint64, uint32) { return toInt(S_TWO_POW31, ROUND_NEAREST_EVEN, true) }, 0x7FFFFFFF, FLAG_INVALID},
+		{"2^31 to uint", func() (uint64, uint32) { return toInt(S_TWO_POW31, ROUND_NEAREST_EVEN, false) }, 0x80000000, 0},
+		{"-2^31 to int", func() (uint64, uint32) { return toInt(0xCF000000, ROUND_NEAREST_EVEN, true) }, 0x80000000, 0},
+		{"2^24+1 to single", func() (uint64, uint32) { return intToFloat(singleFormat, 16777217, ROUND_NEAREST_EVEN, true) }, 0x4B800000, FLAG_INEXACT},
+		{"2^24+1 to single up", func() (uint64, uint32) { return intToFloat(singleFormat, 16777217, ROUND_UP, true) }, 0x4B800001, FLAG_INEXACT},
+		{"-1 to single", func() (uint64, uint32) { return intToFloat(singleFormat, 0xFFFFFFFF, ROUND_NEAREST_EVEN, true) }, 0xBF800000, 0},
+		{"2^32-1 to single", func() (uint64, uint32) { return intToFloat(singleFormat, 0xFFFFFFFF, ROUND_NEAREST_EVEN, false) }, 0x4F800000, FLAG_INEXACT},
+		{"2^32-1 to double", func() (uint64, uint32) { return intToFloat(doubleFormat, 0xFFFFFFFF, ROUND_NEAREST_EVEN, false) }, 0x41EFFFFFFFE00000, 0},
+		{"double 0.1 to single", func() (uint64, uint32) {
+			return floatConvert(doubleFormat, singleFormat, 0x3FB999999999999A, ROUND_NEAREST_EVEN)
+		}, 0x3DCCCCCD, FLAG_INEXACT},
+		{"double to single overflow", func() (uint64, uint32) {
+			return floatConvert(doubleFormat, singleFormat, 0x47F0000000000000, ROUND_NEAREST_EVEN)
+		}, S_INF, FLAG_OVERFLOW | FLAG_INEXACT},
+		{"single 1.5 to double", func() (uint64, uint32) {
+			return floatConvert(singleFormat, doubleFormat, 0x3FC00000, ROUND_NEAREST_EVEN)
+		}, 0x3FF8000000000000, 0},
+		{"single signaling NaN to double", func() (uint64, uint32) {
+			return floatConvert(singleFormat, doubleFormat, S_SNAN, ROUND_NEAREST_EVEN)
+		}, D_QNAN, FLAG_INVALID},
+		{"min of zeros", func() (uint64, uint32) { return floatMinMax(singleFormat, 0, S_NEG_ZERO, false) }, S_NEG_ZERO, 0},
+		{"max of zeros", func() (uint64, uint32) { return floatMinMax(singleFormat, S_NEG_ZERO, 0, true) }, 0, 0},
+		{"min with quiet NaN", func() (uint64, uint32) { return floatMinMax(singleFormat, S_QNAN, S_ONE, false) }, S_ONE, 0},
+		{"min with signaling NaN", func() (uint64, uint32) { return floatMinMax(singleFormat, S_SNAN, S_ONE, false) }, S_ONE, FLAG_INVALID},
+		{"max of NaNs", func() (uint64, uint32) { return floatMinMax(singleFormat, S_SNAN, 0x7FC00001, true) }, S_QNAN, FLAG_INVALID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, flags := test.op()
+			if got != test.want || flags != test.wantFlags {
+				t.Errorf("got 0x%x flags 0x%02x, want 0x%x flags 0x%02x", got, flags, test.want, test.wantFlags)
+			}
+		})
+	}
+}
+
+// toInt converts a single precision value with floatToInt.
+func toInt(a uint64, rm uint32, signed bool) (uint64, uint32) {
+	val, flags := floatToInt(singleFormat, a, rm, signed)
+	return uint64(val), flags
+}
+
+func TestSoftFloatCompare(t *testing.T) {
+	const (
+		EQ = 0
+		LT = -1
+	)
+	tests := []struct {
+		name      string
+		a, b      uint64
+		cmp       int
+		orEqual   bool
+		signaling bool
+		want      bool
+		wantFlags uint32
+	}{
+		{"feq", S_ONE, S_ONE, EQ, false, false, true, 0},
+		{"feq zeros", 0, S_NEG_ZERO, EQ, false, false, true, 0},
+		{"feq quiet NaN", S_QNAN, S_ONE, EQ, false, false, false, 0},
+		{"feq signaling NaN", S_SNAN, S_ONE, EQ, false, false, false, FLAG_INVALID},
+		{"flt", S_ONE, S_TWO, LT, false, true, true, 0},
+		{"flt zeros", S_NEG_ZERO, 0, LT, false, true, false, 0},
+		{"flt -inf", 0xFF800000, S_ONE, LT, false, true, true, 0},
+		{"flt quiet NaN", S_QNAN, S_ONE, LT, false, true, false, FLAG_INVALID},
+		{"fle equal", S_TWO, S_TWO, LT, true, true, true, 0},
+		{"fle greater", S_THREE, S_TWO, LT, true, true, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, flags := floatCompare(singleFormat, test.a, test.b, test.cmp, test.orEqual, test.signaling)
+			if got != test.want || flags != test.wantFlags {
+				t.Errorf("got %v flags 0x%02x, want %v flags 0x%02x", got, flags, test.want, test.wantFlags)
+			}
+		})
+	}
+}
+
+func TestSoftFloatClassify(t *testing.T) {
+	tests := []struct {
+		a    uint64
+		want uint32
+	}{
+		{0xFF800000, 1 << 0},
+		{0xBF800000, 1 << 1},
+		{0x80000001, 1 << 2},
+		{S_NEG_ZERO, 1 << 3},
+		{0, 1 << 4},
+		{S_MIN_SUB, 1 << 5},
+		{S_ONE, 1 << 6},
+		{S_INF, 1 << 7},
+		{S_SNAN, 1 << 8},
+		{S_QNAN, 1 << 9},
+	}
+	for _, test := range tests {
+		if got := floatClassify(singleFormat, test.a); got != test.want {
+			t.Errorf("fclass(0x%08x) = 0x%x, want 0x%x", test.a, got, test.want)
+		}
+	}
+}
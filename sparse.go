@@ -0,0 +1,89 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SparseStore backs the whole 32-bit address space with 4KiB pages allocated on first write.
+// It implements Device with offsets equal to physical addresses.
+type SparseStore struct {
+	lock  sync.Mutex
+	pages map[uint32]*[PAGE_SIZE]byte // keyed by page number
+
+	// UnmappedRead is called when a page that was never written is read.
+	// The read fails with the returned error, or returns zeros when it is nil.
+	// When UnmappedRead itself is nil such reads fail.
+	UnmappedRead func(addr uint32) error
+}
+
+func NewSparseStore() *SparseStore {
+	return &SparseStore{pages: make(map[uint32]*[PAGE_SIZE]byte)}
+}
+
+// readByte returns the byte at addr, the caller must hold s.lock.
+func (s *SparseStore) readByte(addr uint32) (byte, error) {
+	page, ok := s.pages[addr/PAGE_SIZE]
+	if !ok {
+		if s.UnmappedRead == nil {
+			return 0, fmt.Errorf("read of unmapped page at addr=%d", addr)
+		}
+		return 0, s.UnmappedRead(addr)
+	}
+	return page[addr%PAGE_SIZE], nil
+}
+
+// writeByte sets the byte at addr, allocating its page if needed. The caller must hold s.lock.
+func (s *SparseStore) writeByte(addr uint32, val byte) {
+	page, ok := s.pages[addr/PAGE_SIZE]
+	if !ok {
+		page = new([PAGE_SIZE]byte)
+		s.pages[addr/PAGE_SIZE] = page
+	}
+	page[addr%PAGE_SIZE] = val
+}
+
+func (s *SparseStore) Load(addr uint32, size uint32) (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var val uint32
+	for i := uint32(0); i < size; i++ {
+		b, err := s.readByte(addr + i)
+		if err != nil {
+			return 0, err
+		}
+		val |= uint32(b) << (8 * i)
+	}
+	return val, nil
+}
+
+func (s *SparseStore) Store(addr uint32, size uint32, val uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := uint32(0); i < size; i++ {
+		s.writeByte(addr+i, byte(val>>(8*i)))
+	}
+	return nil
+}
+
+// LoadBytes copies data at addr, allocating pages as needed.
+func (s *SparseStore) LoadBytes(addr uint32, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, b := range data {
+		s.writeByte(addr+uint32(i), b)
+	}
+}
+
+// TouchedPages returns the base address of every allocated page, in increasing order.
+func (s *SparseStore) TouchedPages() []uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pages := make([]uint32, 0, len(s.pages))
+	for page := range s.pages {
+		pages = append(pages, page*PAGE_SIZE)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return pages
+}
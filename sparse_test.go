@@ -0,0 +1,119 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSparseStore(t *testing.T) {
+	s := NewSparseStore()
+	if _, err := s.Load(0x5000, 4); err == nil {
+		t.Error("read of an unmapped page succeeded")
+	}
+	s.Store(0xFFFFFFFC, 4, 0xDEADBEEF)
+	s.Store(0x12345FFE, 4, 0x11223344) // across a page boundary
+	s.LoadBytes(0x7000, []byte{1, 2, 3})
+	tests := []struct {
+		addr uint32
+		size uint32
+		want uint32
+	}{
+		{0xFFFFFFFC, 4, 0xDEADBEEF},
+		{0xFFFFFFFF, 1, 0xDE},
+		{0x12345FFE, 4, 0x11223344},
+		{0x12346000, 2, 0x1122},
+		{0x7001, 2, 0x0302},
+		{0x7FFF, 1, 0}, // allocated page, never written
+	}
+	for _, test := range tests {
+		got, err := s.Load(test.addr, test.size)
+		if err != nil {
+			t.Errorf("read at 0x%08x: %v", test.addr, err)
+		} else if got != test.want {
+			t.Errorf("read 0x%x at 0x%08x, want 0x%x", got, test.addr, test.want)
+		}
+	}
+	want := []uint32{0x7000, 0x12345000, 0x12346000, 0xFFFFF000}
+	if got := s.TouchedPages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("touched pages %x, want %x", got, want)
+	}
+}
+
+func TestSparseUnmappedRead(t *testing.T) {
+	errUnmapped := errors.New("unmapped")
+	tests := []struct {
+		name         string
+		unmappedRead func(addr uint32) error
+		wantErr      error
+	}{
+		{"zeros", func(addr uint32) error { return nil }, nil},
+		{"custom error", func(addr uint32) error { return errUnmapped }, errUnmapped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewSparseMemory()
+			m.Sparse().UnmappedRead = test.unmappedRead
+			val, err := m.ReadWord(0x40000000)
+			if !errors.Is(err, test.wantErr) || val != 0 {
+				t.Errorf("read 0x%x, %v, want 0, %v", val, err, test.wantErr)
+			}
+			if len(m.Sparse().TouchedPages()) != 0 {
+				t.Error("a read allocated a page")
+			}
+		})
+	}
+}
+
+func TestSparseMemory(t *testing.T) {
+	m, err := NewMemoryWithConfig(MemoryConfig{Regions: []MemoryRegion{{Base: 0x1000, Size: 0x1000}}, Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewMemory().Sparse() != nil {
+		t.Error("the default memory is sparse")
+	}
+	m.WriteWord(0x1000, 1)                // RAM region
+	m.WriteWord(CLINT_BASE+CLINT_MSIP, 1) // unclaimed, goes to the sparse store
+	m.WriteWord(0xFFFFFFF0, 2)
+	if err := m.LoadBytes(0x1FFE, []byte{1, 2, 3, 4}); err != nil {
+		t.Errorf("load across the end of RAM into the sparse store failed: %v", err)
+	}
+	if !m.Loadable(0x80000000, 0x10000000) {
+		t.Error("the sparse store is not loadable")
+	}
+	want := []uint32{0x2000, CLINT_BASE, 0xFFFFF000}
+	if got := m.Sparse().TouchedPages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("touched pages %x, want %x", got, want)
+	}
+	low, _ := m.ReadHalfWord(0x1FFE)
+	high, _ := m.ReadHalfWord(0x2000)
+	if low != 0x0201 || high != 0x0403 {
+		t.Errorf("read 0x%04x in RAM and 0x%04x in the sparse store, want 0x0201 and 0x0403", low, high)
+	}
+	if _, err := m.ReadWord(0x1FFE); err == nil {
+		t.Error("a read across the end of RAM succeeded")
+	}
+
+	m.Bus.Attach(0x30000000, 0x1000, NewRAM(0x1000))
+	m.WriteWord(0x30000000, 3)
+	if got := m.Sparse().TouchedPages(); len(got) != len(want) {
+		t.Errorf("a write to a device allocated a sparse page: %x", got)
+	}
+}
+
+func TestStackAtTheTopOfTheAddressSpace(t *testing.T) {
+	cpu := NewCPU(NewSparseMemory())
+	cpu.Registers[STACK_POINTER] = 0xFFFFFFF0
+	cpu.Registers[ARG_ZERO] = 42
+	runProgram(t, cpu, []uint32{
+		0x00a12623, // sw a0, 12(sp)
+		0x00c12583, // lw a1, 12(sp)
+		EBREAK_WORD,
+	})
+	wantRegisters(t, cpu, map[uint32]uint32{ARG_ONE: 42})
+	want := []uint32{0, 0xFFFFF000}
+	if got := cpu.Memory.Sparse().TouchedPages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("touched pages %x, want %x", got, want)
+	}
+}
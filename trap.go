@@ -0,0 +1,329 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exception causes, as reported in mcause for synchronous traps.
+const (
+	CAUSE_INSTRUCTION_MISALIGNED   = 0
+	CAUSE_INSTRUCTION_ACCESS_FAULT = 1
+	CAUSE_ILLEGAL_INSTRUCTION      = 2
+	CAUSE_BREAKPOINT               = 3
+	CAUSE_LOAD_MISALIGNED          = 4
+	CAUSE_LOAD_ACCESS_FAULT        = 5
+	CAUSE_STORE_MISALIGNED         = 6
+	CAUSE_STORE_ACCESS_FAULT       = 7
+	CAUSE_ECALL_FROM_U             = 8
+	CAUSE_ECALL_FROM_S             = 9
+	CAUSE_ECALL_FROM_M             = 11
+	CAUSE_INSTRUCTION_PAGE_FAULT   = 12
+	CAUSE_LOAD_PAGE_FAULT          = 13
+	CAUSE_STORE_PAGE_FAULT         = 15
+)
+
+// Interrupt causes, as reported in mcause with bit 31 set. They double as bit indexes in mip and mie.
+const (
+	INTERRUPT_SUPERVISOR_SOFTWARE = 1
+	INTERRUPT_MACHINE_SOFTWARE    = 3
+	INTERRUPT_SUPERVISOR_TIMER    = 5
+	INTERRUPT_MACHINE_TIMER       = 7
+	INTERRUPT_SUPERVISOR_EXTERNAL = 9
+	INTERRUPT_MACHINE_EXTERNAL    = 11
+)
+
+// mip and mie bits.
+const (
+	MIP_SSIP = 1 << INTERRUPT_SUPERVISOR_SOFTWARE
+	MIP_MSIP = 1 << INTERRUPT_MACHINE_SOFTWARE
+	MIP_STIP = 1 << INTERRUPT_SUPERVISOR_TIMER
+	MIP_MTIP = 1 << INTERRUPT_MACHINE_TIMER
+	MIP_SEIP = 1 << INTERRUPT_SUPERVISOR_EXTERNAL
+	MIP_MEIP = 1 << INTERRUPT_MACHINE_EXTERNAL
+)
+
+// interruptPriority lists the interrupts from the highest to the lowest priority.
+var interruptPriority = []uint32{
+	INTERRUPT_MACHINE_EXTERNAL, INTERRUPT_MACHINE_SOFTWARE, INTERRUPT_MACHINE_TIMER,
+	INTERRUPT_SUPERVISOR_EXTERNAL, INTERRUPT_SUPERVISOR_SOFTWARE, INTERRUPT_SUPERVISOR_TIMER,
+}
+
+// mstatus fields.
+const (
+	MSTATUS_SIE  = 1 << 1
+	MSTATUS_MIE  = 1 << 3
+	MSTATUS_SPIE = 1 << 5
+	MSTATUS_MPIE = 1 << 7
+	MSTATUS_SPP  = 1 << 8
+	MSTATUS_MPP  = 0b11 << 11
+	MSTATUS_FS   = 0b11 << 13
+	MSTATUS_MPRV = 1 << 17
+	MSTATUS_SUM  = 1 << 18
+	MSTATUS_MXR  = 1 << 19
+	MSTATUS_TVM  = 1 << 20
+	MSTATUS_TW   = 1 << 21
+	MSTATUS_TSR  = 1 << 22
+	MSTATUS_SD   = 1 << 31
+)
+
+// Privilege levels, as encoded in mstatus.MPP.
+const (
+	PRIVILEGE_USER       = 0
+	PRIVILEGE_SUPERVISOR = 1
+	PRIVILEGE_MACHINE    = 3
+)
+
+// Exception is a synchronous trap raised while fetching or executing an instruction.
+// When the program has installed a trap vector it is delivered to it, otherwise
+// ExecuteSingle returns it as an error.
+type Exception struct {
+	Cause uint32 // mcause value
+	Tval  uint32 // mtval value: faulting address or instruction bits
+	Err   error  // underlying error, if any
+}
+
+func (e *Exception) Error() string {
+	msg := fmt.Sprintf("%s (tval=0x%08x)", causeToString(e.Cause), e.Tval)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Exception) Unwrap() error {
+	return e.Err
+}
+
+func causeToString(cause uint32) string {
+	switch cause {
+	case CAUSE_INSTRUCTION_MISALIGNED:
+		return "instruction address misaligned"
+	case CAUSE_INSTRUCTION_ACCESS_FAULT:
+		return "instruction access fault"
+	case CAUSE_ILLEGAL_INSTRUCTION:
+		return "illegal instruction"
+	case CAUSE_BREAKPOINT:
+		return "breakpoint"
+	case CAUSE_LOAD_MISALIGNED:
+		return "load address misaligned"
+	case CAUSE_LOAD_ACCESS_FAULT:
+		return "load access fault"
+	case CAUSE_STORE_MISALIGNED:
+		return "store/AMO address misaligned"
+	case CAUSE_STORE_ACCESS_FAULT:
+		return "store/AMO access fault"
+	case CAUSE_ECALL_FROM_U:
+		return "environment call from U-mode"
+	case CAUSE_ECALL_FROM_S:
+		return "environment call from S-mode"
+	case CAUSE_ECALL_FROM_M:
+		return "environment call from M-mode"
+	case CAUSE_INSTRUCTION_PAGE_FAULT:
+		return "instruction page fault"
+	case CAUSE_LOAD_PAGE_FAULT:
+		return "load page fault"
+	case CAUSE_STORE_PAGE_FAULT:
+		return "store/AMO page fault"
+	default:
+		return fmt.Sprintf("exception %d", cause)
+	}
+}
+
+// illegalInstruction builds the exception raised by an instruction that cannot be executed.
+func illegalInstruction(instruction Instruction, err error) *Exception {
+	return &Exception{Cause: CAUSE_ILLEGAL_INSTRUCTION, Tval: instruction.raw, Err: err}
+}
+
+// TrapHandlerInstalled reports whether the program set up a trap vector, in mtvec or,
+// for the exceptions delegated by medeleg, in stvec.
+// Without one the emulator keeps its historical behaviour: exceptions are returned
+// by ExecuteSingle as errors and EBREAK stops execution with E_BREAK.
+func (c *CPU) TrapHandlerInstalled() bool {
+	return c.mtvec != 0 || (c.medeleg != 0 && c.stvec != 0)
+}
+
+// hasTrapHandler reports whether the trap vector that would handle cause at the current privilege level is set.
+func (c *CPU) hasTrapHandler(cause uint32) bool {
+	if c.delegated(cause) {
+		return c.stvec != 0
+	}
+	return c.mtvec != 0
+}
+
+// emulatesECALL reports whether the microkernel services ECALL instead of the program: only when no
+// trap handler would take it. Otherwise ECALL raises the environment call exception of the current
+// privilege level, so firmware running user mode programs receives their ECALLs.
+func (c *CPU) emulatesECALL() bool {
+	return !c.hasTrapHandler(CAUSE_ECALL_FROM_U + c.privilege)
+}
+
+// delegated reports whether a trap raised at the current privilege level goes to supervisor mode:
+// traps raised below machine mode are delegated by medeleg (exceptions) or mideleg (interrupts, cause bit 31 set).
+func (c *CPU) delegated(cause uint32) bool {
+	code := cause &^ (1 << 31)
+	delegation := c.medeleg
+	if cause&(1<<31) != 0 {
+		delegation = c.mideleg
+	}
+	return c.privilege <= PRIVILEGE_SUPERVISOR && code < 32 && delegation&(1<<code) != 0
+}
+
+// handleException delivers an exception raised by the instruction at pc to the trap handler.
+// Errors that are not RISC-V exceptions are emulator faults and are returned as is.
+func (c *CPU) handleException(pc uint32, err error) (int, error) {
+	var exception *Exception
+	if !errors.As(err, &exception) {
+		return -1, err
+	}
+	if !c.hasTrapHandler(exception.Cause) {
+		c.PC = pc
+		return -1, fmt.Errorf("crash at PC=%d with error:\n%w", pc, exception)
+	}
+	c.takeTrap(pc, exception.Cause, exception.Tval)
+	return OK, nil
+}
+
+// pendingInterrupts returns the value of mip: the software writable bits
+// combined with the lines driven by the interrupt controllers.
+func (c *CPU) pendingInterrupts() uint32 {
+	mip := c.mip
+	if c.Clint != nil {
+		if c.Clint.SoftwarePending(c.HartID) {
+			mip |= MIP_MSIP
+		}
+		if c.Clint.TimerPending(c.HartID) {
+			mip |= MIP_MTIP
+		}
+	}
+	if c.Plic != nil {
+		if c.Plic.Interrupting(2 * c.HartID) {
+			mip |= MIP_MEIP
+		}
+		if c.Plic.Interrupting(2*c.HartID + 1) {
+			mip |= MIP_SEIP
+		}
+	}
+	return mip
+}
+
+// pendingInterrupt selects the interrupt to take before the next instruction, if any.
+// Machine interrupts are taken unless running in machine mode with mstatus.MIE clear,
+// delegated ones below machine mode unless running in supervisor mode with mstatus.SIE clear.
+func (c *CPU) pendingInterrupt() (uint32, bool) {
+	pending := c.pendingInterrupts() & c.mie
+	if pending == 0 {
+		return 0, false
+	}
+	machineEnabled := c.privilege < PRIVILEGE_MACHINE || c.mstatus&MSTATUS_MIE != 0
+	supervisorEnabled := c.privilege < PRIVILEGE_SUPERVISOR || (c.privilege == PRIVILEGE_SUPERVISOR && c.mstatus&MSTATUS_SIE != 0)
+	for _, interrupt := range interruptPriority {
+		if pending&(1<<interrupt) == 0 {
+			continue
+		}
+		if c.mideleg&(1<<interrupt) == 0 && machineEnabled {
+			return interrupt, true
+		}
+		if c.mideleg&(1<<interrupt) != 0 && supervisorEnabled {
+			return interrupt, true
+		}
+	}
+	return 0, false
+}
+
+// executeWFI waits for an interrupt. Pending interrupts are only checked between instructions,
+// so when the machine timer is enabled, time is fast-forwarded to the next timer event instead.
+func (c *CPU) executeWFI(instruction Instruction) error {
+	if c.privilege == PRIVILEGE_USER || (c.privilege < PRIVILEGE_MACHINE && c.mstatus&MSTATUS_TW != 0) {
+		return illegalInstruction(instruction, errors.New("WFI not allowed at the current privilege level"))
+	}
+	if c.pendingInterrupts()&c.mie == 0 && c.mie&MIP_MTIP != 0 && c.Clint != nil {
+		c.Clint.SkipToTimer(c.HartID)
+	}
+	return nil
+}
+
+// Privilege returns the privilege level the hart is currently running at.
+func (c *CPU) Privilege() uint32 {
+	return c.privilege
+}
+
+// takeTrap jumps to the trap vector of the privilege level handling the trap, see delegated.
+func (c *CPU) takeTrap(pc uint32, cause uint32, tval uint32) {
+	interrupt := cause&(1<<31) != 0
+	code := cause &^ (1 << 31)
+
+	var tvec uint32
+	if c.delegated(cause) {
+		c.sepc = pc
+		c.scause = cause
+		c.stval = tval
+		mstatus := c.mstatus &^ (MSTATUS_SPIE | MSTATUS_SPP)
+		if c.mstatus&MSTATUS_SIE != 0 {
+			mstatus |= MSTATUS_SPIE
+		}
+		if c.privilege == PRIVILEGE_SUPERVISOR {
+			mstatus |= MSTATUS_SPP
+		}
+		c.mstatus = mstatus &^ MSTATUS_SIE
+		c.privilege = PRIVILEGE_SUPERVISOR
+		tvec = c.stvec
+	} else {
+		c.mepc = pc
+		c.mcause = cause
+		c.mtval = tval
+		mstatus := c.mstatus &^ (MSTATUS_MPIE | MSTATUS_MPP)
+		if c.mstatus&MSTATUS_MIE != 0 {
+			mstatus |= MSTATUS_MPIE
+		}
+		mstatus |= c.privilege << 11
+		c.mstatus = mstatus &^ MSTATUS_MIE
+		c.privilege = PRIVILEGE_MACHINE
+		tvec = c.mtvec
+	}
+
+	base := tvec &^ 0b11
+	if tvec&0b11 == 1 && interrupt { // vectored mode only applies to interrupts
+		c.PC = base + 4*code
+	} else {
+		c.PC = base
+	}
+}
+
+// executeMRET returns from a machine-mode trap handler to the privilege level saved in mstatus.MPP.
+func (c *CPU) executeMRET(instruction Instruction) error {
+	if c.privilege != PRIVILEGE_MACHINE {
+		return illegalInstruction(instruction, errors.New("MRET outside of machine mode"))
+	}
+	mpp := (c.mstatus & MSTATUS_MPP) >> 11
+	mstatus := c.mstatus &^ (MSTATUS_MIE | MSTATUS_MPP)
+	if c.mstatus&MSTATUS_MPIE != 0 {
+		mstatus |= MSTATUS_MIE
+	}
+	if mpp != PRIVILEGE_MACHINE {
+		mstatus &^= MSTATUS_MPRV
+	}
+	c.mstatus = mstatus | MSTATUS_MPIE
+	c.privilege = mpp
+	c.PC = c.mepc
+	return nil
+}
+
+// executeSRET returns from a supervisor-mode trap handler to the privilege level saved in mstatus.SPP.
+func (c *CPU) executeSRET(instruction Instruction) error {
+	if c.privilege < PRIVILEGE_SUPERVISOR || (c.privilege == PRIVILEGE_SUPERVISOR && c.mstatus&MSTATUS_TSR != 0) {
+		return illegalInstruction(instruction, errors.New("SRET not allowed at the current privilege level"))
+	}
+	var spp uint32 = PRIVILEGE_USER
+	if c.mstatus&MSTATUS_SPP != 0 {
+		spp = PRIVILEGE_SUPERVISOR
+	}
+	mstatus := c.mstatus &^ (MSTATUS_SIE | MSTATUS_SPP | MSTATUS_MPRV)
+	if c.mstatus&MSTATUS_SPIE != 0 {
+		mstatus |= MSTATUS_SIE
+	}
+	c.mstatus = mstatus | MSTATUS_SPIE
+	c.privilege = spp
+	c.PC = c.sepc
+	return nil
+}
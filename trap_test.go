@@ -0,0 +1,395 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	UNIMP_WORD = 0xc0001073 // csrrw zero, cycle, zero
+	MRET_WORD  = 0x30200073
+	SRET_WORD  = 0x10200073
+	HANDLER    = 0x40
+)
+
+// machineHandler records mcause, mtval and mepc in a2-a4, then returns after the trapping instruction.
+var machineHandler = []uint32{
+	0x34202673, // csrr a2, mcause
+	0x343026f3, // csrr a3, mtval
+	0x34102773, // csrr a4, mepc
+	0x00470313, // addi t1, a4, 4
+	0x34131073, // csrw mepc, t1
+	MRET_WORD,
+}
+
+// trapTest runs a program at address 0 with a handler at HANDLER until it stops with E_BREAK.
+type trapTest struct {
+	name    string
+	setup   func(c *CPU)
+	program []uint32
+	handler []uint32
+	check   func(t *testing.T, c *CPU)
+}
+
+func runTrapTests(t *testing.T, tests []trapTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			cpu.Personality = PERSONALITY_BARE_METAL
+			for i, word := range test.handler {
+				cpu.Memory.WriteWord(HANDLER+uint32(i*4), word)
+			}
+			if test.setup != nil {
+				test.setup(cpu)
+			}
+			if state := runProgram(t, cpu, test.program); state != E_BREAK {
+				t.Fatalf("state = %d, want E_BREAK", state)
+			}
+			test.check(t, cpu)
+		})
+	}
+}
+
+// wantRegisters checks the value of integer registers.
+func wantRegisters(t *testing.T, c *CPU, want map[uint32]uint32) {
+	t.Helper()
+	for reg, val := range want {
+		if c.Registers[reg] != val {
+			t.Errorf("x%d = 0x%08x, want 0x%08x", reg, c.Registers[reg], val)
+		}
+	}
+}
+
+func TestMachineTraps(t *testing.T) {
+	runTrapTests(t, []trapTest{
+		{
+			name:  "illegal instruction",
+			setup: func(c *CPU) { c.mtvec = HANDLER },
+			program: []uint32{
+				UNIMP_WORD,
+				0x00100593, // li a1, 1
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			handler: machineHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{
+					ARG_ONE:   1,
+					ARG_TWO:   CAUSE_ILLEGAL_INSTRUCTION,
+					ARG_THREE: UNIMP_WORD,
+					ARG_FOUR:  0,
+				})
+			},
+		},
+		{
+			name:  "breakpoint",
+			setup: func(c *CPU) { c.mtvec = HANDLER },
+			program: []uint32{
+				0x00000013, // nop
+				EBREAK_WORD,
+				0x00100593, // li a1, 1
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			handler: machineHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ONE: 1, ARG_TWO: CAUSE_BREAKPOINT, ARG_THREE: 4, ARG_FOUR: 4})
+			},
+		},
+		{
+			name: "exception from user mode",
+			setup: func(c *CPU) {
+				c.mtvec = HANDLER
+				c.privilege = PRIVILEGE_USER
+			},
+			program: []uint32{UNIMP_WORD},
+			handler: []uint32{
+				0x34202673, // csrr a2, mcause
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: CAUSE_ILLEGAL_INSTRUCTION})
+				if c.Privilege() != PRIVILEGE_MACHINE {
+					t.Errorf("privilege = %d, want machine mode", c.Privilege())
+				}
+				if c.mstatus&MSTATUS_MPP != 0 {
+					t.Errorf("mstatus.MPP = %d, want user mode", (c.mstatus&MSTATUS_MPP)>>11)
+				}
+			},
+		},
+		{
+			name: "vectored mode only applies to interrupts",
+			setup: func(c *CPU) {
+				c.mtvec = HANDLER | 1
+			},
+			program: []uint32{
+				UNIMP_WORD,
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			handler: machineHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: CAUSE_ILLEGAL_INSTRUCTION})
+			},
+		},
+	})
+}
+
+func TestDelegatedTraps(t *testing.T) {
+	runTrapTests(t, []trapTest{
+		{
+			name: "breakpoint delegated from user mode without a machine handler",
+			setup: func(c *CPU) {
+				c.medeleg = 1 << CAUSE_BREAKPOINT
+				c.stvec = HANDLER
+				c.privilege = PRIVILEGE_USER
+			},
+			program: []uint32{EBREAK_WORD},
+			handler: []uint32{
+				0x14202673, // csrr a2, scause
+				0x141026f3, // csrr a3, sepc
+				0x10501073, // csrw stvec, zero
+				EBREAK_WORD,
+			},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: CAUSE_BREAKPOINT, ARG_THREE: 0})
+				if c.Privilege() != PRIVILEGE_SUPERVISOR {
+					t.Errorf("privilege = %d, want supervisor mode", c.Privilege())
+				}
+				if c.mstatus&MSTATUS_SPP != 0 {
+					t.Error("mstatus.SPP is set, want user mode")
+				}
+			},
+		},
+		{
+			name: "exceptions are not delegated from machine mode",
+			setup: func(c *CPU) {
+				c.mtvec = HANDLER
+				c.medeleg = 1 << CAUSE_ILLEGAL_INSTRUCTION
+				c.stvec = 0x80
+			},
+			program: []uint32{
+				UNIMP_WORD,
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			handler: machineHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_TWO: CAUSE_ILLEGAL_INSTRUCTION})
+				if c.scause != 0 {
+					t.Errorf("scause = %d, want 0", c.scause)
+				}
+			},
+		},
+		{
+			name: "sret returns to user mode",
+			setup: func(c *CPU) {
+				c.privilege = PRIVILEGE_SUPERVISOR
+				c.sepc = HANDLER
+				c.mstatus |= MSTATUS_SPIE
+			},
+			program: []uint32{SRET_WORD},
+			handler: []uint32{EBREAK_WORD},
+			check: func(t *testing.T, c *CPU) {
+				if c.Privilege() != PRIVILEGE_USER {
+					t.Errorf("privilege = %d, want user mode", c.Privilege())
+				}
+				if c.mstatus&MSTATUS_SIE == 0 {
+					t.Error("mstatus.SIE was not restored from SPIE")
+				}
+			},
+		},
+	})
+}
+
+func TestMRET(t *testing.T) {
+	cpu := NewCPU(NewMemory())
+	cpu.mepc = HANDLER
+	cpu.mstatus = MSTATUS_MPIE // MPP is user mode
+	cpu.Memory.WriteWord(0, MRET_WORD)
+	if _, err := cpu.ExecuteSingle(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.PC != HANDLER {
+		t.Errorf("PC = 0x%x, want 0x%x", cpu.PC, HANDLER)
+	}
+	if cpu.Privilege() != PRIVILEGE_USER {
+		t.Errorf("privilege = %d, want user mode", cpu.Privilege())
+	}
+	if cpu.mstatus&MSTATUS_MIE == 0 || cpu.mstatus&MSTATUS_MPIE == 0 {
+		t.Errorf("mstatus = 0x%x, want MIE and MPIE set", cpu.mstatus)
+	}
+}
+
+func TestTrapsWithoutHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(c *CPU)
+		program []uint32
+	}{
+		{
+			name:    "illegal instruction",
+			program: []uint32{0x00000013, UNIMP_WORD},
+		},
+		{
+			name:    "mret from user mode",
+			setup:   func(c *CPU) { c.privilege = PRIVILEGE_USER },
+			program: []uint32{0x00000013, MRET_WORD},
+		},
+		{
+			name: "delegated exception without a supervisor handler",
+			setup: func(c *CPU) {
+				c.mtvec = HANDLER
+				c.medeleg = 1 << CAUSE_ILLEGAL_INSTRUCTION
+				c.privilege = PRIVILEGE_USER
+			},
+			program: []uint32{0x00000013, UNIMP_WORD},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			if test.setup != nil {
+				test.setup(cpu)
+			}
+			for i, word := range test.program {
+				cpu.Memory.WriteWord(uint32(i*4), word)
+			}
+			var err error
+			for steps := 0; steps < len(test.program) && err == nil; steps++ {
+				_, err = cpu.ExecuteSingle()
+			}
+			if err == nil {
+				t.Fatal("the exception did not stop execution")
+			}
+			if !strings.Contains(err.Error(), "crash at PC=4") || cpu.PC != 4 {
+				t.Errorf("PC = %d, error %q, want the address of the faulting instruction", cpu.PC, err)
+			}
+		})
+	}
+}
+
+func TestECALLEmulation(t *testing.T) {
+	const (
+		LI_A7_1000 = 0x3e800893 // li a7, 1000, an unknown syscall
+		ECALL_WORD = 0x00000073
+		ENOSYS_A0  = 1<<32 - ENOSYS
+	)
+	// records the cause and stops in machine mode
+	stopHandler := []uint32{
+		0x34202673, // csrr a2, mcause
+		0x30501073, // csrw mtvec, zero
+		EBREAK_WORD,
+	}
+	linux := func(setup func(c *CPU)) func(c *CPU) {
+		return func(c *CPU) {
+			c.Personality = PERSONALITY_LINUX
+			setup(c)
+		}
+	}
+	runTrapTests(t, []trapTest{
+		{
+			name:    "emulated without a trap handler",
+			setup:   linux(func(c *CPU) {}),
+			program: []uint32{LI_A7_1000, ECALL_WORD, EBREAK_WORD},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: ENOSYS_A0})
+			},
+		},
+		{
+			name:  "machine mode ECALL taken by the machine handler",
+			setup: linux(func(c *CPU) { c.mtvec = HANDLER }),
+			program: []uint32{
+				LI_A7_1000,
+				ECALL_WORD,
+				0x00100593, // li a1, 1
+				0x30501073, // csrw mtvec, zero
+				EBREAK_WORD,
+			},
+			handler: machineHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: 0, ARG_ONE: 1, ARG_TWO: CAUSE_ECALL_FROM_M, ARG_FOUR: 4})
+			},
+		},
+		{
+			name:  "supervisor mode ECALL taken by the machine handler",
+			setup: linux(func(c *CPU) { c.mtvec, c.privilege = HANDLER, PRIVILEGE_SUPERVISOR }),
+			program: []uint32{
+				LI_A7_1000,
+				ECALL_WORD,
+			},
+			handler: stopHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: 0, ARG_TWO: CAUSE_ECALL_FROM_S})
+			},
+		},
+		{
+			name:  "user mode ECALL taken by the machine handler",
+			setup: linux(func(c *CPU) { c.mtvec, c.privilege = HANDLER, PRIVILEGE_USER }),
+			program: []uint32{
+				LI_A7_1000,
+				ECALL_WORD,
+			},
+			handler: stopHandler,
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: 0, ARG_TWO: CAUSE_ECALL_FROM_U})
+			},
+		},
+		{
+			name:    "user mode ECALL emulated without a trap handler",
+			setup:   linux(func(c *CPU) { c.privilege = PRIVILEGE_USER }),
+			program: []uint32{LI_A7_1000, ECALL_WORD, EBREAK_WORD},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: ENOSYS_A0})
+			},
+		},
+		{
+			name: "user mode ECALL delegated to the supervisor handler",
+			setup: linux(func(c *CPU) {
+				c.medeleg = 1 << CAUSE_ECALL_FROM_U
+				c.stvec = HANDLER
+				c.privilege = PRIVILEGE_USER
+			}),
+			program: []uint32{
+				LI_A7_1000,
+				ECALL_WORD,
+			},
+			handler: []uint32{
+				0x14202673, // csrr a2, scause
+				0x10501073, // csrw stvec, zero
+				EBREAK_WORD,
+			},
+			check: func(t *testing.T, c *CPU) {
+				wantRegisters(t, c, map[uint32]uint32{ARG_ZERO: 0, ARG_TWO: CAUSE_ECALL_FROM_U})
+			},
+		},
+	})
+}
+
+func TestPersonality(t *testing.T) {
+	tests := []struct {
+		name        string
+		elf         *ELFFile
+		personality Personality
+		want        Personality
+	}{
+		{"program without an ELF file", nil, PERSONALITY_AUTO, PERSONALITY_LINUX},
+		{"Linux program", &ELFFile{OSABI: ELFOSABI_LINUX}, PERSONALITY_AUTO, PERSONALITY_LINUX},
+		{"bare-metal firmware", &ELFFile{OSABI: ELFOSABI_NONE}, PERSONALITY_AUTO, PERSONALITY_BARE_METAL},
+		{"standalone program", &ELFFile{OSABI: ELFOSABI_STANDALONE}, PERSONALITY_AUTO, PERSONALITY_BARE_METAL},
+		{"newlib program making Linux syscalls", &ELFFile{OSABI: ELFOSABI_NONE}, PERSONALITY_LINUX, PERSONALITY_LINUX},
+		{"semihosting Linux program", &ELFFile{OSABI: ELFOSABI_LINUX}, PERSONALITY_SEMIHOSTING, PERSONALITY_SEMIHOSTING},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewCPU(NewMemory())
+			cpu.ELF = test.elf
+			cpu.Personality = test.personality
+			if got := cpu.personality(); got != test.want {
+				t.Errorf("personality = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Standard location of the 16550 UART, as used by QEMU's virt machine.
+const (
+	UART_BASE = 0x10000000
+	UART_SIZE = 0x100
+	UART_IRQ  = 10 // PLIC source of the UART
+)
+
+// 16550 registers, relative to the UART base.
+const (
+	UART_RBR = 0 // receive buffer (read), transmit holding (write), divisor latch low (DLAB)
+	UART_IER = 1 // interrupt enable, divisor latch high (DLAB)
+	UART_IIR = 2 // interrupt identification (read), FIFO control (write)
+	UART_LCR = 3 // line control
+	UART_MCR = 4 // modem control
+	UART_LSR = 5 // line status
+	UART_MSR = 6 // modem status
+	UART_SCR = 7 // scratch
+)
+
+// 16550 register bits.
+const (
+	UART_IER_RDI  = 0x01 // received data available interrupt
+	UART_IER_THRI = 0x02 // transmit holding register empty interrupt
+	UART_IIR_NONE = 0x01 // no interrupt pending
+	UART_IIR_THRI = 0x02
+	UART_IIR_RDI  = 0x04
+	UART_IIR_FIFO = 0xC0 // FIFOs enabled
+	UART_FCR_FIFO = 0x01
+	UART_FCR_RX   = 0x02 // clear the receive FIFO
+	UART_LCR_DLAB = 0x80 // divisor latch access
+	UART_MCR_LOOP = 0x10
+	UART_LSR_DR   = 0x01 // data ready
+	UART_LSR_OE   = 0x02 // overrun error
+	UART_LSR_THRE = 0x20 // transmit holding register empty
+	UART_LSR_TEMT = 0x40 // transmitter empty
+
+	UART_FIFO_SIZE = 16
+)
+
+// UART is a 16550-compatible serial port. Transmitted bytes are written to an io.Writer
+// right away and received bytes are read from an io.Reader in the background.
+type UART struct {
+	lock   sync.Mutex
+	space  *sync.Cond // signalled when the receive FIFO has room
+	output io.Writer
+
+	rx         []byte
+	ier        uint8
+	lcr        uint8
+	mcr        uint8
+	lsr        uint8
+	scr        uint8
+	dll        uint8
+	dlm        uint8
+	fifo       bool
+	thrPending bool // transmit holding register empty interrupt not yet acknowledged
+	closed     bool // set by Close, received bytes are dropped
+
+	plic *PLIC
+	irq  uint32
+}
+
+// NewUART creates a UART transmitting to output and receiving from input.
+// Either of them can be nil. Input is read in the background until it returns an error
+// such as io.EOF or the UART is closed.
+func NewUART(input io.Reader, output io.Writer) *UART {
+	u := &UART{output: output}
+	u.space = sync.NewCond(&u.lock)
+	if input != nil {
+		go u.readLoop(input)
+	}
+	return u
+}
+
+// ConnectIRQ routes the interrupt of the UART to a PLIC source.
+func (u *UART) ConnectIRQ(plic *PLIC, source uint32) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.plic = plic
+	u.irq = source
+	u.updateIRQ()
+}
+
+// AttachUART maps a UART at the standard address and connects it to the PLIC of the CPU.
+func (c *CPU) AttachUART(input io.Reader, output io.Writer) (*UART, error) {
+	u := NewUART(input, output)
+	err := c.Memory.Bus.Attach(UART_BASE, UART_SIZE, u)
+	if err != nil {
+		return nil, err
+	}
+	if c.Plic != nil {
+		u.ConnectIRQ(c.Plic, UART_IRQ)
+	}
+	return u, nil
+}
+
+// Close stops receiving, so that another UART can read the same input, such as os.Stdin.
+// The background reader ends as soon as its pending Read returns, since a Read cannot be
+// interrupted, and drops the bytes it got. Bytes already in the receive FIFO stay readable.
+func (u *UART) Close() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.closed = true
+	u.space.Broadcast()
+	return nil
+}
+
+// readLoop feeds the receive FIFO from input, waiting for the program to make room.
+func (u *UART) readLoop(input io.Reader) {
+	buf := make([]byte, 256)
+	for {
+		n, err := input.Read(buf)
+		for _, b := range buf[:n] {
+			u.Receive(b)
+		}
+		if err != nil || u.isClosed() {
+			return
+		}
+	}
+}
+
+func (u *UART) isClosed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.closed
+}
+
+// Receive queues a byte as if it came from the serial line, blocking while the receive FIFO is full.
+// Once the UART is closed, the byte is dropped.
+func (u *UART) Receive(b byte) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for len(u.rx) >= u.fifoSize() && !u.closed {
+		u.space.Wait()
+	}
+	if u.closed {
+		return
+	}
+	u.rx = append(u.rx, b)
+	u.updateIRQ()
+}
+
+// fifoSize returns the depth of the receive buffer: 16 bytes with FIFOs enabled, 1 otherwise.
+func (u *UART) fifoSize() int {
+	if u.fifo {
+		return UART_FIFO_SIZE
+	}
+	return 1
+}
+
+// interrupt returns the value of IIR describing the highest priority pending interrupt.
+func (u *UART) interrupt() uint8 {
+	var iir uint8 = UART_IIR_NONE
+	switch {
+	case u.ier&UART_IER_RDI != 0 && len(u.rx) > 0:
+		iir = UART_IIR_RDI
+	case u.ier&UART_IER_THRI != 0 && u.thrPending:
+		iir = UART_IIR_THRI
+	}
+	if u.fifo {
+		iir |= UART_IIR_FIFO
+	}
+	return iir
+}
+
+// updateIRQ drives the interrupt line from the pending interrupts. The caller must hold u.lock.
+func (u *UART) updateIRQ() {
+	if u.plic == nil {
+		return
+	}
+	if u.interrupt()&UART_IIR_NONE == 0 {
+		u.plic.AssertIRQ(u.irq)
+	} else {
+		u.plic.DeassertIRQ(u.irq)
+	}
+}
+
+// Load reads a UART register. Wider accesses read the register at their first byte.
+func (u *UART) Load(offset uint32, size uint32) (uint32, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	defer u.updateIRQ()
+	dlab := u.lcr&UART_LCR_DLAB != 0
+	switch offset {
+	case UART_RBR:
+		if dlab {
+			return uint32(u.dll), nil
+		}
+		if len(u.rx) == 0 {
+			return 0, nil
+		}
+		b := u.rx[0]
+		u.rx = u.rx[1:]
+		u.space.Broadcast()
+		return uint32(b), nil
+	case UART_IER:
+		if dlab {
+			return uint32(u.dlm), nil
+		}
+		return uint32(u.ier), nil
+	case UART_IIR:
+		iir := u.interrupt()
+		if iir&0x0F == UART_IIR_THRI { // reading IIR acknowledges the transmitter interrupt
+			u.thrPending = false
+		}
+		return uint32(iir), nil
+	case UART_LCR:
+		return uint32(u.lcr), nil
+	case UART_MCR:
+		return uint32(u.mcr), nil
+	case UART_LSR:
+		lsr := u.lsr | UART_LSR_THRE | UART_LSR_TEMT
+		if len(u.rx) > 0 {
+			lsr |= UART_LSR_DR
+		}
+		u.lsr &^= UART_LSR_OE // error bits clear on read
+		return uint32(lsr), nil
+	case UART_MSR:
+		if u.mcr&UART_MCR_LOOP != 0 { // modem control outputs are looped back to the inputs
+			return uint32(u.mcr&0x0C)<<4 | uint32(u.mcr&0x01)<<5 | uint32(u.mcr&0x02)<<3, nil
+		}
+		return 0xB0, nil // clear to send, data set ready and carrier detect
+	case UART_SCR:
+		return uint32(u.scr), nil
+	}
+	return 0, fmt.Errorf("UART read out of range at offset=%d", offset)
+}
+
+// Store writes a UART register. Wider accesses write the register at their first byte.
+func (u *UART) Store(offset uint32, size uint32, val uint32) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	defer u.updateIRQ()
+	b := uint8(val)
+	dlab := u.lcr&UART_LCR_DLAB != 0
+	switch offset {
+	case UART_RBR:
+		if dlab {
+			u.dll = b
+			return nil
+		}
+		return u.transmit(b)
+	case UART_IER:
+		if dlab {
+			u.dlm = b
+			return nil
+		}
+		if b&UART_IER_THRI != 0 && u.ier&UART_IER_THRI == 0 { // the holding register is always empty
+			u.thrPending = true
+		}
+		u.ier = b & 0x0F
+	case UART_IIR:
+		fifo := b&UART_FCR_FIFO != 0
+		if b&UART_FCR_RX != 0 || fifo != u.fifo { // toggling the FIFOs also clears them
+			u.rx = u.rx[:0]
+			u.space.Broadcast()
+		}
+		u.fifo = fifo
+	case UART_LCR:
+		u.lcr = b
+	case UART_MCR:
+		u.mcr = b & 0x1F
+	case UART_LSR, UART_MSR:
+		// read-only
+	case UART_SCR:
+		u.scr = b
+	default:
+		return fmt.Errorf("UART write out of range at offset=%d", offset)
+	}
+	return nil
+}
+
+// transmit sends a byte written to THR, which completes immediately. The caller must hold u.lock.
+func (u *UART) transmit(b byte) error {
+	u.thrPending = true
+	if u.mcr&UART_MCR_LOOP != 0 {
+		if len(u.rx) >= u.fifoSize() {
+			u.lsr |= UART_LSR_OE
+			return nil
+		}
+		u.rx = append(u.rx, b)
+		return nil
+	}
+	if u.output == nil {
+		return nil
+	}
+	_, err := u.output.Write([]byte{b})
+	return err
+}
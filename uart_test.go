@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRegister reads a UART register, failing the test on error.
+func readRegister(t *testing.T, u *UART, offset uint32) uint32 {
+	t.Helper()
+	val, err := u.Load(offset, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func TestUARTTransmit(t *testing.T) {
+	var output bytes.Buffer
+	u := NewUART(nil, &output)
+	for _, b := range []byte("ok\n") {
+		if err := u.Store(UART_RBR, 1, uint32(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if output.String() != "ok\n" {
+		t.Errorf("transmitted %q, want %q", output.String(), "ok\n")
+	}
+	if lsr := readRegister(t, u, UART_LSR); lsr != UART_LSR_THRE|UART_LSR_TEMT {
+		t.Errorf("LSR = 0x%02x, want the transmitter empty", lsr)
+	}
+}
+
+func TestUARTReceive(t *testing.T) {
+	tests := []struct {
+		name    string
+		fcr     uint32
+		receive string
+		want    string
+	}{
+		{"single byte", 0, "a", "a"},
+		{"fifo", UART_FCR_FIFO, "hello", "hello"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := NewUART(nil, nil)
+			u.Store(UART_IIR, 1, test.fcr)
+			for _, b := range []byte(test.receive) {
+				u.Receive(b)
+			}
+			var got []byte
+			for readRegister(t, u, UART_LSR)&UART_LSR_DR != 0 {
+				got = append(got, byte(readRegister(t, u, UART_RBR)))
+			}
+			if string(got) != test.want {
+				t.Errorf("received %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUARTInput(t *testing.T) {
+	u := NewUART(strings.NewReader("abcdefghijklmnopqrstuvwxyz"), nil)
+	u.Store(UART_IIR, 1, UART_FCR_FIFO)
+	var got []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got) < 26 && time.Now().Before(deadline) {
+		if readRegister(t, u, UART_LSR)&UART_LSR_DR != 0 {
+			got = append(got, byte(readRegister(t, u, UART_RBR)))
+		}
+	}
+	if string(got) != "abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestUARTClose(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	u := NewUART(r, nil)
+	w.Write([]byte("a"))
+	// the reader holds "b" until the program makes room in the single byte receive buffer
+	go w.Write([]byte("b"))
+	time.Sleep(10 * time.Millisecond)
+	u.Close()
+
+	written := make(chan struct{})
+	go func() {
+		w.Write([]byte("c"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Error("the input is still read after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := readRegister(t, u, UART_RBR); got != 'a' {
+		t.Errorf("received %q, want the byte received before Close", got)
+	}
+	if lsr := readRegister(t, u, UART_LSR); lsr&UART_LSR_DR != 0 {
+		t.Errorf("LSR = 0x%02x, want no data after Close", lsr)
+	}
+}
+
+func TestUARTRegisters(t *testing.T) {
+	u := NewUART(nil, nil)
+	u.Store(UART_LCR, 1, UART_LCR_DLAB|3)
+	u.Store(UART_RBR, 1, 0x0C)
+	u.Store(UART_IER, 1, 0x01)
+	if dll, dlm := readRegister(t, u, UART_RBR), readRegister(t, u, UART_IER); dll != 0x0C || dlm != 0x01 {
+		t.Errorf("divisor latch = 0x%02x%02x, want 0x010c", dlm, dll)
+	}
+	u.Store(UART_LCR, 1, 3)
+	if ier := readRegister(t, u, UART_IER); ier != 0 {
+		t.Errorf("IER = 0x%x, the divisor latch was written to it", ier)
+	}
+	u.Store(UART_SCR, 1, 0x5A)
+	if scr := readRegister(t, u, UART_SCR); scr != 0x5A {
+		t.Errorf("SCR = 0x%x, want 0x5a", scr)
+	}
+	u.Store(UART_IIR, 1, UART_FCR_FIFO)
+	if iir := readRegister(t, u, UART_IIR); iir != UART_IIR_FIFO|UART_IIR_NONE {
+		t.Errorf("IIR = 0x%x, want FIFOs enabled and no interrupt", iir)
+	}
+	if _, err := u.Load(UART_SIZE-1, 1); err == nil {
+		t.Error("read out of range was accepted")
+	}
+}
+
+func TestUARTLoopback(t *testing.T) {
+	var output bytes.Buffer
+	u := NewUART(nil, &output)
+	u.Store(UART_MCR, 1, UART_MCR_LOOP)
+	u.Store(UART_RBR, 1, 'x')
+	u.Store(UART_RBR, 1, 'y') // the receive buffer holds a single byte without FIFOs
+	if output.Len() != 0 {
+		t.Errorf("looped back bytes were transmitted: %q", output.String())
+	}
+	if lsr := readRegister(t, u, UART_LSR); lsr&(UART_LSR_DR|UART_LSR_OE) != UART_LSR_DR|UART_LSR_OE {
+		t.Errorf("LSR = 0x%02x, want data ready and overrun", lsr)
+	}
+	if lsr := readRegister(t, u, UART_LSR); lsr&UART_LSR_OE != 0 {
+		t.Error("the overrun error was not cleared by reading LSR")
+	}
+	if rbr := readRegister(t, u, UART_RBR); rbr != 'x' {
+		t.Errorf("RBR = %q, want 'x'", rune(rbr))
+	}
+}
+
+func TestUARTInterrupts(t *testing.T) {
+	plic := NewPLIC(PLIC_DEFAULT_SOURCES, 2)
+	plic.Store(PLIC_PRIORITY+UART_IRQ*4, 4, 1)
+	plic.Store(PLIC_ENABLE, 4, 1<<UART_IRQ)
+	u := NewUART(nil, nil)
+	u.ConnectIRQ(plic, UART_IRQ)
+
+	u.Receive('a')
+	if plic.Interrupting(0) {
+		t.Error("interrupt raised with IER clear")
+	}
+	u.Store(UART_IER, 1, UART_IER_RDI)
+	if !plic.Interrupting(0) || readRegister(t, u, UART_IIR) != UART_IIR_RDI {
+		t.Error("received data did not raise the interrupt")
+	}
+	readRegister(t, u, UART_RBR)
+	if plic.Interrupting(0) || readRegister(t, u, UART_IIR) != UART_IIR_NONE {
+		t.Error("the interrupt was not lowered once the data was read")
+	}
+
+	u.Store(UART_IER, 1, UART_IER_RDI|UART_IER_THRI)
+	if readRegister(t, u, UART_IIR) != UART_IIR_THRI {
+		t.Error("enabling the transmitter interrupt did not raise it")
+	}
+	if readRegister(t, u, UART_IIR) != UART_IIR_NONE {
+		t.Error("reading IIR did not acknowledge the transmitter interrupt")
+	}
+}
+
+func TestUARTFirmware(t *testing.T) {
+	var output bytes.Buffer
+	cpu := NewCPU(NewMemory())
+	u, err := cpu.AttachUART(nil, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Receive('x')
+	runProgram(t, cpu, []uint32{
+		0x100002b7, // lui t0, 0x10000
+		0x06800513, // li a0, 'h'
+		0x00a28023, // sb a0, 0(t0)
+		0x06900513, // li a0, 'i'
+		0x00a28023, // sb a0, 0(t0)
+		0x0052c583, // lbu a1, 5(t0)
+		0x0002c603, // lbu a2, 0(t0)
+		EBREAK_WORD,
+	})
+	if output.String() != "hi" {
+		t.Errorf("transmitted %q, want %q", output.String(), "hi")
+	}
+	wantRegisters(t, cpu, map[uint32]uint32{
+		ARG_ONE: UART_LSR_DR | UART_LSR_THRE | UART_LSR_TEMT,
+		ARG_TWO: 'x',
+	})
+	if _, err := cpu.AttachUART(nil, nil); err == nil {
+		t.Error("a second UART was attached at the same address")
+	}
+}